@@ -0,0 +1,15 @@
+// Package cacheline configures the struct padding used by the multicast
+// channel at build time. The channel pads its hot fields so that fields
+// written by different goroutines don't share a CPU cache line. By default
+// it assumes 64-byte cache lines.
+//
+// Build with the tag multicast_cacheline128 to pad for 128-byte cache lines
+// (e.g. Apple M-series and POWER), or with the tag multicast_compact to turn
+// padding off. The compact mode keeps channels small, which helps when
+// thousands of small channels are created on memory-constrained targets, but
+// makes goroutines sending and receiving on the same channel contend for
+// cache lines.
+//
+//	go build -tags multicast_cacheline128 ./...
+//	go build -tags multicast_compact ./...
+package cacheline
@@ -0,0 +1,8 @@
+//go:build !multicast_compact
+// +build !multicast_compact
+
+package cacheline
+
+// Padding is 1 when structs are padded to cache lines and 0 when padding is
+// turned off.
+const Padding = 1
@@ -0,0 +1,7 @@
+//go:build multicast_cacheline128
+// +build multicast_cacheline128
+
+package cacheline
+
+// Size is the number of bytes in a CPU cache line.
+const Size = 128
@@ -19,12 +19,16 @@ Just like native Go channels, the channel exhibits blocking backpressure to
 the sender goroutines when the channel buffer is full. Total speed of the
 channel is dictated by the slowest receiver.
 
-Lock and Goroutine free
+Lock free
 
 This multicast channel is different from other multicast implementations in
 that it uses only fast synchronization primitives like atomic operations to
-implement its features. Furthermore, it also doesn't use goroutines internally.
-This implementation is low-latency and has a high throughput.
+implement its features. Sending and receiving don't start goroutines. Only
+WithCommitter and WithCoarseClock start a goroutine per channel, which exits
+when the channel is closed, and RangeContext, NewEndpointContext and a fair
+SendContext or SendTimeout that gives up start a short-lived goroutine, see
+their documentation. This implementation is low-latency and has a high
+throughput.
 
 If you are in a situation where you need to record and replay a stream
 of data or you need to split a stream of data into multiple identical streams,
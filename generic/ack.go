@@ -0,0 +1,102 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> Ack
+//jig:needs Endpoint<Foo>, Endpoint<Foo> wakeUp
+
+// Ack acknowledges the message most recently delivered to an endpoint created
+// with WithAck, so the endpoint advances to the next message. Ack may be
+// called from any goroutine, also from within the foreach function passed to
+// Range. Calling Ack when there is no message awaiting acknowledgement has no
+// effect.
+func (e *EndpointFoo) Ack() {
+	if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, acknowledged) {
+		e.wakeUp()
+	}
+}
+
+//jig:template Endpoint<Foo> Nack
+//jig:needs Endpoint<Foo>, Endpoint<Foo> wakeUp
+
+// Nack rejects the message most recently delivered to an endpoint created
+// with WithAck, so it is delivered again unless it has been retried too often.
+// Nack may be called from any goroutine, also from within the foreach
+// function passed to Range. Calling Nack when there is no message awaiting
+// acknowledgement has no effect.
+func (e *EndpointFoo) Nack() {
+	if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected) {
+		e.wakeUp()
+	}
+}
+
+//jig:template Endpoint<Foo> awaitAck
+//jig:needs Endpoint<Foo> block, Endpoint<Foo> wakeUp, Endpoint<Foo> deadLetter, Chan<Foo> loadRing, ErrRetriesExhausted
+
+// awaitingAck records that the message at index is delivered and awaits
+// acknowledgement.
+func (e *EndpointFoo) awaitingAck(index uint64) {
+	if e.ackSeq != index {
+		e.ackSeq = index
+		e.ackAttempts = 0
+	}
+	e.ackAttempts++
+	if e.ackTimeout != 0 {
+		e.ackDeadline = time.Now().Add(e.ackTimeout).UnixNano()
+	}
+	atomic.StoreUint32(&e.ackState, unacknowledged)
+}
+
+// awaitAck blocks until the message awaiting acknowledgement is acknowledged
+// or rejected, see Ack and Nack, or its ack timeout expires. It returns
+// redeliver true when the message should be delivered again. A rejected
+// message that is not delivered again is routed to the dead-letter channel,
+// which blocks like Send while that channel is full. It returns ok false when
+// the endpoint was canceled or reading was suspended or aborted via control
+// while waiting.
+func (e *EndpointFoo) awaitAck(control *uint32) (redeliver bool, ok bool) {
+	var timer *time.Timer
+	for atomic.LoadUint32(&e.ackState) == unacknowledged {
+		if e.ackTimeout != 0 {
+			wait := time.Until(time.Unix(0, e.ackDeadline))
+			if wait <= 0 {
+				if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected) {
+					break
+				}
+				continue // acknowledged just in time
+			}
+			if timer == nil {
+				timer = time.AfterFunc(wait, e.wakeUp)
+				defer timer.Stop()
+			} else {
+				timer.Reset(wait)
+			}
+		}
+		if atomic.LoadUint64(&e.endpointState) == canceled || (control != nil && atomic.LoadUint32(control) != proceed) {
+			return false, false
+		}
+		e.blockWhile(func() bool {
+			return atomic.LoadUint32(&e.ackState) == unacknowledged && atomic.LoadUint64(&e.endpointState) != canceled &&
+				(control == nil || atomic.LoadUint32(control) == proceed) &&
+				(e.ackTimeout == 0 || time.Now().UnixNano() < e.ackDeadline)
+		})
+	}
+	if atomic.LoadUint32(&e.ackState) == acknowledged {
+		e.ackSeq = parked
+		return false, true
+	}
+	if e.poison != nil || e.ackAttempts > e.ackRetries {
+		err := e.poison
+		if err == nil {
+			err = ErrRetriesExhausted
+		}
+		r := e.loadRing() // the cursor keeps the message in the buffer
+		e.deadLetter(r.buffer[r.slot(e.ackSeq)], e.ackSeq, e.ackAttempts, err)
+		e.ackSeq = parked
+		return false, true
+	}
+	return true, true
+}
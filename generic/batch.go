@@ -0,0 +1,17 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> batched
+//jig:needs Chan<Foo> elapsed
+
+// batched returns true when the messages written after commit should be
+// committed now, see WithCommitBatch. This is the case when a full batch is
+// waiting, when the maximum delay since the previous commit has passed, or
+// when the channel is closing and every message has to be delivered.
+func (c *ChanFoo) batched(commit uint64) bool {
+	if atomic.LoadUint64(&c.write)-commit >= c.commitBatch || atomic.LoadUint64(&c.channelState) != active {
+		return true
+	}
+	return c.elapsed()-atomic.LoadInt64(&c.lastCommit) >= c.commitDelay
+}
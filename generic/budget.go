@@ -0,0 +1,107 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> LimitBytes
+//jig:needs Chan<Foo>
+
+// LimitBytes bounds the channel by the total estimated size of the messages
+// in its buffer, on top of the number of messages it can hold. The size
+// function is called for every message sent and should return its size in
+// bytes. It is called again when the message leaves the buffer, so it must
+// return the same size for the same message.
+//
+// Send, SendSlice, SendTimeout and SendContext block while the messages in
+// the buffer would exceed the budget, until the slowest endpoint has read
+// enough messages to make room. TrySend returns false instead of blocking. A single message larger than the
+// budget is accepted when the buffer is empty. FastSend ignores the budget.
+//
+// LimitBytes must be called before any message is sent to the channel.
+func (c *ChanFoo) LimitBytes(budget int64, size func(value foo) int) {
+	c.byteBudget = budget
+	c.size = size
+}
+
+//jig:template Chan<Foo> Bytes
+//jig:needs Chan<Foo>
+
+// Bytes returns the total estimated size of the messages in the buffer of a
+// channel bounded by LimitBytes. For other channels it returns 0.
+func (c *ChanFoo) Bytes() int64 {
+	return atomic.LoadInt64(&c.bytes)
+}
+
+//jig:template Chan<Foo> admit
+//jig:needs Chan<Foo> slideBuffer
+
+// admit adds size to the bytes in the buffer when this fits the budget,
+// sliding the buffer to make room. When spins is nil, admit does not wait for
+// endpoints to read. It returns false when the size was not admitted.
+func (c *ChanFoo) admit(size int64, spins *uint32) bool {
+	for retry := true; ; {
+		bytes := atomic.LoadInt64(&c.bytes)
+		if bytes == 0 || bytes+size <= c.byteBudget {
+			if atomic.CompareAndSwapInt64(&c.bytes, bytes, bytes+size) {
+				return true
+			}
+			continue
+		}
+		if !c.slideBuffer(spins) {
+			return false // channel was closed
+		}
+		if spins == nil {
+			if !retry {
+				return false // over budget
+			}
+			retry = false
+		}
+	}
+}
+
+//jig:template Chan<Foo> refund
+//jig:needs Chan<Foo>
+
+// refund subtracts the size of values that were admitted but not sent, because
+// the channel was closed, from the bytes in the buffer.
+func (c *ChanFoo) refund(values []foo) {
+	if c.size == nil {
+		return
+	}
+	size := int64(0)
+	for _, value := range values {
+		size += int64(c.size(value))
+	}
+	atomic.AddInt64(&c.bytes, -size)
+}
+
+//jig:template Chan<Foo> release
+//jig:needs Chan<Foo>
+
+// release subtracts the size of the messages from begin up to end from the
+// bytes in the buffer and drops their headers. It is called just before the
+// messages leave the buffer. When read is true, no endpoint can read the
+// messages anymore, so their values are recycled (see Recycle).
+func (c *ChanFoo) release(r *ringFoo, begin, end uint64, read bool) {
+	if r.headers != nil {
+		for index := begin; index < end; index++ {
+			r.headers[r.slot(index)] = nil
+		}
+	}
+	if c.recycle != nil && read {
+		for index := begin; index < end; index++ {
+			if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+				c.recycle(r.buffer[r.slot(index)])
+			}
+		}
+	}
+	if c.size == nil {
+		return
+	}
+	size := int64(0)
+	for index := begin; index < end; index++ {
+		if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+			size += int64(c.size(r.buffer[r.slot(index)]))
+		}
+	}
+	atomic.AddInt64(&c.bytes, -size)
+}
@@ -0,0 +1,94 @@
+package multicast
+
+import (
+	"math"
+	"math/bits"
+	"unsafe"
+)
+
+//jig:template ErrCapacity
+//jig:needs ChannelError
+
+// ErrCapacity is returned by NewChanChecked when the requested buffer or
+// endpoint capacity is negative or too large to be allocated.
+// NewChan and NewChanOpts panic with it instead.
+const ErrCapacity = ChannelError("capacity out of range")
+
+//jig:template maxBytes
+
+// maxBytes is the largest allocation the Go runtime can make: 2^31-1 bytes on
+// 32-bit platforms and 2^47-1 bytes on 64-bit platforms, whose address space
+// is limited to 48 bits.
+const maxBytes = uint64(^uintptr(0) >> 1 >> (^uintptr(0) >> 63 * 16))
+
+//jig:template bufferSize<Foo>
+//jig:needs ErrCapacity, maxBytes
+
+// bufferSizeFoo returns the number of messages in the buffer of a channel
+// created with the given capacity. The capacity is rounded up to a power of 2
+// unless exact is true, and a capacity of 0 gives a buffer of 1 message.
+// Every message takes a slot in the buffer and a timestamp, so ErrCapacity is
+// returned when the slots and timestamps together would not fit the largest
+// possible allocation.
+func bufferSizeFoo(capacity int, exact bool) (uint64, error) {
+	if capacity < 0 {
+		return 0, ErrCapacity
+	}
+	size := uint64(capacity)
+	if size < 1 {
+		size = 1
+	}
+	if !exact && size&(size-1) != 0 {
+		if bits.Len64(size-1) == 64 {
+			return 0, ErrCapacity // the next power of 2 does not fit in 64 bits
+		}
+		size = 1 << uint(bits.Len64(size-1))
+	}
+	if size > maxBufferSizeFoo() {
+		return 0, ErrCapacity
+	}
+	return size, nil
+}
+
+// maxBufferSizeFoo returns the largest number of messages a buffer can hold.
+func maxBufferSizeFoo() uint64 {
+	var zero foo
+	return maxBytes / (uint64(unsafe.Sizeof(zero)) + 8) // slot and timestamp
+}
+
+//jig:template endpointTable<Foo>
+//jig:needs Endpoint<Foo>, ErrCapacity, maxBytes
+
+// endpointTableFoo returns the number of entries in the endpoint table of a
+// channel created with the given endpoint capacity. ErrCapacity is returned
+// when the capacity is negative, doesn't fit the uint32 the table is indexed
+// with or when the table would not fit the largest possible allocation.
+func endpointTableFoo(capacity int) (uint32, error) {
+	var entry EndpointFoo
+	if capacity < 0 || uint64(capacity) > math.MaxUint32 || uint64(capacity) > maxBytes/uint64(unsafe.Sizeof(entry)) {
+		return 0, ErrCapacity
+	}
+	return uint32(capacity), nil
+}
+
+//jig:template NewChanChecked<Foo>
+//jig:needs NewChanOpts<Foo>, bufferSize<Foo>, endpointTable<Foo>
+
+// NewChanCheckedFoo creates a channel like NewChanOpts, but returns
+// ErrCapacity instead of panicking when the buffer or endpoint capacity is
+// out of range. Use it to validate capacities that come from configuration,
+// e.g. a buffer of hundreds of millions of messages retaining a full day of
+// data.
+func NewChanCheckedFoo(options ...ChanOption) (*ChanFoo, error) {
+	o := chanOptions{bufferCapacity: 128, endpointCapacity: 8}
+	for _, option := range options {
+		option(&o)
+	}
+	if _, err := endpointTableFoo(o.endpointCapacity); err != nil {
+		return nil, err
+	}
+	if _, err := bufferSizeFoo(o.bufferCapacity, o.exact); err != nil {
+		return nil, err
+	}
+	return NewChanOptsFoo(options...), nil
+}
@@ -0,0 +1,58 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Slot<Foo>
+
+// SlotFoo is a slot in the buffer of a channel claimed by Claim. The message
+// is constructed in place through Value and then sent by passing the slot to
+// Publish.
+type SlotFoo struct {
+	Value *foo // points into the buffer of the channel
+	seq   uint64
+}
+
+//jig:template Chan<Foo> Claim
+//jig:needs Chan<Foo>, Slot<Foo>, Chan<Foo> slideBuffer, Chan<Foo> publish, ErrSealed, ErrClosed, Chan<Foo> awaitResume, Chan<Foo> throttle, Chan<Foo> awaitConsumed
+
+// Claim reserves the next slot in the buffer of the channel, blocking like
+// Send until there is room. The message is then constructed directly in the
+// buffer through the Value of the slot, which saves copying a large value
+// through the parameter of Send. Claim can be used by concurrent goroutines.
+// Every claimed slot must be passed to Publish as soon as possible, because
+// endpoints can't read past a slot that is not published yet. The value in
+// the slot may hold an old message, so every field should be set.
+//
+// When the channel was sealed, Claim returns ErrSealed. When the channel is
+// closed while waiting for room, Claim returns ErrClosed.
+func (c *ChanFoo) Claim() (SlotFoo, error) {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return SlotFoo{}, ErrSealed
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return SlotFoo{}, err
+	}
+	write := atomic.AddUint64(&c.write, 1) - 1
+	var spins uint32
+	for write >= atomic.LoadUint64(&c.end) {
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			return SlotFoo{}, ErrClosed
+		}
+	}
+	r := c.loadRing() // can't grow before the slot is published
+	return SlotFoo{Value: &r.buffer[r.slot(write)], seq: write}, nil
+}
+
+// Publish sends the message constructed in a slot returned by Claim. Messages
+// count against the byte budget of the channel (see LimitBytes) when they are
+// published, but Publish never blocks on it.
+func (c *ChanFoo) Publish(slot SlotFoo) {
+	if c.size != nil {
+		atomic.AddInt64(&c.bytes, int64(c.size(*slot.Value)))
+	}
+	c.stamp(c.loadRing(), slot.seq, 0, nil)
+	if c.lockstep == 1 {
+		c.awaitConsumed(slot.seq + 1)
+	}
+}
@@ -0,0 +1,37 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> CloseWith
+//jig:needs Chan<Foo> Close, Chan<Foo> Seal, Chan<Foo> slideBuffer, Chan<Foo> publish, Chan<Foo> admit
+
+// CloseWith sends a final value to the channel and then closes it with err,
+// see Close. The final value is guaranteed to be the last message delivered
+// to every endpoint, immediately before the close notification. To guarantee
+// this, CloseWith seals the channel (see Seal) and endpoints ignore any
+// message that a concurrent Send still manages to commit after the final
+// value. This gives e.g. "summary record then close" semantics without having
+// to coordinate senders with the goroutine closing the channel. When the
+// channel was already closed, CloseWith only calls Close.
+func (c *ChanFoo) CloseWith(value foo, err error) {
+	if atomic.LoadUint64(&c.channelState) == active {
+		c.Seal()
+		var spins uint32
+		size := int64(0)
+		if c.size != nil {
+			size = int64(c.size(value))
+		}
+		if c.size == nil || c.admit(size, &spins) {
+			write := atomic.AddUint64(&c.write, 1) - 1
+			for write >= atomic.LoadUint64(&c.end) {
+				if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+					atomic.AddInt64(&c.bytes, -size) // not sent, see LimitBytes
+					return // channel was closed
+				}
+			}
+			atomic.StoreUint64(&c.final, write+1) // before anything after it is committed
+			c.publish(write, value)
+		}
+	}
+	c.Close(err)
+}
@@ -0,0 +1,101 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> Commit
+//jig:needs Endpoint<Foo>, Chan<Foo> commitData, ErrOutOfRange, Endpoint<Foo> checkpoint
+
+// Commit marks all messages with a sequence number lower than seq as processed
+// by an endpoint created with WithManualCommit, so the channel no longer needs
+// to retain them for the endpoint. To commit the message being delivered from
+// inside the function passed to Range, pass Seq()+1. Progress can only move
+// forward and not beyond the most recently sent message, otherwise Commit
+// returns ErrOutOfRange. Commit also returns ErrOutOfRange when the endpoint
+// has finished. Commit should be called from the goroutine using the endpoint.
+func (e *EndpointFoo) Commit(seq uint64) error {
+	if atomic.LoadUint64(&e.cursor) == parked {
+		return ErrOutOfRange
+	}
+	if seq < atomic.LoadUint64(&e.committed) || seq > e.commitData() {
+		return ErrOutOfRange
+	}
+	atomic.StoreUint64(&e.committed, seq)
+	e.checkpoint()
+	return nil
+}
+
+//jig:template Endpoint<Foo> Committed
+//jig:needs Endpoint<Foo>
+
+// Committed returns the sequence number of the first message that was not
+// committed (see Commit). For an endpoint created with WithManualCommit,
+// calling Seek with this sequence number redelivers every uncommitted message.
+func (e *EndpointFoo) Committed() uint64 {
+	return atomic.LoadUint64(&e.committed)
+}
+
+//jig:template Endpoint<Foo> retained
+//jig:needs Endpoint<Foo>
+
+// retained returns the first message the channel has to keep in its buffer for
+// the endpoint with the given cursor. For an endpoint created with
+// WithManualCommit that is the first uncommitted message, so Seek can go back
+// to it (see Commit). When values are recycled, it is the first value handed
+// out by the last call to Next or ReadBatch, which the caller may use until
+// its next read (see Recycle). A parked cursor is returned as is.
+func (e *EndpointFoo) retained(cursor uint64) uint64 {
+	if cursor == parked {
+		return parked
+	}
+	if e.manualCommit == 1 {
+		if committed := atomic.LoadUint64(&e.committed); committed < cursor {
+			cursor = committed
+		}
+	}
+	if e.recycle != nil {
+		if held := atomic.LoadUint64(&e.held); held < cursor {
+			cursor = held
+		}
+	}
+	return cursor
+}
+
+//jig:template CursorStore
+
+// CursorStore saves the positions of named endpoints, so a restarted process
+// can resume reading where it left off, see WithCursorStore. Load returns ok
+// false when no position was saved for the endpoint. Save is called from the
+// goroutine reading the endpoint. When Save returns an error, the position is
+// saved again later.
+type CursorStore interface {
+	Load(name string) (seq uint64, ok bool, err error)
+	Save(name string, seq uint64) error
+}
+
+//jig:template Endpoint<Foo> checkpoint
+//jig:needs Endpoint<Foo>
+
+// checkpoint saves the position of the endpoint in its cursor store when it
+// changed and the checkpoint interval has passed since it was last saved.
+func (e *EndpointFoo) checkpoint() {
+	if e.cursorStore == nil || e.name == "" {
+		return
+	}
+	seq := atomic.LoadUint64(&e.cursor)
+	if e.manualCommit == 1 {
+		seq = atomic.LoadUint64(&e.committed)
+	}
+	if seq == parked || seq == e.saved {
+		return
+	}
+	now := time.Now().UnixNano()
+	if now-e.checkpointed < e.checkpointEvery.Nanoseconds() {
+		return
+	}
+	if e.cursorStore.Save(e.name, seq) == nil {
+		e.saved, e.checkpointed = seq, now
+	}
+}
@@ -0,0 +1,46 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> startCommitter
+//jig:needs Chan<Foo> commitData
+
+// startCommitter starts the goroutine committing the messages sent to the
+// channel, see WithCommitter. The goroutine exits when the channel is closed,
+// after which the endpoints commit the remaining messages themselves.
+func (c *ChanFoo) startCommitter() {
+	exit := make(chan struct{})
+	c.committerExit = exit
+	atomic.StoreUint32(&c.committer, working)
+	go func(done <-chan struct{}) {
+		defer close(exit)
+		for {
+			select {
+			case <-c.commits:
+				c.commitAll()
+			case <-done:
+				atomic.StoreUint32(&c.committer, resting)
+				c.commitAll()
+				return
+			}
+		}
+	}(c.signal().done)
+}
+
+//jig:template Chan<Foo> published
+//jig:needs Chan<Foo> wake
+
+// published is called by a sender after storing messages in the buffer. With
+// a committer goroutine, the committer is notified and it will wake up the
+// endpoints once the messages are committed. Otherwise the endpoints are woken
+// up to commit the messages themselves.
+func (c *ChanFoo) published() {
+	if c.commits != nil {
+		select {
+		case c.commits <- struct{}{}:
+		default: // the committer was already notified
+		}
+		return
+	}
+	c.wake()
+}
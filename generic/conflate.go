@@ -0,0 +1,133 @@
+package multicast
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+//jig:template Chan<Foo> ConflateBy
+//jig:needs Chan<Foo>
+
+// ConflateBy makes Send conflate messages by key when the buffer is full.
+// Instead of blocking until the slowest endpoint has read another message,
+// Send will replace an older message with the same key as the new message.
+// Only messages that none of the endpoints started reading are replaced, so
+// every endpoint still observes the latest message for every key. When there
+// is no such message, Send blocks as usual. The key function is called for
+// every message compared and should return a comparable value.
+//
+// ConflateBy must be called before any message is sent to the channel. Send,
+// SendAt, SendAfter, SendHeaders, SendSlice, SendContext, SendTimeout and
+// TrySend conflate messages, FastSend does not. TrySend, SendContext and
+// SendTimeout only fail when there is no message to replace either. The
+// replacing message takes the place of the replaced one, with its own
+// timestamp, due time and headers. Note that a message replaced this way is
+// not passed to the reduce function of Summarize.
+func (c *ChanFoo) ConflateBy(key func(value foo) interface{}) {
+	c.key = key
+}
+
+//jig:template Chan<Foo> sendConflated
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> publish, Chan<Foo> replace, Chan<Foo> awaitEnd, Headers
+
+// sendConflated sends value like send, but when the buffer is full it
+// replaces an older message with the same key instead of waiting for room.
+// It returns false when the channel was closed before value was sent.
+func (c *ChanFoo) sendConflated(value foo, due int64, headers Headers) bool {
+	var spins uint32
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write >= atomic.LoadUint64(&c.end) {
+			if !c.slideBuffer(nil) {
+				return false // channel was closed
+			}
+			if write >= atomic.LoadUint64(&c.end) {
+				if c.replace(value, due, headers) {
+					return true
+				}
+				backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+				continue
+			}
+		}
+		if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+			c.awaitEnd(write)
+			c.publishAt(write, value, due, headers)
+			return true
+		}
+	}
+}
+
+//jig:template Chan<Foo> replace
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> elapsed, Chan<Foo> loadRing, Chan<Foo> timestamp, Chan<Foo> cloned, Headers
+
+// replace looks for the most recent committed message with the same key as
+// value that is beyond the cursors of all endpoints and replaces it in place,
+// with the due time (see SendAt) and headers (see SendHeaders) of value.
+// While replacing, the uncommitted bit of the message is set, so endpoints
+// reaching it will wait (see settled) until the replacement is complete.
+func (c *ChanFoo) replace(value foo, due int64, headers Headers) bool {
+	commit := c.commitData()
+	key := c.key(value)
+	replaced := false
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		unread := func(index uint64) bool {
+			for i := uint32(0); i < endpoints.len; i++ {
+				cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+				if cursor != parked && cursor >= index {
+					return false
+				}
+			}
+			return true
+		}
+		r := c.loadRing() // can't grow while we have access to the endpoints
+		begin := atomic.LoadUint64(&c.begin)
+		for index := commit; index > begin && unread(index-1); index-- {
+			slot := r.slot(index - 1)
+			written := atomic.LoadInt64(&r.written[slot])
+			if written&2 == 2 || c.key(r.buffer[slot]) != key {
+				continue
+			}
+			atomic.StoreInt64(&r.written[slot], written|1)
+			if !unread(index - 1) {
+				atomic.StoreInt64(&r.written[slot], written)
+				return // an endpoint started reading it
+			}
+			if c.size != nil {
+				atomic.AddInt64(&c.bytes, -int64(c.size(r.buffer[slot]))) // value was admitted by Send
+			}
+			old := r.buffer[slot]
+			r.buffer[slot] = c.cloned(value)
+			if c.recycle != nil {
+				c.recycle(old) // no endpoint read it, see unread
+			}
+			if r.headers != nil {
+				r.headers[slot] = headers
+			}
+			updated := c.timestamp()
+			if due > updated {
+				updated = due
+				if atomic.LoadUint32(&c.deferred) == 0 {
+					atomic.StoreUint32(&c.deferred, 1) // before storing written, see pending
+				}
+			}
+			atomic.StoreInt64(&r.written[slot], updated<<2)
+			replaced = true
+			return
+		}
+	})
+	return replaced
+}
+
+//jig:template ring<Foo> settled
+//jig:needs Chan<Foo>
+
+// settled returns the written entry of a committed message after waiting for
+// a replacement of the message by a conflating Send to complete.
+func (r *ringFoo) settled(index uint64) int64 {
+	written := atomic.LoadInt64(&r.written[r.slot(index)])
+	for written&1 == 1 {
+		runtime.Gosched()
+		written = atomic.LoadInt64(&r.written[r.slot(index)])
+	}
+	return written
+}
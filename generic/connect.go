@@ -0,0 +1,22 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> AutoConnect
+//jig:needs Chan<Foo> attach
+
+// AutoConnect defers starting the producer of the channel until n endpoints
+// have been created. The start function is called exactly once, from the
+// goroutine creating the n-th endpoint, just before NewEndpoint returns. This
+// way all n consumers are guaranteed to receive every message sent by the
+// producer, without coordinating their startup by hand. When n is not
+// positive, start is called immediately. AutoConnect must be called before any
+// endpoint is created.
+func (c *ChanFoo) AutoConnect(n int, start func()) {
+	if n <= 0 {
+		start()
+		return
+	}
+	atomic.StoreInt64(&c.connectPending, int64(n))
+	c.connect = start
+}
@@ -0,0 +1,187 @@
+package multicast
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> RangeContext
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate, Endpoint<Foo> wakeUp
+
+// RangeContext works like Range, but will also stop when the passed in
+// context is canceled. In that case the endpoint is canceled and RangeContext
+// returns the error of the context. When the context is never canceled,
+// RangeContext returns nil when the endpoint was canceled or the channel was
+// closed.
+//
+// Note that, unlike Range, RangeContext starts a goroutine to wait for the
+// context to be done. This goroutine exits when RangeContext returns.
+func (e *EndpointFoo) RangeContext(ctx context.Context, foreach func(value foo, err error, closed bool) bool, maxAge time.Duration) error {
+	if ctx.Done() == nil {
+		e.iterate(foreach, nil, maxAge, nil)
+		return nil
+	}
+	var control uint32
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreUint32(&control, abort)
+			e.wakeUp()
+		case <-returned:
+		}
+	}()
+	e.iterate(foreach, nil, maxAge, &control)
+	close(returned)
+	if atomic.LoadUint32(&control) == abort {
+		return ctx.Err()
+	}
+	return nil
+}
+
+//jig:template Chan<Foo> NewEndpointContext
+//jig:needs Chan<Foo> NewEndpoint, Endpoint<Foo> Cancel
+
+// NewEndpointContext works like NewEndpoint, but binds the endpoint to the
+// passed in context. When the context is canceled, the endpoint is canceled,
+// waking up a Range or Next blocked on it. This way an endpoint is never
+// leaked because Cancel was forgotten on an early return.
+//
+// Note that, when the context can be canceled, NewEndpointContext starts a
+// goroutine to wait for the context to be done. This goroutine exits when the
+// endpoint finishes.
+func (c *ChanFoo) NewEndpointContext(ctx context.Context, keep uint64) (*EndpointFoo, error) {
+	e, err := c.NewEndpoint(keep)
+	if err != nil || ctx.Done() == nil {
+		return e, err
+	}
+	done := e.Done()
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-done: // finished, so it may be reused already
+			default:
+				e.Cancel()
+			}
+		case <-done:
+		}
+	}()
+	return e, nil
+}
+
+//jig:template Chan<Foo> SendContext
+//jig:needs Chan<Foo> sendWait
+
+// SendContext works like Send, but when it is blocked on a full buffer it
+// will give up when the passed in context is canceled and return the error of
+// the context. The message is then not sent. A conflating channel (see
+// ConflateBy) replaces an older message instead of blocking, when it can. When the channel was sealed,
+// SendContext returns ErrSealed. When the channel is closed while waiting for
+// room, SendContext returns ErrClosed.
+func (c *ChanFoo) SendContext(ctx context.Context, value foo) error {
+	return c.sendWait(value, ctx.Done(), time.Time{}, func() error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			return nil
+		}
+	})
+}
+
+//jig:template Chan<Foo> SendTimeout
+//jig:needs Chan<Foo> sendWait, ErrTimeout
+
+// SendTimeout works like Send, but when it is blocked on a full buffer for
+// longer than the timeout it will give up and return ErrTimeout. The message
+// is then not sent. A conflating channel (see ConflateBy) replaces an older
+// message instead of blocking, when it can. When the channel was sealed, SendTimeout returns
+// ErrSealed. When the channel is closed while waiting for room, SendTimeout
+// returns ErrClosed.
+func (c *ChanFoo) SendTimeout(value foo, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	return c.sendWait(value, nil, deadline, func() error {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		return nil
+	})
+}
+
+//jig:template Chan<Foo> sendWait
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> publish, Chan<Foo> admit, Chan<Foo> reserve, Chan<Foo> awaitTurn, Chan<Foo> awaitConsumed, ErrSealed, ErrClosed, ErrRateLimited, Chan<Foo> awaitEnd, Chan<Foo> replace, Chan<Foo> awaitResumeUntil
+
+// sendWait sends value like Send, but gives up with the error returned by
+// expired. While the channel is paused, it blocks until cancel is closed or
+// the deadline passes, unless the deadline is zero.
+func (c *ChanFoo) sendWait(value foo, cancel <-chan struct{}, deadline time.Time, expired func() error) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if c.fair == 1 {
+		if err := c.awaitTurn(expired); err != nil {
+			return err
+		}
+		defer c.passTurn()
+	}
+	if err := c.awaitResumeUntil(cancel, deadline, expired); err != nil {
+		return err
+	}
+	var spins uint32
+	if c.rateInterval != 0 {
+		for wait := c.reserve(1); wait != 0; wait = c.reserve(1) {
+			if c.ratePolicy == RateReject {
+				return ErrRateLimited
+			}
+			if err := expired(); err != nil {
+				return err
+			}
+			if wait > int64(time.Millisecond) {
+				wait = int64(time.Millisecond)
+			}
+			time.Sleep(time.Duration(wait))
+		}
+	}
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		for !c.admit(size, nil) {
+			if err := expired(); err != nil {
+				return err
+			}
+			if !c.slideBuffer(&spins) {
+				return ErrClosed
+			}
+		}
+	}
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write < atomic.LoadUint64(&c.end) {
+			if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+				c.awaitEnd(write)
+				c.publish(write, value)
+				if c.lockstep == 1 {
+					c.awaitConsumed(write + 1)
+				}
+				return nil
+			}
+			continue
+		}
+		if c.key != nil && c.replace(value, 0, nil) {
+			if c.lockstep == 1 {
+				c.awaitConsumed(atomic.LoadUint64(&c.write))
+			}
+			return nil
+		}
+		if err := expired(); err != nil {
+			atomic.AddInt64(&c.bytes, -size)
+			return err
+		}
+		if !c.slideBuffer(&spins) {
+			atomic.AddInt64(&c.bytes, -size)
+			return ErrClosed
+		}
+	}
+}
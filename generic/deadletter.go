@@ -0,0 +1,69 @@
+package multicast
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+//jig:template Failure
+
+// Failure describes why a message was routed to the dead-letter channel of an
+// endpoint, see DeadLetter.
+type Failure struct {
+	Endpoint string // name of the endpoint, see WithName
+	Seq      uint64 // sequence number of the message
+	Attempts int    // number of times the message was delivered
+	Err      error  // ErrRetriesExhausted or the error passed to Reject
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("message %d failed after %d attempts: %v", f.Seq, f.Attempts, f.Err)
+}
+
+//jig:template Endpoint<Foo> DeadLetter
+//jig:needs Endpoint<Foo>, ErrRetriesExhausted
+
+// DeadLetter makes the endpoint route messages that failed to the channel
+// passed in, instead of silently advancing past them. A message fails when
+// it was not acknowledged after being delivered the maximum number of times
+// (see WithAck) or when the foreach function rejects it by calling Reject.
+// The failed function, when not nil, is called with the message and a Failure
+// describing why it failed, before the message is sent to the channel. Either
+// the channel or the failed function may be nil. Both are used from the
+// goroutine reading the endpoint, so a full dead-letter channel will block
+// reading until there is room. DeadLetter must be called before reading from
+// the endpoint.
+func (e *EndpointFoo) DeadLetter(channel *ChanFoo, failed func(value foo, failure Failure)) {
+	e.deadLetters, e.onDeadLetter = channel, failed
+}
+
+//jig:template Endpoint<Foo> Reject
+//jig:needs Endpoint<Foo>
+
+// Reject reports the message being delivered as a poison message that should
+// not be processed again. The message is routed to the dead-letter channel of
+// the endpoint (see DeadLetter) with err as the reason of the failure. For an
+// endpoint created with WithAck, the message is not redelivered regardless of
+// the number of retries left. Reject must be called from within the foreach
+// function passed to Range.
+func (e *EndpointFoo) Reject(err error) {
+	e.poison = err
+	atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected)
+}
+
+//jig:template Endpoint<Foo> deadLetter
+//jig:needs Endpoint<Foo>, Failure
+
+// deadLetter routes the failed message at seq to the dead-letter channel of the
+// endpoint. It sends from the goroutine reading the endpoint, so reading
+// blocks while the dead-letter channel is full, see DeadLetter.
+func (e *EndpointFoo) deadLetter(value foo, seq uint64, attempts uint32, err error) {
+	e.poison = nil
+	failure := Failure{Endpoint: e.name, Seq: seq, Attempts: int(attempts), Err: err}
+	if e.onDeadLetter != nil {
+		e.onDeadLetter(value, failure)
+	}
+	if e.deadLetters != nil {
+		e.deadLetters.Send(value)
+	}
+}
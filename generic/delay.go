@@ -0,0 +1,63 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> SendAt
+//jig:needs Chan<Foo> Send
+
+// SendAt sends a value to the channel like Send, but the endpoints withhold
+// the message until time t. The message is committed to the buffer right
+// away, so it keeps its place in the order of messages and its sequence
+// number. Because endpoints read messages in order, a message that is not due
+// yet also holds back the messages sent after it. So SendAt works best as a
+// delay queue when the due times increase with the order of sending, e.g. when
+// every message is delayed by the same duration. Timestamps reported for the
+// message (e.g. by RangeMeta) are its due time. A time in the past delivers
+// the message right away. On a conflating channel (see ConflateBy), a message
+// replacing an older one takes its place, with the new due time.
+func (c *ChanFoo) SendAt(value foo, t time.Time) error {
+	due := t.Sub(c.start).Nanoseconds()
+	if due <= 0 {
+		due = 0
+	}
+	return c.send(value, due, nil)
+}
+
+//jig:template Chan<Foo> SendAfter
+//jig:needs Chan<Foo> Send, Chan<Foo> elapsed
+
+// SendAfter sends a value to the channel like Send, but the endpoints
+// withhold the message until duration d has passed, see SendAt for details.
+func (c *ChanFoo) SendAfter(value foo, d time.Duration) error {
+	if d <= 0 {
+		return c.send(value, 0, nil)
+	}
+	return c.send(value, c.elapsed()+d.Nanoseconds(), nil)
+}
+
+//jig:template Endpoint<Foo> due
+//jig:needs Endpoint<Foo>, Chan<Foo> elapsed, Endpoint<Foo> sleep
+
+// pending returns true when the message with the given written entry was sent
+// by SendAt or SendAfter and is not due yet. Other messages are never due in
+// the future, so the clock is only read once a delayed message was sent. This
+// keeps reading the clock for every message off the receive path, which
+// matters when the channel is used as a plain queue.
+func (e *EndpointFoo) pending(written int64) bool {
+	return written&2 == 0 && atomic.LoadUint32(&e.deferred) == 1 && written>>2 > e.elapsed()
+}
+
+// due waits until the message with the given written entry is due. It returns
+// false when the endpoint was canceled or reading was suspended or aborted via
+// control while waiting.
+func (e *EndpointFoo) due(written int64, control *uint32) bool {
+	for e.pending(written) {
+		if !e.sleep(time.Duration(written>>2-e.elapsed()), control) {
+			return false
+		}
+	}
+	return true
+}
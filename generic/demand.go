@@ -0,0 +1,76 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Endpoint<Foo> Request
+//jig:needs Endpoint<Foo>
+
+// Request grants the channel credit for n more messages to be sent to the
+// endpoint. An endpoint that calls Request takes part in the demand signaled
+// to producers, see Demand. Credit granted while the endpoint is lagging
+// behind counts from the message it will read next, so credit is never spent
+// on messages it did not receive yet.
+func (e *EndpointFoo) Request(n uint64) {
+	if n == 0 {
+		return
+	}
+	for {
+		demand := atomic.LoadUint64(&e.demand)
+		base := demand
+		if cursor := atomic.LoadUint64(&e.cursor); base < cursor {
+			base = cursor
+		}
+		if atomic.CompareAndSwapUint64(&e.demand, demand, base+n) {
+			return
+		}
+	}
+}
+
+//jig:template Chan<Foo> Demand
+//jig:needs endpoints<Foo>
+
+// Demand returns the number of messages that can be sent to the channel
+// before exceeding the credit granted by any of the endpoints that called
+// Request. This is the smallest outstanding demand of those endpoints, so a
+// producer that sends no more than Demand messages never sends a message one of
+// them did not ask for. When no endpoint requested messages, Demand returns 0.
+func (c *ChanFoo) Demand() uint64 {
+	write := atomic.LoadUint64(&c.write)
+	demand := uint64(0)
+	requested := false
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		limit := atomic.LoadUint64(&entries[i].demand)
+		if limit == 0 || atomic.LoadUint64(&entries[i].cursor) == parked {
+			continue
+		}
+		outstanding := uint64(0)
+		if limit > write {
+			outstanding = limit - write
+		}
+		if !requested || outstanding < demand {
+			demand = outstanding
+			requested = true
+		}
+	}
+	return demand
+}
+
+//jig:template Chan<Foo> AwaitDemand
+//jig:needs Chan<Foo> Demand, backoff
+
+// AwaitDemand blocks until Demand is non-zero and then returns it. This allows
+// a producer to generate messages only when consumers asked for them. When the
+// channel is closed or sealed, AwaitDemand returns 0.
+func (c *ChanFoo) AwaitDemand() uint64 {
+	var spins uint32
+	for {
+		if demand := c.Demand(); demand > 0 {
+			return demand
+		}
+		if atomic.LoadUint64(&c.channelState) != active || atomic.LoadUint32(&c.sealed) != 0 {
+			return 0
+		}
+		backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+	}
+}
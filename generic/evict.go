@@ -0,0 +1,123 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> EvictSlow
+//jig:needs Chan<Foo> evictSlow
+
+// EvictSlow makes the channel automatically cancel endpoints that fall too
+// far behind, so a single stuck endpoint can no longer stall all senders. An
+// endpoint is evicted when the number of committed messages it did not read
+// exceeds maxLag, or when the oldest message it did not read is older than
+// maxDelay. A zero maxLag or maxDelay disables that threshold. When not nil,
+// the evicted function is called with the evicted endpoint and its lag in
+// messages, e.g. to log the name of the endpoint (see WithName).
+//
+// An evicted endpoint behaves as if Cancel was called on it. Use Evicted to
+// find out whether an endpoint was evicted. EvictSlow must be called before any
+// message is sent to the channel. Endpoints are checked when a message is sent
+// and when a sender finds the buffer full.
+func (c *ChanFoo) EvictSlow(maxLag uint64, maxDelay time.Duration, evicted func(endpoint *EndpointFoo, lag uint64)) {
+	c.maxLag = maxLag
+	c.maxDelay = maxDelay
+	c.onEvict = evicted
+}
+
+//jig:template Endpoint<Foo> Evicted
+//jig:needs Endpoint<Foo>
+
+// Evicted returns true when the endpoint was canceled because it fell too far
+// behind, see EvictSlow.
+func (e *EndpointFoo) Evicted() bool {
+	return atomic.LoadUint32(&e.evicted) == 1
+}
+
+//jig:template Chan<Foo> evictSlow
+//jig:needs Chan<Foo> evict, Chan<Foo> commitData
+
+// evictSlow evicts the endpoints lagging behind too far. It returns quickly
+// when the messages in the buffer can't exceed the thresholds.
+func (c *ChanFoo) evictSlow() {
+	if c.maxLag == 0 && c.maxDelay == 0 {
+		return
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	commit := c.commitData()
+	if begin == commit {
+		return
+	}
+	if c.maxLag == 0 || commit-begin <= c.maxLag {
+		if c.maxDelay == 0 || !c.delayed(begin) {
+			return
+		}
+	}
+	var evicted []evictionFoo
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		evicted = c.evict(endpoints.entry[:endpoints.len])
+	})
+	c.evicted(evicted)
+}
+
+//jig:template Chan<Foo> evict
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> elapsed, Chan<Foo> loadRing, Endpoint<Foo> park, Endpoint<Foo> wakeUp
+
+type evictionFoo struct {
+	endpoint *EndpointFoo
+	lag      uint64
+}
+
+// evict marks the endpoints lagging behind too far as evicted and cancels
+// them. It must be called with access to the endpoints, which may be shared
+// (see AccessShared). The evicted endpoints are returned, so the caller can
+// call evicted after releasing the endpoints.
+func (c *ChanFoo) evict(entries []EndpointFoo) (evicted []evictionFoo) {
+	if c.maxLag == 0 && c.maxDelay == 0 {
+		return nil
+	}
+	commit := c.commitData()
+	for i := range entries {
+		ep := &entries[i]
+		cursor := atomic.LoadUint64(&ep.cursor)
+		if cursor == parked || cursor >= commit || atomic.LoadUint32(&ep.evicted) == 1 {
+			continue
+		}
+		if (c.maxLag == 0 || commit-cursor <= c.maxLag) && (c.maxDelay == 0 || !c.delayed(cursor)) {
+			continue
+		}
+		atomic.StoreUint32(&ep.evicted, 1)
+		if atomic.CompareAndSwapUint64(&ep.endpointState, active, canceled) ||
+			atomic.CompareAndSwapUint64(&ep.endpointState, closed, canceled) {
+			evicted = append(evicted, evictionFoo{ep, commit - cursor})
+		}
+	}
+	return evicted
+}
+
+// delayed returns true when the message at index was sent longer than
+// maxDelay ago.
+func (c *ChanFoo) delayed(index uint64) bool {
+	r := c.loadRing()
+	updated := atomic.LoadInt64(&r.written[r.slot(index)]) >> 2
+	return updated != 0 && c.elapsed()-updated > c.maxDelay.Nanoseconds()
+}
+
+// evicted parks the evicted endpoints that are not inside a call to Range and
+// calls the eviction callback of the channel.
+func (c *ChanFoo) evicted(evicted []evictionFoo) {
+	for _, eviction := range evicted {
+		if atomic.LoadUint32(&eviction.endpoint.endpointActivity) == idling {
+			eviction.endpoint.park()
+		}
+	}
+	for _, eviction := range evicted {
+		eviction.endpoint.wakeUp()
+	}
+	for _, eviction := range evicted {
+		if c.onEvict != nil {
+			c.onEvict(eviction.endpoint, eviction.lag)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package multicast
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+//jig:template Chan<Foo> awaitTurn
+//jig:needs Chan<Foo>, backoff
+
+// awaitTurn takes a ticket and blocks until it is the turn of the ticket to
+// send, see WithFairSend. When expired returns an error before that, the error
+// is returned and a goroutine is started that passes on the turn when it
+// comes, so the senders behind it are not blocked.
+func (c *ChanFoo) awaitTurn(expired func() error) error {
+	ticket := atomic.AddUint64(&c.ticket, 1) - 1
+	var spins uint32
+	for atomic.LoadUint64(&c.serving) != ticket {
+		if expired != nil {
+			if err := expired(); err != nil {
+				go func() {
+					for atomic.LoadUint64(&c.serving) != ticket {
+						runtime.Gosched()
+					}
+					c.passTurn()
+				}()
+				return err
+			}
+		}
+		backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+	}
+	return nil
+}
+
+// tryTurn takes a ticket only when it is its turn right away.
+func (c *ChanFoo) tryTurn() bool {
+	serving := atomic.LoadUint64(&c.serving)
+	return atomic.CompareAndSwapUint64(&c.ticket, serving, serving+1)
+}
+
+// passTurn lets the sender with the next ticket send.
+func (c *ChanFoo) passTurn() {
+	atomic.AddUint64(&c.serving, 1)
+}
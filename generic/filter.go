@@ -0,0 +1,28 @@
+package multicast
+
+//jig:template Endpoint<Foo> Filter
+//jig:needs Endpoint<Foo>
+
+// Filter makes the endpoint skip messages for which the keep function returns
+// false. Skipped messages are never passed to the foreach function of Range,
+// nor returned by Next or ReadBatch, which saves the cost of calling foreach
+// for messages the consumer is not interested in. The keep function is called
+// from the goroutine reading the endpoint. Filter must be called before
+// reading from the endpoint.
+func (e *EndpointFoo) Filter(keep func(value foo) bool) {
+	e.filter = keep
+}
+
+//jig:template Endpoint<Foo> Map
+//jig:needs Endpoint<Foo>
+
+// Map makes the endpoint pass every message through the transform function
+// before delivering it, e.g. to redact or enrich messages for a specific
+// consumer without copying them into a separate channel. The message in the
+// buffer of the channel is not changed, so other endpoints are not affected.
+// When a filter was set (see Filter), only messages kept by the filter are
+// transformed. The transform function is called from the goroutine reading
+// the endpoint. Map must be called before reading from the endpoint.
+func (e *EndpointFoo) Map(transform func(value foo) foo) {
+	e.transform = transform
+}
@@ -0,0 +1,90 @@
+package multicast
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//jig:template consumerGroup
+//jig:needs ChanPadding
+
+// consumerGroup is shared by the endpoints that joined a group, see WithGroup.
+type consumerGroup struct {
+	claimed uint64 // sequence number after the last message claimed
+	_______ pad56
+	resize  sync.RWMutex // held for writing while claims grows
+	claims  []uint64     // sequence number+1 of the message claimed, by slot
+}
+
+// claim returns true when the message with sequence number seq was not
+// claimed by another member of the group yet, in which case it is now claimed.
+// Claims are kept for every message in the buffer, so a message skipped by one
+// member, e.g. because of its filter, can still be claimed by a member that
+// reaches it later. Size is the size of the ring holding the message.
+func (g *consumerGroup) claim(seq, size uint64) bool {
+	g.resize.RLock()
+	for uint64(len(g.claims)) < size {
+		g.resize.RUnlock()
+		g.grow(size)
+		g.resize.RLock()
+	}
+	defer g.resize.RUnlock()
+	slot := &g.claims[seq&uint64(len(g.claims)-1)]
+	for {
+		claimed := atomic.LoadUint64(slot)
+		if claimed > seq {
+			return false // claimed by another member, or no longer in the buffer
+		}
+		if atomic.CompareAndSwapUint64(slot, claimed, seq+1) {
+			break
+		}
+	}
+	for {
+		claimed := atomic.LoadUint64(&g.claimed)
+		if claimed > seq || atomic.CompareAndSwapUint64(&g.claimed, claimed, seq+1) {
+			return true
+		}
+	}
+}
+
+// grow makes room for the claims of the messages in a ring of the given size.
+// The number of claims is a power of 2 of at least size, so the messages in
+// the buffer never share a slot.
+func (g *consumerGroup) grow(size uint64) {
+	g.resize.Lock()
+	defer g.resize.Unlock()
+	if uint64(len(g.claims)) >= size {
+		return
+	}
+	n := uint64(1)
+	for n < size {
+		n *= 2
+	}
+	claims := make([]uint64, n)
+	for _, claimed := range g.claims {
+		if claimed != 0 {
+			claims[(claimed-1)&(n-1)] = claimed
+		}
+	}
+	g.claims = claims
+}
+
+//jig:template Chan<Foo> join
+//jig:needs Chan<Foo>
+
+// join returns the consumer group with the given name, creating it when it
+// does not exist yet, and the sequence number a new member should start at.
+// It must be called while creating an endpoint.
+func (c *ChanFoo) join(name string, start uint64) (*consumerGroup, uint64) {
+	if c.groups == nil {
+		c.groups = make(map[string]*consumerGroup)
+	}
+	group := c.groups[name]
+	if group == nil {
+		group = &consumerGroup{claimed: start}
+		c.groups[name] = group
+	} else if claimed := atomic.LoadUint64(&group.claimed); claimed > start {
+		start = claimed
+	}
+	return group, start
+}
@@ -0,0 +1,21 @@
+package multicast
+
+//jig:template Headers
+
+// Headers holds metadata of a message, like a trace ID, its source or content
+// type, see SendHeaders. Headers should not be modified after being sent, as
+// they are shared by all endpoints.
+type Headers map[string]string
+
+//jig:template Chan<Foo> SendHeaders
+//jig:needs Chan<Foo> Send, Headers
+
+// SendHeaders sends a value with headers attached to it, see Send for details.
+// The headers are carried through the buffer with the message and passed to
+// the foreach function of RangeMeta, so metadata like a trace ID doesn't have
+// to be wrapped together with every value. Headers are only kept when the
+// channel was created with WithHeaders. On a conflating channel (see
+// ConflateBy), a message replacing an older one carries the new headers.
+func (c *ChanFoo) SendHeaders(value foo, headers Headers) error {
+	return c.send(value, 0, headers)
+}
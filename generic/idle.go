@@ -0,0 +1,43 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> idle
+//jig:needs endpoints<Foo>, Endpoint<Foo> park, Endpoint<Foo> wakeUp
+
+// idle cancels the endpoints that were idle for longer than their idle
+// timeout, see WithIdleTimeout. It must be called with access to the
+// endpoints, which may be shared (see AccessShared). The canceled endpoints
+// are returned, so the caller can call idled after releasing the endpoints.
+func (c *ChanFoo) idle(entries []EndpointFoo) (idle []*EndpointFoo) {
+	now := time.Now().UnixNano()
+	for i := range entries {
+		ep := &entries[i]
+		if ep.idleTimeout == 0 || atomic.LoadUint64(&ep.cursor) == parked ||
+			atomic.LoadUint32(&ep.endpointActivity) != idling ||
+			now-atomic.LoadInt64(&ep.lastRead) <= ep.idleTimeout.Nanoseconds() {
+			continue
+		}
+		if atomic.CompareAndSwapUint64(&ep.endpointState, active, canceled) ||
+			atomic.CompareAndSwapUint64(&ep.endpointState, closed, canceled) {
+			idle = append(idle, ep)
+		}
+	}
+	return idle
+}
+
+// idled parks the canceled idle endpoints that are still not inside a call to
+// Range.
+func (c *ChanFoo) idled(idle []*EndpointFoo) {
+	for _, ep := range idle {
+		if atomic.LoadUint32(&ep.endpointActivity) == idling {
+			ep.park()
+		}
+	}
+	for _, ep := range idle {
+		ep.wakeUp()
+	}
+}
@@ -0,0 +1,71 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> OnLag
+//jig:needs Chan<Foo> checkLag
+
+// OnLag registers an observer that is called when the lag of an endpoint, the
+// number of committed messages it did not read yet, first exceeds threshold
+// and again when it has recovered. The lagging argument of the observer tells
+// which of the two happened. An endpoint that finishes while lagging is
+// reported as recovered with a lag of 0. This allows alerting on slow
+// endpoints long before they have to be evicted (see EvictSlow).
+//
+// The lag of the endpoints is checked when messages are sent or read, but at
+// most once per interval, so the observer is called at most once per interval
+// for any endpoint. The observer is called from the goroutine sending or
+// reading the message that triggered the check. OnLag must be called before
+// any message is sent to the channel.
+func (c *ChanFoo) OnLag(threshold uint64, interval time.Duration, observer func(endpoint *EndpointFoo, lag uint64, lagging bool)) {
+	c.lagThreshold = threshold
+	c.lagInterval = interval
+	c.onLag = observer
+}
+
+//jig:template Chan<Foo> checkLag
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> elapsed
+
+func (c *ChanFoo) checkLag() {
+	if c.onLag == nil {
+		return
+	}
+	now := c.elapsed()
+	checked := atomic.LoadInt64(&c.lagChecked)
+	if checked != 0 && now-checked < c.lagInterval.Nanoseconds() {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.lagChecked, checked, now) {
+		return // another goroutine is checking
+	}
+	type change struct {
+		endpoint *EndpointFoo
+		lag      uint64
+		lagging  bool
+	}
+	var changes []change
+	commit := c.commitData()
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		ep := &entries[i]
+		lag := uint64(0)
+		if cursor := atomic.LoadUint64(&ep.cursor); cursor != parked && cursor < commit {
+			lag = commit - cursor
+		}
+		lagging := lag > c.lagThreshold
+		if lagging != (atomic.LoadUint32(&ep.lagging) == 1) {
+			if lagging {
+				atomic.StoreUint32(&ep.lagging, 1)
+			} else {
+				atomic.StoreUint32(&ep.lagging, 0)
+			}
+			changes = append(changes, change{ep, lag, lagging})
+		}
+	}
+	for _, change := range changes {
+		c.onLag(change.endpoint, change.lag, change.lagging)
+	}
+}
@@ -0,0 +1,53 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+//jig:template Chan<Foo> allocate
+//jig:needs Chan<Foo>
+
+// allocate replaces the empty ring the channel was created with by a ring of
+// the same size that can hold messages, sized from the bufferCapacity passed
+// when creating the channel, so channels discarded before their first
+// message don't pay for a buffer and its timestamps. The timestamps also hold
+// the commit flags of the messages, so they are needed by every Send, not
+// only those that record a time. When goroutines allocate concurrently, the
+// ring stored first is returned to all.
+func (c *ChanFoo) allocate(empty *ringFoo) *ringFoo {
+	r := &ringFoo{
+		buffer:  make([]foo, empty.size),
+		written: make([]int64, empty.size),
+		mod:     empty.mod,
+		size:    empty.size,
+	}
+	if c.roundRobin == 1 {
+		r.owners = make([]uint32, empty.size)
+	}
+	if c.headers == 1 {
+		r.headers = make([]Headers, empty.size)
+	}
+	if !atomic.CompareAndSwapPointer(&c.ring, unsafe.Pointer(empty), unsafe.Pointer(r)) {
+		return (*ringFoo)(atomic.LoadPointer(&c.ring)) // allocated by another goroutine
+	}
+	return r
+}
+
+//jig:template endpoints<Foo> allocate
+//jig:needs Chan<Foo>
+
+// allocate creates the table of endpoints, sized from the endpointCapacity
+// passed when creating the channel, together with the lower bounds of their
+// cursors (see slowest). It is called by the first NewEndpoint, which has
+// exclusive access to the endpoints. Entries are never moved, so the table is
+// allocated only once.
+func (e *endpointsFoo) allocate(c *ChanFoo) {
+	e.entry = make([]EndpointFoo, e.capacity)
+	e.shards = make([]uint64, (e.capacity+63)/64)
+	if c.wakeups == 1 {
+		for i := range e.entry {
+			e.entry[i].wakeup = make(chan struct{}, 1)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package multicast
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> leaked
+//jig:needs endpoints<Foo>, Endpoint<Foo> info, Chan<Foo> commitData
+
+// origin returns the stack trace of the goroutine creating an endpoint when
+// leak detection is enabled, see WithLeakDetection.
+func (c *ChanFoo) origin() string {
+	if c.leakIdle == 0 {
+		return ""
+	}
+	return string(debug.Stack())
+}
+
+// leaked returns the endpoints that did not read any messages for longer than
+// the leak detection idle time while holding on to the oldest message in the
+// full buffer. Every endpoint is returned only once. It must be called with
+// access to the endpoints, which may be shared (see AccessShared), after
+// which the caller should call reportLeaks.
+func (c *ChanFoo) leaked(entries []EndpointFoo) (leaks []EndpointInfo) {
+	if c.leakIdle == 0 {
+		return nil
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	idle := time.Now().Add(-c.leakIdle).UnixNano()
+	for i := range entries {
+		ep := &entries[i]
+		cursor := atomic.LoadUint64(&ep.cursor)
+		if cursor != begin || ep.overflow != OverflowBlock ||
+			atomic.LoadUint64(&ep.endpointState) != active ||
+			atomic.LoadUint32(&ep.endpointPaused) == 1 ||
+			atomic.LoadUint32(&ep.endpointActivity) != idling ||
+			atomic.LoadInt64(&ep.lastRead) > idle {
+			continue
+		}
+		if atomic.CompareAndSwapUint32(&ep.leakReported, 0, 1) {
+			leaks = append(leaks, ep.info(cursor, c.commitData()))
+		}
+	}
+	return leaks
+}
+
+// reportLeaks passes the leaked endpoints to the leak detection callback.
+func (c *ChanFoo) reportLeaks(leaks []EndpointInfo) {
+	for _, leak := range leaks {
+		c.onLeak(leak)
+	}
+}
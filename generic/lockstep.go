@@ -0,0 +1,52 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+//jig:template Chan<Foo> awaitConsumed
+//jig:needs endpoints<Foo>
+
+// awaitConsumed blocks until every active endpoint has consumed the messages
+// before seq, see WithLockstep. Endpoints that finished or were canceled don't
+// have to consume anything. Like an endpoint in blockWhile, the sender
+// registers as stalled and takes the channel to block on before checking the
+// endpoints one last time, so an endpoint advancing its cursor concurrently
+// either sees the sender and wakes it, or the sender notices the advance.
+func (c *ChanFoo) awaitConsumed(seq uint64) {
+	for !c.consumed(seq) {
+		atomic.AddInt32(&c.stalled, 1)
+		senders := *(*chan struct{})(atomic.LoadPointer(&c.senders))
+		if !c.consumed(seq) {
+			<-senders
+		}
+		atomic.AddInt32(&c.stalled, -1)
+	}
+}
+
+// consumed returns true when every active endpoint has consumed the messages
+// before seq.
+func (c *ChanFoo) consumed(seq uint64) bool {
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if cursor := atomic.LoadUint64(&entries[i].cursor); cursor != parked && cursor < seq {
+			return false
+		}
+	}
+	return true
+}
+
+//jig:template Chan<Foo> wakeSenders
+//jig:needs Chan<Foo>
+
+// wakeSenders wakes up the senders blocked in awaitConsumed. It is called
+// after an endpoint advanced its cursor. When no sender is blocked, it returns
+// right away.
+func (c *ChanFoo) wakeSenders() {
+	if atomic.LoadInt32(&c.stalled) == 0 {
+		return
+	}
+	next := make(chan struct{})
+	close(*(*chan struct{})(atomic.SwapPointer(&c.senders, unsafe.Pointer(&next))))
+}
@@ -0,0 +1,64 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+//jig:template MemStats
+
+// MemStats reports the memory used by a channel in bytes, see MemStats.
+type MemStats struct {
+	Channel    uint64 // the channel itself
+	Buffer     uint64 // slots of the messages in the buffer
+	Timestamps uint64 // timestamps recorded with the messages
+	Metadata   uint64 // labels, errors, owners and headers of the messages
+	Endpoints  uint64 // table of endpoints
+	Payload    uint64 // estimated size of the data the messages refer to
+}
+
+// Total returns the total number of bytes reported.
+func (m MemStats) Total() uint64 {
+	return m.Channel + m.Buffer + m.Timestamps + m.Metadata + m.Endpoints + m.Payload
+}
+
+//jig:template Chan<Foo> MemStats
+//jig:needs Chan<Foo>, MemStats, endpoints<Foo>, Chan<Foo> loadRing, Chan<Foo> commitData
+
+// MemStats returns the memory used by the channel, which helps planning the
+// capacity of many channels. The sizes of the buffer, timestamps and endpoint
+// table follow from the capacities of the channel. The data messages refer to
+// (e.g. the bytes of a slice) is estimated by calling size for every message
+// in the buffer. When size is nil, the size passed to LimitBytes is used
+// instead, otherwise the payload is reported as 0.
+func (c *ChanFoo) MemStats(size func(value foo) int) MemStats {
+	var zero foo
+	var entry EndpointFoo
+	var label string
+	var err error
+	var headers Headers
+	stats := MemStats{Channel: uint64(unsafe.Sizeof(*c))}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		r := (*ringFoo)(atomic.LoadPointer(&c.ring)) // don't allocate the buffer
+		stats.Buffer = uint64(len(r.buffer)) * uint64(unsafe.Sizeof(zero))
+		stats.Timestamps = uint64(len(r.written)) * 8
+		stats.Metadata = uint64(len(r.labels))*uint64(unsafe.Sizeof(label)) +
+			uint64(len(r.errs))*uint64(unsafe.Sizeof(err)) +
+			uint64(len(r.owners))*4 +
+			uint64(len(r.headers))*uint64(unsafe.Sizeof(headers))
+		stats.Endpoints = uint64(len(endpoints.entry)) * uint64(unsafe.Sizeof(entry))
+		switch {
+		case size != nil:
+			// the buffer can't slide or grow while we have access to the endpoints
+			commit := c.commitData()
+			for index := atomic.LoadUint64(&c.begin); index < commit; index++ {
+				if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+					stats.Payload += uint64(size(r.buffer[r.slot(index)]))
+				}
+			}
+		case c.size != nil:
+			stats.Payload = uint64(atomic.LoadInt64(&c.bytes))
+		}
+	})
+	return stats
+}
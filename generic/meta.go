@@ -0,0 +1,48 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Message
+//jig:needs Headers
+
+// Message describes a message delivered by RangeMeta.
+type Message struct {
+	Seq  uint64        // sequence number, see RangeSeq
+	Sent time.Time     // zero for messages sent using FastSend
+	Age  time.Duration // time between sending and delivery
+
+	// Headers passed to SendHeaders, nil unless the channel was created
+	// with WithHeaders.
+	Headers Headers
+}
+
+//jig:template Endpoint<Foo> RangeMeta
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate, Chan<Foo> elapsed, Chan<Foo> loadRing, Message
+
+// RangeMeta works like Range, but passes a Message describing every message to
+// the foreach function. It carries the sequence number, the time the message
+// was sent and its age at the time of delivery, so a consumer can e.g. detect
+// that it is processing stale messages. The sent time and age are zero for
+// messages sent using FastSend. The message also carries its headers, see
+// SendHeaders. The close notification carries the sequence
+// number the next message would have had.
+func (e *EndpointFoo) RangeMeta(foreach func(value foo, msg Message, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(func(value foo, err error, closed bool) bool {
+		msg := Message{Seq: e.cursor}
+		if closed {
+			return foreach(value, msg, err, true)
+		}
+		r := e.loadRing()
+		if updated := atomic.LoadInt64(&r.written[r.slot(msg.Seq)]) >> 2; updated != 0 {
+			msg.Sent = e.start.Add(time.Duration(updated))
+			msg.Age = time.Duration(e.elapsed() - updated)
+		}
+		if r.headers != nil {
+			msg.Headers = r.headers[r.slot(msg.Seq)]
+		}
+		return foreach(value, msg, nil, false)
+	}, nil, maxAge, nil)
+}
@@ -7,6 +7,9 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
+
+	"github.com/reactivego/multicast/cacheline"
 )
 
 //jig:template ChannelError
@@ -22,16 +25,38 @@ func (e ChannelError) Error() string { return string(e) }
 // endpoints has already been created.
 const ErrOutOfEndpoints = ChannelError("out of endpoints")
 
+//jig:template ErrSealed
+//jig:needs ChannelError
+
+// ErrSealed is returned by Send and FastSend when the channel was sealed by
+// calling Seal.
+const ErrSealed = ChannelError("channel sealed")
+
+//jig:template ErrTimeout
+//jig:needs ChannelError
+
+// ErrTimeout is returned by SendTimeout when the message could not be sent
+// before the timeout expired.
+const ErrTimeout = ChannelError("timeout")
+
 //jig:template ChanPadding
 
-const _PADDING = 1            // 0 turns padding off, 1 turns it on.
-const _EXTRA_PADDING = 0 * 64 // multiples of 64, benefits inconclusive.
+// Padding is configured at build time, see package cacheline. Fields are
+// grouped into 64 bytes, so on larger cache lines every group gets the
+// difference as extra padding.
+const _PADDING = cacheline.Padding         // 0 turns padding off, 1 turns it on.
+const _EXTRA_PADDING = cacheline.Size - 64 // multiples of 64.
 
 type pad60 [_PADDING * (_EXTRA_PADDING + 60)]byte
 type pad56 [_PADDING * (_EXTRA_PADDING + 56)]byte
+type pad52 [_PADDING * (_EXTRA_PADDING + 52)]byte
 type pad48 [_PADDING * (_EXTRA_PADDING + 48)]byte
+type pad44 [_PADDING * (_EXTRA_PADDING + 44)]byte
 type pad40 [_PADDING * (_EXTRA_PADDING + 40)]byte
+type pad36 [_PADDING * (_EXTRA_PADDING + 36)]byte
 type pad32 [_PADDING * (_EXTRA_PADDING + 32)]byte
+type pad28 [_PADDING * (_EXTRA_PADDING + 28)]byte
+type pad24 [_PADDING * (_EXTRA_PADDING + 24)]byte
 
 //jig:template ChanState
 
@@ -41,11 +66,19 @@ const (
 	working
 )
 
+// Pause state of channel
+const (
+	running uint32 = iota
+	pausing
+	paused
+)
+
 // Activity of endpoints
 const (
 	idling uint32 = iota
 	enumerating
 	creating
+	ranging
 )
 
 // State of endpoint and channel
@@ -55,6 +88,20 @@ const (
 	closed
 )
 
+// Control of ranging over an endpoint
+const (
+	proceed uint32 = iota
+	abort          // cancel the endpoint
+	suspend        // return leaving the endpoint active
+)
+
+// State of a message delivered to an endpoint in acknowledged mode
+const (
+	unacknowledged uint32 = iota
+	acknowledged
+	rejected
+)
+
 // Cursor is parked so it does not influence advancing the commit index.
 const (
 	parked uint64 = math.MaxUint64
@@ -66,51 +113,249 @@ const (
 	ReplayAll uint64 = math.MaxUint64
 )
 
+//jig:template closeSignal
+
+// closeSignal is closed by Close together with the error passed to Close, see
+// Done and Err. Reset replaces it by a new one instead of reusing it, so
+// goroutines still holding the previous one don't race with Reset.
+type closeSignal struct {
+	done chan struct{}
+	err  error
+}
+
+//jig:template backoff
+
+// backoff is called by a goroutine waiting in a spinlock. It will spin for
+// budget iterations before calling runtime.Gosched to yield the processor.
+func backoff(spins *uint32, budget uint32) {
+	if *spins < budget {
+		*spins++
+		return
+	}
+	*spins = 0
+	runtime.Gosched()
+}
+
+//jig:template ErrOutOfRange
+//jig:needs ChannelError
+
+// ErrOutOfRange is returned by Seek when the sequence number is not (or no
+// longer) available in the buffer or when the endpoint has finished.
+const ErrOutOfRange = ChannelError("sequence number out of range")
+
+//jig:template ErrInUse
+//jig:needs ChannelError
+
+// ErrInUse is returned by Reset when the channel is not closed or still has
+// endpoints that did not finish.
+const ErrInUse = ChannelError("channel in use")
+
+//jig:template ErrOverflow
+//jig:needs ChannelError
+
+// ErrOverflow is delivered with the close notification to an endpoint created
+// with policy OverflowError when it fell too far behind.
+const ErrOverflow = ChannelError("endpoint overflow")
+
+//jig:template ErrInvalidRequest
+//jig:needs ChannelError
+
+// ErrInvalidRequest is delivered to a subscriber that requested a number of
+// messages that is not positive, see Subscription.
+const ErrInvalidRequest = ChannelError("invalid request")
+
+//jig:template ErrRateLimited
+//jig:needs ChannelError
+
+// ErrRateLimited is returned by Send when the channel has a rate limit with
+// policy RateReject and the limit was exceeded.
+const ErrRateLimited = ChannelError("rate limited")
+
+//jig:template ErrRetriesExhausted
+//jig:needs ChannelError
+
+// ErrRetriesExhausted is reported for a message that was dead-lettered because
+// it was not acknowledged after being delivered the maximum number of times,
+// see WithAck and DeadLetter.
+const ErrRetriesExhausted = ChannelError("retries exhausted")
+
+//jig:template ErrClosed
+//jig:needs ChannelError
+
+// ErrClosed is returned by Send, Claim and the other methods that send to the
+// channel, when the channel was closed while waiting for room in the buffer.
+// The message is then not sent.
+const ErrClosed = ChannelError("channel closed")
+
 //jig:template Chan<Foo>
-//jig:needs ChanPadding, ChanState
+//jig:needs ChanPadding, ChanState, closeSignal, backoff, RetentionPolicy, RatePolicy, EndpointInfo, consumerGroup, Failure, CursorStore, Headers, WaitStrategy
 
 // ChanFoo is a fast, concurrent multi-(casting,sending,receiving) buffered
 // channel. It is implemented using only sync/atomic operations. Spinlocks using
 // runtime.Gosched() are used in situations where goroutines are waiting or
 // contending for resources.
 type ChanFoo struct {
-	buffer     []foo
-	_________a pad40
+	ring       unsafe.Pointer // *ringFoo
+	_________a pad56
 	begin      uint64
 	_________b pad56
 	end        uint64
 	_________c pad56
 	commit     uint64
 	_________d pad56
-	mod        uint64
+	write      uint64
 	_________e pad56
+	ticket     uint64 // see WithFairSend
+	_________f pad56
+	serving    uint64
+	_________g pad56
+	bytes      int64 // see LimitBytes
+	_________h pad56
 	endpoints  endpointsFoo
 
 	// ChanFoo State
 
-	err           error
-	____________f pad48
-	channelState  uint64 // active, closed
-	____________g pad56
+	channelState  uint64         // active, closed
+	final         uint64         // sequence number after the final message, see CloseWith
+	closing       unsafe.Pointer // *closeSignal, see Done
+	sealed        uint32
+	aborted       uint32 // see CloseNow
+	____________i pad32
 
-	write              uint64
-	_________________h pad56
-	start              time.Time
-	_________________i pad40
-	written            []int64 // nanoseconds since start
-	_________________j pad40
-	committerActivity  uint32 // resting, working
-	_________________k pad60
+	// ChanFoo Wakeups
 
-	receivers          *sync.Cond
-	_________________l pad56
+	receivers     unsafe.Pointer // *chan struct{} closed by broadcast
+	senders       unsafe.Pointer // *chan struct{} closed by wakeSenders
+	sleepers      int32          // endpoints blocked on receivers
+	waking        uint32         // a sender is broadcasting
+	dirty         uint32         // messages committed since the last broadcast
+	stalled       int32          // senders blocked on senders, see WithLockstep
+	____________j pad32
+
+	// ChanFoo Bookkeeping, written now and then by senders and the goroutines
+	// of the channel.
+
+	rateArrival       int64 // see WithRateLimit
+	lastCommit        int64 // elapsed time of the most recent batch commit
+	lagChecked        int64
+	attached          int64                     // number of endpoints that did not finish
+	connectPending    int64                     // see AutoConnect
+	coarse            int64                     // see WithCoarseClock
+	scanned           int64                     // time of the last full scan in slideBuffer, atomic
+	shrinkChecked     int64                     // elapsed time the buffer was last checked
+	lowSince          int64                     // elapsed time since the buffer has been underused
+	summary           atomic.Value              // *reductionFoo
+	resumed           atomic.Value              // chan struct{} closed by Resume
+	groups            map[string]*consumerGroup // see WithGroup
+	marks             sync.Once
+	trimmed           uint32 // see ForceTrimBefore
+	paused            uint32 // see Pause
+	committer         uint32 // resting, working
+	committerActivity uint32 // resting, working
+	aboveHigh         uint32
+	refCount          uint32 // 1 when enabled, 2 when torn down
+	rotation          uint32
+	deferred          uint32 // a message was sent by SendAt or SendAfter
+	____________k     pad36
+
+	// ChanFoo Configuration, set before the channel is used. It is only read
+	// afterwards, so it is not padded.
+
+	growLimit     uint64 // see WithGrowth
+	commitBatch   uint64 // see WithCommitBatch
+	commitDelay   int64
+	commits       chan struct{} // see WithCommitter
+	committerExit chan struct{}
+	reduce        func(summary interface{}, value foo) interface{}
+	key           func(value foo) interface{} // see ConflateBy
+	byteBudget    int64
+	size          func(value foo) int
+	clone         func(value foo) foo // see Recycle
+	recycle       func(value foo)
+	retention     RetentionPolicy // see WithRetention
+	lowWater      uint64          // see WithWatermarks
+	highWater     uint64
+	onHigh        func()
+	onLow         func()
+	maxLag        uint64 // see EvictSlow
+	maxDelay      time.Duration
+	onEvict       func(endpoint *EndpointFoo, lag uint64)
+	lagThreshold  uint64 // see OnLag
+	lagInterval   time.Duration
+	onLag         func(endpoint *EndpointFoo, lag uint64, lagging bool)
+	rateInterval  int64
+	rateTolerance int64
+	leakIdle      time.Duration // see WithLeakDetection
+	onLeak        func(leak EndpointInfo)
+	teardown      func() // see WithRefCount
+	onFirst       func() // see OnFirstEndpoint
+	onLast        func() // see OnLastEndpoint
+	connect       func()
+	start         time.Time
+	clock         func() time.Time // nil means time.Now
+	resolution    time.Duration    // 0 means no coarse clock
+	clockExit     chan struct{}
+	shrinkAfter   int64         // see WithShrink
+	shrinkMin     uint64        // capacity below which the buffer doesn't shrink
+	wait          WaitStrategy  // nil means spin, yield and block after 250ms
+	closeAfter    time.Duration // see WithBackoff
+	blockAfter    time.Duration
+	spinBudget    uint32 // spins before calling runtime.Gosched
+	lossy         uint32 // see WithLossy
+	conflate      uint32 // see WithConflate
+	fair          uint32 // see WithFairSend
+	lockstep      uint32 // see WithLockstep
+	roundRobin    uint32 // see WithRoundRobin
+	headers       uint32 // see WithHeaders
+	untimed       uint32 // see WithoutTimestamps
+	wakeups       uint32 // endpoints have their own wakeup channel
+	ratePolicy    RatePolicy
+}
+
+// ringFoo holds the messages of the channel. It is replaced by a larger ring
+// when the buffer grows (see WithGrowth), so it should be loaded after the
+// index of the message to access was loaded.
+type ringFoo struct {
+	buffer  []foo
+	written []int64   // nanoseconds since start<<2 | marker<<1 | uncommitted
+	labels  []string  // labels of markers, see Mark
+	errs    []error   // errors of error events, see SendError
+	owners  []uint32  // index+1 of the endpoint a message is assigned to, see WithRoundRobin
+	headers []Headers // headers of messages, see WithHeaders
+	mod     uint64
+	size    uint64 // number of slots, a power of 2 unless WithExactCapacity
+}
+
+// slot returns the position in the ring of the message with the given
+// sequence number. A ring of a power of 2 slots masks the sequence number,
+// only an exact capacity ring (see WithExactCapacity) pays for a division.
+func (r *ringFoo) slot(index uint64) uint64 {
+	if r.size&r.mod == 0 {
+		return index & r.mod
+	}
+	return index % r.size
+}
+
+// signal returns the signal closed by Close, see closeSignal.
+func (c *ChanFoo) signal() *closeSignal {
+	return (*closeSignal)(atomic.LoadPointer(&c.closing))
+}
+
+type reductionFoo struct {
+	value interface{}
 }
 
 type endpointsFoo struct {
 	entry             []EndpointFoo
 	len               uint32
 	endpointsActivity uint32 // idling, enumerating, creating
-	________          pad32
+	capacity          uint32 // length of entry once allocated, see NewForChan
+	sliding           int32  // goroutines inside AccessShared
+	________          pad24
+	shards            []uint64 // lower bound of the cursors of every 64 entries, see slowest
+	min               uint64   // lower bound of the cursors of all entries
+	lossy             int32    // endpoints that don't block senders
+	_________         pad28
 }
 
 //jig:template Endpoint<Foo>
@@ -119,21 +364,75 @@ type endpointsFoo struct {
 // EndpointFoo is returned by a call to NewEndpoint on the channel. Every
 // endpoint should be used by only a single goroutine, so no sharing between
 // goroutines.
+// Use Shared to wrap an endpoint that has to be shared between goroutines.
 type EndpointFoo struct {
 	*ChanFoo
-	_____________a pad56
-	cursor         uint64
-	_____________b pad56
-	endpointState  uint64 // active, canceled, closed
-	_____________c pad56
-	lastActive     time.Time // track activity to deterime when to sleep
-	_____________d pad40
-	endpointClosed uint64 // active, closed
-	_____________e pad56
+	_____________a   pad56
+	cursor           uint64
+	committed        uint64 // see WithManualCommit
+	held             uint64 // first value handed out by the last Next or ReadBatch, see Recycle
+	_____________b   pad40
+	endpointState    uint64 // active, canceled, closed
+	_____________c   pad56
+	demand           uint64 // see Request
+	endpointActivity uint32 // idling, ranging
+	sleeping         uint32
+	ackState         uint32 // unacknowledged, acknowledged, rejected
+	_____________d   pad44
+
+	// EndpointFoo State, written by the goroutine reading the endpoint and now
+	// and then by senders.
+
+	lastRead         int64 // see Chan.Endpoints
+	delivered        int64
+	dropped          uint64 // see Dropped
+	endpointClosed   uint64 // active, closed
+	ackSeq           uint64 // sequence number of the message awaiting ack
+	ackDeadline      int64
+	checkpointed     int64
+	saved            uint64
+	lastActive       time.Time // track activity to deterime when to sleep
+	poison           error     // see Reject
+	ackAttempts      uint32
+	overflowed       uint32
+	lagging          uint32 // see OnLag
+	evicted          uint32 // see EvictSlow
+	endpointPaused   uint32 // see Endpoint.Pause
+	leakReported     uint32
+	endpointFinished uint32
+	_____________e   pad60
+
+	// EndpointFoo Configuration, set when the endpoint is created. It is only
+	// read afterwards, so it is not padded.
+
+	name            string                           // see WithName
+	origin          string                           // see WithLeakDetection
+	cursorStore     CursorStore                      // see WithCursorStore
+	maxAge          time.Duration                    // see WithMaxAge
+	gap             func(missed uint64)              // see WithGapHandler
+	idleTimeout     time.Duration                    // see WithIdleTimeout
+	filter          func(value foo) bool             // see Filter
+	transform       func(value foo) foo              // see Map
+	sample          uint64                           // see WithSample
+	throttle        time.Duration                    // see WithThrottle
+	debounce        time.Duration                    // see WithDebounce
+	onPanic         func(recovered interface{})      // see WithPanicHandler
+	group           *consumerGroup                   // see WithGroup
+	ackTimeout      time.Duration                    // see WithAck
+	deadLetters     *ChanFoo                         // see DeadLetter
+	onDeadLetter    func(value foo, failure Failure) // see DeadLetter
+	checkpointEvery time.Duration
+	wakeup          chan struct{}  // see WithEndpointWakeups
+	endpointDone    chan struct{}  // closed when the endpoint finishes
+	overflow        OverflowPolicy // see WithOverflow
+	index           uint32         // position in the endpoints, see WithRoundRobin
+	acking          uint32
+	ackRetries      uint32
+	manualCommit    uint32
 }
 
 //jig:template NewChan<Foo>
-//jig:needs Chan<Foo>, endpoints<Foo>
+//jig:needs Chan<Foo>, endpoints<Foo>, bufferSize<Foo>, endpointTable<Foo>
 
 // NewChanFoo creates a new channel. The parameters bufferCapacity and
 // endpointCapacity determine the size of the message buffer and maximum
@@ -141,45 +440,221 @@ type EndpointFoo struct {
 //
 // Note that bufferCapacity is always scaled up to a power of 2 so e.g.
 // specifying 400 will create a buffer of 512 (2^9). Also because of this a
-// bufferCapacity of 0 is scaled up to 1 (2^0).
+// bufferCapacity of 0 is scaled up to 1 (2^0). See WithExactCapacity to use
+// the exact capacity instead.
+//
+// NewChanFoo panics with ErrCapacity when a capacity is negative or the
+// buffer or endpoint table is too large to be allocated, see NewChanChecked.
 func NewChanFoo(bufferCapacity int, endpointCapacity int) *ChanFoo {
-	// Round capacity up to power of 2
-	size := uint64(1) << uint(math.Ceil(math.Log2(float64(bufferCapacity))))
-	c := &ChanFoo{
-		end:     size,
-		mod:     size - 1,
-		buffer:  make([]foo, size),
-		start:   time.Now(),
-		written: make([]int64, size),
+	size, err := bufferSizeFoo(bufferCapacity, false)
+	if err != nil {
+		panic(err)
+	}
+	entries, err := endpointTableFoo(endpointCapacity)
+	if err != nil {
+		panic(err)
+	}
+	return newChanFoo(size, entries)
+}
+
+// newChanFoo creates a new channel with a buffer of exactly size messages and
+// a table of entries endpoints, both validated by the caller. They are
+// allocated when first used, see loadRing and NewForChan.
+func newChanFoo(size uint64, entries uint32) *ChanFoo {
+	receivers := make(chan struct{})
+	senders := make(chan struct{})
+	return &ChanFoo{
+		ring:       unsafe.Pointer(&ringFoo{mod: size - 1, size: size}),
+		end:        size,
+		start:      time.Now(),
+		closing:    unsafe.Pointer(&closeSignal{done: make(chan struct{})}),
+		closeAfter: time.Millisecond,
+		blockAfter: 250 * time.Millisecond,
 		endpoints: endpointsFoo{
-			entry: make([]EndpointFoo, endpointCapacity),
+			capacity: entries,
 		},
+		receivers: unsafe.Pointer(&receivers),
+		senders:   unsafe.Pointer(&senders),
 	}
-	c.receivers = sync.NewCond(c)
-	return c
 }
 
-// Lock, empty method so we can pass *ChanFoo to sync.NewCond as a Locker.
+// Lock is an empty method, kept because *ChanFoo used to be passed to
+// sync.NewCond as a Locker.
+//
+// Deprecated: Lock does nothing.
 func (c *ChanFoo) Lock() {}
 
-// Unlock, empty method so we can pass *ChanFoo to sync.NewCond as a Locker.
+// Unlock is an empty method, kept because *ChanFoo used to be passed to
+// sync.NewCond as a Locker.
+//
+// Deprecated: Unlock does nothing.
 func (c *ChanFoo) Unlock() {}
 
+//jig:template Chan<Foo> loadRing
+//jig:needs Chan<Foo>, Chan<Foo> allocate
+
+// loadRing returns the ring holding the messages. A channel is created with
+// an empty ring, which is replaced by an allocated one the first time the
+// ring is loaded, normally by the first Send, see allocate.
+func (c *ChanFoo) loadRing() *ringFoo {
+	r := (*ringFoo)(atomic.LoadPointer(&c.ring))
+	if r.written == nil {
+		return c.allocate(r)
+	}
+	return r
+}
+
+//jig:template Chan<Foo> elapsed
+//jig:needs Chan<Foo>
+
+// elapsed returns the nanoseconds passed since the channel was created. When
+// the channel has a custom clock, the result is at least 1, so it can be
+// distinguished from a missing timestamp.
+func (c *ChanFoo) elapsed() int64 {
+	if c.clock == nil {
+		return time.Since(c.start).Nanoseconds()
+	}
+	if elapsed := c.clock().Sub(c.start).Nanoseconds(); elapsed > 0 {
+		return elapsed
+	}
+	return 1
+}
+
+//jig:template Chan<Foo> SetSpinBudget
+//jig:needs Chan<Foo>
+
+// SetSpinBudget sets the number of times a goroutine waiting on the channel
+// will retry before calling runtime.Gosched to yield the processor. This
+// applies to senders waiting for buffer space, goroutines creating endpoints
+// or enumerating them and receivers backing off in Range. The default of 0
+// yields on every retry, which works well on machines with few cores. On
+// machines with many cores a larger budget may reduce latency.
+func (c *ChanFoo) SetSpinBudget(spins int) {
+	atomic.StoreUint32(&c.spinBudget, uint32(spins))
+}
+
 //jig:template Chan<Foo> Close
+//jig:needs Chan<Foo> wakeAll
 
 // Close will close the channel. Pass in an error or nil. Endpoints  continue to
 // receive data until the buffer is empty. Only then will the close notification
 // be delivered to the Range function.
 func (c *ChanFoo) Close(err error) {
 	if atomic.CompareAndSwapUint64(&c.channelState, active, closed) {
-		c.err = err
-		c.endpoints.Access(func(endpoints *endpointsFoo) {
+		signal := c.signal()
+		signal.err = err
+		c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
 			for i := uint32(0); i < endpoints.len; i++ {
 				atomic.CompareAndSwapUint64(&endpoints.entry[i].endpointState, active, closed)
 			}
 		})
+		close(signal.done)
+	}
+	c.wakeAll()
+}
+
+//jig:template Chan<Foo> CloseNow
+//jig:needs Chan<Foo> Close, Chan<Foo> wakeAll
+
+// CloseNow will close the channel like Close, but instead of letting the
+// endpoints receive the data remaining in the buffer, the remaining data is
+// discarded and the close notification is delivered immediately. Messages
+// already being delivered to the foreach function of Range when CloseNow is
+// called are not affected.
+func (c *ChanFoo) CloseNow(err error) {
+	c.Close(err)
+	atomic.StoreUint32(&c.aborted, 1)
+	c.wakeAll()
+}
+
+//jig:template Chan<Foo> Reset
+//jig:needs endpoints<Foo>, ErrInUse, Chan<Foo> startCommitter, Chan<Foo> startClock
+
+// Reset makes a closed channel available for reuse, without reallocating its
+// buffer and endpoints. The buffered messages, the error passed to Close and
+// any summary (see Summarize) are cleared and the channel is unsealed.
+//
+// Reset returns ErrInUse when the channel was not closed or when any of its
+// endpoints did not finish yet. The caller must make sure no goroutine is
+// sending to the channel while calling Reset.
+func (c *ChanFoo) Reset() error {
+	err := error(ErrInUse)
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		if atomic.LoadUint64(&c.channelState) != closed {
+			return
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			if atomic.LoadUint64(&endpoints.entry[i].cursor) != parked {
+				return
+			}
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			endpoints.entry[i].endpointClosed = 0
+			endpoints.invalidate(i) // begin moves back
+		}
+		var zero foo
+		r := (*ringFoo)(atomic.LoadPointer(&c.ring)) // nothing to clear when not allocated
+		for i := range r.buffer {
+			r.buffer[i] = zero
+			r.written[i] = 0
+		}
+		for i := range r.labels {
+			r.labels[i] = ""
+			r.errs[i] = nil
+		}
+		for i := range r.headers {
+			r.headers[i] = nil
+		}
+		size := r.size
+		atomic.StoreUint64(&c.begin, 0)
+		atomic.StoreUint64(&c.end, size)
+		atomic.StoreUint64(&c.commit, 0)
+		atomic.StoreUint64(&c.write, 0)
+		atomic.StoreInt64(&c.bytes, 0)
+		c.reduce = nil
+		c.summary = atomic.Value{}
+		c.groups = nil // claims of the previous session, see WithGroup
+		atomic.StorePointer(&c.closing, unsafe.Pointer(&closeSignal{done: make(chan struct{})}))
+		if c.clock != nil {
+			c.start = c.clock()
+		} else {
+			c.start = time.Now()
+		}
+		atomic.StoreUint32(&c.sealed, 0)
+		atomic.StoreUint32(&c.aborted, 0)
+		atomic.StoreUint64(&c.final, 0)
+		atomic.StoreUint32(&c.trimmed, 0)
+		atomic.StoreUint64(&c.channelState, active)
+		err = nil
+	})
+	if err == nil && c.commits != nil {
+		<-c.committerExit
+		c.startCommitter()
 	}
-	c.receivers.Broadcast()
+	if err == nil && c.resolution != 0 {
+		<-c.clockExit
+		c.startClock()
+	}
+	return err
+}
+
+//jig:template Chan<Foo> Seal
+//jig:needs Chan<Foo>
+
+// Seal will seal the channel, after which Send and FastSend will reject any
+// further messages by returning ErrSealed. Unlike Close, the channel stays
+// open; new endpoints can still be created and will replay the messages in
+// the buffer, after which they keep waiting for messages that will never
+// come. This is useful for serving a finalized stream to late receivers.
+func (c *ChanFoo) Seal() {
+	atomic.StoreUint32(&c.sealed, 1)
+}
+
+//jig:template Chan<Foo> Sealed
+
+// Sealed returns true when the channel was sealed using the Seal method.
+func (c *ChanFoo) Sealed() bool {
+	return atomic.LoadUint32(&c.sealed) != 0
 }
 
 //jig:template Chan<Foo> Closed
@@ -189,8 +664,34 @@ func (c *ChanFoo) Closed() bool {
 	return atomic.LoadUint64(&c.channelState) >= closed
 }
 
+//jig:template Chan<Foo> Done
+//jig:needs Chan<Foo>
+
+// Done returns a channel that is closed when the channel is closed using the
+// Close method. This allows observing termination of the channel in a select
+// statement without creating an endpoint.
+func (c *ChanFoo) Done() <-chan struct{} {
+	return c.signal().done
+}
+
+//jig:template Chan<Foo> Err
+//jig:needs Chan<Foo>
+
+// Err returns the error passed to Close once the channel is closed (see Done).
+// Before the channel is closed, or when it was closed with a nil error, Err
+// returns nil.
+func (c *ChanFoo) Err() error {
+	signal := c.signal()
+	select {
+	case <-signal.done:
+		return signal.err
+	default:
+		return nil
+	}
+}
+
 //jig:template Chan<Foo> FastSend
-//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, ErrSealed, ErrClosed, Chan<Foo> watermark, Chan<Foo> checkLag, Chan<Foo> awaitResume, Chan<Foo> throttle, Chan<Foo> awaitConsumed, Chan<Foo> assign, Chan<Foo> wake, Chan<Foo> cloned
 
 // FastSend can be used to send values to the channel from a SINGLE goroutine.
 // Also, this does not record the time a message was sent, so the maxAge value
@@ -199,68 +700,414 @@ func (c *ChanFoo) Closed() bool {
 // Note, that when the number of unread messages has reached bufferCapacity, then
 // the call to FastSend will block until the slowest Endpoint has read another
 // message.
-func (c *ChanFoo) FastSend(value foo) {
+//
+// When the channel was sealed, FastSend returns ErrSealed. When the channel is
+// closed while waiting for room, FastSend returns ErrClosed.
+func (c *ChanFoo) FastSend(value foo) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return err
+	}
+	var spins uint32
 	for c.commit == c.end {
-		if !c.slideBuffer() {
-			return // channel was closed
+		if !c.slideBuffer(&spins) {
+			return ErrClosed
 		}
 	}
-	c.buffer[c.commit&c.mod] = value
+	r := c.loadRing()
+	r.buffer[r.slot(c.commit)] = c.cloned(value)
+	if r.owners != nil {
+		c.assign(r, c.commit)
+	}
+	if c.reduce != nil {
+		summary := c.summary.Load().(*reductionFoo).value
+		c.summary.Store(&reductionFoo{c.reduce(summary, value)})
+	}
 	atomic.AddUint64(&c.commit, 1)
-	c.receivers.Broadcast()
+	c.wake()
+	c.watermark()
+	c.checkLag()
+	if c.lockstep == 1 {
+		c.awaitConsumed(c.commit)
+	}
+	return nil
 }
 
 //jig:template Chan<Foo> Send
-//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> publish, Chan<Foo> sendConflated, Chan<Foo> admit, ErrSealed, ErrClosed, Chan<Foo> awaitResume, Chan<Foo> throttle, Chan<Foo> awaitTurn, Chan<Foo> awaitConsumed
 
 // Send can be used by concurrent goroutines to send values to the channel.
 //
 // Note, that when the number of unread messages has reached bufferCapacity, then
 // the call to Send will block until the slowest Endpoint has read another
 // message.
-func (c *ChanFoo) Send(value foo) {
+//
+// When the channel was sealed, Send returns ErrSealed. When the channel is
+// closed while waiting for room, Send returns ErrClosed.
+func (c *ChanFoo) Send(value foo) error {
+	return c.send(value, 0, nil)
+}
+
+// send sends value with the given headers (see SendHeaders), withholding it
+// from the endpoints until the channel has existed for due nanoseconds (see
+// SendAt). A due of 0 delivers it right away.
+func (c *ChanFoo) send(value foo, due int64, headers Headers) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if c.fair == 1 {
+		c.awaitTurn(nil)
+		defer c.passTurn()
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return err
+	}
+	var spins uint32
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		if !c.admit(size, &spins) {
+			return ErrClosed
+		}
+	}
+	if c.key != nil {
+		if !c.sendConflated(value, due, headers) {
+			atomic.AddInt64(&c.bytes, -size) // not sent, see LimitBytes
+			return ErrClosed
+		}
+		if c.lockstep == 1 {
+			c.awaitConsumed(atomic.LoadUint64(&c.write))
+		}
+		return nil
+	}
 	write := atomic.AddUint64(&c.write, 1) - 1
 	for write >= atomic.LoadUint64(&c.end) {
-		if !c.slideBuffer() {
-			return // channel was closed
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			atomic.AddInt64(&c.bytes, -size) // not sent, see LimitBytes
+			return ErrClosed
+		}
+	}
+	c.publishAt(write, value, due, headers)
+	if c.lockstep == 1 {
+		c.awaitConsumed(write + 1)
+	}
+	return nil
+}
+
+//jig:template Chan<Foo> SendSlice
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> elapsed, Chan<Foo> admit, Chan<Foo> retain, ErrSealed, ErrClosed, Chan<Foo> watermark, Chan<Foo> checkLag, Chan<Foo> awaitResume, Chan<Foo> throttle, Chan<Foo> awaitTurn, Chan<Foo> awaitConsumed, Chan<Foo> assign, Chan<Foo> published, Chan<Foo> timestamp, Chan<Foo> cloned, Chan<Foo> shrink, Chan<Foo> sendConflated, Chan<Foo> refund
+
+// SendSlice can be used by concurrent goroutines to send a burst of values to
+// the channel. It reserves a contiguous range of messages in the buffer in one
+// go and stores a single timestamp for all the values. Receivers are notified
+// once after all values have been stored, instead of once per value as is the
+// case for Send.
+//
+// Note, that when the number of unread messages reaches bufferCapacity, then
+// the call to SendSlice will block until the slowest Endpoint has read
+// another message.
+//
+// When the channel conflates messages (see ConflateBy), the values are sent
+// one by one instead, so each of them can replace an older message.
+//
+// When the channel was sealed, SendSlice returns ErrSealed. When the channel
+// is closed while waiting for room, SendSlice returns ErrClosed and the values
+// not stored yet are not sent.
+func (c *ChanFoo) SendSlice(values []foo) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if c.fair == 1 {
+		c.awaitTurn(nil)
+		defer c.passTurn()
+	}
+	c.awaitResume()
+	if err := c.throttle(uint64(len(values))); err != nil {
+		return err
+	}
+	var spins uint32
+	if c.size != nil {
+		size := int64(0)
+		for _, value := range values {
+			size += int64(c.size(value))
+		}
+		if !c.admit(size, &spins) {
+			return ErrClosed
+		}
+	}
+	if c.key != nil {
+		for i, value := range values {
+			if !c.sendConflated(value, 0, nil) {
+				c.refund(values[i:])
+				return ErrClosed
+			}
+		}
+		if c.lockstep == 1 {
+			c.awaitConsumed(atomic.LoadUint64(&c.write))
 		}
+		return nil
 	}
-	c.buffer[write&c.mod] = value
-	updated := time.Since(c.start).Nanoseconds()
-	if updated == 0 {
-		panic("clock failure; zero duration measured")
+	count := uint64(len(values))
+	write := atomic.AddUint64(&c.write, count) - count
+	updated := c.timestamp()
+	for i, value := range values {
+		if write >= atomic.LoadUint64(&c.end) {
+			c.published() // let receivers read what was stored so far
+			for write >= atomic.LoadUint64(&c.end) {
+				if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+					c.refund(values[i:])
+					return ErrClosed
+				}
+			}
+			updated = c.timestamp()
+		}
+		r := c.loadRing()
+		r.buffer[r.slot(write)] = c.cloned(value)
+		if r.owners != nil {
+			c.assign(r, write)
+		}
+		atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+1)
+		write++
+	}
+	c.published()
+	c.retain()
+	c.shrink()
+	c.watermark()
+	c.checkLag()
+	if c.lockstep == 1 {
+		c.awaitConsumed(write)
+	}
+	return nil
+}
+
+//jig:template Chan<Foo> TrySend
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> publish, Chan<Foo> admit, Chan<Foo> reserve, Chan<Foo> awaitTurn, Chan<Foo> awaitConsumed, Chan<Foo> awaitEnd, Chan<Foo> replace
+
+// TrySend can be used by concurrent goroutines to send values to the channel
+// without ever blocking. When the number of unread messages has reached
+// bufferCapacity, TrySend will return false immediately instead of waiting
+// for the slowest Endpoint to read another message. TrySend also returns false
+// when the channel was sealed or paused, when its rate limit was exceeded or,
+// in lockstep mode, when the previous message was not consumed yet. When the
+// channel conflates messages (see ConflateBy), a full buffer only makes
+// TrySend return false when there is no older message to replace.
+func (c *ChanFoo) TrySend(value foo) bool {
+	if atomic.LoadUint32(&c.sealed) != 0 || atomic.LoadUint32(&c.paused) != 0 {
+		return false
+	}
+	if c.fair == 1 {
+		if !c.tryTurn() {
+			return false // other senders are waiting
+		}
+		defer c.passTurn()
+	}
+	if c.lockstep == 1 && !c.consumed(atomic.LoadUint64(&c.write)) {
+		return false // previous message not consumed yet
+	}
+	if c.rateInterval != 0 && c.reserve(1) != 0 {
+		return false // rate limited
+	}
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		if !c.admit(size, nil) {
+			return false // over budget
+		}
+	}
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write >= atomic.LoadUint64(&c.end) {
+			c.slideBuffer(nil)
+			if write >= atomic.LoadUint64(&c.end) {
+				if c.key != nil && c.replace(value, 0, nil) {
+					return true
+				}
+				atomic.AddInt64(&c.bytes, -size)
+				return false // buffer full
+			}
+		}
+		if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+			c.awaitEnd(write)
+			c.publish(write, value)
+			return true
+		}
 	}
-	atomic.StoreInt64(&c.written[write&c.mod], updated<<1+1)
-	c.receivers.Broadcast()
+}
+
+//jig:template Chan<Foo> publish
+//jig:needs Chan<Foo> elapsed, Chan<Foo> retain, Chan<Foo> watermark, Chan<Foo> evictSlow, Chan<Foo> checkLag, Chan<Foo> assign, Chan<Foo> published, Chan<Foo> timestamp, Chan<Foo> cloned, Chan<Foo> shrink
+
+func (c *ChanFoo) publish(write uint64, value foo) {
+	c.publishAt(write, value, 0, nil)
+}
+
+// publishAt publishes value like publish, but timestamps it with due when that
+// lies in the future, so endpoints withhold it until it is due (see SendAt).
+// The headers are stored with the message when the channel keeps headers.
+func (c *ChanFoo) publishAt(write uint64, value foo, due int64, headers Headers) {
+	r := c.loadRing()
+	r.buffer[r.slot(write)] = c.cloned(value)
+	c.stamp(r, write, due, headers)
+}
+
+// stamp commits the message already stored in the buffer at write, see
+// publishAt.
+func (c *ChanFoo) stamp(r *ringFoo, write uint64, due int64, headers Headers) {
+	if r.headers != nil {
+		r.headers[r.slot(write)] = headers
+	}
+	updated := c.timestamp()
+	if due > updated {
+		updated = due
+		if atomic.LoadUint32(&c.deferred) == 0 {
+			atomic.StoreUint32(&c.deferred, 1) // before storing written, see pending
+		}
+	}
+	if r.owners != nil {
+		c.assign(r, write)
+	}
+	atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+1)
+	c.published()
+	c.retain()
+	c.shrink()
+	c.watermark()
+	c.evictSlow()
+	c.checkLag()
+}
+
+//jig:template Chan<Foo> Mark
+//jig:needs endpoints<Foo>, Chan<Foo> slideBuffer, Chan<Foo> elapsed, Chan<Foo> awaitResume, Chan<Foo> published, Chan<Foo> timestamp
+
+// Mark injects an in-band marker with the given label into the channel and
+// returns its sequence number. The marker occupies a slot in the buffer just
+// like a message sent via Send, so it is ordered with respect to the messages
+// sent concurrently. Range will skip markers, use RangeMarks to observe them.
+// Markers are never skipped because of the maxAge passed to RangeMarks.
+//
+// Like Send, Mark can be used by concurrent goroutines but should not be
+// mixed with FastSend.
+func (c *ChanFoo) Mark(label string) (seq uint64) {
+	seq, _ = c.mark(label, nil)
+	return seq
+}
+
+// mark injects a marker with the given label into the channel, which is an
+// error event when err is not nil, see SendError. It returns false when the
+// channel was closed before the marker was stored.
+func (c *ChanFoo) mark(label string, err error) (seq uint64, ok bool) {
+	c.awaitResume()
+	c.marks.Do(func() {
+		c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(*endpointsFoo) {
+			r := c.loadRing() // can't grow while we have access to the endpoints
+			r.labels = make([]string, len(r.buffer))
+			r.errs = make([]error, len(r.buffer))
+		})
+	})
+	write := atomic.AddUint64(&c.write, 1) - 1
+	var spins uint32
+	for write >= atomic.LoadUint64(&c.end) {
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			return write, false // channel was closed
+		}
+	}
+	var zero foo
+	r := c.loadRing()
+	r.buffer[r.slot(write)] = zero
+	r.labels[r.slot(write)] = label
+	r.errs[r.slot(write)] = err
+	updated := c.timestamp()
+	atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+2+1)
+	c.published()
+	return write, true
 }
 
 //jig:template Chan<Foo> slideBuffer
-//jig:needs endpoints<Foo>
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> grow, Chan<Foo> release, Chan<Foo> evict, Chan<Foo> leaked, Chan<Foo> idle, endpoints<Foo> slowest, Chan<Foo> advanceEnd, Chan<Foo> slideSingle
 
-func (c *ChanFoo) slideBuffer() bool {
+// slideBuffer moves the beginning of the buffer up to the slowest endpoint to
+// make room for new messages. Senders slide the buffer concurrently, with
+// shared access to the endpoints. Only when the buffer may grow, values are
+// recycled (see Recycle) or messages are assigned round-robin, slideBuffer
+// takes exclusive access. A channel with a single endpoint takes the fast path
+// of slideSingle instead. It returns false when the channel is no longer
+// active and there is no room.
+func (c *ChanFoo) slideBuffer(spins *uint32) bool {
+	exclusive := c.roundRobin == 1 || c.recycle != nil || c.loadRing().size <= c.growLimit/2
+	if c.endpoints.capacity == 1 && !exclusive && c.lossy == 0 && c.maxLag == 0 && c.maxDelay == 0 && c.leakIdle == 0 {
+		if slowestCursor, spinlock, ok := c.slideSingle(); ok {
+			return c.slid(slowestCursor, spinlock, spins)
+		}
+	}
 	slowestCursor := parked
-	spinlock := c.endpoints.Access(func(endpoints *endpointsFoo) {
-		for i := uint32(0); i < endpoints.len; i++ {
-			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
-			if cursor < slowestCursor {
-				slowestCursor = cursor
-			}
+	var evicted []evictionFoo
+	var leaks []EndpointInfo
+	var idle []*EndpointFoo
+	access := c.endpoints.AccessShared
+	if exclusive {
+		access = c.endpoints.Access
+	}
+	spinlock := access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		now := time.Now().UnixNano()
+		full := now-atomic.LoadInt64(&c.scanned) > time.Millisecond.Nanoseconds()
+		if full {
+			atomic.StoreInt64(&c.scanned, now)
+			evicted = c.evict(endpoints.entry[:endpoints.len])
 		}
-		if atomic.LoadUint64(&c.begin) < slowestCursor && slowestCursor <= atomic.LoadUint64(&c.end) {
-			if c.mod < 16 {
-				atomic.AddUint64(&c.begin, 1)
-				atomic.AddUint64(&c.end, 1)
-			} else {
-				atomic.StoreUint64(&c.begin, slowestCursor)
-				atomic.StoreUint64(&c.end, slowestCursor+c.mod+1)
+		lossy := c.lossy == 1 || atomic.LoadInt32(&endpoints.lossy) > 0
+		begin := atomic.LoadUint64(&c.begin)
+		slowestCursor = endpoints.slowest(c, begin, full)
+		r := c.loadRing()
+		if begin < slowestCursor && slowestCursor <= atomic.LoadUint64(&c.end) {
+			next := slowestCursor
+			if r.size <= 16 {
+				next = begin + 1
+			}
+			if atomic.CompareAndSwapUint64(&c.begin, begin, next) {
+				c.release(r, begin, next, !lossy)
+				c.advanceEnd(r, begin, next)
+			}
+		} else if exclusive && r.size <= c.growLimit/2 && c.commitData() == atomic.LoadUint64(&c.end) {
+			c.grow()
+			slowestCursor = begin
+		} else if lossy && slowestCursor == parked && begin < c.commitData() {
+			// drop the oldest message for the endpoints lagging behind
+			if atomic.CompareAndSwapUint64(&c.begin, begin, begin+1) {
+				c.release(r, begin, begin+1, false)
+				c.advanceEnd(r, begin, begin+1)
 			}
+			slowestCursor = begin + 1
 		} else {
 			slowestCursor = parked
+			if full {
+				leaks = c.leaked(endpoints.entry[:endpoints.len])
+				idle = c.idle(endpoints.entry[:endpoints.len])
+			}
 		}
 	})
+	c.evicted(evicted)
+	c.reportLeaks(leaks)
+	c.idled(idle)
+	return c.slid(slowestCursor, spinlock, spins)
+}
+
+// slid backs off a sender waiting for room after slideBuffer found none, which
+// is when slowestCursor is parked. It returns false when the channel is no
+// longer active and there is no room.
+func (c *ChanFoo) slid(slowestCursor uint64, spinlock bool, spins *uint32) bool {
 	if slowestCursor == parked {
-		if spinlock {
-			runtime.Gosched() // spinlock while full
+		if spinlock && spins != nil {
+			if c.wait == nil {
+				backoff(spins, atomic.LoadUint32(&c.spinBudget)) // spinlock while full
+			} else if *spins++; c.wait.Wait(*spins) {
+				time.Sleep(time.Millisecond) // endpoints don't wake up senders
+			}
 		}
 		if atomic.LoadUint64(&c.channelState) != active {
 			return false // !more
@@ -269,9 +1116,132 @@ func (c *ChanFoo) slideBuffer() bool {
 	return true // more
 }
 
+//jig:template Chan<Foo> advanceEnd
+//jig:needs Chan<Foo>
+
+// advanceEnd moves the end of the buffer after the beginning was moved from
+// begin to next with a compare-and-swap. Senders sliding concurrently move the
+// beginning in turn, so advanceEnd first waits for the slide that moved the
+// beginning to begin to move the end. This keeps senders from storing
+// messages in slots that are still being released.
+func (c *ChanFoo) advanceEnd(r *ringFoo, begin, next uint64) {
+	for atomic.LoadUint64(&c.end) != begin+r.size {
+		runtime.Gosched()
+	}
+	atomic.StoreUint64(&c.end, next+r.size)
+}
+
+//jig:template endpoints<Foo> slowest
+//jig:needs endpoints<Foo>, OverflowPolicy, Chan<Foo> gate, Endpoint<Foo> retained
+
+// slowest returns the cursor of the slowest endpoint that blocks senders, or
+// parked when no endpoint does. To avoid scanning thousands of endpoints over
+// and over, it keeps a lower bound of the cursors of every 64 endpoints and of
+// all endpoints. Unless all is true, only the groups of endpoints holding back
+// the beginning of the buffer are scanned again. Cursors only move back with
+// exclusive access to the endpoints, which forgets the bounds (see
+// invalidate). It must be called by slideBuffer with access to the endpoints,
+// which may be shared (see AccessShared).
+func (e *endpointsFoo) slowest(c *ChanFoo, begin uint64, all bool) uint64 {
+	if c.lossy == 1 {
+		return parked // no endpoint blocks senders
+	}
+	all = all || c.roundRobin == 1 // gate depends on the other endpoints
+	if min := atomic.LoadUint64(&e.min); !all && begin < min {
+		return min
+	}
+	slowest := parked
+	for shard := uint32(0); shard*64 < e.len; shard++ {
+		min := atomic.LoadUint64(&e.shards[shard])
+		if all || min <= begin {
+			min = parked
+			end := shard*64 + 64
+			if end > e.len {
+				end = e.len
+			}
+			for i := shard * 64; i < end; i++ {
+				ep := &e.entry[i]
+				cursor := atomic.LoadUint64(&ep.cursor)
+				if cursor == parked || atomic.LoadUint32(&ep.evicted) == 1 || ep.overflow != OverflowBlock {
+					continue
+				}
+				if c.roundRobin == 1 {
+					cursor = c.gate(e.entry[:e.len], i, cursor)
+				}
+				if cursor = ep.retained(cursor); cursor < min {
+					min = cursor
+				}
+			}
+			atomic.StoreUint64(&e.shards[shard], min)
+		}
+		if min < slowest {
+			slowest = min
+		}
+	}
+	atomic.StoreUint64(&e.min, slowest)
+	return slowest
+}
+
+//jig:template Chan<Foo> grow
+//jig:needs Chan<Foo> loadRing
+
+// grow replaces the ring of the channel by one of double the size. It must be
+// called with exclusive access to the endpoints and only when all messages in
+// the buffer are committed, so no sender or replace is writing to the ring.
+func (c *ChanFoo) grow() {
+	old := c.loadRing()
+	size := old.size * 2
+	r := &ringFoo{
+		buffer:  make([]foo, size),
+		written: make([]int64, size),
+		mod:     size - 1,
+		size:    size,
+	}
+	if old.labels != nil {
+		r.labels = make([]string, size)
+		r.errs = make([]error, size)
+	}
+	if old.owners != nil {
+		r.owners = make([]uint32, size)
+	}
+	if old.headers != nil {
+		r.headers = make([]Headers, size)
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	end := atomic.LoadUint64(&c.end)
+	for index := begin; index < end; index++ {
+		r.buffer[r.slot(index)] = old.buffer[old.slot(index)]
+		r.written[r.slot(index)] = atomic.LoadInt64(&old.written[old.slot(index)])
+		if r.labels != nil {
+			r.labels[r.slot(index)] = old.labels[old.slot(index)]
+			r.errs[r.slot(index)] = old.errs[old.slot(index)]
+		}
+		if r.owners != nil {
+			r.owners[r.slot(index)] = atomic.LoadUint32(&old.owners[old.slot(index)])
+		}
+		if r.headers != nil {
+			r.headers[r.slot(index)] = old.headers[old.slot(index)]
+		}
+	}
+	atomic.StorePointer(&c.ring, unsafe.Pointer(r))
+	atomic.StoreUint64(&c.end, begin+size)
+}
+
 //jig:template Chan<Foo> commitData
+//jig:needs Chan<Foo> wake, Chan<Foo> batched
 
 func (c *ChanFoo) commitData() uint64 {
+	commit := atomic.LoadUint64(&c.commit)
+	if atomic.LoadUint32(&c.committer) != working && (c.commitBatch <= 1 || c.batched(commit)) {
+		commit = c.commitAll() // no committer goroutine, see WithCommitter
+	}
+	if final := atomic.LoadUint64(&c.final); final != 0 && commit > final {
+		return final // messages sent after the final message, see CloseWith
+	}
+	return commit
+}
+
+func (c *ChanFoo) commitAll() uint64 {
 	commit := atomic.LoadUint64(&c.commit)
 	if commit >= atomic.LoadUint64(&c.write) {
 		return commit
@@ -280,9 +1250,10 @@ func (c *ChanFoo) commitData() uint64 {
 		return commit // allow only a single receiver goroutine at a time
 	}
 	commit = atomic.LoadUint64(&c.commit)
+	r := c.loadRing()
 	newcommit := commit
-	for ; atomic.LoadInt64(&c.written[newcommit&c.mod])&1 == 1; newcommit++ {
-		atomic.AddInt64(&c.written[newcommit&c.mod], -1)
+	for ; atomic.LoadInt64(&r.written[r.slot(newcommit)])&1 == 1; newcommit++ {
+		atomic.AddInt64(&r.written[r.slot(newcommit)], -1)
 		if newcommit >= atomic.LoadUint64(&c.end) {
 			break
 		}
@@ -292,15 +1263,113 @@ func (c *ChanFoo) commitData() uint64 {
 		panic(fmt.Sprintf("commitData: range error (commit=%d,write=%d,newcommit=%d)", commit, write, newcommit))
 	}
 	if newcommit > commit {
+		if c.reduce != nil {
+			summary := c.summary.Load().(*reductionFoo).value
+			for seq := commit; seq < newcommit; seq++ {
+				if atomic.LoadInt64(&r.written[r.slot(seq)])&2 == 0 {
+					summary = c.reduce(summary, r.buffer[r.slot(seq)])
+				}
+			}
+			c.summary.Store(&reductionFoo{summary})
+		}
 		if !atomic.CompareAndSwapUint64(&c.commit, commit, newcommit) {
 			panic(fmt.Sprintf("commitData; swap error (c.commit=%d,%d,%d)", c.commit, commit, newcommit))
 		}
-		c.receivers.Broadcast() // fresh data! wakeup blocked receiver goroutines
+		if c.commitBatch > 1 {
+			atomic.StoreInt64(&c.lastCommit, c.elapsed())
+		}
+		c.wake() // fresh data! wakeup blocked receiver goroutines
 	}
 	atomic.StoreUint32(&c.committerActivity, resting)
 	return atomic.LoadUint64(&c.commit)
 }
 
+//jig:template Chan<Foo> Summarize
+//jig:needs Chan<Foo>
+
+// Summarize makes the channel maintain a summary of all the messages sent to
+// it, e.g. a count or a checksum. The summary starts out as initial and for
+// every message (in the order the endpoints observe them) the reduce function
+// is called to combine the summary with the message into a new summary.
+//
+// Summarize must be called before any message is sent to the channel. The
+// final summary can be obtained by calling Summary after the close
+// notification was delivered to an endpoint. This allows consumers to verify
+// they received the complete stream.
+func (c *ChanFoo) Summarize(initial interface{}, reduce func(summary interface{}, value foo) interface{}) {
+	c.summary.Store(&reductionFoo{initial})
+	c.reduce = reduce
+}
+
+//jig:template Chan<Foo> Summary
+//jig:needs Chan<Foo>, Chan<Foo> commitData
+
+// Summary returns the summary of the messages sent to the channel so far, or
+// nil when Summarize was not called. Once the close notification has been
+// delivered to an endpoint, the summary covers all messages sent.
+func (c *ChanFoo) Summary() interface{} {
+	c.commitData()
+	if summary, ok := c.summary.Load().(*reductionFoo); ok {
+		return summary.value
+	}
+	return nil
+}
+
+//jig:template Chan<Foo> Latest
+//jig:needs Chan<Foo>, Chan<Foo> commitData, Chan<Foo> loadRing, ring<Foo> settled
+
+// Latest returns the most recently committed message without the need to
+// create an endpoint. This is useful for channels carrying "current state"
+// style messages, where a late joiner is only interested in the newest one.
+// When no message has been committed yet, ok is false.
+func (c *ChanFoo) Latest() (value foo, ok bool) {
+	for index := c.commitData(); index > 0; {
+		index--
+		r := c.loadRing()
+		written := r.settled(index)
+		value = r.buffer[r.slot(index)]
+		if atomic.LoadUint64(&c.end) > index+r.size || atomic.LoadInt64(&r.written[r.slot(index)]) != written {
+			index = c.commitData() // slot was reused while reading it, start over
+			continue
+		}
+		if written&2 == 0 {
+			return value, true
+		}
+	}
+	var zero foo
+	return zero, false
+}
+
+//jig:template Chan<Foo> Len
+//jig:needs endpoints<Foo>, Chan<Foo> commitData
+
+// Len returns the number of committed messages that have not yet been read by
+// the slowest endpoint. When the channel has no endpoints, Len returns 0.
+func (c *ChanFoo) Len() int {
+	commit := c.commitData()
+	slowest := commit
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+			if cursor < slowest {
+				slowest = cursor
+			}
+		}
+	})
+	return int(commit - slowest)
+}
+
+//jig:template Chan<Foo> Cap
+//jig:needs Chan<Foo>
+
+// Cap returns the capacity of the buffer of the channel. This is
+// bufferCapacity as passed to NewChan rounded up to a power of 2 (unless
+// WithExactCapacity was used), or larger when the buffer has grown (see
+// WithGrowth).
+func (c *ChanFoo) Cap() int {
+	return int((*ringFoo)(atomic.LoadPointer(&c.ring)).size) // don't allocate the buffer
+}
+
 //jig:template Chan<Foo> NewEndpoint
 //jig:needs endpoints<Foo>
 
@@ -315,31 +1384,87 @@ func (c *ChanFoo) commitData() uint64 {
 // An endpoint that is canceled or read until it is exhausted (after channel was
 // closed) will be reused by NewEndpoint.
 func (c *ChanFoo) NewEndpoint(keep uint64) (*EndpointFoo, error) {
-	return c.endpoints.NewForChanFoo(c, keep)
+	return c.endpoints.NewForChanFoo(c, endpointOptions{keep: keep})
 }
 
 //jig:template endpoints<Foo>
-//jig:needs Chan<Foo>, ErrOutOfEndpoints
+//jig:needs Chan<Foo>, ErrOutOfEndpoints, endpointOptions, Chan<Foo> leaked, Chan<Foo> attach, Chan<Foo> join, endpoints<Foo> allocate, OverflowPolicy
 
-func (e *endpointsFoo) NewForChanFoo(c *ChanFoo, keep uint64) (*EndpointFoo, error) {
+func (e *endpointsFoo) NewForChanFoo(c *ChanFoo, o endpointOptions) (*EndpointFoo, error) {
+	var spins uint32
+	budget := atomic.LoadUint32(&c.spinBudget)
 	for !atomic.CompareAndSwapUint32(&e.endpointsActivity, idling, creating) {
-		runtime.Gosched()
+		backoff(&spins, budget)
+	}
+	for atomic.LoadInt32(&e.sliding) != 0 {
+		backoff(&spins, budget) // wait for slides that may have missed our cursor
 	}
+	var count int64
+	defer func() {
+		if count != 0 {
+			c.created(count) // after allowing access to the endpoints again
+		}
+	}()
 	defer atomic.StoreUint32(&e.endpointsActivity, idling)
 	var start uint64
 	commit := c.commitData()
 	begin := atomic.LoadUint64(&c.begin)
-	if commit-begin <= keep {
+	if commit-begin <= o.keep {
 		start = begin
 	} else {
-		start = commit - keep
+		start = commit - o.keep
+	}
+	if o.resuming && begin <= o.resume && o.resume <= commit {
+		start = o.resume // see WithCursorStore
+	}
+	var group *consumerGroup
+	if o.group != "" {
+		group, start = c.join(o.group, start)
+	}
+	if e.entry == nil {
+		e.allocate(c)
 	}
 	if int(e.len) == len(e.entry) {
 		for index := uint32(0); index < e.len; index++ {
 			ep := &e.entry[index]
-			if atomic.CompareAndSwapUint64(&ep.cursor, parked, start) {
+			if atomic.LoadUint64(&ep.cursor) == parked && atomic.CompareAndSwapUint64(&ep.cursor, parked, start) { // don't write active cursors
 				ep.endpointState = atomic.LoadUint64(&c.channelState)
 				ep.lastActive = time.Now()
+				atomic.StoreInt64(&ep.lastRead, ep.lastActive.UnixNano())
+				ep.endpointDone = make(chan struct{})
+				atomic.StoreUint32(&ep.endpointFinished, 0)
+				ep.name = o.name
+				ep.maxAge = o.maxAge
+				ep.gap = o.gap
+				ep.overflow = o.overflow
+				ep.idleTimeout = o.idleTimeout
+				ep.sample = o.sample
+				ep.throttle = o.throttle
+				ep.delivered = 0
+				ep.debounce = o.debounce
+				ep.onPanic = o.onPanic
+				ep.group = group
+				ep.index = index
+				ep.acking, ep.ackTimeout, ep.ackRetries = o.acking, o.ackTimeout, o.ackRetries
+				ep.ackSeq = parked
+				ep.deadLetters, ep.onDeadLetter, ep.poison = nil, nil, nil
+				ep.manualCommit = o.manualCommit
+				atomic.StoreUint64(&ep.committed, start)
+				atomic.StoreUint64(&ep.held, parked)
+				ep.cursorStore, ep.checkpointEvery = o.cursorStore, o.checkpointEvery
+				ep.checkpointed, ep.saved = 0, start
+				ep.filter = nil
+				ep.transform = nil
+				atomic.StoreUint64(&ep.dropped, 0)
+				atomic.StoreUint32(&ep.overflowed, 0)
+				atomic.StoreUint64(&ep.demand, 0)
+				atomic.StoreUint32(&ep.evicted, 0)
+				atomic.StoreUint32(&ep.lagging, 0)
+				atomic.StoreUint32(&ep.endpointPaused, 0)
+				ep.origin = c.origin()
+				atomic.StoreUint32(&ep.leakReported, 0)
+				e.enter(ep)
+				count = c.attach()
 				return ep, nil
 			}
 		}
@@ -350,14 +1475,46 @@ func (e *endpointsFoo) NewForChanFoo(c *ChanFoo, keep uint64) (*EndpointFoo, err
 	ep.cursor = start
 	ep.endpointState = atomic.LoadUint64(&c.channelState)
 	ep.lastActive = time.Now()
-	e.len++
+	ep.lastRead = ep.lastActive.UnixNano()
+	ep.endpointDone = make(chan struct{})
+	ep.name = o.name
+	ep.maxAge = o.maxAge
+	ep.gap = o.gap
+	ep.overflow = o.overflow
+	ep.idleTimeout = o.idleTimeout
+	ep.sample = o.sample
+	ep.throttle = o.throttle
+	ep.debounce = o.debounce
+	ep.onPanic = o.onPanic
+	ep.group = group
+	ep.index = e.len
+	ep.acking, ep.ackTimeout, ep.ackRetries = o.acking, o.ackTimeout, o.ackRetries
+	ep.ackSeq = parked
+	ep.manualCommit = o.manualCommit
+	ep.committed = start
+	ep.held = parked
+	ep.cursorStore, ep.checkpointEvery = o.cursorStore, o.checkpointEvery
+	ep.saved = start
+	ep.origin = c.origin()
+	e.enter(ep)
+	atomic.StoreUint32(&e.len, e.len+1) // see assign
+	count = c.attach()
 	return ep, nil
 }
 
-func (e *endpointsFoo) Access(access func(*endpointsFoo)) bool {
+// Access calls access with exclusive access to the endpoints. It waits for
+// NewForChan, other calls to Access and calls to AccessShared to finish, so
+// access has a stable view of the endpoints and the beginning of the buffer.
+// It returns false when it had to wait.
+func (e *endpointsFoo) Access(budget uint32, access func(*endpointsFoo)) bool {
 	contention := false
+	var spins uint32
 	for !atomic.CompareAndSwapUint32(&e.endpointsActivity, idling, enumerating) {
-		runtime.Gosched()
+		backoff(&spins, budget)
+		contention = true
+	}
+	for atomic.LoadInt32(&e.sliding) != 0 {
+		backoff(&spins, budget)
 		contention = true
 	}
 	access(e)
@@ -365,86 +1522,695 @@ func (e *endpointsFoo) Access(access func(*endpointsFoo)) bool {
 	return !contention
 }
 
-//jig:template Endpoint<Foo> Range
+// AccessShared calls access with access to the endpoints that is shared with
+// other calls to AccessShared, but excludes NewForChan and Access. Senders
+// sliding the buffer use it, so they don't serialize on each other. Access
+// may only read fields of the endpoints that are accessed atomically and
+// must move the beginning of the buffer with a compare-and-swap, see
+// advanceEnd. It returns false when it had to wait.
+func (e *endpointsFoo) AccessShared(budget uint32, access func(*endpointsFoo)) bool {
+	contention := false
+	var spins uint32
+	for {
+		atomic.AddInt32(&e.sliding, 1)
+		if atomic.LoadUint32(&e.endpointsActivity) == idling {
+			break
+		}
+		atomic.AddInt32(&e.sliding, -1) // let Access or NewForChan finish first
+		backoff(&spins, budget)
+		contention = true
+	}
+	access(e)
+	atomic.AddInt32(&e.sliding, -1)
+	return !contention
+}
+
+// Snapshot returns the entries of the endpoints registered so far without
+// getting access to the endpoints. Entries are never moved or freed and their
+// number only grows, a finished endpoint just parks its cursor until its
+// entry is reused. So the snapshot can be scanned while endpoints are created
+// and canceled, as long as only fields are read that are accessed atomically,
+// like the cursor. Scans that need a stable view, e.g. because they move the
+// beginning of the buffer, must use Access instead.
+func (e *endpointsFoo) Snapshot() []EndpointFoo {
+	n := atomic.LoadUint32(&e.len)
+	if n == 0 {
+		return nil // entry may still be allocated
+	}
+	return e.entry[:n]
+}
+
+// enter accounts for an endpoint created by NewForChan. An endpoint that
+// doesn't block senders is counted until it parks, see park.
+func (e *endpointsFoo) enter(ep *EndpointFoo) {
+	if ep.overflow != OverflowBlock {
+		atomic.AddInt32(&e.lossy, 1)
+	}
+	e.invalidate(ep.index)
+}
+
+// invalidate forgets the lower bounds of the cursors kept by slowest for the
+// entry at index, after its cursor was moved back. It must be called with
+// exclusive access to the endpoints.
+func (e *endpointsFoo) invalidate(index uint32) {
+	atomic.StoreUint64(&e.shards[index/64], 0)
+	atomic.StoreUint64(&e.min, 0)
+}
+
+//jig:template Endpoint<Foo> Lag
+//jig:needs Endpoint<Foo>, Chan<Foo> commitData
+
+// Lag returns the number of committed messages the endpoint has not read yet.
+// Unlike the other methods of the endpoint, Lag may be called from any
+// goroutine, e.g. to monitor how far a consumer is behind. When the endpoint
+// was canceled or closed and all messages have been read, Lag returns 0.
+func (e *EndpointFoo) Lag() int {
+	commit := e.commitData()
+	cursor := atomic.LoadUint64(&e.cursor)
+	if cursor >= commit {
+		return 0
+	}
+	return int(commit - cursor)
+}
+
+//jig:template Endpoint<Foo> Dropped
 //jig:needs Endpoint<Foo>
 
+// Dropped returns the number of messages the endpoint missed because it was
+// lagging too far behind on a lossy channel (see WithLossy). Dropped may be
+// called from any goroutine.
+func (e *EndpointFoo) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+//jig:template Endpoint<Foo> Name
+//jig:needs Endpoint<Foo>
+
+// Name returns the human-readable name of the endpoint as passed to
+// NewEndpointOpts using WithName.
+func (e *EndpointFoo) Name() string {
+	return e.name
+}
+
+//jig:template Endpoint<Foo> Done
+//jig:needs Endpoint<Foo>
+
+// Done returns a channel that is closed when the endpoint finishes. That is
+// when the close notification of the channel has been delivered after reading
+// all messages, or when the endpoint was canceled. Use it to select on the
+// completion of the endpoint alongside other channels.
+func (e *EndpointFoo) Done() <-chan struct{} {
+	return e.endpointDone
+}
+
+//jig:template Endpoint<Foo> Range
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate
+
 // Range will call the passed in foreach function with all the messages in
 // the buffer, followed by all the messages received. When the foreach function
 // returns true Range will continue, when you return false this is the same as
 // calling Cancel. When canceled the foreach will never be called again.
 // Passing a maxAge duration other than 0 will skip messages that are older
-// than maxAge.
+// than maxAge. When maxAge is 0, the maxAge the endpoint was created with
+// applies (see WithMaxAge).
 //
 // When the channel is closed, eventually when the buffer is exhausted the close
 // with optional error will be notified by calling foreach one last time with
 // the closed parameter set to true.
 func (e *EndpointFoo) Range(foreach func(value foo, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(foreach, nil, maxAge, nil)
+}
+
+//jig:template Endpoint<Foo> RangeMarks
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate
+
+// RangeMarks works like Range, but will additionally call the passed in mark
+// function for every marker injected in the channel by Mark. The mark function
+// is passed the label and sequence number of the marker. Returning false from
+// mark is the same as calling Cancel.
+func (e *EndpointFoo) RangeMarks(foreach func(value foo, err error, closed bool) bool, mark func(label string, seq uint64) bool, maxAge time.Duration) {
+	e.iterate(foreach, mark, maxAge, nil)
+}
+
+//jig:template Endpoint<Foo> RangeSeq
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate
+
+// RangeSeq works like Range, but passes the sequence number of every message
+// and the time it was sent to the foreach function. Sequence numbers are
+// consecutive, so a consumer can detect gaps, e.g. caused by maxAge skipping
+// messages. The sent time is the zero time for messages sent using FastSend.
+// The close notification carries the sequence number the next message would
+// have had.
+func (e *EndpointFoo) RangeSeq(foreach func(value foo, seq uint64, sent time.Time, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(func(value foo, err error, closed bool) bool {
+		seq := e.cursor
+		if closed {
+			return foreach(value, seq, time.Time{}, err, true)
+		}
+		var sent time.Time
+		r := e.loadRing()
+		if updated := atomic.LoadInt64(&r.written[r.slot(seq)]) >> 2; updated != 0 {
+			sent = e.start.Add(time.Duration(updated))
+		}
+		return foreach(value, seq, sent, nil, false)
+	}, nil, maxAge, nil)
+}
+
+//jig:template Endpoint<Foo> RangeTimeout
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate, Endpoint<Foo> wakeUp
+
+// RangeTimeout works like Range, but returns when no new message arrived
+// within the deadline. The endpoint is then not canceled, so the caller can
+// do some housekeeping and call RangeTimeout again to resume where it left
+// off. RangeTimeout returns true when it returned because of the deadline and
+// false when the endpoint was canceled or the close notification was
+// delivered.
+func (e *EndpointFoo) RangeTimeout(foreach func(value foo, err error, closed bool) bool, maxAge time.Duration, deadline time.Duration) (timeout bool) {
+	var control, returned uint32
+	last := time.Now().UnixNano()
+	var expire func()
+	expire = func() {
+		if atomic.LoadUint32(&returned) == 1 {
+			return
+		}
+		if idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&last)); idle < deadline {
+			time.AfterFunc(deadline-idle, expire) // a message arrived since
+			return
+		}
+		atomic.StoreUint32(&control, suspend)
+		e.wakeUp()
+	}
+	timer := time.AfterFunc(deadline, expire)
+	e.iterate(func(value foo, err error, closed bool) bool {
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+		return foreach(value, err, closed)
+	}, nil, maxAge, &control)
+	atomic.StoreUint32(&returned, 1)
+	timer.Stop()
+	return atomic.LoadUint64(&e.cursor) != parked
+}
+
+//jig:template Endpoint<Foo> RangeErr
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate
+
+// RangeErr works like Range, but the foreach function returns an error
+// instead of a bool. When foreach returns a non-nil error, the endpoint is
+// canceled and RangeErr returns that error. This way the reason for stopping
+// is not lost. RangeErr returns nil when the endpoint was canceled otherwise,
+// or when foreach returned nil for the close notification.
+func (e *EndpointFoo) RangeErr(foreach func(value foo, err error, closed bool) error, maxAge time.Duration) (err error) {
+	e.iterate(func(value foo, closeErr error, closed bool) bool {
+		err = foreach(value, closeErr, closed)
+		return err == nil
+	}, nil, maxAge, nil)
+	return err
+}
+
+//jig:template Endpoint<Foo> iterate
+//jig:needs Endpoint<Foo>, Endpoint<Foo> await, Endpoint<Foo> closeErr, Endpoint<Foo> park, Endpoint<Foo> lapped, Chan<Foo> elapsed, Chan<Foo> loadRing, ring<Foo> settled, Chan<Foo> watermark, Chan<Foo> wakeSenders, Chan<Foo> checkLag, Endpoint<Foo> hold, Endpoint<Foo> coalesce, Endpoint<Foo> recoverPanic, Endpoint<Foo> owns, Endpoint<Foo> awaitAck, Endpoint<Foo> deadLetter, Endpoint<Foo> checkpoint, Endpoint<Foo> due
+
+func (e *EndpointFoo) iterate(foreach func(value foo, err error, closed bool) bool, mark func(label string, seq uint64) bool, maxAge time.Duration, control *uint32) {
+	atomic.StoreUint32(&e.endpointActivity, ranging)
+	if atomic.LoadUint64(&e.endpointState) == canceled || atomic.LoadUint64(&e.cursor) == parked {
+		e.park()
+		return
+	}
+	if e.onPanic != nil {
+		defer e.recoverPanic()
+	}
+	if maxAge == 0 {
+		maxAge = e.maxAge
+	}
+	if e.recycle != nil {
+		atomic.StoreUint64(&e.held, parked) // the caller is done with them, see Recycle
+	}
 	e.lastActive = time.Now()
 	for {
-		commit := e.commitData()
-		for ; e.cursor == commit; commit = e.commitData() {
-			if atomic.CompareAndSwapUint64(&e.endpointState, canceled, canceled) {
-				atomic.StoreUint64(&e.cursor, parked)
-				return
+		commit, state := e.await(control)
+		switch {
+		case state == canceled:
+			return
+		case state == closed:
+			var zero foo
+			foreach(zero, e.closeErr(), true)
+			e.park()
+			return //we're done
+		case commit == e.cursor:
+			return // suspended
+		}
+		if e.conflate == 1 && commit-e.cursor > 1 {
+			e.skip(e.cursor, commit-1) // skip to most recent message
+		}
+		if e.throttle != 0 || e.debounce != 0 {
+			if !e.coalesce(control) {
+				if control != nil && atomic.LoadUint32(control) == abort {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
+				}
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return // suspended
 			}
-			if atomic.LoadUint64(&e.commit) < atomic.LoadUint64(&e.write) {
-				if e.endpointClosed == 1 {
-					panic(fmt.Sprintf("data written after closing endpoint; commit(%d) write(%d)",
-						atomic.LoadUint64(&e.commit), atomic.LoadUint64(&e.write)))
+			commit = e.commitData()
+			atomic.StoreUint64(&e.cursor, commit-1) // skip to most recent message
+		}
+		// process data we got
+		r := e.loadRing()
+		for ; e.cursor != commit && atomic.LoadUint32(&e.aborted) == 0; atomic.AddUint64(&e.cursor, 1) {
+			if !e.hold(control) {
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
 				}
-				runtime.Gosched() // just backoff a little ~1us
-				e.lastActive = time.Now()
-			} else {
-				now := time.Now()
-				if now.Before(e.lastActive.Add(1 * time.Millisecond)) {
-					if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
-						e.endpointClosed = 1 // note close happened, but don't close yet.
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return // suspended
+			}
+			redeliver := false
+			if e.acking == 1 && e.ackSeq == e.cursor {
+				var ok bool
+				if redeliver, ok = e.awaitAck(control); !ok {
+					if control != nil && atomic.LoadUint32(control) == abort {
+						atomic.StoreUint64(&e.endpointState, canceled)
 					}
-					runtime.Gosched() // 0<lastActive<1ms: just backoff a little ~1us
-				} else if now.Before(e.lastActive.Add(250 * time.Millisecond)) {
-					if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
-						var zero foo
-						foreach(zero, e.err, true)
-						atomic.StoreUint64(&e.cursor, parked)
-						return //we're done
+					if atomic.LoadUint64(&e.endpointState) == canceled {
+						e.park()
+						return
 					}
-					runtime.Gosched() // 1ms<lastActive<250ms: just backoff a little ~1us
-				} else {
-					e.receivers.Wait() // 250ms<lastActive: block on condition
-					e.lastActive = time.Now()
+					atomic.StoreUint32(&e.endpointActivity, idling)
+					return // suspended
+				}
+				if !redeliver {
+					continue // acknowledged or given up
 				}
 			}
-		}
-		// process data we got
-		for ; e.cursor != commit; atomic.AddUint64(&e.cursor, 1) {
-			item := e.buffer[e.cursor&e.mod]
+			written := r.settled(e.cursor)
+			if !e.due(written, control) {
+				if control != nil && atomic.LoadUint32(control) == abort {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
+				}
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return // suspended
+			}
+			item := r.buffer[r.slot(e.cursor)]
+			if e.lapped(e.cursor) {
+				break
+			}
 			emit := true
-			if maxAge != 0 {
-				stale := time.Since(e.start).Nanoseconds() - maxAge.Nanoseconds()
-				updated := atomic.LoadInt64(&e.written[e.cursor&e.mod]) >> 1
+			if redeliver {
+				// the message passed all checks when it was first delivered
+			} else if written&2 == 2 {
+				if mark != nil && !mark(r.labels[r.slot(e.cursor)], e.cursor) {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				emit = false
+			} else if e.sample > 1 && e.cursor%e.sample != 0 {
+				emit = false
+			} else if maxAge != 0 {
+				stale := e.elapsed() - maxAge.Nanoseconds()
+				updated := written >> 2
 				if updated != 0 && updated <= stale {
 					emit = false
 				}
 			}
+			if emit && !redeliver {
+				if e.filter != nil && !e.filter(item) {
+					emit = false
+				} else if r.owners != nil && !e.owns(r, e.cursor) {
+					emit = false // assigned to another endpoint
+				} else if e.group != nil && !e.group.claim(e.cursor, r.size) {
+					emit = false // delivered to another member of the group
+				}
+			}
+			if emit && e.transform != nil {
+				item = e.transform(item)
+			}
+			stay := emit && e.acking == 1
+			if stay {
+				e.awaitingAck(e.cursor) // before foreach, which may ack right away
+			}
 			if emit && !foreach(item, nil, false) {
 				atomic.StoreUint64(&e.endpointState, canceled)
 			}
+			if e.poison != nil && !stay {
+				e.deadLetter(r.buffer[r.slot(e.cursor)], e.cursor, 1, e.poison)
+			}
+			if control != nil && atomic.LoadUint32(control) == abort {
+				atomic.StoreUint64(&e.endpointState, canceled)
+			}
 			if atomic.LoadUint64(&e.endpointState) == canceled {
-				atomic.StoreUint64(&e.cursor, parked)
+				e.park()
+				return
+			}
+			if control != nil && atomic.LoadUint32(control) == suspend {
+				if !stay {
+					atomic.AddUint64(&e.cursor, 1)
+				}
+				e.watermark()
+				e.wakeSenders()
+				e.checkLag()
+				e.checkpoint()
+				atomic.StoreInt64(&e.lastRead, time.Now().UnixNano())
+				atomic.StoreUint32(&e.endpointActivity, idling)
 				return
 			}
+			if stay {
+				atomic.AddUint64(&e.cursor, ^uint64(0)) // don't advance until acknowledged
+			}
 		}
+		e.watermark()
+		e.wakeSenders()
+		e.checkLag()
+		e.checkpoint()
 		e.lastActive = time.Now()
+		atomic.StoreInt64(&e.lastRead, e.lastActive.UnixNano())
+	}
+}
+
+//jig:template Endpoint<Foo> lapped
+//jig:needs Endpoint<Foo>, OverflowPolicy
+
+// lapped is called after reading the message at cursor. On a lossy channel it
+// reports whether the buffer was slid beyond cursor, in which case the message
+// read may have been overwritten. The same applies after ForceTrimBefore. An
+// endpoint that was evicted (see EvictSlow) is always lapped. The cursor of the endpoint is then moved to
+// the oldest message still in the buffer, the skipped messages are counted as
+// dropped and the gap handler of the endpoint is called. For an endpoint with
+// policy OverflowError, the endpoint is closed with ErrOverflow instead.
+func (e *EndpointFoo) lapped(cursor uint64) bool {
+	if atomic.LoadUint32(&e.evicted) == 1 {
+		return true // the message read may have been overwritten
+	}
+	if e.lossy == 0 && e.overflow == OverflowBlock && atomic.LoadUint32(&e.trimmed) == 0 {
+		return false
+	}
+	begin := atomic.LoadUint64(&e.begin)
+	if cursor >= begin {
+		return false
+	}
+	if e.overflow == OverflowError {
+		atomic.CompareAndSwapUint64(&e.endpointState, active, closed)
+		atomic.StoreUint32(&e.overflowed, 1)
+		return true
+	}
+	e.skip(cursor, begin)
+	return true
+}
+
+// skip moves the cursor of the endpoint from cursor forward to seq, counting
+// the messages in between as dropped and reporting them to the gap handler.
+func (e *EndpointFoo) skip(cursor, seq uint64) {
+	atomic.AddUint64(&e.dropped, seq-cursor)
+	atomic.StoreUint64(&e.cursor, seq)
+	if e.gap != nil {
+		e.gap(seq - cursor)
+	}
+}
+
+//jig:template Endpoint<Foo> closeErr
+//jig:needs Endpoint<Foo>, ErrOverflow
+
+// closeErr returns the error to deliver with the close notification.
+func (e *EndpointFoo) closeErr() error {
+	if atomic.LoadUint32(&e.overflowed) == 1 {
+		return ErrOverflow
+	}
+	return e.signal().err
+}
+
+//jig:template Endpoint<Foo> await
+//jig:needs Endpoint<Foo>, Endpoint<Foo> park, Endpoint<Foo> block
+
+// await blocks until data beyond the cursor of the endpoint has been committed
+// and then returns the commit index with state active. When the endpoint was
+// canceled, the cursor is parked and state canceled is returned. When the
+// channel was closed and all data has been read, state closed is returned and
+// the caller should park the cursor after delivering the close notification.
+// When ranging was suspended via control, the returned commit index equals
+// the cursor.
+func (e *EndpointFoo) await(control *uint32) (commit uint64, state uint64) {
+	if atomic.LoadUint32(&e.evicted) == 1 {
+		e.park()
+		return e.cursor, canceled
+	}
+	if atomic.LoadUint32(&e.aborted) == 1 && atomic.LoadUint64(&e.endpointState) == closed {
+		commit = atomic.LoadUint64(&e.commit)
+		atomic.StoreUint64(&e.cursor, commit) // discard remaining data
+		return commit, closed
+	}
+	if atomic.LoadUint32(&e.overflowed) == 1 && atomic.LoadUint64(&e.endpointState) == closed {
+		return e.cursor, closed
+	}
+	var spins, attempt uint32
+	budget := atomic.LoadUint32(&e.spinBudget)
+	for commit = e.commitData(); e.cursor == commit; commit = e.commitData() {
+		if control != nil && atomic.LoadUint32(control) == abort {
+			atomic.StoreUint64(&e.endpointState, canceled)
+		}
+		if atomic.CompareAndSwapUint64(&e.endpointState, canceled, canceled) {
+			e.park()
+			return commit, canceled
+		}
+		if control != nil && atomic.LoadUint32(control) == suspend {
+			atomic.StoreUint32(&e.endpointActivity, idling)
+			return commit, active
+		}
+		if final := atomic.LoadUint64(&e.final); atomic.LoadUint64(&e.commit) < atomic.LoadUint64(&e.write) && (final == 0 || commit < final) {
+			if e.endpointClosed == 1 {
+				panic(fmt.Sprintf("data written after closing endpoint; commit(%d) write(%d)",
+					atomic.LoadUint64(&e.commit), atomic.LoadUint64(&e.write)))
+			}
+			backoff(&spins, budget) // just backoff a little ~1us
+			e.lastActive = time.Now()
+		} else if e.wait != nil {
+			if atomic.LoadUint64(&e.endpointState) == closed {
+				if time.Since(e.lastActive) >= e.closeAfter {
+					return commit, closed
+				}
+				e.endpointClosed = 1 // note close happened, but don't close yet.
+				backoff(&spins, budget)
+			} else if attempt++; e.wait.Wait(attempt) {
+				e.block(control)
+				e.lastActive = time.Now()
+				attempt = 0
+			}
+		} else {
+			now := time.Now()
+			if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
+				if !now.Before(e.lastActive.Add(e.closeAfter)) {
+					return commit, closed
+				}
+				e.endpointClosed = 1    // note close happened, but don't close yet.
+				backoff(&spins, budget) // 0<lastActive<closeAfter: just backoff a little ~1us
+			} else if now.Before(e.lastActive.Add(e.blockAfter)) {
+				backoff(&spins, budget) // 0<lastActive<blockAfter: just backoff a little ~1us
+			} else {
+				e.block(control) // blockAfter<lastActive: block until woken up
+				e.lastActive = time.Now()
+			}
+		}
+	}
+	return commit, active
+}
+
+//jig:template Endpoint<Foo> ReadBatch
+//jig:needs Endpoint<Foo>, Endpoint<Foo> await, Endpoint<Foo> park, Endpoint<Foo> lapped, Chan<Foo> elapsed, Chan<Foo> loadRing, ring<Foo> settled, Chan<Foo> watermark, Chan<Foo> wakeSenders, Chan<Foo> checkLag, Endpoint<Foo> hold, Endpoint<Foo> coalesce, Endpoint<Foo> owns, Endpoint<Foo> Next, Endpoint<Foo> checkpoint, Endpoint<Foo> due
+
+// ReadBatch will block until messages are available and then copy up to
+// len(dst) of them into dst in one go, returning the number of messages
+// copied. The cursor of the endpoint is advanced only once per batch, which
+// makes ReadBatch cheaper than Range for high throughput consumers. Markers
+// and messages older than the maxAge the endpoint was created with are
+// skipped.
+//
+// When the channel is closed, eventually when the buffer is exhausted
+// ReadBatch will return 0. ReadBatch also returns 0 when the endpoint was
+// canceled.
+func (e *EndpointFoo) ReadBatch(dst []foo) int {
+	if len(dst) == 0 {
+		return 0
+	}
+	if e.acking == 1 {
+		value, ok, _ := e.Next() // one message at a time, see WithAck
+		if !ok {
+			return 0
+		}
+		dst[0] = value
+		return 1
+	}
+	atomic.StoreUint32(&e.endpointActivity, ranging)
+	if atomic.LoadUint64(&e.endpointState) == canceled || atomic.LoadUint64(&e.cursor) == parked {
+		e.park()
+		return 0
+	}
+	if e.recycle != nil {
+		atomic.StoreUint64(&e.held, parked) // the caller is done with them, see Recycle
+	}
+	e.lastActive = time.Now()
+	for {
+		commit, state := e.await(nil)
+		switch state {
+		case canceled:
+			return 0
+		case closed:
+			e.park()
+			return 0
+		}
+		count := 0
+		cursor := e.cursor
+		if e.conflate == 1 && commit-cursor > 1 {
+			e.skip(cursor, commit-1) // skip to most recent message
+			cursor = commit - 1
+		}
+		if e.throttle != 0 || e.debounce != 0 {
+			if !e.coalesce(nil) {
+				e.park()
+				return 0
+			}
+			commit = e.commitData()
+			cursor = commit - 1 // skip to most recent message
+		}
+		stale := int64(0)
+		if e.maxAge != 0 {
+			stale = e.elapsed() - e.maxAge.Nanoseconds()
+		}
+		if !e.hold(nil) {
+			e.park()
+			return 0
+		}
+		r := e.loadRing()
+		if e.recycle != nil {
+			atomic.StoreUint64(&e.held, cursor) // until the next read, see Recycle
+		}
+		for ; cursor != commit && count < len(dst) && atomic.LoadUint32(&e.aborted) == 0; cursor++ {
+			if e.key != nil {
+				atomic.StoreUint64(&e.cursor, cursor) // see replace
+			}
+			written := r.settled(cursor)
+			if count > 0 && e.pending(written) {
+				break // deliver the messages that are due first
+			}
+			if !e.due(written, nil) {
+				e.park()
+				return 0
+			}
+			value := r.buffer[r.slot(cursor)]
+			if e.lapped(cursor) {
+				cursor = atomic.LoadUint64(&e.cursor)
+				break
+			}
+			if updated := written >> 2; written&2 == 0 && (updated == 0 || updated > stale) &&
+				(e.sample <= 1 || cursor%e.sample == 0) && (e.filter == nil || e.filter(value)) &&
+				(r.owners == nil || e.owns(r, cursor)) && (e.group == nil || e.group.claim(cursor, r.size)) {
+				if e.transform != nil {
+					value = e.transform(value)
+				}
+				dst[count] = value
+				count++
+			}
+		}
+		atomic.StoreUint64(&e.cursor, cursor)
+		e.watermark()
+		e.wakeSenders()
+		e.checkLag()
+		e.checkpoint()
+		e.lastActive = time.Now()
+		atomic.StoreInt64(&e.lastRead, e.lastActive.UnixNano())
+		if count > 0 {
+			atomic.StoreUint32(&e.endpointActivity, idling)
+			return count
+		}
+	}
+}
+
+//jig:template Endpoint<Foo> Next
+//jig:needs Endpoint<Foo>, Endpoint<Foo> next
+
+// Next will block until the next message is available and return it with ok
+// set to true. Next allows pulling messages from the endpoint one at a time
+// instead of receiving them via a callback passed to Range.
+//
+// When the channel is closed, eventually when the buffer is exhausted Next
+// will return with closed set to true. When the endpoint is canceled, Next will
+// return with both ok and closed set to false.
+func (e *EndpointFoo) Next() (value foo, ok bool, closed bool) {
+	var control uint32
+	return e.next(&control)
+}
+
+//jig:template Endpoint<Foo> NextTimeout
+//jig:needs Endpoint<Foo>, Endpoint<Foo> next, Endpoint<Foo> wakeUp
+
+// NextTimeout works like Next, but will give up waiting for the next message
+// when the timeout expires. In that case both ok and closed are false, but
+// unlike when canceled, the endpoint can still be used.
+func (e *EndpointFoo) NextTimeout(timeout time.Duration) (value foo, ok bool, closed bool) {
+	var control uint32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreUint32(&control, suspend)
+		e.wakeUp()
+	})
+	defer timer.Stop()
+	return e.next(&control)
+}
+
+//jig:template Endpoint<Foo> next
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate
+
+func (e *EndpointFoo) next(control *uint32) (value foo, ok bool, closed bool) {
+	e.iterate(func(v foo, err error, c bool) bool {
+		value, ok, closed = v, !c, c
+		if e.recycle != nil && !c {
+			atomic.StoreUint64(&e.held, e.cursor) // until the next read, see Recycle
+		}
+		atomic.StoreUint32(control, suspend)
+		return true
+	}, nil, 0, control)
+	return
+}
+
+//jig:template Endpoint<Foo> park
+//jig:needs Endpoint<Foo>, Chan<Foo> watermark, Chan<Foo> wakeSenders, Chan<Foo> detach, OverflowPolicy
+
+func (e *EndpointFoo) park() {
+	finished := atomic.CompareAndSwapUint32(&e.endpointFinished, 0, 1)
+	if finished {
+		close(e.endpointDone)
+	}
+	atomic.StoreUint32(&e.endpointActivity, idling)
+	atomic.StoreUint64(&e.cursor, parked)
+	e.watermark()
+	e.wakeSenders()
+	if finished {
+		if e.overflow != OverflowBlock {
+			atomic.AddInt32(&e.endpoints.lossy, -1) // see enter
+		}
+		e.detach()
 	}
 }
 
 //jig:template Endpoint<Foo> Cancel
-//jig:needs Endpoint<Foo>
+//jig:needs Endpoint<Foo>, Endpoint<Foo> park, Endpoint<Foo> wakeUp
 
 // Cancel cancels the endpoint, making it available to be reused when
 // NewEndpoint is called on the channel. When canceled the foreach function
 // passed to Range is not notified, instead just never called again.
+//
+// When the endpoint is not inside a call to Range, its cursor is parked
+// immediately so the endpoint no longer holds back senders that are blocked
+// on a full buffer. Otherwise Range will park the cursor as soon as it
+// observes the cancel.
 func (e *EndpointFoo) Cancel() {
-	atomic.CompareAndSwapUint64(&e.endpointState, active, canceled)
-	e.receivers.Broadcast()
+	if atomic.CompareAndSwapUint64(&e.endpointState, active, canceled) ||
+		atomic.CompareAndSwapUint64(&e.endpointState, closed, canceled) {
+		if atomic.LoadUint32(&e.endpointActivity) == idling {
+			e.park()
+		}
+	}
+	e.wakeUp()
 }
@@ -0,0 +1,79 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template NotificationKind
+
+// NotificationKind tells what a Notification delivered by RangeNotifications
+// is about.
+type NotificationKind int
+
+const (
+	// OnNext notifications carry a message sent to the channel.
+	OnNext NotificationKind = iota
+	// OnError notifications carry an error sent by SendError. More
+	// notifications may follow.
+	OnError
+	// OnComplete is the last notification, delivered when the channel is
+	// closed. It carries the error the channel was closed with, if any.
+	OnComplete
+)
+
+//jig:template Notification<Foo>
+//jig:needs NotificationKind
+
+// NotificationFoo is a materialized event delivered by RangeNotifications.
+type NotificationFoo struct {
+	Kind  NotificationKind
+	Value foo   // for OnNext
+	Err   error // for OnError and OnComplete
+}
+
+//jig:template Chan<Foo> SendError
+//jig:needs Chan<Foo> Mark, ErrSealed, ErrClosed
+
+// SendError sends an error event to the channel without closing it. Unlike
+// Close, more messages can be sent after the error, which matches Rx
+// semantics where individual errors flow through the stream. The error event
+// occupies a sequence number like a marker (see Mark) and is delivered as an
+// OnError notification by RangeNotifications. Other ways of reading skip error
+// events like they skip markers, but RangeMarks observes them as markers
+// labeled with the text of the error. A nil err is ignored. When the channel
+// was sealed, SendError returns ErrSealed. When the channel is closed while
+// waiting for room, SendError returns ErrClosed.
+func (c *ChanFoo) SendError(err error) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if err != nil {
+		if _, ok := c.mark(err.Error(), err); !ok {
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+//jig:template Endpoint<Foo> RangeNotifications
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate, Chan<Foo> loadRing, Notification<Foo>
+
+// RangeNotifications works like Range, but passes every message, error event
+// (see SendError) and the close of the channel to the foreach function as a
+// materialized notification. When foreach returns false, the endpoint is
+// canceled.
+func (e *EndpointFoo) RangeNotifications(foreach func(n NotificationFoo) bool, maxAge time.Duration) {
+	e.iterate(func(value foo, err error, closed bool) bool {
+		if closed {
+			return foreach(NotificationFoo{Kind: OnComplete, Err: err})
+		}
+		return foreach(NotificationFoo{Kind: OnNext, Value: value})
+	}, func(label string, seq uint64) bool {
+		r := e.loadRing()
+		if err := r.errs[r.slot(seq)]; err != nil {
+			return foreach(NotificationFoo{Kind: OnError, Err: err})
+		}
+		return true
+	}, maxAge, nil)
+}
@@ -0,0 +1,627 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template ChanOption
+//jig:needs RetentionPolicy, RatePolicy, EndpointInfo, WaitStrategy
+
+// ChanOption configures a channel created by NewChanOpts. Options allow new
+// settings to be added to the channel without changing the signature of its
+// constructor.
+type ChanOption func(*chanOptions)
+
+type chanOptions struct {
+	bufferCapacity   int
+	endpointCapacity int
+	spinBudget       int
+	clock            func() time.Time
+	lossy            bool
+	conflate         bool
+	growth           bool
+	maxCapacity      int
+	retention        RetentionPolicy
+	lowWater         int
+	highWater        int
+	onHigh           func()
+	onLow            func()
+	rate             float64
+	burst            int
+	ratePolicy       RatePolicy
+	fair             bool
+	lockstep         bool
+	leakIdle         time.Duration
+	onLeak           func(leak EndpointInfo)
+	roundRobin       bool
+	refCount         bool
+	teardown         func()
+	headers          bool
+	wait             WaitStrategy
+	wakeups          bool
+	commitBatch      int
+	commitDelay      time.Duration
+	committer        bool
+	backoff          bool
+	closeAfter       time.Duration
+	blockAfter       time.Duration
+	untimed          bool
+	exact            bool
+	shrinkMin        int
+	shrinkAfter      time.Duration
+	resolution       time.Duration
+}
+
+// WithBufferCapacity sets the size of the message buffer of the channel. The
+// capacity is scaled up to a power of 2, unless WithExactCapacity is used.
+// The default is 128.
+func WithBufferCapacity(capacity int) ChanOption {
+	return func(o *chanOptions) { o.bufferCapacity = capacity }
+}
+
+// WithExactCapacity makes the channel use a buffer of exactly the capacity
+// set by WithBufferCapacity instead of scaling it up to a power of 2. This
+// saves memory on large buffers, e.g. 5 million messages take 5 million slots
+// instead of 8 million, at the cost of a division for every access to the
+// buffer when the capacity is not a power of 2. Growth (see WithGrowth)
+// doubles the exact capacity.
+func WithExactCapacity() ChanOption {
+	return func(o *chanOptions) { o.exact = true }
+}
+
+// WithEndpointCapacity sets the maximum number of concurrent receiving
+// endpoints of the channel. The default is 8.
+func WithEndpointCapacity(capacity int) ChanOption {
+	return func(o *chanOptions) { o.endpointCapacity = capacity }
+}
+
+// WithSpinBudget sets the spin budget of the channel, see SetSpinBudget.
+func WithSpinBudget(spins int) ChanOption {
+	return func(o *chanOptions) { o.spinBudget = spins }
+}
+
+// WithClock replaces time.Now as the source of the timestamps recorded with
+// messages sent to the channel. This affects the maxAge filtering performed
+// by endpoints and the interval of RangeWindow, so a fake clock allows testing
+// them deterministically. The clock should never go back in time.
+func WithClock(now func() time.Time) ChanOption {
+	return func(o *chanOptions) { o.clock = now }
+}
+
+// WithWaitStrategy replaces the default way goroutines wait on the channel,
+// see WaitStrategy. By default, an endpoint that has read everything spins
+// and yields for a while, then blocks when the channel has been idle for
+// 250ms. A sender waiting for room spins and yields.
+func WithWaitStrategy(strategy WaitStrategy) ChanOption {
+	return func(o *chanOptions) { o.wait = strategy }
+}
+
+// WithEndpointWakeups gives every endpoint its own wakeup channel, instead of
+// all endpoints blocking on one wakeup channel shared by them. A state change
+// of a single endpoint, like it being canceled, evicted or its NextTimeout
+// expiring, then only wakes up that endpoint instead of all of them. This pays
+// off with many mostly idle endpoints. Blocked endpoints are woken up by
+// WaitStrategy BlockingWait or by the default strategy after 250ms of idling.
+func WithEndpointWakeups() ChanOption {
+	return func(o *chanOptions) { o.wakeups = true }
+}
+
+// WithCommitBatch makes the endpoints commit the messages sent to the channel
+// in batches of the given size, instead of committing every message as soon
+// as it is available. This reduces the contention between the endpoints of a
+// channel with a high fan-out that all race to do the commit work. A batch is
+// also committed when maxDelay has passed since the previous commit (at least
+// 1ms), so maxDelay bounds the latency added to every message. When the
+// channel is closed, the remaining messages are committed right away.
+// Messages sent with FastSend are not affected.
+func WithCommitBatch(size int, maxDelay time.Duration) ChanOption {
+	return func(o *chanOptions) { o.commitBatch, o.commitDelay = size, maxDelay }
+}
+
+// WithCommitter runs a dedicated goroutine that commits the messages sent to
+// the channel, so the endpoints never do commit work and the order of the
+// messages of concurrent senders is settled with a predictable latency. The
+// endpoints are woken up by the committer, so WithCommitBatch has no effect.
+// The goroutine exits when the channel is closed and is restarted by Reset.
+func WithCommitter() ChanOption {
+	return func(o *chanOptions) { o.committer = true }
+}
+
+// WithBackoff sets the thresholds of the way an endpoint that has read
+// everything waits for new messages, when no WaitStrategy is set. The endpoint
+// spins, yielding the processor every spin budget, until it has been idle for
+// blockAfter (default 250ms) and then blocks until a sender wakes it up. A
+// blockAfter of 0 disables spinning, the endpoint then blocks right away.
+// When the channel is closed, the endpoint keeps waiting for messages still
+// being sent until it has been idle for closeAfter (default 1ms).
+func WithBackoff(closeAfter, blockAfter time.Duration) ChanOption {
+	return func(o *chanOptions) { o.backoff, o.closeAfter, o.blockAfter = true, closeAfter, blockAfter }
+}
+
+// WithoutTimestamps stops the channel from recording the time every message
+// was sent, saving a clock call per message for users that never filter on
+// age. Messages are then treated like messages sent using FastSend: maxAge
+// doesn't skip them, Message.Sent is zero and neither SeekTime nor a
+// RetentionPolicy with a MaxAge work. Messages sent with SendAt or SendAfter
+// are still delayed. The buffer keeps a word per message regardless, because
+// it also tracks whether the message was committed.
+func WithoutTimestamps() ChanOption {
+	return func(o *chanOptions) { o.untimed = true }
+}
+
+// WithCoarseClock makes the channel record the time messages were sent from
+// a clock that is updated by a ticker every resolution (e.g. 1ms), instead of
+// reading the clock for every message. This saves a clock call per message,
+// at the cost of timestamps, and so maxAge filtering, being only as precise as
+// the resolution. The ticker stops when the channel is closed and is
+// restarted by Reset.
+func WithCoarseClock(resolution time.Duration) ChanOption {
+	return func(o *chanOptions) { o.resolution = resolution }
+}
+
+// WithLossy makes the channel never block a sender because of an endpoint
+// lagging behind. Instead, when the buffer is full the oldest message is
+// overwritten, like in a classic ring buffer, and so dropped for the endpoints
+// that did not read it yet. Every endpoint counts the messages it missed, see
+// Dropped. To observe the gaps in the stream of messages as they occur, create
+// endpoints with WithGapHandler.
+func WithLossy() ChanOption {
+	return func(o *chanOptions) { o.lossy = true }
+}
+
+// WithConflate turns the channel into a latest-only channel. Like with
+// WithLossy, senders never block because of an endpoint lagging behind. On top
+// of that, an endpoint that has fallen behind skips directly to the most
+// recent message, so it never observes intermediate values. The skipped
+// messages are counted as dropped, see Dropped. This is useful for
+// broadcasting state snapshots.
+func WithConflate() ChanOption {
+	return func(o *chanOptions) { o.conflate = true }
+}
+
+// WithGrowth makes the buffer of the channel grow instead of blocking senders
+// when it is full because an endpoint is lagging behind. Every time the buffer
+// grows, its capacity is doubled. The capacity never exceeds maxCapacity, a
+// maxCapacity of 0 means the buffer can grow without limit. Once the maximum
+// is reached, senders block as usual. The buffer never shrinks.
+func WithGrowth(maxCapacity int) ChanOption {
+	return func(o *chanOptions) { o.growth, o.maxCapacity = true, maxCapacity }
+}
+
+// WithShrink makes the buffer of the channel shrink when it is mostly unused,
+// so a channel sized for bursts doesn't hold on to the memory of its buffer
+// while idle. When for the duration after no more than a quarter of the
+// buffer held messages that an endpoint did not read yet, the capacity of the
+// buffer is halved, but never below minCapacity. Messages read by all
+// endpoints that don't fit half of the smaller buffer are released, so they
+// are no longer replayed to new endpoints. The buffer is checked when
+// messages are sent and when Shrink is called. WithShrink should not be
+// combined with FastSend.
+func WithShrink(minCapacity int, after time.Duration) ChanOption {
+	return func(o *chanOptions) { o.shrinkMin, o.shrinkAfter = minCapacity, after }
+}
+
+// WithRetention sets the policy that determines how long messages are kept in
+// the buffer for replay to new endpoints, see RetentionPolicy.
+func WithRetention(policy RetentionPolicy) ChanOption {
+	return func(o *chanOptions) { o.retention = policy }
+}
+
+// WithWatermarks registers callbacks that are called when the number of
+// messages sent but not yet read by the slowest endpoint crosses the high and
+// low watermarks. The onHigh callback is called once the number of unread
+// messages reaches high, after which onLow is called once it has dropped to low
+// again, and so on. This allows producers to throttle themselves before Send
+// starts to block on a full buffer. The callbacks are called from the goroutine
+// sending or reading the message that crossed the watermark and should return
+// quickly.
+func WithWatermarks(low, high int, onHigh, onLow func()) ChanOption {
+	return func(o *chanOptions) {
+		o.lowWater, o.highWater = low, high
+		o.onHigh, o.onLow = onHigh, onLow
+	}
+}
+
+// WithRateLimit limits the rate at which messages can be sent to the channel
+// to rate messages per second, allowing bursts of up to burst messages. The
+// policy determines what happens when a message would exceed the limit. The
+// limit applies to Send, FastSend, SendSlice, SendTimeout and SendContext.
+// TrySend returns false when the limit would be exceeded.
+func WithRateLimit(rate float64, burst int, policy RatePolicy) ChanOption {
+	return func(o *chanOptions) { o.rate, o.burst, o.ratePolicy = rate, burst, policy }
+}
+
+// WithFairSend makes concurrent senders enter the channel in the order in
+// which they arrived. Without it, a sender that keeps sending can overtake
+// senders waiting for room in a nearly full buffer. With fair sending, every
+// sender waits for its turn, so it makes progress in roughly arrival order at
+// the cost of some throughput. This applies to Send, SendSlice, SendTimeout
+// and SendContext. TrySend returns false when other senders are waiting.
+func WithFairSend() ChanOption {
+	return func(o *chanOptions) { o.fair = true }
+}
+
+// WithLockstep turns the channel into a barrier. Send does not return until
+// every active endpoint has consumed the message sent, so every message is
+// processed by all endpoints before the next one is sent. This allows driving
+// e.g. simulation steps with strict round based progress. This applies to
+// Send, FastSend, SendSlice, SendTimeout and SendContext; the timeout of the
+// latter two does not apply to waiting for the endpoints. TrySend does not
+// wait, but returns false while the previous message was not consumed yet.
+func WithLockstep() ChanOption {
+	return func(o *chanOptions) { o.lockstep = true }
+}
+
+// WithLeakDetection enables reporting endpoints that appear to be leaked. An
+// endpoint that is no longer used, but was not canceled, keeps the oldest
+// message it did not read in the buffer, so it eventually blocks all senders.
+// With leak detection enabled, the stack trace of the goroutine creating an
+// endpoint is recorded. When a sender finds the buffer full because of an
+// endpoint that is not inside a call to Range and did not read any messages
+// for longer than idle, report is called once for that endpoint. The Origin of
+// the leak passed to report tells where the endpoint was created. The callback
+// is called from the goroutine of the sender and should return quickly.
+//
+// Recording stack traces makes creating endpoints considerably slower, so
+// leak detection is meant for debugging.
+func WithLeakDetection(idle time.Duration, report func(leak EndpointInfo)) ChanOption {
+	return func(o *chanOptions) { o.leakIdle, o.onLeak = idle, report }
+}
+
+// WithRefCount makes the channel close automatically when its last endpoint
+// is canceled or finishes, after which teardown is called when not nil. This
+// allows a producer to stop when nobody is listening anymore, e.g. by
+// selecting on Done. The channel is only closed after at least one endpoint
+// was created. Once closed, the channel stays closed, even when new endpoints
+// are created.
+func WithRefCount(teardown func()) ChanOption {
+	return func(o *chanOptions) { o.refCount, o.teardown = true, teardown }
+}
+
+// WithRoundRobin turns the channel into a work distribution queue. Instead of
+// multicasting every message to all endpoints, every message is assigned to
+// only one of the endpoints when it is sent, taking turns. The other endpoints
+// skip it. Only the endpoint a message was assigned to holds back senders when
+// the buffer is full, so endpoints don't have to wait for each other. When the
+// endpoint a message was assigned to is canceled before reading it, the
+// message is taken over by the next endpoint reaching it. A message sent while
+// there are no endpoints is delivered to the first endpoint reaching it.
+func WithRoundRobin() ChanOption {
+	return func(o *chanOptions) { o.roundRobin = true }
+}
+
+// WithHeaders makes the channel keep the headers passed to SendHeaders with
+// every message, so they can be observed via RangeMeta. Without this option
+// the headers are dropped, which saves the memory to hold them.
+func WithHeaders() ChanOption {
+	return func(o *chanOptions) { o.headers = true }
+}
+
+//jig:template NewChanOpts<Foo>
+//jig:needs NewChan<Foo>, ChanOption, Chan<Foo> startCommitter, Chan<Foo> startClock
+
+// NewChanOptsFoo creates a new channel configured by the given options.
+// Without any options a channel with a buffer capacity of 128 and an endpoint
+// capacity of 8 is created. Like NewChan it panics with ErrCapacity when a
+// capacity is out of range.
+func NewChanOptsFoo(options ...ChanOption) *ChanFoo {
+	o := chanOptions{bufferCapacity: 128, endpointCapacity: 8}
+	for _, option := range options {
+		option(&o)
+	}
+	size, err := bufferSizeFoo(o.bufferCapacity, o.exact)
+	if err != nil {
+		panic(err) // see NewChanChecked
+	}
+	entries, err := endpointTableFoo(o.endpointCapacity)
+	if err != nil {
+		panic(err)
+	}
+	c := newChanFoo(size, entries)
+	atomic.StoreUint32(&c.spinBudget, uint32(o.spinBudget))
+	if o.lossy || o.conflate {
+		c.lossy = 1
+	}
+	if o.conflate {
+		c.conflate = 1
+	}
+	if o.fair {
+		c.fair = 1
+	}
+	if o.lockstep {
+		c.lockstep = 1
+	}
+	if o.roundRobin {
+		c.roundRobin = 1
+	}
+	if o.headers {
+		c.headers = 1
+	}
+	if o.refCount {
+		c.refCount = 1
+		c.teardown = o.teardown
+	}
+	if o.growth {
+		c.growLimit = maxBufferSizeFoo() // don't grow beyond what can be allocated
+		if o.maxCapacity > 0 && uint64(o.maxCapacity) < c.growLimit {
+			c.growLimit = uint64(o.maxCapacity)
+		}
+	}
+	c.retention = o.retention
+	if o.shrinkAfter > 0 {
+		if o.shrinkMin < 1 {
+			o.shrinkMin = 1
+		}
+		c.shrinkMin, c.shrinkAfter = uint64(o.shrinkMin), int64(o.shrinkAfter)
+	}
+	if o.rate > 0 {
+		if o.burst < 1 {
+			o.burst = 1
+		}
+		c.rateInterval = int64(float64(time.Second) / o.rate)
+		c.rateTolerance = int64(o.burst) * c.rateInterval
+		c.ratePolicy = o.ratePolicy
+	}
+	if o.leakIdle > 0 && o.onLeak != nil {
+		c.leakIdle, c.onLeak = o.leakIdle, o.onLeak
+	}
+	if o.highWater > 0 {
+		c.lowWater, c.highWater = uint64(o.lowWater), uint64(o.highWater)
+		c.onHigh, c.onLow = o.onHigh, o.onLow
+	}
+	c.wait = o.wait
+	if o.untimed {
+		c.untimed = 1
+	}
+	if o.backoff {
+		c.closeAfter, c.blockAfter = o.closeAfter, o.blockAfter
+	}
+	if o.commitBatch > 1 {
+		if o.commitDelay < time.Millisecond {
+			o.commitDelay = time.Millisecond
+		}
+		c.commitBatch, c.commitDelay = uint64(o.commitBatch), int64(o.commitDelay)
+	}
+	if o.wakeups {
+		c.wakeups = 1
+	}
+	if o.clock != nil {
+		c.clock = o.clock
+		c.start = o.clock()
+	}
+	if o.resolution > 0 {
+		c.resolution = o.resolution
+		c.startClock()
+	}
+	if o.committer {
+		c.commits = make(chan struct{}, 1)
+		c.startCommitter()
+	}
+	return c
+}
+
+//jig:template OverflowPolicy
+
+// OverflowPolicy determines what happens when the buffer of a channel is full
+// and an endpoint has not read the oldest message in the buffer yet.
+type OverflowPolicy uint32
+
+const (
+	// OverflowBlock blocks senders until the endpoint has read another
+	// message. No messages are lost.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest lets senders overwrite the oldest message without
+	// waiting for the endpoint. The endpoint counts the messages it missed,
+	// see Dropped and WithGapHandler.
+	OverflowDropOldest
+
+	// OverflowError lets senders overwrite the oldest message without waiting
+	// for the endpoint. When this causes the endpoint to miss messages, it is
+	// closed with ErrOverflow.
+	OverflowError
+)
+
+//jig:template RatePolicy
+
+// RatePolicy determines what happens when a message sent to a channel would
+// exceed its rate limit, see WithRateLimit.
+type RatePolicy uint32
+
+const (
+	// RateBlock blocks the sender until the message can be sent without
+	// exceeding the rate limit.
+	RateBlock RatePolicy = iota
+
+	// RateReject rejects the message, Send then returns ErrRateLimited.
+	RateReject
+)
+
+//jig:template endpointOptions
+//jig:needs OverflowPolicy
+
+type endpointOptions struct {
+	keep            uint64
+	maxAge          time.Duration
+	name            string
+	gap             func(missed uint64)
+	overflow        OverflowPolicy
+	idleTimeout     time.Duration
+	sample          uint64
+	throttle        time.Duration
+	debounce        time.Duration
+	onPanic         func(recovered interface{})
+	group           string
+	acking          uint32
+	ackTimeout      time.Duration
+	ackRetries      uint32
+	manualCommit    uint32
+	cursorStore     CursorStore
+	checkpointEvery time.Duration
+	resume          uint64
+	resuming        bool
+}
+
+//jig:template EndpointOption
+//jig:needs endpointOptions
+
+// EndpointOption configures an endpoint created by NewEndpointOpts.
+type EndpointOption func(*endpointOptions)
+
+// WithKeep specifies how many entries of the existing channel buffer the
+// endpoint should keep, see NewEndpoint. The default is ReplayAll.
+func WithKeep(keep uint64) EndpointOption {
+	return func(o *endpointOptions) { o.keep = keep }
+}
+
+// WithMaxAge fixes the maxAge of the endpoint. Messages older than maxAge are
+// skipped, both when replaying the messages kept in the buffer and when
+// receiving new messages. A maxAge passed explicitly to Range takes
+// precedence.
+func WithMaxAge(maxAge time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.maxAge = maxAge }
+}
+
+// WithName gives the endpoint a human-readable name, e.g. for logging.
+func WithName(name string) EndpointOption {
+	return func(o *endpointOptions) { o.name = name }
+}
+
+// WithGapHandler sets a function that is called whenever messages were dropped
+// before the endpoint could read them, so its cursor jumped ahead. This
+// happens when the endpoint fell behind on a lossy or conflating channel (see
+// WithLossy and WithConflate) or with policy OverflowDropOldest, and when
+// messages were trimmed from the buffer (see ForceTrimBefore and
+// WithRetention). The number of missed messages is passed to the handler. The
+// handler is called from the goroutine using the endpoint, just before the
+// first message after the gap is read. Sequence numbers (see Seq) are stable
+// message IDs, so inside the handler Seq returns the ID of the first message
+// after the gap and the IDs missed are Seq()-missed up to Seq().
+func WithGapHandler(gap func(missed uint64)) EndpointOption {
+	return func(o *endpointOptions) { o.gap = gap }
+}
+
+// WithOverflow sets the policy that determines what happens when the buffer
+// of the channel is full and the endpoint is lagging behind. The default is
+// OverflowBlock.
+func WithOverflow(policy OverflowPolicy) EndpointOption {
+	return func(o *endpointOptions) { o.overflow = policy }
+}
+
+// WithIdleTimeout makes the channel cancel the endpoint automatically when it
+// is not inside a call to Range and did not read any messages for longer than
+// timeout. This releases the slot of an endpoint abandoned by a crashed
+// consumer, so it no longer blocks senders forever. The endpoint is only
+// checked when a sender finds the buffer full. A canceled endpoint behaves as
+// if Cancel was called on it.
+func WithIdleTimeout(timeout time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.idleTimeout = timeout }
+}
+
+// WithSample makes the endpoint deliver only every nth message, skipping the
+// others without calling foreach. Messages are sampled by sequence number (see
+// Seq), so only messages with a sequence number that is a multiple of n are
+// delivered. This allows e.g. a dashboard to follow a high frequency stream
+// at a fraction of the cost. An n of 0 or 1 delivers every message.
+func WithSample(n uint64) EndpointOption {
+	return func(o *endpointOptions) { o.sample = n }
+}
+
+// WithThrottle makes the endpoint deliver at most one message per interval.
+// When the interval has passed since the previous message was delivered, the
+// most recent message is delivered and the messages sent in between are
+// skipped, so the latest message wins. This suits e.g. user interfaces that
+// can't keep up with every update. Markers in between are skipped as well.
+func WithThrottle(interval time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.throttle = interval }
+}
+
+// WithDebounce makes the endpoint deliver a message only after no messages
+// were sent to the channel for the quiet duration. Of every burst of messages
+// only the most recent one is delivered, the others are skipped. This allows
+// e.g. coalescing a burst of configuration changes into a single expensive
+// reload. Markers in between are skipped as well.
+func WithDebounce(quiet time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.debounce = quiet }
+}
+
+// WithPanicHandler makes the endpoint recover from a panic raised by the
+// foreach function passed to Range, or by the functions passed to Filter and
+// Map. The endpoint is then canceled, so its slot can be reused and it no
+// longer blocks senders, and the recovered value is passed to handler. The
+// call to Range then returns normally. The handler is called from the
+// goroutine reading the endpoint.
+func WithPanicHandler(handler func(recovered interface{})) EndpointOption {
+	return func(o *endpointOptions) { o.onPanic = handler }
+}
+
+// WithGroup makes the endpoint join the consumer group with the given name.
+// Every message is delivered to only one of the members of a group, the first
+// member to reach it, while the other members skip it. This turns the members
+// of a group into competing consumers. A member that doesn't deliver a message,
+// e.g. because of its filter (see Filter), leaves it to the other members. A member joining the group starts
+// after the last message delivered to the group, the keep option only applies
+// to the first member. Members can join and leave at any time, the remaining
+// members simply take over their share of the messages.
+func WithGroup(name string) EndpointOption {
+	return func(o *endpointOptions) { o.group = name }
+}
+
+// WithAck turns on acknowledged delivery for the endpoint. The endpoint then
+// delivers one message at a time and only advances past it once the consumer
+// called Ack. When the consumer calls Nack instead, or does not acknowledge
+// the message within timeout, the message is delivered again, up to retries
+// times. After that the message is skipped, or routed to the dead-letter
+// channel of the endpoint (see DeadLetter). A timeout of 0 waits for Ack or
+// Nack indefinitely. Together this gives at-least-once delivery. Note that a
+// message awaiting acknowledgement holds back senders when the buffer is
+// full, like any unread message. ReadBatch reads a single message at a time
+// in this mode.
+func WithAck(timeout time.Duration, retries int) EndpointOption {
+	return func(o *endpointOptions) { o.acking, o.ackTimeout, o.ackRetries = 1, timeout, uint32(retries) }
+}
+
+// WithManualCommit decouples reading from committing progress. The channel
+// then retains every message the endpoint read but did not yet mark as
+// processed by calling Commit, so after a failure the consumer can Seek back
+// to the sequence number returned by Committed and have the uncommitted
+// messages delivered again. Note that uncommitted messages hold back senders
+// when the buffer is full, like any unread message.
+func WithManualCommit() EndpointOption {
+	return func(o *endpointOptions) { o.manualCommit = 1 }
+}
+
+// WithCursorStore makes the endpoint resume from the position saved in store
+// under the name of the endpoint (see WithName), and save its position there
+// after reading, at most once every interval. A restarted process can then
+// continue where it left off, instead of replaying everything or losing its
+// place. The saved position is only used when it is within the messages
+// retained in the buffer, otherwise the endpoint starts as configured by
+// WithKeep. For an endpoint created with WithManualCommit, the committed
+// position (see Commit) is saved instead of the read position. An endpoint
+// without a name does not use the store.
+func WithCursorStore(store CursorStore, interval time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.cursorStore, o.checkpointEvery = store, interval }
+}
+
+//jig:template Chan<Foo> NewEndpointOpts
+//jig:needs endpoints<Foo>, EndpointOption
+
+// NewEndpointOpts will create a new channel endpoint configured by the given
+// options. Without any options it behaves like NewEndpoint(ReplayAll). When
+// the position of the endpoint can't be loaded from its cursor store (see
+// WithCursorStore), the error of the store is returned.
+func (c *ChanFoo) NewEndpointOpts(options ...EndpointOption) (*EndpointFoo, error) {
+	o := endpointOptions{keep: ReplayAll}
+	for _, option := range options {
+		option(&o)
+	}
+	if o.cursorStore != nil && o.name != "" {
+		var err error
+		if o.resume, o.resuming, err = o.cursorStore.Load(o.name); err != nil {
+			return nil, err
+		}
+	}
+	return c.endpoints.NewForChanFoo(c, o)
+}
@@ -0,0 +1,91 @@
+package multicast
+
+import "hash/fnv"
+
+//jig:template PartitionedChan<Foo>
+//jig:needs NewChanOpts<Foo>, Chan<Foo> Send, Chan<Foo> TrySend, Chan<Foo> Close, Chan<Foo> NewEndpoint, Endpoint<Foo> Cancel
+
+// PartitionedChanFoo spreads the messages sent to it over a number of
+// partitions, each of which is a separate channel. The partition of a message
+// is determined by hashing its key, so all messages with the same key end up
+// in the same partition in the order they were sent. Messages with different
+// keys can then be consumed in parallel by endpoints on different partitions.
+type PartitionedChanFoo struct {
+	partitions []*ChanFoo
+	key        func(value foo) string
+}
+
+// Partitions returns the number of partitions of the channel.
+func (p *PartitionedChanFoo) Partitions() int {
+	return len(p.partitions)
+}
+
+// Partition returns the channel of partition i.
+func (p *PartitionedChanFoo) Partition(i int) *ChanFoo {
+	return p.partitions[i]
+}
+
+// PartitionOf returns the index of the partition a message with the given
+// key is sent to.
+func (p *PartitionedChanFoo) PartitionOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.partitions)))
+}
+
+// Send sends a value to the partition determined by its key, see
+// ChanFoo.Send for details.
+func (p *PartitionedChanFoo) Send(value foo) error {
+	return p.partitions[p.PartitionOf(p.key(value))].Send(value)
+}
+
+// TrySend sends a value to the partition determined by its key only when
+// this can be done without blocking, see ChanFoo.TrySend for details.
+func (p *PartitionedChanFoo) TrySend(value foo) bool {
+	return p.partitions[p.PartitionOf(p.key(value))].TrySend(value)
+}
+
+// Close closes all partitions, see ChanFoo.Close for details.
+func (p *PartitionedChanFoo) Close(err error) {
+	for _, c := range p.partitions {
+		c.Close(err)
+	}
+}
+
+// NewEndpoints creates an endpoint on every partition, see
+// ChanFoo.NewEndpoint for details. The endpoint at index i of the returned
+// slice receives the messages of partition i. When an endpoint can't be
+// created on one of the partitions, the endpoints created so far are canceled
+// and the error is returned.
+func (p *PartitionedChanFoo) NewEndpoints(keep uint64) ([]*EndpointFoo, error) {
+	list := make([]*EndpointFoo, 0, len(p.partitions))
+	for _, c := range p.partitions {
+		e, err := c.NewEndpoint(keep)
+		if err != nil {
+			for _, e := range list {
+				e.Cancel()
+			}
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+//jig:template NewPartitionedChan<Foo>
+//jig:needs PartitionedChan<Foo>
+
+// NewPartitionedChanFoo creates a channel with the given number of partitions
+// (at least 1). The key function returns the key of a message that determines
+// its partition. Every partition is created by NewChanOpts with the given
+// options.
+func NewPartitionedChanFoo(partitions int, key func(value foo) string, options ...ChanOption) *PartitionedChanFoo {
+	if partitions < 1 {
+		partitions = 1
+	}
+	p := &PartitionedChanFoo{key: key}
+	for i := 0; i < partitions; i++ {
+		p.partitions = append(p.partitions, NewChanOptsFoo(options...))
+	}
+	return p
+}
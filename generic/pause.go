@@ -0,0 +1,159 @@
+package multicast
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> Pause
+//jig:needs Chan<Foo>
+
+// Pause makes Send, FastSend, SendSlice and Mark block until Resume is called,
+// without closing the channel. TrySend returns false while the channel is
+// paused, SendTimeout and SendContext give up when they expire. Endpoints keep
+// receiving the messages already sent. Closing a paused channel releases the
+// blocked senders. This allows quiescing producers, e.g. while consumers are
+// moved to another channel during a failover.
+func (c *ChanFoo) Pause() {
+	if atomic.CompareAndSwapUint32(&c.paused, running, pausing) {
+		c.resumed.Store(make(chan struct{}))
+		atomic.StoreUint32(&c.paused, paused)
+	}
+}
+
+//jig:template Chan<Foo> Resume
+//jig:needs Chan<Foo>
+
+// Resume releases the senders blocked by Pause.
+func (c *ChanFoo) Resume() {
+	for !atomic.CompareAndSwapUint32(&c.paused, paused, running) {
+		if atomic.LoadUint32(&c.paused) == running {
+			return
+		}
+		runtime.Gosched() // Pause is storing a new resumed channel
+	}
+	close(c.resumed.Load().(chan struct{}))
+}
+
+//jig:template Chan<Foo> Paused
+
+// Paused returns true when the channel was paused using the Pause method.
+func (c *ChanFoo) Paused() bool {
+	return atomic.LoadUint32(&c.paused) != running
+}
+
+//jig:template Chan<Foo> awaitResume
+//jig:needs Chan<Foo>
+
+// awaitResume blocks while the channel is paused and not closed.
+func (c *ChanFoo) awaitResume() {
+	for {
+		switch atomic.LoadUint32(&c.paused) {
+		case running:
+			return
+		case pausing:
+			runtime.Gosched()
+		case paused:
+			select {
+			case <-c.resumed.Load().(chan struct{}):
+			case <-c.signal().done:
+				return
+			}
+		}
+	}
+}
+
+//jig:template Chan<Foo> awaitResumeUntil
+//jig:needs Chan<Foo>, ErrTimeout
+
+// awaitResumeUntil blocks like awaitResume, but gives up when cancel is closed
+// and returns the error of expired, or returns ErrTimeout when the deadline
+// passes. A zero deadline never passes.
+func (c *ChanFoo) awaitResumeUntil(cancel <-chan struct{}, deadline time.Time, expired func() error) error {
+	var timeout <-chan time.Time
+	for {
+		switch atomic.LoadUint32(&c.paused) {
+		case running:
+			return nil
+		case pausing:
+			runtime.Gosched()
+		case paused:
+			if timeout == nil && !deadline.IsZero() {
+				timer := time.NewTimer(time.Until(deadline))
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			select {
+			case <-c.resumed.Load().(chan struct{}):
+			case <-c.signal().done:
+				return nil
+			case <-cancel:
+				return expired()
+			case <-timeout:
+				return ErrTimeout
+			}
+		}
+	}
+}
+
+//jig:template Endpoint<Foo> Pause
+//jig:needs Endpoint<Foo>
+
+// Pause temporarily stops the endpoint from receiving messages, without
+// abandoning its cursor like Cancel does. Range, Next and ReadBatch block
+// before delivering the next message until Resume is called. Messages sent in
+// the mean time are retained in the buffer, so a paused endpoint holds back
+// senders like any other endpoint that is lagging behind. Pause can be called
+// from any goroutine.
+//
+// Note that Pause, Resume and Paused of the endpoint hide those of the channel
+// the endpoint was created on. To pause the senders of the channel, call Pause
+// on the channel itself.
+func (e *EndpointFoo) Pause() {
+	atomic.StoreUint32(&e.endpointPaused, 1)
+}
+
+//jig:template Endpoint<Foo> Resume
+//jig:needs Endpoint<Foo>, Endpoint<Foo> wakeUp
+
+// Resume lets the endpoint continue receiving messages from where it was
+// paused.
+func (e *EndpointFoo) Resume() {
+	atomic.StoreUint32(&e.endpointPaused, 0)
+	e.wakeUp()
+}
+
+//jig:template Endpoint<Foo> Paused
+//jig:needs Endpoint<Foo>
+
+// Paused returns true when the endpoint was paused using its Pause method.
+func (e *EndpointFoo) Paused() bool {
+	return atomic.LoadUint32(&e.endpointPaused) == 1
+}
+
+//jig:template Endpoint<Foo> hold
+//jig:needs Endpoint<Foo>, Endpoint<Foo> block
+
+// hold blocks while the endpoint is paused, until Resume wakes it up.
+// It returns false when the endpoint was canceled or when control asks to
+// abort or suspend ranging.
+func (e *EndpointFoo) hold(control *uint32) bool {
+	for atomic.LoadUint32(&e.endpointPaused) == 1 {
+		if control != nil && atomic.LoadUint32(control) == abort {
+			atomic.StoreUint64(&e.endpointState, canceled)
+		}
+		if atomic.LoadUint64(&e.endpointState) == canceled {
+			return false
+		}
+		if control != nil && atomic.LoadUint32(control) == suspend {
+			return false
+		}
+		e.blockWhile(func() bool {
+			return atomic.LoadUint32(&e.endpointPaused) == 1 &&
+				atomic.LoadUint64(&e.endpointState) != canceled &&
+				(control == nil || atomic.LoadUint32(control) == proceed)
+		})
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package multicast
+
+import "sync"
+
+//jig:template BytePool
+
+// BytePool is a pool of byte buffers of a fixed size backed by a sync.Pool.
+// It allows a channel of byte slices to copy the payload of every message
+// into a pooled buffer and to return the buffer once all endpoints have read
+// the message, so the buffers are reused instead of left to the garbage
+// collector, see Recycle.
+type BytePool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBytePool creates a pool of buffers with a capacity of size bytes.
+func NewBytePool(size int) *BytePool {
+	p := &BytePool{size: size}
+	p.pool.New = func() interface{} { return make([]byte, size) }
+	return p
+}
+
+// Copy returns a copy of data in a buffer taken from the pool. Data that
+// doesn't fit a buffer of the pool is copied into a newly allocated slice
+// instead, which Put will not keep.
+func (p *BytePool) Copy(data []byte) []byte {
+	if len(data) > p.size {
+		return append([]byte(nil), data...)
+	}
+	buf := p.pool.Get().([]byte)[:len(data)]
+	copy(buf, data)
+	return buf
+}
+
+// Put returns a buffer obtained from Copy to the pool. Slices that were not
+// allocated by the pool are ignored.
+func (p *BytePool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	p.pool.Put(buf[:p.size])
+}
+
+//jig:template Chan<Foo> Recycle
+//jig:needs Chan<Foo>
+
+// Recycle makes the channel pass every value through clone before storing it
+// in the buffer and call recycle with the stored value once no endpoint can
+// read it anymore. Together with a BytePool, this allows a channel of byte
+// slices to copy payloads into pooled buffers and return them to the pool:
+//
+//	pool := NewBytePool(64 << 10)
+//	channel.Recycle(pool.Copy, pool.Put)
+//
+// A value is recycled when the buffer slides past it after all endpoints
+// read it, when it is discarded by a retention policy or TrimBefore and when
+// it is replaced by a conflating Send. Values that a lossy endpoint (see
+// WithLossy and WithOverflow) or ForceTrimBefore may still be reading are not
+// recycled, nor are the values left in the buffer of a closed channel.
+//
+// A receiver may use a value until its foreach function returns. The values
+// returned by Next or ReadBatch may be used until the next call to Next,
+// ReadBatch or Range on the same endpoint. Until then, the channel holds them
+// back from recycling, which also keeps senders from reusing their slots. A
+// receiver that holds on to a value after that must copy it. Values stored
+// using Claim and Publish are not cloned.
+//
+// Either function may be nil. Recycle must be called before any message is
+// sent to the channel.
+func (c *ChanFoo) Recycle(clone func(value foo) foo, recycle func(value foo)) {
+	c.clone = clone
+	c.recycle = recycle
+}
+
+//jig:template Chan<Foo> cloned
+//jig:needs Chan<Foo>
+
+// cloned returns value as it should be stored in the buffer, see Recycle.
+func (c *ChanFoo) cloned(value foo) foo {
+	if c.clone == nil {
+		return value
+	}
+	return c.clone(value)
+}
@@ -0,0 +1,231 @@
+package multicast
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+//jig:template PriorityChan<Foo>
+//jig:needs NewChanOpts<Foo>, Chan<Foo> Send, Chan<Foo> TrySend, Chan<Foo> Close, Chan<Foo> NewEndpoint, PriorityEndpoint<Foo>
+
+// PriorityChanFoo delivers messages sent with a higher priority before
+// messages sent with a lower priority that are still waiting to be read. Every
+// priority has its own lane, which is a separate channel, and the endpoints
+// of the channel merge the lanes at read time. This allows e.g. control
+// messages to overtake bulk data. Priority 0 is the highest priority. The
+// order of messages sent with the same priority is preserved.
+type PriorityChanFoo struct {
+	lanes []*ChanFoo
+}
+
+// Lanes returns the number of priorities of the channel.
+func (p *PriorityChanFoo) Lanes() int {
+	return len(p.lanes)
+}
+
+// Lane returns the channel of the given priority.
+func (p *PriorityChanFoo) Lane(priority int) *ChanFoo {
+	return p.lanes[p.lane(priority)]
+}
+
+// lane returns the index of the lane for priority, clamping the priority to
+// the lanes available.
+func (p *PriorityChanFoo) lane(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority >= len(p.lanes) {
+		return len(p.lanes) - 1
+	}
+	return priority
+}
+
+// Send sends a value with the given priority, see ChanFoo.Send for details.
+// A priority beyond the lowest priority of the channel is sent with the lowest
+// priority.
+func (p *PriorityChanFoo) Send(value foo, priority int) error {
+	return p.lanes[p.lane(priority)].Send(value)
+}
+
+// TrySend sends a value with the given priority only when this can be done
+// without blocking, see ChanFoo.TrySend for details.
+func (p *PriorityChanFoo) TrySend(value foo, priority int) bool {
+	return p.lanes[p.lane(priority)].TrySend(value)
+}
+
+// Close closes all lanes, see ChanFoo.Close for details.
+func (p *PriorityChanFoo) Close(err error) {
+	for _, c := range p.lanes {
+		c.Close(err)
+	}
+}
+
+// NewEndpoint creates an endpoint that receives the messages of all lanes,
+// see ChanFoo.NewEndpoint for details. When an endpoint can't be created on
+// one of the lanes, the endpoints created so far are canceled and the error
+// is returned.
+func (p *PriorityChanFoo) NewEndpoint(keep uint64) (*PriorityEndpointFoo, error) {
+	e := &PriorityEndpointFoo{}
+	for _, c := range p.lanes {
+		ep, err := c.NewEndpoint(keep)
+		if err != nil {
+			e.Cancel()
+			return nil, err
+		}
+		e.lanes = append(e.lanes, ep)
+	}
+	return e, nil
+}
+
+//jig:template NewPriorityChan<Foo>
+//jig:needs PriorityChan<Foo>
+
+// NewPriorityChanFoo creates a channel with the given number of priorities
+// (at least 1). Every lane is created by NewChanOpts with the given options.
+func NewPriorityChanFoo(lanes int, options ...ChanOption) *PriorityChanFoo {
+	if lanes < 1 {
+		lanes = 1
+	}
+	p := &PriorityChanFoo{}
+	for i := 0; i < lanes; i++ {
+		p.lanes = append(p.lanes, NewChanOptsFoo(options...))
+	}
+	return p
+}
+
+//jig:template PriorityEndpoint<Foo>
+//jig:needs Endpoint<Foo>, Endpoint<Foo> poll, Endpoint<Foo> exhausted, Endpoint<Foo> Cancel, Endpoint<Foo> park, Endpoint<Foo> closeErr, Endpoint<Foo> block, backoff
+
+// PriorityEndpointFoo is returned by a call to NewEndpoint on a priority
+// channel. It reads from the lane with the highest priority that has a
+// message available. Like any endpoint, it should be used by only a single
+// goroutine.
+type PriorityEndpointFoo struct {
+	lanes    []*EndpointFoo
+	canceled uint32
+	wakeups  []reflect.SelectCase // see block
+}
+
+// Next will block until the next message is available on any of the lanes and
+// return the one with the highest priority with ok set to true.
+//
+// When all lanes are closed, eventually when their buffers are exhausted Next
+// will return with closed set to true. When the endpoint is canceled, Next
+// will return with both ok and closed set to false.
+func (p *PriorityEndpointFoo) Next() (value foo, ok bool, closed bool) {
+	lastActive := time.Now()
+	var spins uint32
+	for atomic.LoadUint32(&p.canceled) == 0 {
+		open := 0
+		for _, e := range p.lanes {
+			if value, ok = e.poll(); ok {
+				return value, true, false
+			}
+			if !e.exhausted() {
+				open++
+			}
+		}
+		if open == 0 {
+			for _, e := range p.lanes {
+				e.park()
+			}
+			return value, false, true
+		}
+		if time.Since(lastActive) < time.Millisecond {
+			backoff(&spins, atomic.LoadUint32(&p.lanes[0].spinBudget))
+		} else {
+			p.block(open)
+		}
+	}
+	return value, false, false
+}
+
+// block blocks until a message is available on one of the lanes, or a lane
+// wakes up its endpoint because its state changed, see Next. Like blockWhile
+// does for a single endpoint, block registers as a sleeper on every lane and
+// takes the channels to block on before checking the lanes one last time, so
+// a wakeup can't be missed. It doesn't block when the number of open lanes
+// differs from open.
+func (p *PriorityEndpointFoo) block(open int) {
+	p.wakeups = p.wakeups[:0]
+	for _, e := range p.lanes {
+		atomic.AddInt32(&e.sleepers, 1)
+		wakeup := e.wakeup
+		if wakeup != nil {
+			atomic.StoreUint32(&e.sleeping, 1)
+		} else {
+			wakeup = *(*chan struct{})(atomic.LoadPointer(&e.receivers))
+		}
+		p.wakeups = append(p.wakeups, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wakeup)})
+	}
+	blocked := atomic.LoadUint32(&p.canceled) == 0
+	for _, e := range p.lanes {
+		if atomic.LoadUint64(&e.cursor) < e.commitData() {
+			blocked = false // a message to read
+		} else if !e.exhausted() {
+			open--
+		}
+	}
+	if blocked && open == 0 {
+		reflect.Select(p.wakeups) // none of the lanes was exhausted since
+	}
+	for _, e := range p.lanes {
+		atomic.StoreUint32(&e.sleeping, 0)
+		atomic.AddInt32(&e.sleepers, -1)
+	}
+}
+
+// Range will call the passed in foreach function with the messages of all
+// lanes, the one with the highest priority available first. When the channel
+// is closed, foreach is called once with closed set to true and err set to
+// the error the channel was closed with. When foreach returns false, the
+// endpoint is canceled.
+func (p *PriorityEndpointFoo) Range(foreach func(value foo, err error, closed bool) bool) {
+	for {
+		value, ok, closed := p.Next()
+		switch {
+		case ok:
+			if !foreach(value, nil, false) {
+				p.Cancel()
+				return
+			}
+		case closed:
+			foreach(value, p.lanes[0].closeErr(), true)
+			return
+		default:
+			return // canceled
+		}
+	}
+}
+
+// Cancel cancels the endpoint on every lane, see EndpointFoo.Cancel.
+func (p *PriorityEndpointFoo) Cancel() {
+	atomic.StoreUint32(&p.canceled, 1)
+	for _, e := range p.lanes {
+		e.Cancel()
+	}
+}
+
+//jig:template Endpoint<Foo> poll
+//jig:needs Endpoint<Foo> next, Chan<Foo> commitData
+
+// poll returns the next message when one is available without waiting.
+func (e *EndpointFoo) poll() (value foo, ok bool) {
+	if atomic.LoadUint64(&e.cursor) >= e.commitData() {
+		return value, false
+	}
+	control := suspend
+	value, ok, _ = e.next(&control)
+	return value, ok
+}
+
+//jig:template Endpoint<Foo> exhausted
+//jig:needs Endpoint<Foo>, Chan<Foo> commitData
+
+// exhausted returns true when the endpoint has finished, or its channel was
+// closed or the endpoint canceled and it has read all messages.
+func (e *EndpointFoo) exhausted() bool {
+	cursor := atomic.LoadUint64(&e.cursor)
+	return cursor == parked || atomic.LoadUint64(&e.endpointState) != active && cursor >= e.commitData()
+}
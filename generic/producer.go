@@ -0,0 +1,59 @@
+package multicast
+
+//jig:template Producer<Foo>
+//jig:needs Chan<Foo>, Chan<Foo> SendSlice
+
+// ProducerFoo batches the messages sent by a single goroutine, so many
+// producers can send to the same channel without contending for every
+// message. Messages are collected locally and sent to the channel in one go
+// using SendSlice once the batch is full, which reserves all their slots in
+// the buffer with a single atomic operation and notifies the receivers once.
+//
+// Messages are not visible to the endpoints until their batch was flushed.
+// So a producer that may go quiet should call Flush after a burst of messages,
+// to bound their latency. The order of the messages of a producer is
+// preserved, but batches of different producers are not interleaved message
+// by message. A producer should be used by only a single goroutine.
+type ProducerFoo struct {
+	c     *ChanFoo
+	batch []foo
+}
+
+// Send adds a value to the batch of the producer and flushes the batch when
+// it is full. When flushing fails, the error of Flush is returned.
+func (p *ProducerFoo) Send(value foo) error {
+	p.batch = append(p.batch, value)
+	if len(p.batch) < cap(p.batch) {
+		return nil
+	}
+	return p.Flush()
+}
+
+// Flush sends the messages in the batch of the producer to the channel, see
+// ChanFoo.SendSlice for details. The batch is emptied even when the channel
+// rejects the messages, e.g. because it was sealed.
+func (p *ProducerFoo) Flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := p.c.SendSlice(p.batch)
+	var zero foo
+	for i := range p.batch {
+		p.batch[i] = zero // don't hold on to the values
+	}
+	p.batch = p.batch[:0]
+	return err
+}
+
+//jig:template Chan<Foo> Producer
+//jig:needs Producer<Foo>
+
+// Producer returns a producer that sends to the channel in batches of the
+// given size (at least 1), see ProducerFoo. Every sending goroutine should
+// use its own producer.
+func (c *ChanFoo) Producer(size int) *ProducerFoo {
+	if size < 1 {
+		size = 1
+	}
+	return &ProducerFoo{c: c, batch: make([]foo, 0, size)}
+}
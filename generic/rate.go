@@ -0,0 +1,55 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> throttle
+//jig:needs Chan<Foo> reserve, ErrRateLimited
+
+// throttle enforces the rate limit of the channel (see WithRateLimit) for
+// sending count messages. It blocks or returns ErrRateLimited depending on the
+// rate policy.
+func (c *ChanFoo) throttle(count uint64) error {
+	if c.rateInterval == 0 {
+		return nil
+	}
+	for wait := c.reserve(count); wait != 0; wait = c.reserve(count) {
+		if c.ratePolicy == RateReject {
+			return ErrRateLimited
+		}
+		time.Sleep(time.Duration(wait))
+	}
+	return nil
+}
+
+//jig:template Chan<Foo> reserve
+//jig:needs Chan<Foo> elapsed
+
+// reserve implements the rate limit as a token bucket, using the generic cell
+// rate algorithm. The theoretical arrival time of the next message is kept in
+// rateArrival, so a reservation is a single compare and swap. It returns 0 when
+// count messages can be sent now, otherwise the nanoseconds to wait before
+// trying again.
+func (c *ChanFoo) reserve(count uint64) int64 {
+	cost := int64(count) * c.rateInterval
+	tolerance := c.rateTolerance
+	if cost > tolerance {
+		tolerance = cost // allow a burst larger than the bucket when it is full
+	}
+	for {
+		now := c.elapsed()
+		loaded := atomic.LoadInt64(&c.rateArrival)
+		arrival := loaded
+		if arrival < now {
+			arrival = now
+		}
+		if wait := arrival + cost - now - tolerance; wait > 0 {
+			return wait
+		}
+		if atomic.CompareAndSwapInt64(&c.rateArrival, loaded, arrival+cost) {
+			return 0
+		}
+	}
+}
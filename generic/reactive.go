@@ -0,0 +1,218 @@
+package multicast
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+//jig:template Subscription
+
+// Subscription is the link between a publisher and a subscriber in the style
+// of Reactive Streams. The subscriber uses it to signal demand for messages
+// and to cancel the subscription.
+type Subscription interface {
+	// Request signals demand for n more messages. A request of
+	// math.MaxInt64 or more in total is treated as unbounded. Requesting
+	// a number that is not positive fails the subscription with
+	// ErrInvalidRequest.
+	Request(n int64)
+
+	// Cancel stops the delivery of messages to the subscriber.
+	Cancel()
+}
+
+//jig:template Subscriber<Foo>
+//jig:needs Subscription
+
+// SubscriberFoo receives messages from a publisher in the style of Reactive
+// Streams. OnSubscribe is called first, followed by at most as many calls to
+// OnNext as were requested via the subscription, terminated by either
+// OnError or OnComplete.
+type SubscriberFoo interface {
+	OnSubscribe(subscription Subscription)
+	OnNext(value foo)
+	OnError(err error)
+	OnComplete()
+}
+
+//jig:template Publisher<Foo>
+//jig:needs Subscriber<Foo>
+
+// PublisherFoo publishes messages to subscribers in the style of Reactive
+// Streams.
+type PublisherFoo interface {
+	Subscribe(subscriber SubscriberFoo)
+}
+
+//jig:template Chan<Foo> Publisher
+//jig:needs publisher<Foo>
+
+// Publisher returns the channel as a Reactive Streams style publisher. Every
+// subscriber gets its own endpoint on the channel, created with the given
+// keep argument (see NewEndpoint). Messages are delivered to the subscriber
+// from a goroutine started by Subscribe, but only as many as the subscriber
+// requested. Closing the channel completes the subscriber, or fails it when
+// the channel was closed with an error. When no endpoint can be created, the
+// subscriber fails with ErrOutOfEndpoints.
+func (c *ChanFoo) Publisher(keep uint64) PublisherFoo {
+	return publisherFoo{c, keep}
+}
+
+//jig:template publisher<Foo>
+//jig:needs Publisher<Foo>, subscription<Foo>, Chan<Foo> NewEndpoint
+
+type publisherFoo struct {
+	channel *ChanFoo
+	keep    uint64
+}
+
+func (p publisherFoo) Subscribe(subscriber SubscriberFoo) {
+	endpoint, err := p.channel.NewEndpoint(p.keep)
+	if err != nil {
+		subscriber.OnSubscribe(&subscriptionFoo{canceled: 1})
+		subscriber.OnError(err)
+		return
+	}
+	s := &subscriptionFoo{endpoint: endpoint, demand: make(chan struct{}, 1)}
+	subscriber.OnSubscribe(s)
+	go s.deliver(subscriber)
+}
+
+//jig:template subscription<Foo>
+//jig:needs Subscriber<Foo>, Endpoint<Foo> Next, Endpoint<Foo> Cancel, Endpoint<Foo> closeErr, ErrInvalidRequest, Endpoint<Foo> wakeUp
+
+type subscriptionFoo struct {
+	endpoint  *EndpointFoo
+	requested int64
+	invalid   uint32
+	canceled  uint32
+	demand    chan struct{} // signaled by Request and Cancel
+}
+
+func (s *subscriptionFoo) Request(n int64) {
+	if atomic.LoadUint32(&s.canceled) == 1 {
+		return
+	}
+	if n <= 0 {
+		atomic.StoreUint32(&s.invalid, 1)
+		s.stop()
+		return
+	}
+	for {
+		requested := atomic.LoadInt64(&s.requested)
+		total := requested + n
+		if total < requested {
+			total = math.MaxInt64 // unbounded
+		}
+		if atomic.CompareAndSwapInt64(&s.requested, requested, total) {
+			break
+		}
+	}
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriptionFoo) Cancel() {
+	if atomic.CompareAndSwapUint32(&s.canceled, 0, 1) {
+		s.stop()
+	}
+}
+
+// stop cancels the endpoint and wakes up the goroutine delivering messages.
+func (s *subscriptionFoo) stop() {
+	if s.endpoint == nil {
+		return
+	}
+	s.endpoint.Cancel()
+	s.endpoint.wakeUp()
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriptionFoo) deliver(subscriber SubscriberFoo) {
+	for {
+		for atomic.LoadInt64(&s.requested) == 0 && atomic.LoadUint32(&s.invalid) == 0 && atomic.LoadUint32(&s.canceled) == 0 {
+			<-s.demand
+		}
+		value, ok, closed := s.endpoint.Next()
+		switch {
+		case atomic.LoadUint32(&s.invalid) == 1:
+			s.endpoint.Cancel()
+			subscriber.OnError(ErrInvalidRequest)
+			return
+		case closed:
+			if err := s.endpoint.closeErr(); err != nil {
+				subscriber.OnError(err)
+			} else {
+				subscriber.OnComplete()
+			}
+			return
+		case !ok:
+			return // canceled
+		}
+		if atomic.LoadInt64(&s.requested) != math.MaxInt64 {
+			atomic.AddInt64(&s.requested, -1)
+		}
+		subscriber.OnNext(value)
+	}
+}
+
+//jig:template Chan<Foo> Subscriber
+//jig:needs chanSubscriber<Foo>
+
+// Subscriber returns a Reactive Streams style subscriber that sends the
+// messages it receives to the channel. This allows subscribing the channel to
+// a publisher. The subscriber keeps up to prefetch messages requested from the
+// publisher. Because OnNext blocks while the buffer of the channel is full, it
+// exerts backpressure on the publisher. When the publisher completes or fails,
+// the channel is closed with the corresponding error. When the channel was
+// sealed, the subscription is canceled.
+func (c *ChanFoo) Subscriber(prefetch int64) SubscriberFoo {
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	return &chanSubscriberFoo{channel: c, prefetch: prefetch}
+}
+
+//jig:template chanSubscriber<Foo>
+//jig:needs Subscriber<Foo>, Chan<Foo> Send, Chan<Foo> Close
+
+type chanSubscriberFoo struct {
+	channel      *ChanFoo
+	prefetch     int64
+	received     int64
+	subscription Subscription
+}
+
+func (s *chanSubscriberFoo) OnSubscribe(subscription Subscription) {
+	if s.subscription != nil {
+		subscription.Cancel() // already subscribed
+		return
+	}
+	s.subscription = subscription
+	subscription.Request(s.prefetch)
+}
+
+func (s *chanSubscriberFoo) OnNext(value foo) {
+	if s.channel.Send(value) != nil {
+		s.subscription.Cancel()
+		return
+	}
+	s.received++
+	if s.received >= (s.prefetch+1)/2 {
+		s.subscription.Request(s.received)
+		s.received = 0
+	}
+}
+
+func (s *chanSubscriberFoo) OnError(err error) {
+	s.channel.Close(err)
+}
+
+func (s *chanSubscriberFoo) OnComplete() {
+	s.channel.Close(nil)
+}
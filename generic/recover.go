@@ -0,0 +1,18 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Endpoint<Foo> recoverPanic
+//jig:needs Endpoint<Foo>, Endpoint<Foo> park, Endpoint<Foo> wakeUp
+
+// recoverPanic is deferred by Range when the endpoint has a panic handler, see
+// WithPanicHandler. It recovers from a panic, cancels and parks the endpoint
+// and passes the recovered value to the panic handler.
+func (e *EndpointFoo) recoverPanic() {
+	if recovered := recover(); recovered != nil {
+		atomic.StoreUint64(&e.endpointState, canceled)
+		e.park()
+		e.wakeUp()
+		e.onPanic(recovered)
+	}
+}
@@ -0,0 +1,71 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> OnFirstEndpoint
+//jig:needs Chan<Foo> attach
+
+// OnFirstEndpoint registers a callback that is called when the number of
+// endpoints of the channel that did not finish yet goes from 0 to 1. Together
+// with OnLastEndpoint this allows a lazy producer to start e.g. polling
+// upstream only when someone subscribes. The callback is called from the
+// goroutine creating the endpoint, just before NewEndpoint returns.
+// OnFirstEndpoint must be called before any endpoint is created.
+func (c *ChanFoo) OnFirstEndpoint(first func()) {
+	c.onFirst = first
+}
+
+//jig:template Chan<Foo> OnLastEndpoint
+//jig:needs Chan<Foo> detach
+
+// OnLastEndpoint registers a callback that is called when the number of
+// endpoints of the channel that did not finish yet goes from 1 to 0, because
+// the last endpoint was canceled or finished reading a closed channel. This
+// allows a lazy producer to stop when the last subscriber leaves. The callback
+// is called from the goroutine that finished the endpoint. OnLastEndpoint must
+// be called before any endpoint is created.
+func (c *ChanFoo) OnLastEndpoint(last func()) {
+	c.onLast = last
+}
+
+//jig:template Chan<Foo> attach
+//jig:needs Chan<Foo>
+
+// attach counts an endpoint created on the channel. It returns the number of
+// endpoints that did not finish yet, which should be passed to created after
+// allowing access to the endpoints again.
+func (c *ChanFoo) attach() int64 {
+	return atomic.AddInt64(&c.attached, 1)
+}
+
+// created calls the first endpoint callback and the start function of
+// AutoConnect when due.
+func (c *ChanFoo) created(count int64) {
+	if count == 1 && c.onFirst != nil {
+		c.onFirst()
+	}
+	if c.connect != nil && atomic.AddInt64(&c.connectPending, -1) == 0 {
+		c.connect()
+	}
+}
+
+//jig:template Chan<Foo> detach
+//jig:needs Chan<Foo> attach, Chan<Foo> Close
+
+// detach uncounts a finished endpoint. When it was the last endpoint, the last
+// endpoint callback is called. Also, when the channel was created with
+// WithRefCount, the channel is closed and torn down, but only once.
+func (c *ChanFoo) detach() {
+	if atomic.AddInt64(&c.attached, -1) != 0 {
+		return
+	}
+	if c.onLast != nil {
+		c.onLast()
+	}
+	if atomic.CompareAndSwapUint32(&c.refCount, 1, 2) {
+		c.Close(nil)
+		if c.teardown != nil {
+			c.teardown()
+		}
+	}
+}
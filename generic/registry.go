@@ -0,0 +1,115 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template EndpointStatus
+
+// EndpointStatus is the state of an endpoint as reported by Chan.Endpoints.
+type EndpointStatus uint32
+
+const (
+	// EndpointActive is the state of an endpoint receiving messages.
+	EndpointActive EndpointStatus = iota
+
+	// EndpointPaused is the state of an endpoint that was paused, see
+	// Endpoint.Pause.
+	EndpointPaused
+
+	// EndpointCanceled is the state of an endpoint that was canceled but did
+	// not finish yet.
+	EndpointCanceled
+
+	// EndpointClosed is the state of an endpoint of a closed channel that did
+	// not read all messages yet.
+	EndpointClosed
+
+	// EndpointEvicted is the state of an endpoint that was evicted because it
+	// was too slow, see EvictSlow.
+	EndpointEvicted
+)
+
+// String returns the state as a lowercase word, e.g. for logging.
+func (s EndpointStatus) String() string {
+	switch s {
+	case EndpointActive:
+		return "active"
+	case EndpointPaused:
+		return "paused"
+	case EndpointCanceled:
+		return "canceled"
+	case EndpointClosed:
+		return "closed"
+	case EndpointEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+//jig:template EndpointInfo
+//jig:needs EndpointStatus
+
+// EndpointInfo describes an endpoint registered with a channel at the time
+// Chan.Endpoints was called.
+type EndpointInfo struct {
+	Name       string         // see WithName
+	Cursor     uint64         // sequence number of the next message to read
+	Lag        uint64         // committed messages not read yet
+	State      EndpointStatus // see EndpointStatus
+	LastActive time.Time      // when the endpoint last read messages
+	Origin     string         // stack trace of its creation, see WithLeakDetection
+}
+
+//jig:template Chan<Foo> Endpoints
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Endpoint<Foo> info
+
+// Endpoints returns a snapshot of all endpoints registered with the channel
+// that did not finish yet. The name of every endpoint can be set when it is
+// created using WithName, so a misbehaving endpoint can be identified e.g. by
+// its lag or the time it was last active. Endpoints may be called from any
+// goroutine.
+func (c *ChanFoo) Endpoints() []EndpointInfo {
+	var infos []EndpointInfo
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		commit := c.commitData()
+		for i := uint32(0); i < endpoints.len; i++ {
+			e := &endpoints.entry[i]
+			cursor := atomic.LoadUint64(&e.cursor)
+			if cursor == parked {
+				continue
+			}
+			infos = append(infos, e.info(cursor, commit))
+		}
+	})
+	return infos
+}
+
+//jig:template Endpoint<Foo> info
+//jig:needs Endpoint<Foo>, EndpointInfo
+
+// info describes the endpoint at the given cursor for the given commit index.
+func (e *EndpointFoo) info(cursor, commit uint64) EndpointInfo {
+	info := EndpointInfo{
+		Name:       e.name,
+		Cursor:     cursor,
+		LastActive: time.Unix(0, atomic.LoadInt64(&e.lastRead)),
+		Origin:     e.origin,
+	}
+	if cursor < commit {
+		info.Lag = commit - cursor
+	}
+	switch {
+	case atomic.LoadUint32(&e.evicted) == 1:
+		info.State = EndpointEvicted
+	case atomic.LoadUint64(&e.endpointState) == canceled:
+		info.State = EndpointCanceled
+	case atomic.LoadUint64(&e.endpointState) == closed:
+		info.State = EndpointClosed
+	case atomic.LoadUint32(&e.endpointPaused) == 1:
+		info.State = EndpointPaused
+	}
+	return info
+}
@@ -0,0 +1,175 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template RetentionPolicy
+
+// RetentionPolicy bounds the messages a channel keeps in its buffer after all
+// endpoints have read them. Such messages are normally kept until the buffer
+// is full, so they can be replayed to new endpoints. Messages beyond the
+// policy are released as soon as possible instead and their slots are zeroed,
+// so the garbage collector can reclaim any memory they refer to. A zero field
+// does not limit retention. Messages that an active endpoint has not read yet,
+// or not committed yet when it was created with WithManualCommit, are never
+// released by the policy.
+type RetentionPolicy struct {
+	// MaxCount is the maximum number of messages kept in the buffer.
+	MaxCount int
+
+	// MaxAge is the maximum age of the messages kept in the buffer. Since
+	// messages sent with FastSend have no timestamp, MaxAge does not apply
+	// to them.
+	MaxAge time.Duration
+
+	// MaxBytes is the maximum total estimated size of the messages kept in
+	// the buffer. It only applies to a channel bounded by LimitBytes, which
+	// provides the size function.
+	MaxBytes int64
+}
+
+//jig:template Chan<Foo> Retain
+//jig:needs Chan<Foo> retain
+
+// Retain enforces the retention policy of the channel (see WithRetention).
+// The policy is enforced every time a message is sent, but releasing messages
+// because of their age also requires calling Retain periodically when no
+// messages are being sent.
+func (c *ChanFoo) Retain() {
+	c.retain()
+}
+
+//jig:template Chan<Foo> retain
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> elapsed, Chan<Foo> discard, Endpoint<Foo> retained
+
+func (c *ChanFoo) retain() {
+	policy := c.retention
+	if policy == (RetentionPolicy{}) {
+		return
+	}
+	stale := int64(0)
+	if policy.MaxAge > 0 {
+		stale = c.elapsed() - policy.MaxAge.Nanoseconds()
+	}
+	expired := func(r *ringFoo, begin, commit uint64, bytes int64) bool {
+		switch {
+		case begin >= commit:
+			return false
+		case policy.MaxCount > 0 && commit-begin > uint64(policy.MaxCount):
+			return true
+		case policy.MaxAge > 0:
+			if written := atomic.LoadInt64(&r.written[r.slot(begin)]) >> 2; written > 0 && written < stale {
+				return true
+			}
+		}
+		return policy.MaxBytes > 0 && c.size != nil && bytes > policy.MaxBytes
+	}
+	if !expired(c.loadRing(), atomic.LoadUint64(&c.begin), c.commitData(), atomic.LoadInt64(&c.bytes)) {
+		return
+	}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		r := c.loadRing()
+		begin := atomic.LoadUint64(&c.begin)
+		commit := c.commitData()
+		limit := commit
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := endpoints.entry[i].retained(atomic.LoadUint64(&endpoints.entry[i].cursor))
+			if cursor < limit {
+				limit = cursor // don't release what an endpoint did not read or commit
+			}
+		}
+		bytes := atomic.LoadInt64(&c.bytes)
+		index := begin
+		for ; index < limit && expired(r, index, commit, bytes); index++ {
+			if c.size != nil && atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+				bytes -= int64(c.size(r.buffer[r.slot(index)]))
+			}
+		}
+		if index > begin {
+			c.discard(r, begin, index, true)
+		}
+	})
+}
+
+//jig:template Chan<Foo> TrimBefore
+//jig:needs Chan<Foo> trim
+
+// TrimBefore discards the messages with a sequence number before seq from the
+// buffer and zeroes their slots, so they will no longer be replayed to new
+// endpoints. This allows freeing memory for messages that were checkpointed
+// downstream. When an active endpoint did not read all of these messages yet,
+// or did not commit them (see WithManualCommit), TrimBefore returns ErrInUse
+// and discards nothing. The same applies to a value of a recycling channel
+// that was handed out by the last call to Next or ReadBatch (see Recycle). When seq is beyond the most
+// recently committed message, TrimBefore returns ErrOutOfRange.
+func (c *ChanFoo) TrimBefore(seq uint64) error {
+	return c.trim(seq, false)
+}
+
+//jig:template Chan<Foo> ForceTrimBefore
+//jig:needs Chan<Foo> trim
+
+// ForceTrimBefore works like TrimBefore, but instead of failing it advances
+// endpoints that did not read all of the discarded messages yet. Such an
+// endpoint skips to seq as if it fell behind on a lossy channel; the skipped
+// messages are counted as dropped and reported to its gap handler. An endpoint
+// created with policy OverflowError is closed with ErrOverflow instead.
+func (c *ChanFoo) ForceTrimBefore(seq uint64) error {
+	return c.trim(seq, true)
+}
+
+//jig:template Chan<Foo> trim
+//jig:needs endpoints<Foo>, Chan<Foo> commitData, Chan<Foo> discard, ErrInUse, ErrOutOfRange, Endpoint<Foo> retained
+
+func (c *ChanFoo) trim(seq uint64, force bool) error {
+	commit := c.commitData()
+	if seq > commit {
+		return ErrOutOfRange
+	}
+	err := error(nil)
+	forced := false
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		begin := atomic.LoadUint64(&c.begin)
+		if seq <= begin {
+			return
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+			if endpoints.entry[i].retained(cursor) >= seq {
+				continue
+			}
+			if !force {
+				err = ErrInUse
+				return
+			}
+			if cursor < seq {
+				atomic.StoreUint32(&c.trimmed, 1) // see lapped
+			}
+			forced = true // don't recycle values the endpoint may still use
+		}
+		c.discard(c.loadRing(), begin, seq, !forced)
+	})
+	return err
+}
+
+//jig:template Chan<Foo> discard
+//jig:needs Chan<Foo> loadRing, Chan<Foo> release
+
+// discard removes the messages from begin up to end from the buffer, zeroing
+// their slots. It must be called with exclusive access to the endpoints. See
+// release for read.
+func (c *ChanFoo) discard(r *ringFoo, begin, end uint64, read bool) {
+	c.release(r, begin, end, read)
+	var zero foo
+	for index := begin; index < end; index++ {
+		r.buffer[r.slot(index)] = zero
+		if r.labels != nil {
+			r.labels[r.slot(index)] = ""
+			r.errs[r.slot(index)] = nil
+		}
+	}
+	atomic.StoreUint64(&c.begin, end)
+	atomic.StoreUint64(&c.end, end+r.size)
+}
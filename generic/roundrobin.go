@@ -0,0 +1,75 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> orphaned
+//jig:needs endpoints<Foo>
+
+// orphaned returns true when a message assigned to owner (see WithRoundRobin)
+// may be taken over by another endpoint, because it was sent while there were
+// no endpoints or because its owner was canceled.
+func (c *ChanFoo) orphaned(owner uint32) bool {
+	if owner == 0 {
+		return true
+	}
+	ep := &c.endpoints.entry[owner-1]
+	return atomic.LoadUint64(&ep.cursor) == parked || atomic.LoadUint64(&ep.endpointState) == canceled
+}
+
+//jig:template Chan<Foo> assign
+//jig:needs Chan<Foo> orphaned
+
+// assign assigns the message at index to the next endpoint in turn. It must
+// be called before the message is committed.
+func (c *ChanFoo) assign(r *ringFoo, index uint64) {
+	owner := uint32(0)
+	n := atomic.LoadUint32(&c.endpoints.len)
+	for tries := uint32(0); tries < n; tries++ {
+		i := atomic.AddUint32(&c.rotation, 1) % n
+		if !c.orphaned(i + 1) {
+			owner = i + 1
+			break
+		}
+	}
+	atomic.StoreUint32(&r.owners[r.slot(index)], owner)
+}
+
+//jig:template Chan<Foo> gate
+//jig:needs Chan<Foo> orphaned, Chan<Foo> commitData, Chan<Foo> loadRing
+
+// gate returns the index of the first message at or beyond cursor that the
+// endpoint at position i in entries may still read, so it holds back senders.
+// When there is no such message, the commit index is returned. It must be
+// called with exclusive access to the endpoints.
+func (c *ChanFoo) gate(entries []EndpointFoo, i uint32, cursor uint64) uint64 {
+	r := c.loadRing()
+	commit := c.commitData()
+	for ; cursor < commit; cursor++ {
+		owner := atomic.LoadUint32(&r.owners[r.slot(cursor)])
+		if owner == i+1 || c.orphaned(owner) {
+			return cursor
+		}
+	}
+	return commit
+}
+
+//jig:template Endpoint<Foo> owns
+//jig:needs Chan<Foo> orphaned
+
+// owns returns true when the message at index was assigned to the endpoint,
+// taking it over when it was orphaned.
+func (e *EndpointFoo) owns(r *ringFoo, index uint64) bool {
+	slot := &r.owners[r.slot(index)]
+	for {
+		owner := atomic.LoadUint32(slot)
+		if owner == e.index+1 {
+			return true
+		}
+		if !e.orphaned(owner) {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(slot, owner, e.index+1) {
+			return true
+		}
+	}
+}
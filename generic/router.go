@@ -0,0 +1,129 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template RoutePolicy
+
+// RoutePolicy determines what a router does when the buffer of the channel
+// a message is routed to is full.
+type RoutePolicy int
+
+const (
+	// RouteBlock blocks the router until the route channel has room for the
+	// message. This exerts backpressure on the channel the router consumes.
+	RouteBlock RoutePolicy = iota
+
+	// RouteDrop drops the message when the route channel is full.
+	RouteDrop
+)
+
+//jig:template RouteMetrics
+
+// RouteMetrics contains the number of messages routed to and dropped by a
+// single route of a router.
+type RouteMetrics struct {
+	Routed  uint64
+	Dropped uint64
+}
+
+//jig:template Router<Foo>
+//jig:needs Endpoint<Foo>, RoutePolicy, RouteMetrics
+
+// RouterFoo consumes the messages of a single endpoint and routes every
+// message to one of several output channels, based on a route index returned
+// by a user supplied key function. This is the opposite of multicasting a
+// message to all endpoints of a channel.
+type RouterFoo struct {
+	endpoint *EndpointFoo
+	key      func(value foo) int
+	routes   []routeFoo
+	unrouted uint64
+}
+
+type routeFoo struct {
+	*ChanFoo
+	policy  RoutePolicy
+	routed  uint64
+	dropped uint64
+}
+
+//jig:template NewRouter<Foo>
+//jig:needs Router<Foo>
+
+// NewRouterFoo creates a router that will consume the messages received by
+// endpoint. The key function is called for every message and should return
+// the index of the route (as returned by Route) to send the message to. When
+// the index does not refer to a route, the message is discarded and counted
+// as unrouted.
+func NewRouterFoo(endpoint *EndpointFoo, key func(value foo) int) *RouterFoo {
+	return &RouterFoo{endpoint: endpoint, key: key}
+}
+
+//jig:template Router<Foo> Route
+//jig:needs Router<Foo>
+
+// Route adds the channel c as an output of the router and returns its route
+// index. The policy determines what happens when the buffer of c is full.
+// Routes should be added before calling Run.
+func (r *RouterFoo) Route(c *ChanFoo, policy RoutePolicy) int {
+	r.routes = append(r.routes, routeFoo{ChanFoo: c, policy: policy})
+	return len(r.routes) - 1
+}
+
+//jig:template Router<Foo> Run
+//jig:needs Router<Foo>, Endpoint<Foo> Range, Chan<Foo> Send, Chan<Foo> TrySend, Chan<Foo> Close
+
+// Run will range over the endpoint of the router and route the messages to
+// the output channels until the endpoint is canceled or closed. When the
+// endpoint is closed, all output channels are closed with the same error.
+// Run blocks, so it should be called from its own goroutine.
+func (r *RouterFoo) Run(maxAge time.Duration) {
+	r.endpoint.Range(func(value foo, err error, closed bool) bool {
+		if closed {
+			for i := range r.routes {
+				r.routes[i].Close(err)
+			}
+			return true
+		}
+		index := r.key(value)
+		if index < 0 || index >= len(r.routes) {
+			atomic.AddUint64(&r.unrouted, 1)
+			return true
+		}
+		route := &r.routes[index]
+		if route.policy == RouteDrop {
+			if !route.TrySend(value) {
+				atomic.AddUint64(&route.dropped, 1)
+				return true
+			}
+		} else {
+			route.Send(value)
+		}
+		atomic.AddUint64(&route.routed, 1)
+		return true
+	}, maxAge)
+}
+
+//jig:template Router<Foo> Metrics
+//jig:needs Router<Foo>
+
+// Metrics returns the number of messages routed to and dropped by the route
+// with the given index. It is safe to call Metrics while Run is active.
+func (r *RouterFoo) Metrics(route int) RouteMetrics {
+	return RouteMetrics{
+		Routed:  atomic.LoadUint64(&r.routes[route].routed),
+		Dropped: atomic.LoadUint64(&r.routes[route].dropped),
+	}
+}
+
+//jig:template Router<Foo> Unrouted
+//jig:needs Router<Foo>
+
+// Unrouted returns the number of messages discarded because the key function
+// returned an index that did not refer to a route.
+func (r *RouterFoo) Unrouted() uint64 {
+	return atomic.LoadUint64(&r.unrouted)
+}
@@ -0,0 +1,130 @@
+package multicast
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> Seq
+//jig:needs Endpoint<Foo>
+
+// Seq returns the sequence number of the next message the endpoint will read.
+// Every message sent to the channel gets the next sequence number, starting
+// at 0. Markers (see Mark) also occupy a sequence number.
+func (e *EndpointFoo) Seq() uint64 {
+	return atomic.LoadUint64(&e.cursor)
+}
+
+//jig:template Endpoint<Foo> Seek
+//jig:needs endpoints<Foo>, Endpoint<Foo>, Chan<Foo> commitData, ErrOutOfRange
+
+// Seek positions the endpoint so the next message it reads is the one with
+// sequence number seq. This allows rewinding the endpoint to reprocess
+// messages still retained in the buffer, or skipping ahead up to the most
+// recently committed message. When seq is not within that range or the
+// endpoint has finished, Seek returns ErrOutOfRange.
+//
+// Seek should be called from the goroutine using the endpoint, but not from
+// inside the function passed to Range.
+func (e *EndpointFoo) Seek(seq uint64) error {
+	commit := e.commitData()
+	err := error(ErrOutOfRange)
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(endpoints *endpointsFoo) {
+		// slideBuffer can't move begin while we have access to the endpoints
+		if atomic.LoadUint64(&e.cursor) != parked && atomic.LoadUint64(&e.begin) <= seq && seq <= commit {
+			atomic.StoreUint64(&e.cursor, seq)
+			endpoints.invalidate(e.index)
+			err = nil
+		}
+	})
+	return err
+}
+
+//jig:template Endpoint<Foo> SeekTime
+//jig:needs endpoints<Foo>, Endpoint<Foo>, Chan<Foo> commitData, Chan<Foo> loadRing, ErrOutOfRange
+
+// SeekTime positions the endpoint at the first message retained in the buffer
+// that was sent at or after t. When all retained messages were sent before t,
+// the endpoint is positioned after the most recently committed message. This
+// is useful to e.g. replay the messages of the last 30 seconds. When the
+// endpoint has finished, SeekTime returns ErrOutOfRange.
+//
+// SeekTime relies on the timestamps recorded by Send, so it should not be
+// used on channels fed by FastSend. Like Seek, it should not be called from
+// inside the function passed to Range.
+func (e *EndpointFoo) SeekTime(t time.Time) error {
+	e.commitData()
+	target := t.Sub(e.start).Nanoseconds()
+	err := error(ErrOutOfRange)
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(endpoints *endpointsFoo) {
+		if atomic.LoadUint64(&e.cursor) == parked {
+			return
+		}
+		begin := atomic.LoadUint64(&e.begin)
+		commit := atomic.LoadUint64(&e.commit)
+		r := e.loadRing()
+		offset := sort.Search(int(commit-begin), func(i int) bool {
+			return atomic.LoadInt64(&r.written[r.slot(begin+uint64(i))])>>2 >= target
+		})
+		atomic.StoreUint64(&e.cursor, begin+uint64(offset))
+		endpoints.invalidate(e.index)
+		err = nil
+	})
+	return err
+}
+
+//jig:template Endpoint<Foo> Clone
+//jig:needs endpoints<Foo>, Endpoint<Foo> Cancel, ErrOutOfRange
+
+// Clone creates a new endpoint on the same channel that starts at the current
+// cursor position of the endpoint, so it will receive the same messages the
+// endpoint receives from now on. This allows forking processing, e.g. to start
+// a debug tap exactly where the main consumer currently is. The clone gets the
+// same options (see NewEndpointOpts), filter and transform (see Filter and Map)
+// as the endpoint, but it does not join the group of the endpoint (see
+// WithGroup) nor save its position in the cursor store of the endpoint (see
+// WithCursorStore). When the endpoint has finished, Clone returns ErrOutOfRange.
+// When no endpoint can be created, Clone returns ErrOutOfEndpoints.
+func (e *EndpointFoo) Clone() (*EndpointFoo, error) {
+	clone, err := e.endpoints.NewForChanFoo(e.ChanFoo, endpointOptions{
+		keep:         ReplayAll,
+		maxAge:       e.maxAge,
+		name:         e.name,
+		gap:          e.gap,
+		overflow:     e.overflow,
+		idleTimeout:  e.idleTimeout,
+		sample:       e.sample,
+		throttle:     e.throttle,
+		debounce:     e.debounce,
+		onPanic:      e.onPanic,
+		acking:       e.acking,
+		ackTimeout:   e.ackTimeout,
+		ackRetries:   e.ackRetries,
+		manualCommit: e.manualCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clone.filter, clone.transform = e.filter, e.transform
+	clone.deadLetters, clone.onDeadLetter = e.deadLetters, e.onDeadLetter
+	err = ErrOutOfRange
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(*endpointsFoo) {
+		// slideBuffer can't move begin while we have access to the endpoints
+		cursor := atomic.LoadUint64(&e.cursor)
+		if cursor == parked {
+			return
+		}
+		if begin := atomic.LoadUint64(&e.begin); cursor < begin {
+			cursor = begin // the endpoint was lapped
+		}
+		atomic.StoreUint64(&clone.cursor, cursor)
+		atomic.StoreUint64(&clone.committed, cursor)
+		err = nil
+	})
+	if err != nil {
+		clone.Cancel()
+		return nil, err
+	}
+	return clone, nil
+}
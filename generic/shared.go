@@ -0,0 +1,83 @@
+package multicast
+
+import (
+	"sync"
+	"time"
+)
+
+//jig:template SharedEndpoint<Foo>
+//jig:needs Endpoint<Foo> Range, Endpoint<Foo> Next, Endpoint<Foo> NextTimeout, Endpoint<Foo> ReadBatch, Endpoint<Foo> Cancel, Endpoint<Foo> Done, Endpoint<Foo> Lag, Endpoint<Foo> wakeUp
+
+// SharedEndpointFoo wraps an endpoint so it can be used from multiple
+// goroutines. Calls that receive messages are serialized, so every message is
+// received by only one of the goroutines sharing the endpoint. Note that Range
+// holds on to the endpoint until it returns, so other goroutines wanting to
+// receive will block until then. Cancel can be called at any time, also while
+// other goroutines are blocked receiving.
+type SharedEndpointFoo struct {
+	endpoint *EndpointFoo
+	mutex    sync.Mutex
+}
+
+// Range will call foreach for the messages received from the endpoint, see
+// EndpointFoo.Range for details.
+func (s *SharedEndpointFoo) Range(foreach func(value foo, err error, closed bool) bool, maxAge time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endpoint.Range(foreach, maxAge)
+}
+
+// Next will block until the next message is available and return it, see
+// EndpointFoo.Next for details.
+func (s *SharedEndpointFoo) Next() (value foo, ok bool, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.Next()
+}
+
+// NextTimeout works like Next, but gives up when no message is available
+// within timeout, see EndpointFoo.NextTimeout for details. The time spent
+// waiting for other goroutines using the endpoint is not included in the
+// timeout.
+func (s *SharedEndpointFoo) NextTimeout(timeout time.Duration) (value foo, ok bool, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.NextTimeout(timeout)
+}
+
+// ReadBatch will block until messages are available and copy them into dst,
+// see EndpointFoo.ReadBatch for details.
+func (s *SharedEndpointFoo) ReadBatch(dst []foo) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.ReadBatch(dst)
+}
+
+// Cancel cancels the endpoint. Goroutines blocked receiving from the endpoint
+// will return as if the endpoint was canceled before they started.
+func (s *SharedEndpointFoo) Cancel() {
+	s.endpoint.Cancel()
+	s.endpoint.wakeUp()
+}
+
+// Done returns a channel that is closed when the endpoint finishes, see
+// EndpointFoo.Done for details.
+func (s *SharedEndpointFoo) Done() <-chan struct{} {
+	return s.endpoint.Done()
+}
+
+// Lag returns the number of messages the endpoint did not read yet, see
+// EndpointFoo.Lag for details.
+func (s *SharedEndpointFoo) Lag() int {
+	return s.endpoint.Lag()
+}
+
+//jig:template Endpoint<Foo> Shared
+//jig:needs SharedEndpoint<Foo>
+
+// Shared wraps the endpoint so it can be safely used from multiple goroutines,
+// e.g. by handlers serving concurrent requests. After calling Shared, the
+// endpoint should only be used via the returned wrapper.
+func (e *EndpointFoo) Shared() *SharedEndpointFoo {
+	return &SharedEndpointFoo{endpoint: e}
+}
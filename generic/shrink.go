@@ -0,0 +1,135 @@
+package multicast
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+//jig:template Chan<Foo> Shrink
+//jig:needs Chan<Foo> shrink
+
+// Shrink enforces the shrink policy of the channel (see WithShrink). The
+// policy is enforced every time a message is sent, but shrinking a channel
+// that no longer receives any messages requires calling Shrink periodically.
+func (c *ChanFoo) Shrink() {
+	c.shrink()
+}
+
+//jig:template Chan<Foo> shrink
+//jig:needs endpoints<Foo>, Chan<Foo> elapsed, Chan<Foo> halve, Endpoint<Foo> retained
+
+// shrink halves the buffer when the endpoints have been close to the most
+// recent message for the period set by WithShrink, i.e. when no more than a
+// quarter of the buffer was unread all that time. The buffer is checked at
+// most 8 times per period, so sending stays cheap.
+func (c *ChanFoo) shrink() {
+	if c.shrinkAfter == 0 {
+		return
+	}
+	now := c.elapsed()
+	checked := atomic.LoadInt64(&c.shrinkChecked)
+	if checked != 0 && now-checked < c.shrinkAfter/8 || !atomic.CompareAndSwapInt64(&c.shrinkChecked, checked, now) {
+		return // checked recently or being checked by another goroutine
+	}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		r := c.loadRing() // can't grow while we have access to the endpoints
+		write := atomic.LoadUint64(&c.write)
+		slowest := write
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := endpoints.entry[i].retained(atomic.LoadUint64(&endpoints.entry[i].cursor))
+			if cursor < slowest {
+				slowest = cursor
+			}
+		}
+		if r.size/2 < c.shrinkMin || write-slowest > r.size/4 {
+			atomic.StoreInt64(&c.lowSince, 0) // the buffer is in use
+			return
+		}
+		since := atomic.LoadInt64(&c.lowSince)
+		if since == 0 {
+			atomic.StoreInt64(&c.lowSince, now)
+			return
+		}
+		if now-since >= c.shrinkAfter && c.halve(r, write) {
+			atomic.StoreInt64(&c.lowSince, now) // wait another period before halving again
+		}
+	})
+}
+
+//jig:template Chan<Foo> halve
+//jig:needs Chan<Foo> loadRing, Chan<Foo> commitData, Chan<Foo> release
+
+// halve replaces the ring of the channel by one of half the size. It keeps
+// the messages that were sent up to write and that fit in half of the new
+// ring, but never fewer than the endpoints did not read yet. It must be
+// called with exclusive access to the endpoints and only when no more than a
+// quarter of the old ring is unread. Senders store messages without access to
+// the endpoints, so halve first moves the end of the buffer to write to make
+// new senders wait. It gives up and returns false when a message is still
+// being published.
+func (c *ChanFoo) halve(old *ringFoo, write uint64) bool {
+	if c.commitData() != write {
+		return false // a sender is storing a message in the old ring
+	}
+	end := atomic.LoadUint64(&c.end)
+	atomic.StoreUint64(&c.end, write) // senders reserving a slot now wait, see awaitEnd
+	if atomic.LoadUint64(&c.write) != write {
+		atomic.StoreUint64(&c.end, end) // a sender reserved a slot in the old ring
+		return false
+	}
+	size := old.size / 2
+	begin := atomic.LoadUint64(&c.begin)
+	keep := begin
+	if write-begin > size/2 {
+		keep = write - size/2 // endpoints read everything before keep
+	}
+	c.release(old, begin, keep, true)
+	r := &ringFoo{
+		buffer:  make([]foo, size),
+		written: make([]int64, size),
+		mod:     size - 1,
+		size:    size,
+	}
+	if old.labels != nil {
+		r.labels = make([]string, size)
+		r.errs = make([]error, size)
+	}
+	if old.owners != nil {
+		r.owners = make([]uint32, size)
+	}
+	if old.headers != nil {
+		r.headers = make([]Headers, size)
+	}
+	for index := keep; index < write; index++ {
+		r.buffer[r.slot(index)] = old.buffer[old.slot(index)]
+		r.written[r.slot(index)] = atomic.LoadInt64(&old.written[old.slot(index)])
+		if r.labels != nil {
+			r.labels[r.slot(index)] = old.labels[old.slot(index)]
+			r.errs[r.slot(index)] = old.errs[old.slot(index)]
+		}
+		if r.owners != nil {
+			r.owners[r.slot(index)] = atomic.LoadUint32(&old.owners[old.slot(index)])
+		}
+		if r.headers != nil {
+			r.headers[r.slot(index)] = old.headers[old.slot(index)]
+		}
+	}
+	atomic.StorePointer(&c.ring, unsafe.Pointer(r))
+	atomic.StoreUint64(&c.begin, keep)
+	atomic.StoreUint64(&c.end, keep+size)
+	return true
+}
+
+//jig:template Chan<Foo> awaitEnd
+//jig:needs Chan<Foo>
+
+// awaitEnd waits until the slot a sender reserved with a compare-and-swap of
+// write, after checking it was below the end of the buffer, is below the end
+// again. The end only moves down while the buffer is being halved (see
+// halve), which moves it back up when done.
+func (c *ChanFoo) awaitEnd(write uint64) {
+	for write >= atomic.LoadUint64(&c.end) {
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,42 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> slideSingle
+//jig:needs endpoints<Foo>, OverflowPolicy, Chan<Foo> release, Chan<Foo> advanceEnd, Endpoint<Foo> retained
+
+// slideSingle is the fast path of slideBuffer for a channel created with an
+// endpointCapacity of 1, the common setup of a plain queue. The cursor of the
+// only endpoint is the slowest cursor, so there are no endpoints to scan, no
+// bounds to keep (see slowest) and no clock to read for a full scan. It
+// returns ok false when the endpoint needs the general path, because it
+// doesn't block senders or is canceled when idle.
+func (c *ChanFoo) slideSingle() (slowestCursor uint64, spinlock bool, ok bool) {
+	slowestCursor, ok = parked, true
+	spinlock = c.endpoints.AccessShared(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsFoo) {
+		if atomic.LoadUint32(&endpoints.len) == 0 {
+			return // no endpoint blocks senders
+		}
+		ep := &endpoints.entry[0]
+		if ep.overflow != OverflowBlock || ep.idleTimeout != 0 {
+			ok = false
+			return
+		}
+		cursor := ep.retained(atomic.LoadUint64(&ep.cursor))
+		begin := atomic.LoadUint64(&c.begin)
+		if cursor == parked || cursor <= begin || cursor > atomic.LoadUint64(&c.end) {
+			return
+		}
+		r := c.loadRing()
+		next := cursor
+		if r.size <= 16 {
+			next = begin + 1
+		}
+		if atomic.CompareAndSwapUint64(&c.begin, begin, next) {
+			c.release(r, begin, next, true)
+			c.advanceEnd(r, begin, next)
+		}
+		slowestCursor = next
+	})
+	return slowestCursor, spinlock, ok
+}
@@ -0,0 +1,68 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> coalesce
+//jig:needs Endpoint<Foo> sleep, Chan<Foo> commitData
+
+// coalesce waits until the next message may be delivered to an endpoint with
+// a throttle (see WithThrottle) or debounce (see WithDebounce) duration. It
+// returns false when the endpoint was canceled or reading was suspended or
+// aborted via control while waiting.
+func (e *EndpointFoo) coalesce(control *uint32) bool {
+	if e.throttle != 0 && !e.throttled(control) {
+		return false
+	}
+	return e.debounce == 0 || e.debounced(control)
+}
+
+// throttled waits until the throttle interval of the endpoint has passed since
+// the previous message was delivered.
+func (e *EndpointFoo) throttled(control *uint32) bool {
+	wait := time.Duration(e.delivered + e.throttle.Nanoseconds() - time.Now().UnixNano())
+	if !e.sleep(wait, control) {
+		return false
+	}
+	e.delivered = time.Now().UnixNano()
+	return true
+}
+
+// debounced waits until no messages were committed for the debounce duration.
+func (e *EndpointFoo) debounced(control *uint32) bool {
+	commit := e.commitData()
+	deadline := time.Now().Add(e.debounce)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if !e.sleep(time.Millisecond, control) {
+			return false
+		}
+		if latest := e.commitData(); latest != commit {
+			commit = latest
+			deadline = time.Now().Add(e.debounce)
+		}
+	}
+	return true
+}
+
+//jig:template Endpoint<Foo> sleep
+//jig:needs Endpoint<Foo>
+
+// sleep waits for duration d in steps of at most 1ms, so it can return false
+// as soon as the endpoint was canceled or reading was suspended or aborted via
+// control.
+func (e *EndpointFoo) sleep(d time.Duration, control *uint32) bool {
+	deadline := time.Now().Add(d)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if atomic.LoadUint64(&e.endpointState) == canceled || (control != nil && atomic.LoadUint32(control) != proceed) {
+			return false
+		}
+		if step := deadline.Sub(now); step < time.Millisecond {
+			time.Sleep(step)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return true
+}
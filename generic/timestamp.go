@@ -0,0 +1,57 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Chan<Foo> timestamp
+//jig:needs Chan<Foo> elapsed
+
+// timestamp returns the time to record with a message sent now. When
+// timestamps are disabled (see WithoutTimestamps) it returns 0, which marks
+// the message as having no timestamp, like messages sent using FastSend.
+func (c *ChanFoo) timestamp() int64 {
+	if c.untimed == 1 {
+		return 0
+	}
+	if c.resolution != 0 {
+		return atomic.LoadInt64(&c.coarse) // see WithCoarseClock
+	}
+	updated := c.elapsed()
+	if updated == 0 {
+		panic("clock failure; zero duration measured")
+	}
+	return updated
+}
+
+//jig:template Chan<Foo> startClock
+//jig:needs Chan<Foo> elapsed
+
+// startClock starts the goroutine updating the coarse clock of the channel,
+// see WithCoarseClock. The goroutine exits when the channel is closed.
+func (c *ChanFoo) startClock() {
+	tick := func() {
+		if elapsed := c.elapsed(); elapsed > 0 {
+			atomic.StoreInt64(&c.coarse, elapsed)
+		} else {
+			atomic.StoreInt64(&c.coarse, 1) // distinguish from a missing timestamp
+		}
+	}
+	tick()
+	exit := make(chan struct{})
+	c.clockExit = exit
+	go func(done <-chan struct{}) {
+		defer close(exit)
+		ticker := time.NewTicker(c.resolution)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tick()
+			case <-done:
+				return
+			}
+		}
+	}(c.signal().done)
+}
@@ -0,0 +1,155 @@
+package multicast
+
+import "time"
+
+//jig:template ReadOnlyChan<Foo>
+//jig:needs Chan<Foo>, Chan<Foo> NewEndpoint, Chan<Foo> Closed, Chan<Foo> Done, ReadOnlyEndpoint<Foo>
+
+// ReadOnlyChanFoo is a view on a channel that only allows creating endpoints
+// and observing whether the channel was closed. It can be handed to
+// components that should be able to receive from the channel, but not send
+// to or close it. The endpoints it creates are read-only as well.
+type ReadOnlyChanFoo struct {
+	c *ChanFoo
+}
+
+// NewEndpoint will create a new endpoint on the underlying channel, see
+// ChanFoo.NewEndpoint for details. The endpoint doesn't give access to the
+// channel.
+func (r ReadOnlyChanFoo) NewEndpoint(keep uint64) (*ReadOnlyEndpointFoo, error) {
+	e, err := r.c.NewEndpoint(keep)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyEndpointFoo{endpoint: e}, nil
+}
+
+// Closed returns true when the underlying channel was closed.
+func (r ReadOnlyChanFoo) Closed() bool {
+	return r.c.Closed()
+}
+
+// Done returns a channel that is closed when the underlying channel is
+// closed.
+func (r ReadOnlyChanFoo) Done() <-chan struct{} {
+	return r.c.Done()
+}
+
+//jig:template ReadOnlyEndpoint<Foo>
+//jig:needs Endpoint<Foo> Range, Endpoint<Foo> RangeSeq, Endpoint<Foo> RangeErr, Endpoint<Foo> Next, Endpoint<Foo> NextTimeout, Endpoint<Foo> ReadBatch, Endpoint<Foo> Cancel, Endpoint<Foo> Done, Endpoint<Foo> Lag, Endpoint<Foo> Seq, Endpoint<Foo> Seek
+
+// ReadOnlyEndpointFoo is an endpoint created by a read-only view on a channel
+// (see ReadOnly). Unlike EndpointFoo, it doesn't embed the channel, so the
+// methods that send to, close or configure the channel can't be reached
+// through it. Like an endpoint, it should be used by a single goroutine.
+type ReadOnlyEndpointFoo struct {
+	endpoint *EndpointFoo
+}
+
+// Range will call foreach for the messages received from the endpoint, see
+// EndpointFoo.Range for details.
+func (r *ReadOnlyEndpointFoo) Range(foreach func(value foo, err error, closed bool) bool, maxAge time.Duration) {
+	r.endpoint.Range(foreach, maxAge)
+}
+
+// RangeSeq works like Range, but also passes the sequence number and sent
+// time of every message, see EndpointFoo.RangeSeq for details.
+func (r *ReadOnlyEndpointFoo) RangeSeq(foreach func(value foo, seq uint64, sent time.Time, err error, closed bool) bool, maxAge time.Duration) {
+	r.endpoint.RangeSeq(foreach, maxAge)
+}
+
+// RangeErr works like Range, but stops with the error returned by foreach,
+// see EndpointFoo.RangeErr for details.
+func (r *ReadOnlyEndpointFoo) RangeErr(foreach func(value foo, err error, closed bool) error, maxAge time.Duration) error {
+	return r.endpoint.RangeErr(foreach, maxAge)
+}
+
+// Next will block until the next message is available and return it, see
+// EndpointFoo.Next for details.
+func (r *ReadOnlyEndpointFoo) Next() (value foo, ok bool, closed bool) {
+	return r.endpoint.Next()
+}
+
+// NextTimeout works like Next, but gives up when no message is available
+// within timeout, see EndpointFoo.NextTimeout for details.
+func (r *ReadOnlyEndpointFoo) NextTimeout(timeout time.Duration) (value foo, ok bool, closed bool) {
+	return r.endpoint.NextTimeout(timeout)
+}
+
+// ReadBatch will block until messages are available and copy them into dst,
+// see EndpointFoo.ReadBatch for details.
+func (r *ReadOnlyEndpointFoo) ReadBatch(dst []foo) int {
+	return r.endpoint.ReadBatch(dst)
+}
+
+// Cancel cancels the endpoint, see EndpointFoo.Cancel for details.
+func (r *ReadOnlyEndpointFoo) Cancel() {
+	r.endpoint.Cancel()
+}
+
+// Done returns a channel that is closed when the endpoint finishes, see
+// EndpointFoo.Done for details.
+func (r *ReadOnlyEndpointFoo) Done() <-chan struct{} {
+	return r.endpoint.Done()
+}
+
+// Lag returns the number of messages the endpoint did not read yet, see
+// EndpointFoo.Lag for details.
+func (r *ReadOnlyEndpointFoo) Lag() int {
+	return r.endpoint.Lag()
+}
+
+// Seq returns the sequence number of the next message the endpoint will
+// read, see EndpointFoo.Seq for details.
+func (r *ReadOnlyEndpointFoo) Seq() uint64 {
+	return r.endpoint.Seq()
+}
+
+// Seek positions the endpoint at the message with sequence number seq, see
+// EndpointFoo.Seek for details.
+func (r *ReadOnlyEndpointFoo) Seek(seq uint64) error {
+	return r.endpoint.Seek(seq)
+}
+
+//jig:template Chan<Foo> ReadOnly
+//jig:needs ReadOnlyChan<Foo>
+
+// ReadOnly returns a read-only view on the channel.
+func (c *ChanFoo) ReadOnly() ReadOnlyChanFoo {
+	return ReadOnlyChanFoo{c}
+}
+
+//jig:template Sender<Foo>
+//jig:needs Chan<Foo>, Chan<Foo> Send, Chan<Foo> TrySend, Chan<Foo> Close
+
+// SenderFoo is a view on a channel that only allows sending to and closing
+// the channel. It can be handed to producer components that should not be
+// able to create endpoints or inspect the receivers of the channel.
+type SenderFoo struct {
+	c *ChanFoo
+}
+
+// Send will send a value to the underlying channel, see ChanFoo.Send for
+// details.
+func (s SenderFoo) Send(value foo) error {
+	return s.c.Send(value)
+}
+
+// TrySend will send a value to the underlying channel only when this can be
+// done without blocking, see ChanFoo.TrySend for details.
+func (s SenderFoo) TrySend(value foo) bool {
+	return s.c.TrySend(value)
+}
+
+// Close will close the underlying channel, see ChanFoo.Close for details.
+func (s SenderFoo) Close(err error) {
+	s.c.Close(err)
+}
+
+//jig:template Chan<Foo> Sender
+//jig:needs Sender<Foo>
+
+// Sender returns a send-only view on the channel.
+func (c *ChanFoo) Sender() SenderFoo {
+	return SenderFoo{c}
+}
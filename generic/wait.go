@@ -0,0 +1,68 @@
+package multicast
+
+import (
+	"runtime"
+	"time"
+)
+
+//jig:template WaitStrategy
+
+// WaitStrategy determines how goroutines wait on a channel, i.e. how endpoints
+// wait for new messages when they have read everything and how senders wait
+// for room when the buffer is full, see WithWaitStrategy. The choice trades
+// latency for CPU usage: a busy-spinning endpoint picks up a message within
+// nanoseconds but burns a core, a blocking endpoint uses no CPU while idle
+// but needs a sender to wake it up.
+//
+// Wait is called every time a goroutine finds it still has to wait, with the
+// number of times it already waited in a row (starting at 1). It should
+// return quickly, e.g. after yielding the processor or sleeping briefly.
+// When Wait returns true, an endpoint blocks until the next message is sent
+// or the channel is closed. Senders are not woken up by endpoints reading, so
+// a sender sleeps for a millisecond instead.
+type WaitStrategy interface {
+	Wait(attempt uint32) (block bool)
+}
+
+// WaitFunc is an adapter to allow the use of an ordinary function as a
+// WaitStrategy.
+type WaitFunc func(attempt uint32) (block bool)
+
+// Wait calls f(attempt).
+func (f WaitFunc) Wait(attempt uint32) bool {
+	return f(attempt)
+}
+
+// BusySpinWait returns a WaitStrategy that keeps checking the channel without
+// ever giving up the processor. This gives the lowest latency, but occupies a
+// core for every waiting goroutine, so it only makes sense when there are
+// more cores than goroutines using the channel.
+func BusySpinWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool { return false })
+}
+
+// YieldWait returns a WaitStrategy that yields the processor to other
+// goroutines by calling runtime.Gosched every time it waits.
+func YieldWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool {
+		runtime.Gosched()
+		return false
+	})
+}
+
+// SleepWait returns a WaitStrategy that sleeps for the given duration every
+// time it waits. The latency of picking up a message is then roughly the
+// sleep duration.
+func SleepWait(d time.Duration) WaitStrategy {
+	return WaitFunc(func(uint32) bool {
+		time.Sleep(d)
+		return false
+	})
+}
+
+// BlockingWait returns a WaitStrategy that blocks waiting endpoints right
+// away. Idle endpoints then use no CPU at all, but every message they wait for
+// costs a wake up.
+func BlockingWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool { return true })
+}
@@ -0,0 +1,124 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+//jig:template Chan<Foo> wake
+//jig:needs Chan<Foo> wakeEndpoints, Chan<Foo> broadcast
+
+// wake wakes up the endpoints blocked waiting for messages. When no endpoint
+// is blocked, wake returns right away without broadcasting.
+// Concurrent calls are coalesced: while one sender is broadcasting, the others
+// only flag that there is more to tell, so a burst of sends wakes up every
+// blocked endpoint just once instead of once per message.
+func (c *ChanFoo) wake() {
+	if atomic.LoadInt32(&c.sleepers) == 0 {
+		return
+	}
+	if c.wakeups == 1 {
+		c.wakeEndpoints()
+		return
+	}
+	atomic.StoreUint32(&c.dirty, 1)
+	for atomic.LoadUint32(&c.dirty) == 1 && atomic.CompareAndSwapUint32(&c.waking, 0, 1) {
+		atomic.StoreUint32(&c.dirty, 0)
+		c.broadcast()
+		atomic.StoreUint32(&c.waking, 0)
+	}
+}
+
+//jig:template Chan<Foo> wakeAll
+//jig:needs Chan<Foo> wakeEndpoints, Chan<Foo> broadcast
+
+// wakeAll wakes up all blocked endpoints so they notice a change of state,
+// e.g. the channel was closed or some endpoints were evicted.
+func (c *ChanFoo) wakeAll() {
+	c.broadcast()
+	if c.wakeups == 1 {
+		c.wakeEndpoints()
+	}
+}
+
+//jig:template Chan<Foo> broadcast
+//jig:needs Chan<Foo>
+
+// broadcast wakes up all endpoints blocked on the channel shared by them, see
+// block. The channel is closed and replaced by a new one, so every endpoint
+// that took the channel before the broadcast is woken up.
+func (c *ChanFoo) broadcast() {
+	next := make(chan struct{})
+	close(*(*chan struct{})(atomic.SwapPointer(&c.receivers, unsafe.Pointer(&next))))
+}
+
+//jig:template Chan<Foo> wakeEndpoints
+//jig:needs endpoints<Foo>, Endpoint<Foo> wakeUp
+
+// wakeEndpoints wakes up every endpoint blocked on its own wakeup channel, see
+// WithEndpointWakeups.
+func (c *ChanFoo) wakeEndpoints() {
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if atomic.LoadUint32(&entries[i].sleeping) == 1 {
+			entries[i].wakeUp()
+		}
+	}
+}
+
+//jig:template Endpoint<Foo> wakeUp
+//jig:needs Endpoint<Foo>, Chan<Foo> broadcast
+
+// wakeUp wakes up the endpoint when it is blocked waiting for messages. With
+// a shared channel this wakes up all blocked endpoints of the channel.
+func (e *EndpointFoo) wakeUp() {
+	if e.wakeup == nil {
+		e.broadcast()
+		return
+	}
+	if atomic.CompareAndSwapUint32(&e.sleeping, 1, 0) {
+		select {
+		case e.wakeup <- struct{}{}:
+		default: // a stale wakeup is still pending
+		}
+	}
+}
+
+//jig:template Endpoint<Foo> block
+//jig:needs Endpoint<Foo>, Chan<Foo> commitData
+
+// block blocks the endpoint until a sender or a state change wakes it up, see
+// blockWhile. It doesn't block when there are messages to read or the
+// endpoint is no longer active.
+func (e *EndpointFoo) block(control *uint32) {
+	e.blockWhile(func() bool {
+		return e.commitData() == e.cursor && atomic.LoadUint64(&e.endpointState) == active &&
+			(control == nil || atomic.LoadUint32(control) == proceed)
+	})
+}
+
+// blockWhile blocks the endpoint until it is woken up, when blocked returns
+// true. The endpoint registers as a sleeper and takes the channel to block on
+// before calling blocked one last time, so a goroutine changing the condition
+// concurrently either sees the sleeper and wakes it, or the change is noticed
+// by blocked and the endpoint doesn't block. A wakeup can't be missed: a
+// broadcast coming in between the check and blocking closes the channel that
+// was taken.
+func (e *EndpointFoo) blockWhile(blocked func() bool) {
+	atomic.AddInt32(&e.sleepers, 1)
+	var receivers chan struct{}
+	if e.wakeup != nil {
+		atomic.StoreUint32(&e.sleeping, 1)
+	} else {
+		receivers = *(*chan struct{})(atomic.LoadPointer(&e.receivers))
+	}
+	if blocked() {
+		if e.wakeup != nil {
+			<-e.wakeup
+		} else {
+			<-receivers
+		}
+	}
+	atomic.StoreUint32(&e.sleeping, 0)
+	atomic.AddInt32(&e.sleepers, -1)
+}
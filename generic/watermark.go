@@ -0,0 +1,38 @@
+package multicast
+
+import "sync/atomic"
+
+//jig:template Chan<Foo> watermark
+//jig:needs endpoints<Foo>
+
+// watermark calls the watermark callbacks of the channel (see WithWatermarks)
+// when the number of unread messages crossed one of the watermarks. It is
+// called after sending a message and after an endpoint advanced its cursor.
+func (c *ChanFoo) watermark() {
+	if c.highWater == 0 {
+		return
+	}
+	above := atomic.LoadUint32(&c.aboveHigh) == 1
+	write := atomic.LoadUint64(&c.write)
+	if !above && write-atomic.LoadUint64(&c.begin) < c.highWater {
+		return // no endpoint can be further behind than the buffer
+	}
+	slowest := write
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if cursor := atomic.LoadUint64(&entries[i].cursor); cursor < slowest {
+			slowest = cursor
+		}
+	}
+	unread := write - slowest
+	switch {
+	case !above && unread >= c.highWater:
+		if atomic.CompareAndSwapUint32(&c.aboveHigh, 0, 1) && c.onHigh != nil {
+			c.onHigh()
+		}
+	case above && unread <= c.lowWater:
+		if atomic.CompareAndSwapUint32(&c.aboveHigh, 1, 0) && c.onLow != nil {
+			c.onLow()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package multicast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//jig:template Endpoint<Foo> RangeWindow
+//jig:needs Endpoint<Foo>, Endpoint<Foo> iterate, Endpoint<Foo> Cancel, Endpoint<Foo> wakeUp, Chan<Foo> elapsed
+
+// RangeWindow works like Range, but delivers messages in batches to the
+// foreach function. A batch is delivered as soon as size messages have been
+// collected, or when interval has passed since the first message of the batch
+// was received, whichever comes first. This suits consumers feeding bulk
+// APIs, like database inserts or batched HTTP posts. The foreach function
+// owns the batch passed to it and may retain it. A size of 0 or less means
+// batches are only limited by interval and an interval of 0 means batches are
+// only limited by size. The interval is measured with the clock of the
+// channel, see WithClock.
+//
+// When the channel is closed, the remaining messages are delivered as a final
+// batch, followed by the close notification with a nil batch and closed set
+// to true. Returning false from foreach is the same as calling Cancel.
+func (e *EndpointFoo) RangeWindow(foreach func(batch []foo, err error, closed bool) bool, size int, interval time.Duration, maxAge time.Duration) {
+	var batch []foo
+	var opened int64 // elapsed time the first message of the batch was received
+	var timer *time.Timer
+	flush := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		full := batch
+		batch = nil
+		return foreach(full, nil, false)
+	}
+	for {
+		var control uint32
+		arm := func(d time.Duration) {
+			timer = time.AfterFunc(d, func() {
+				atomic.StoreUint32(&control, suspend)
+				e.wakeUp()
+			})
+		}
+		if len(batch) > 0 && interval > 0 {
+			arm(interval - time.Duration(e.elapsed()-opened))
+		}
+		e.iterate(func(value foo, err error, closed bool) bool {
+			if closed {
+				return flush() && foreach(nil, err, true)
+			}
+			batch = append(batch, value)
+			if len(batch) == 1 && interval > 0 {
+				opened = e.elapsed()
+				arm(interval)
+			}
+			if size > 0 && len(batch) >= size {
+				return flush()
+			}
+			return true
+		}, nil, maxAge, &control)
+		if atomic.LoadUint64(&e.cursor) == parked {
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if len(batch) > 0 && time.Duration(e.elapsed()-opened) < interval {
+			continue // woken up before the interval passed on the clock of the channel
+		}
+		if !flush() {
+			e.Cancel()
+			return
+		}
+	}
+}
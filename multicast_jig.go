@@ -6,15 +6,113 @@
 
 package multicast
 
-import _ "github.com/reactivego/multicast/generic"
+import (
+	"context"
+	"time"
+
+	_ "github.com/reactivego/multicast/generic"
+)
 
 func require() {
 	c := NewChan(0, 0)
+	NewChanChecked()
+	NewChanOpts(WithBufferCapacity(0), WithEndpointCapacity(0), WithSpinBudget(0), WithClock(nil), WithLossy(), WithConflate(), WithGrowth(0), WithRetention(RetentionPolicy{}), WithWatermarks(0, 0, nil, nil), WithRateLimit(0, 0, RateBlock), WithFairSend(), WithLockstep(), WithLeakDetection(0, nil), WithRefCount(nil), WithRoundRobin(), WithHeaders(), WithWaitStrategy(nil), WithEndpointWakeups(), WithCommitBatch(0, 0), WithCommitter(), WithBackoff(0, 0), WithoutTimestamps(), WithCoarseClock(0), WithExactCapacity(), WithShrink(0, 0))
+	NewPartitionedChan(0, nil).NewEndpoints(ReplayAll)
+	NewPriorityChan(0).NewEndpoint(ReplayAll)
+	c.LimitBytes(0, nil)
+	c.Recycle(nil, nil)
+	NewBytePool(0)
+	c.Bytes()
+	c.MemStats(nil).Total()
+	c.Retain()
+	c.Shrink()
+	c.TrimBefore(0)
+	c.ForceTrimBefore(0)
+	c.Demand()
+	c.AwaitDemand()
+	c.EvictSlow(0, 0, nil)
+	c.OnLag(0, 0, nil)
+	c.Pause()
+	c.Resume()
+	c.Paused()
+	c.Endpoints()
+	c.OnFirstEndpoint(nil)
+	c.OnLastEndpoint(nil)
+	c.AutoConnect(0, nil)
+	c.Publisher(ReplayAll).Subscribe(c.Subscriber(0))
+	c.SetSpinBudget(0)
 	c.FastSend(nil)
 	c.Send(nil)
+	c.TrySend(nil)
+	c.SendSlice(nil)
+	c.Producer(0).Flush()
+	c.Latest()
+	c.ConflateBy(func(value interface{}) interface{} { return value })
+	c.Len()
+	c.Cap()
+	c.SendTimeout(nil, 0)
+	c.SendContext(context.Background(), nil)
+	c.Mark("")
+	c.SendAt(nil, time.Time{})
+	c.SendAfter(nil, 0)
+	c.SendHeaders(nil, nil)
+	c.SendError(nil)
+	c.CloseWith(nil, nil)
+	slot, _ := c.Claim()
+	c.Publish(slot)
 	c.Close(nil)
 	c.Closed()
+	c.CloseNow(nil)
+	c.Reset()
+	c.Done()
+	c.Err()
+	c.ReadOnly()
+	c.Sender()
+	c.Seal()
+	c.Sealed()
+	c.Summarize(nil, func(summary interface{}, value interface{}) interface{} { return summary })
+	c.Summary()
 	e, _ := c.NewEndpoint(ReplayAll)
+	c.NewEndpointOpts(WithKeep(ReplayAll), WithMaxAge(0), WithName(""), WithGapHandler(nil), WithOverflow(OverflowBlock), WithIdleTimeout(0), WithSample(0), WithThrottle(0), WithDebounce(0), WithPanicHandler(nil), WithGroup(""), WithAck(0, 0), WithManualCommit(), WithCursorStore(nil, 0))
 	e.Range(func(value interface{}, err error, closed bool) bool{ return false }, 0)
+	e.RangeMarks(func(value interface{}, err error, closed bool) bool{ return false }, func(label string, seq uint64) bool { return false }, 0)
+	e.RangeSeq(func(value interface{}, seq uint64, sent time.Time, err error, closed bool) bool { return false }, 0)
+	e.RangeWindow(func(batch []interface{}, err error, closed bool) bool { return false }, 0, 0, 0)
+	e.RangeMeta(func(value interface{}, msg Message, err error, closed bool) bool { return false }, 0)
+	e.RangeNotifications(func(n Notification) bool { return false }, 0)
+	e.RangeErr(func(value interface{}, err error, closed bool) error { return nil }, 0)
+	e.RangeTimeout(func(value interface{}, err error, closed bool) bool { return false }, 0, 0)
+	e.RangeContext(context.Background(), func(value interface{}, err error, closed bool) bool{ return false }, 0)
+	c.NewEndpointContext(context.Background(), ReplayAll)
+	e.Name()
+	e.Next()
+	e.NextTimeout(0)
+	e.ReadBatch(nil)
+	e.Lag()
+	e.Dropped()
+	e.Seq()
+	e.Seek(0)
+	e.SeekTime(time.Time{})
+	e.Done()
+	e.Request(0)
+	e.Evicted()
+	e.Pause()
+	e.Resume()
+	e.Paused()
+	e.Shared()
+	e.Clone()
+	e.Filter(nil)
+	e.Map(nil)
+	e.Ack()
+	e.Nack()
+	e.DeadLetter(c, nil)
+	e.Reject(nil)
+	e.Commit(0)
+	e.Committed()
 	e.Cancel()
+	r := NewRouter(e, func(value interface{}) int { return 0 })
+	r.Route(c, RouteBlock)
+	r.Run(0)
+	r.Metrics(0)
+	r.Unrouted()
 }
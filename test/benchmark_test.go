@@ -303,3 +303,112 @@ func BenchmarkFanOut_Go_1xN(b *testing.B) {
 	// b.Logf("1x%d, %d msg(s), %d ns/send, %.1fM msgs/sec", PAR, NUMREF, nps, 1.0e03/float64(nps))
 	_ = nps
 }
+
+func BenchmarkSPSC_Chan_1x1(b *testing.B) {
+	NUM := b.N
+
+	b.ResetTimer()
+
+	channel := NewChanInt(BUFSIZE, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	wait := make(chan struct{})
+	go func() {
+		var count, sum int64
+		ep.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				sum += int64(value)
+				count++
+			}
+			return true
+		}, 0)
+		if count != int64(NUM) {
+			b.Errorf("data loss; expected %d messages got %d", NUM, count)
+		} else if expected := count * (count - 1) / 2; sum != expected {
+			b.Errorf("data corruption; expected sum %d got %d", expected, sum)
+		}
+		close(wait)
+	}()
+
+	for n := 0; n < NUM; n++ {
+		channel.Send(n)
+	}
+	channel.Close(nil)
+	<-wait
+}
+
+func BenchmarkSPSC_Chan_FastSend_1x1(b *testing.B) {
+	NUM := b.N
+
+	b.ResetTimer()
+
+	channel := NewChanOptsInt(WithBufferCapacity(BUFSIZE), WithEndpointCapacity(1), WithoutTimestamps())
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	wait := make(chan struct{})
+	go func() {
+		var count, sum int64
+		ep.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				sum += int64(value)
+				count++
+			}
+			return true
+		}, 0)
+		if count != int64(NUM) {
+			b.Errorf("data loss; expected %d messages got %d", NUM, count)
+		} else if expected := count * (count - 1) / 2; sum != expected {
+			b.Errorf("data corruption; expected sum %d got %d", expected, sum)
+		}
+		close(wait)
+	}()
+
+	for n := 0; n < NUM; n++ {
+		channel.FastSend(n)
+	}
+	channel.Close(nil)
+	<-wait
+}
+
+func BenchmarkSPSC_Go_1x1(b *testing.B) {
+	NUM := b.N
+
+	b.ResetTimer()
+
+	c := make(chan int, BUFSIZE)
+
+	wait := make(chan struct{})
+	go func() {
+		var count, sum int64
+		for value := range c {
+			sum += int64(value)
+			count++
+		}
+		if count != int64(NUM) {
+			b.Errorf("data loss; expected %d messages got %d", NUM, count)
+		} else if expected := count * (count - 1) / 2; sum != expected {
+			b.Errorf("data corruption; expected sum %d got %d", expected, sum)
+		}
+		close(wait)
+	}()
+
+	for n := 0; n < NUM; n++ {
+		c <- n
+	}
+	close(c)
+	<-wait
+}
+
+func BenchmarkNewChan(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		channel := NewChanInt(BUFSIZE, 8)
+		channel.Close(nil)
+	}
+}
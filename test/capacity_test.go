@@ -0,0 +1,75 @@
+package test
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+)
+
+func TestChanCapacity(t *testing.T) {
+	if _, err := NewChanCheckedInt(WithBufferCapacity(-1)); err != ErrCapacity {
+		t.Fatalf("expected ErrCapacity for a negative capacity got %v", err)
+	}
+	if _, err := NewChanCheckedInt(WithBufferCapacity(int(maxBufferSizeInt()) + 1)); err != ErrCapacity {
+		t.Fatalf("expected ErrCapacity for a buffer that can't be allocated got %v", err)
+	}
+	if _, err := NewChanCheckedInt(WithEndpointCapacity(-1)); err != ErrCapacity {
+		t.Fatalf("expected ErrCapacity for a negative endpoint capacity got %v", err)
+	}
+	if size, err := bufferSizeInt(1<<21+1, false); err != nil || size != 1<<22 {
+		t.Fatalf("expected %d got %d (%v)", uint64(1<<22), size, err)
+	}
+	if size, err := bufferSizeInt(1<<21+1, true); err != nil || size != 1<<21+1 {
+		t.Fatalf("expected %d got %d (%v)", uint64(1<<21+1), size, err)
+	}
+	channel, err := NewChanCheckedInt(WithBufferCapacity(400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Cap() != 512 {
+		t.Fatalf("expected capacity 512 got %d", channel.Cap())
+	}
+	defer func() {
+		if recover() != ErrCapacity {
+			t.Fatal("expected NewChan to panic with ErrCapacity")
+		}
+	}()
+	NewChanInt(-1, 1)
+}
+
+func TestChanEndpointCapacity(t *testing.T) {
+	if truncated := uint64(math.MaxUint32) + 1; truncated <= math.MaxInt {
+		if _, err := NewChanCheckedInt(WithEndpointCapacity(int(truncated))); err != ErrCapacity {
+			t.Fatalf("expected ErrCapacity for an endpoint capacity that doesn't fit 32 bits got %v", err)
+		}
+	}
+	limit := maxBytes / uint64(unsafe.Sizeof(EndpointInt{}))
+	if limit < math.MaxInt {
+		if _, err := NewChanCheckedInt(WithEndpointCapacity(int(limit + 1))); err != ErrCapacity {
+			t.Fatalf("expected ErrCapacity for an endpoint table that can't be allocated got %v", err)
+		}
+	}
+	if capacity, err := endpointTableInt(math.MaxUint16); err != nil || capacity != math.MaxUint16 {
+		t.Fatalf("expected %d got %d (%v)", math.MaxUint16, capacity, err)
+	}
+}
+
+func TestNewChanEndpointCapacity(t *testing.T) {
+	truncated := uint64(math.MaxUint32) + 1
+	if truncated > math.MaxInt {
+		t.Skip("int can't hold a capacity that doesn't fit 32 bits")
+	}
+	for name, create := range map[string]func(){
+		"NewChan":     func() { NewChanInt(128, int(truncated)) },
+		"NewChanOpts": func() { NewChanOptsInt(WithEndpointCapacity(int(truncated))) },
+	} {
+		func() {
+			defer func() {
+				if recover() != ErrCapacity {
+					t.Errorf("expected %s to panic with ErrCapacity before deferring the endpoint table", name)
+				}
+			}()
+			create()
+		}()
+	}
+}
@@ -0,0 +1,146 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChanConflateBy(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	channel.ConflateBy(func(value int) interface{} { return value % 10 })
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []int{1, 2, 3, 4, 12, 13, 23} {
+		channel.Send(value)
+	}
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[1 12 23 4]" {
+		t.Fatalf("expected [1 12 23 4] got %v", received)
+	}
+}
+
+// conflating returns a channel conflating by the last digit of the values,
+// with a full buffer holding 1, 2, 3 and 4 and an endpoint at the start.
+func conflating(t *testing.T, opts ...ChanOption) (*ChanInt, *EndpointInt) {
+	channel := NewChanOptsInt(append([]ChanOption{WithBufferCapacity(4), WithEndpointCapacity(1)}, opts...)...)
+	channel.ConflateBy(func(value int) interface{} { return value % 10 })
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []int{1, 2, 3, 4} {
+		channel.Send(value)
+	}
+	return channel, ep
+}
+
+func received(ep *EndpointInt) string {
+	var values []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			values = append(values, value)
+		}
+		return true
+	}, 0)
+	return fmt.Sprint(values)
+}
+
+func TestChanConflateTrySend(t *testing.T) {
+	channel, ep := conflating(t)
+	if !channel.TrySend(12) {
+		t.Fatal("expected TrySend to replace 2")
+	}
+	if channel.TrySend(15) {
+		t.Fatal("expected TrySend to fail without a message to replace")
+	}
+	channel.Close(nil)
+	if values := received(ep); values != "[1 12 3 4]" {
+		t.Fatalf("expected [1 12 3 4] got %v", values)
+	}
+}
+
+func TestChanConflateSendTimeout(t *testing.T) {
+	channel, ep := conflating(t)
+	if err := channel.SendTimeout(13, time.Second); err != nil {
+		t.Fatalf("expected SendTimeout to replace 3, got %v", err)
+	}
+	if err := channel.SendTimeout(15, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout without a message to replace, got %v", err)
+	}
+	channel.Close(nil)
+	if values := received(ep); values != "[1 2 13 4]" {
+		t.Fatalf("expected [1 2 13 4] got %v", values)
+	}
+}
+
+func TestChanConflateSendContext(t *testing.T) {
+	channel, ep := conflating(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := channel.SendContext(ctx, 14); err != nil {
+		t.Fatalf("expected SendContext to replace 4, got %v", err)
+	}
+	cancel()
+	if err := channel.SendContext(ctx, 15); err != context.Canceled {
+		t.Fatalf("expected context.Canceled without a message to replace, got %v", err)
+	}
+	channel.Close(nil)
+	if values := received(ep); values != "[1 2 3 14]" {
+		t.Fatalf("expected [1 2 3 14] got %v", values)
+	}
+}
+
+func TestChanConflateSendSlice(t *testing.T) {
+	channel, ep := conflating(t)
+	if err := channel.SendSlice([]int{12, 23, 14}); err != nil {
+		t.Fatal(err)
+	}
+	channel.Close(nil)
+	if values := received(ep); values != "[1 12 23 14]" {
+		t.Fatalf("expected [1 12 23 14] got %v", values)
+	}
+}
+
+func TestChanConflateSendHeaders(t *testing.T) {
+	channel, ep := conflating(t, WithHeaders())
+	channel.SendHeaders(12, Headers{"trace": "t12"})
+	channel.Close(nil)
+	var traces []string
+	ep.RangeMeta(func(value int, msg Message, err error, closed bool) bool {
+		if !closed {
+			traces = append(traces, fmt.Sprintf("%d:%s", value, msg.Headers["trace"]))
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(traces) != "[1: 12:t12 3: 4:]" {
+		t.Fatalf("unexpected headers %v", traces)
+	}
+}
+
+func TestChanConflateSendAfter(t *testing.T) {
+	channel, ep := conflating(t)
+	start := time.Now()
+	channel.SendAfter(12, 50*time.Millisecond)
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+	if _, ok, _ := ep.NextTimeout(10 * time.Millisecond); ok {
+		t.Fatal("expected the replacing message to be withheld")
+	}
+	if value, _, _ := ep.Next(); value != 12 {
+		t.Fatalf("expected 12 got %d", value)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected delivery after 50ms got %v", elapsed)
+	}
+}
@@ -1,10 +1,14 @@
 package test
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 	"unsafe"
 
+	"github.com/reactivego/multicast/cacheline"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -62,12 +66,18 @@ func TestMemoryLayout(t *testing.T) {
 		_____________e pad56
 	}
 
-	const sizeofendpoints = _PADDING*(_EXTRA_PADDING+(24+4+4+(32))) + (1-_PADDING)*(24+4+4+(8))
+	const sizeofendpoints = _PADDING*(2*_EXTRA_PADDING+(24+4+4+4+4+(24))+(24+8+4+(28))) + (1-_PADDING)*(24+4+4+4+4+24+8+8)
 	eps := struct {
-		entry    []endpoint
-		len      uint32
-		activity uint32 // idling, enumerating, creating
-		________ pad32
+		entry     []endpoint
+		len       uint32
+		activity  uint32 // idling, enumerating, creating
+		capacity  uint32
+		sliding   int32
+		________  pad24
+		shards    []uint64
+		min       uint64
+		lossy     int32
+		_________ pad28
 	}{}
 	result = int(unsafe.Sizeof(eps))
 	assert.Equal(t, sizeofendpoints, result)
@@ -76,4 +86,112 @@ func TestMemoryLayout(t *testing.T) {
 	ep := endpoint{}
 	result = int(unsafe.Sizeof(ep))
 	assert.Equal(t, sizeofEndpoint, result)
+
+	const sizeofLine = _PADDING*cacheline.Size + (1-_PADDING)*8
+	c := ChanInt{}
+	result = int(unsafe.Offsetof(c.end) - unsafe.Offsetof(c.begin))
+	assert.Equal(t, sizeofLine, result)
+	result = int(unsafe.Offsetof(c.commit) - unsafe.Offsetof(c.end))
+	assert.Equal(t, sizeofLine, result)
+}
+
+// TestPaddingGroups checks that every group of fields closed by a padding
+// field fills whole cache lines, so the hot fields of the channel and its
+// endpoints don't share a cache line with their neighbours. A nested struct
+// with its own padding, like the endpoints of the channel, forms a group of
+// its own. The configuration after the last padding is only read, so it may
+// share a cache line with whatever follows the struct.
+func TestPaddingGroups(t *testing.T) {
+	if cacheline.Padding == 0 {
+		t.Skip("padding turned off by build tag multicast_compact")
+	}
+	for _, err := range paddingErrors(reflect.TypeOf(ChanInt{})) {
+		t.Error(err)
+	}
+	for _, err := range paddingErrors(reflect.TypeOf(EndpointInt{})) {
+		t.Error(err)
+	}
+}
+
+// TestPaddingGroupsMisaligned checks that paddingErrors reports a group that
+// doesn't fill a cache line and a group that spills into the next one.
+func TestPaddingGroupsMisaligned(t *testing.T) {
+	if cacheline.Padding == 0 {
+		t.Skip("padding turned off by build tag multicast_compact")
+	}
+	short := struct {
+		a  uint64
+		__ pad52
+	}{}
+	if errs := paddingErrors(reflect.TypeOf(short)); len(errs) == 0 {
+		t.Error("expected a short group to be reported")
+	}
+	spilled := struct {
+		a  [9]uint64
+		__ pad52
+	}{}
+	if errs := paddingErrors(reflect.TypeOf(spilled)); len(errs) == 0 {
+		t.Error("expected a spilled group to be reported")
+	}
+}
+
+// TestPaddingOffsets checks that the hot fields of the channel and its
+// endpoints start on a cache line.
+func TestPaddingOffsets(t *testing.T) {
+	if cacheline.Padding == 0 {
+		t.Skip("padding turned off by build tag multicast_compact")
+	}
+	c := ChanInt{}
+	e := EndpointInt{}
+	offsets := map[string]uintptr{
+		"ChanInt.begin":             unsafe.Offsetof(c.begin),
+		"ChanInt.end":               unsafe.Offsetof(c.end),
+		"ChanInt.commit":            unsafe.Offsetof(c.commit),
+		"ChanInt.write":             unsafe.Offsetof(c.write),
+		"ChanInt.endpoints":         unsafe.Offsetof(c.endpoints),
+		"ChanInt.channelState":      unsafe.Offsetof(c.channelState),
+		"ChanInt.receivers":         unsafe.Offsetof(c.receivers),
+		"EndpointInt.cursor":        unsafe.Offsetof(e.cursor),
+		"EndpointInt.endpointState": unsafe.Offsetof(e.endpointState),
+		"EndpointInt.demand":        unsafe.Offsetof(e.demand),
+	}
+	for name, offset := range offsets {
+		if offset%cacheline.Size != 0 {
+			t.Errorf("%s: offset %d is not a multiple of %d", name, offset, cacheline.Size)
+		}
+	}
+}
+
+// paddingErrors returns the groups of fields of typ that don't fill whole
+// cache lines.
+func paddingErrors(typ reflect.Type) (errs []string) {
+	start := uintptr(0)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		end := field.Offset + field.Type.Size()
+		switch {
+		case strings.HasPrefix(field.Name, "__"):
+			if (end-start)%cacheline.Size != 0 {
+				errs = append(errs, fmt.Sprintf("%s.%s: group at offset %d is %d bytes, expected a multiple of %d", typ.Name(), field.Name, start, end-start, cacheline.Size))
+			}
+			start = end
+		case field.Type.Kind() == reflect.Struct && padded(field.Type):
+			if field.Offset != start {
+				errs = append(errs, fmt.Sprintf("%s.%s: at offset %d shares a cache line with the fields before it", typ.Name(), field.Name, field.Offset))
+			}
+			errs = append(errs, paddingErrors(field.Type)...)
+			start = end
+		}
+	}
+	return errs
+}
+
+// padded returns true when the struct contains padding fields.
+func padded(typ reflect.Type) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		if strings.HasPrefix(typ.Field(i).Name, "__") {
+			return true
+		}
+	}
+	return false
 }
@@ -5,30 +5,51 @@
 package test
 
 import (
+	"context"
 	"fmt"
+	"github.com/reactivego/multicast/cacheline"
+	"hash/fnv"
 	"math"
+	"math/bits"
+	"reflect"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 //jig:name ChanPadding
 
-const _PADDING = 1	// 0 turns padding off, 1 turns it on.
+// Padding is configured at build time, see package cacheline. Fields are
+// grouped into 64 bytes, so on larger cache lines every group gets the
+// difference as extra padding.
+const _PADDING = cacheline.Padding	// 0 turns padding off, 1 turns it on.
 
-const _EXTRA_PADDING = 0 * 64	// multiples of 64, benefits inconclusive.
+const _EXTRA_PADDING = cacheline.Size - 64	// multiples of 64.
 
 type pad60 [_PADDING * (_EXTRA_PADDING + 60)]byte
 
 type pad56 [_PADDING * (_EXTRA_PADDING + 56)]byte
 
+type pad52 [_PADDING * (_EXTRA_PADDING + 52)]byte
+
 type pad48 [_PADDING * (_EXTRA_PADDING + 48)]byte
 
+type pad44 [_PADDING * (_EXTRA_PADDING + 44)]byte
+
 type pad40 [_PADDING * (_EXTRA_PADDING + 40)]byte
 
+type pad36 [_PADDING * (_EXTRA_PADDING + 36)]byte
+
 type pad32 [_PADDING * (_EXTRA_PADDING + 32)]byte
 
+type pad28 [_PADDING * (_EXTRA_PADDING + 28)]byte
+
+type pad24 [_PADDING * (_EXTRA_PADDING + 24)]byte
+
 //jig:name ChanState
 
 // Activity of committer
@@ -37,11 +58,19 @@ const (
 	working
 )
 
+// Pause state of channel
+const (
+	running	uint32	= iota
+	pausing
+	paused
+)
+
 // Activity of endpoints
 const (
 	idling	uint32	= iota
 	enumerating
 	creating
+	ranging
 )
 
 // State of endpoint and channel
@@ -51,6 +80,20 @@ const (
 	closed
 )
 
+// Control of ranging over an endpoint
+const (
+	proceed	uint32	= iota
+	abort		// cancel the endpoint
+	suspend		// return leaving the endpoint active
+)
+
+// State of a message delivered to an endpoint in acknowledged mode
+const (
+	unacknowledged	uint32	= iota
+	acknowledged
+	rejected
+)
+
 // Cursor is parked so it does not influence advancing the commit index.
 const (
 	parked uint64 = math.MaxUint64
@@ -62,6 +105,69 @@ const (
 	ReplayAll uint64 = math.MaxUint64
 )
 
+//jig:name closeSignal
+
+// closeSignal is closed by Close together with the error passed to Close, see
+// Done and Err. Reset replaces it by a new one instead of reusing it, so
+// goroutines still holding the previous one don't race with Reset.
+type closeSignal struct {
+	done	chan struct{}
+	err	error
+}
+
+//jig:name backoff
+
+// backoff is called by a goroutine waiting in a spinlock. It will spin for
+// budget iterations before calling runtime.Gosched to yield the processor.
+func backoff(spins *uint32, budget uint32) {
+	if *spins < budget {
+		*spins++
+		return
+	}
+	*spins = 0
+	runtime.Gosched()
+}
+
+//jig:name RetentionPolicy
+
+// RetentionPolicy bounds the messages a channel keeps in its buffer after all
+// endpoints have read them. Such messages are normally kept until the buffer
+// is full, so they can be replayed to new endpoints. Messages beyond the
+// policy are released as soon as possible instead and their slots are zeroed,
+// so the garbage collector can reclaim any memory they refer to. A zero field
+// does not limit retention. Messages that an active endpoint has not read yet,
+// or not committed yet when it was created with WithManualCommit, are never
+// released by the policy.
+type RetentionPolicy struct {
+	// MaxCount is the maximum number of messages kept in the buffer.
+	MaxCount	int
+
+	// MaxAge is the maximum age of the messages kept in the buffer. Since
+	// messages sent with FastSend have no timestamp, MaxAge does not apply
+	// to them.
+	MaxAge	time.Duration
+
+	// MaxBytes is the maximum total estimated size of the messages kept in
+	// the buffer. It only applies to a channel bounded by LimitBytes, which
+	// provides the size function.
+	MaxBytes	int64
+}
+
+//jig:name RatePolicy
+
+// RatePolicy determines what happens when a message sent to a channel would
+// exceed its rate limit, see WithRateLimit.
+type RatePolicy uint32
+
+const (
+	// RateBlock blocks the sender until the message can be sent without
+	// exceeding the rate limit.
+	RateBlock	RatePolicy	= iota
+
+	// RateReject rejects the message, Send then returns ErrRateLimited.
+	RateReject
+)
+
 //jig:name ChanInt
 
 // ChanInt is a fast, concurrent multi-(casting,sending,receiving) buffered
@@ -69,41 +175,157 @@ const (
 // runtime.Gosched() are used in situations where goroutines are waiting or
 // contending for resources.
 type ChanInt struct {
-	buffer		[]int
-	_________a	pad40
+	ring		unsafe.Pointer	// *ringInt
+	_________a	pad56
 	begin		uint64
 	_________b	pad56
 	end		uint64
 	_________c	pad56
 	commit		uint64
 	_________d	pad56
-	mod		uint64
+	write		uint64
 	_________e	pad56
+	ticket		uint64	// see WithFairSend
+	_________f	pad56
+	serving		uint64
+	_________g	pad56
+	bytes		int64	// see LimitBytes
+	_________h	pad56
 	endpoints	endpointsInt
 
-	err		error
-	____________f	pad48
-	channelState	uint64	// active, closed
-	____________g	pad56
-
-	write			uint64
-	_________________h	pad56
-	start			time.Time
-	_________________i	pad40
-	written			[]int64	// nanoseconds since start
-	_________________j	pad40
+	channelState	uint64		// active, closed
+	final		uint64		// sequence number after the final message, see CloseWith
+	closing		unsafe.Pointer	// *closeSignal, see Done
+	sealed		uint32
+	aborted		uint32	// see CloseNow
+	____________i	pad32
+
+	receivers	unsafe.Pointer	// *chan struct{} closed by broadcast
+	senders		unsafe.Pointer	// *chan struct{} closed by wakeSenders
+	sleepers	int32		// endpoints blocked on receivers
+	waking		uint32		// a sender is broadcasting
+	dirty		uint32		// messages committed since the last broadcast
+	stalled		int32		// senders blocked on senders, see WithLockstep
+	____________j	pad32
+
+	rateArrival		int64	// see WithRateLimit
+	lastCommit		int64	// elapsed time of the most recent batch commit
+	lagChecked		int64
+	attached		int64				// number of endpoints that did not finish
+	connectPending		int64				// see AutoConnect
+	coarse			int64				// see WithCoarseClock
+	scanned			int64				// time of the last full scan in slideBuffer, atomic
+	shrinkChecked		int64				// elapsed time the buffer was last checked
+	lowSince		int64				// elapsed time since the buffer has been underused
+	summary			atomic.Value			// *reductionInt
+	resumed			atomic.Value			// chan struct{} closed by Resume
+	groups			map[string]*consumerGroup	// see WithGroup
+	marks			sync.Once
+	trimmed			uint32	// see ForceTrimBefore
+	paused			uint32	// see Pause
+	committer		uint32	// resting, working
 	committerActivity	uint32	// resting, working
-	_________________k	pad60
+	aboveHigh		uint32
+	refCount		uint32	// 1 when enabled, 2 when torn down
+	rotation		uint32
+	deferred		uint32	// a message was sent by SendAt or SendAfter
+	____________k		pad36
+
+	growLimit	uint64	// see WithGrowth
+	commitBatch	uint64	// see WithCommitBatch
+	commitDelay	int64
+	commits		chan struct{}	// see WithCommitter
+	committerExit	chan struct{}
+	reduce		func(summary interface{}, value int) interface{}
+	key		func(value int) interface{}	// see ConflateBy
+	byteBudget	int64
+	size		func(value int) int
+	clone		func(value int) int	// see Recycle
+	recycle		func(value int)
+	retention	RetentionPolicy	// see WithRetention
+	lowWater	uint64		// see WithWatermarks
+	highWater	uint64
+	onHigh		func()
+	onLow		func()
+	maxLag		uint64	// see EvictSlow
+	maxDelay	time.Duration
+	onEvict		func(endpoint *EndpointInt, lag uint64)
+	lagThreshold	uint64	// see OnLag
+	lagInterval	time.Duration
+	onLag		func(endpoint *EndpointInt, lag uint64, lagging bool)
+	rateInterval	int64
+	rateTolerance	int64
+	leakIdle	time.Duration	// see WithLeakDetection
+	onLeak		func(leak EndpointInfo)
+	teardown	func()	// see WithRefCount
+	onFirst		func()	// see OnFirstEndpoint
+	onLast		func()	// see OnLastEndpoint
+	connect		func()
+	start		time.Time
+	clock		func() time.Time	// nil means time.Now
+	resolution	time.Duration		// 0 means no coarse clock
+	clockExit	chan struct{}
+	shrinkAfter	int64		// see WithShrink
+	shrinkMin	uint64		// capacity below which the buffer doesn't shrink
+	wait		WaitStrategy	// nil means spin, yield and block after 250ms
+	closeAfter	time.Duration	// see WithBackoff
+	blockAfter	time.Duration
+	spinBudget	uint32	// spins before calling runtime.Gosched
+	lossy		uint32	// see WithLossy
+	conflate	uint32	// see WithConflate
+	fair		uint32	// see WithFairSend
+	lockstep	uint32	// see WithLockstep
+	roundRobin	uint32	// see WithRoundRobin
+	headers		uint32	// see WithHeaders
+	untimed		uint32	// see WithoutTimestamps
+	wakeups		uint32	// endpoints have their own wakeup channel
+	ratePolicy	RatePolicy
+}
+
+// ringInt holds the messages of the channel. It is replaced by a larger ring
+// when the buffer grows (see WithGrowth), so it should be loaded after the
+// index of the message to access was loaded.
+type ringInt struct {
+	buffer	[]int
+	written	[]int64		// nanoseconds since start<<2 | marker<<1 | uncommitted
+	labels	[]string	// labels of markers, see Mark
+	errs	[]error		// errors of error events, see SendError
+	owners	[]uint32	// index+1 of the endpoint a message is assigned to, see WithRoundRobin
+	headers	[]Headers	// headers of messages, see WithHeaders
+	mod	uint64
+	size	uint64	// number of slots, a power of 2 unless WithExactCapacity
+}
+
+// slot returns the position in the ring of the message with the given
+// sequence number. A ring of a power of 2 slots masks the sequence number,
+// only an exact capacity ring (see WithExactCapacity) pays for a division.
+func (r *ringInt) slot(index uint64) uint64 {
+	if r.size&r.mod == 0 {
+		return index & r.mod
+	}
+	return index % r.size
+}
+
+// signal returns the signal closed by Close, see closeSignal.
+func (c *ChanInt) signal() *closeSignal {
+	return (*closeSignal)(atomic.LoadPointer(&c.closing))
+}
 
-	receivers		*sync.Cond
-	_________________l	pad56
+type reductionInt struct {
+	value interface{}
 }
 
 type endpointsInt struct {
 	entry			[]EndpointInt
 	len			uint32
 	endpointsActivity	uint32	// idling, enumerating, creating
-	________		pad32
+	capacity		uint32	// length of entry once allocated, see NewForChan
+	sliding			int32	// goroutines inside AccessShared
+	________		pad24
+	shards			[]uint64	// lower bound of the cursors of every 64 entries, see slowest
+	min			uint64		// lower bound of the cursors of all entries
+	lossy			int32		// endpoints that don't block senders
+	_________		pad28
 }
 
 //jig:name ChannelError
@@ -118,27 +340,129 @@ func (e ChannelError) Error() string	{ return string(e) }
 // endpoints has already been created.
 const ErrOutOfEndpoints = ChannelError("out of endpoints")
 
+//jig:name OverflowPolicy
+
+// OverflowPolicy determines what happens when the buffer of a channel is full
+// and an endpoint has not read the oldest message in the buffer yet.
+type OverflowPolicy uint32
+
+const (
+	// OverflowBlock blocks senders until the endpoint has read another
+	// message. No messages are lost.
+	OverflowBlock	OverflowPolicy	= iota
+
+	// OverflowDropOldest lets senders overwrite the oldest message without
+	// waiting for the endpoint. The endpoint counts the messages it missed,
+	// see Dropped and WithGapHandler.
+	OverflowDropOldest
+
+	// OverflowError lets senders overwrite the oldest message without waiting
+	// for the endpoint. When this causes the endpoint to miss messages, it is
+	// closed with ErrOverflow.
+	OverflowError
+)
+
+//jig:name endpointOptions
+
+type endpointOptions struct {
+	keep		uint64
+	maxAge		time.Duration
+	name		string
+	gap		func(missed uint64)
+	overflow	OverflowPolicy
+	idleTimeout	time.Duration
+	sample		uint64
+	throttle	time.Duration
+	debounce	time.Duration
+	onPanic		func(recovered interface{})
+	group		string
+	acking		uint32
+	ackTimeout	time.Duration
+	ackRetries	uint32
+	manualCommit	uint32
+	cursorStore	CursorStore
+	checkpointEvery	time.Duration
+	resume		uint64
+	resuming	bool
+}
+
 //jig:name endpointsInt
 
-func (e *endpointsInt) NewForChanInt(c *ChanInt, keep uint64) (*EndpointInt, error) {
+func (e *endpointsInt) NewForChanInt(c *ChanInt, o endpointOptions) (*EndpointInt, error) {
+	var spins uint32
+	budget := atomic.LoadUint32(&c.spinBudget)
 	for !atomic.CompareAndSwapUint32(&e.endpointsActivity, idling, creating) {
-		runtime.Gosched()
+		backoff(&spins, budget)
 	}
+	for atomic.LoadInt32(&e.sliding) != 0 {
+		backoff(&spins, budget)
+	}
+	var count int64
+	defer func() {
+		if count != 0 {
+			c.created(count)
+		}
+	}()
 	defer atomic.StoreUint32(&e.endpointsActivity, idling)
 	var start uint64
 	commit := c.commitData()
 	begin := atomic.LoadUint64(&c.begin)
-	if commit-begin <= keep {
+	if commit-begin <= o.keep {
 		start = begin
 	} else {
-		start = commit - keep
+		start = commit - o.keep
+	}
+	if o.resuming && begin <= o.resume && o.resume <= commit {
+		start = o.resume
+	}
+	var group *consumerGroup
+	if o.group != "" {
+		group, start = c.join(o.group, start)
+	}
+	if e.entry == nil {
+		e.allocate(c)
 	}
 	if int(e.len) == len(e.entry) {
 		for index := uint32(0); index < e.len; index++ {
 			ep := &e.entry[index]
-			if atomic.CompareAndSwapUint64(&ep.cursor, parked, start) {
+			if atomic.LoadUint64(&ep.cursor) == parked && atomic.CompareAndSwapUint64(&ep.cursor, parked, start) {
 				ep.endpointState = atomic.LoadUint64(&c.channelState)
 				ep.lastActive = time.Now()
+				atomic.StoreInt64(&ep.lastRead, ep.lastActive.UnixNano())
+				ep.endpointDone = make(chan struct{})
+				atomic.StoreUint32(&ep.endpointFinished, 0)
+				ep.name = o.name
+				ep.maxAge = o.maxAge
+				ep.gap = o.gap
+				ep.overflow = o.overflow
+				ep.idleTimeout = o.idleTimeout
+				ep.sample = o.sample
+				ep.throttle = o.throttle
+				ep.delivered = 0
+				ep.debounce = o.debounce
+				ep.onPanic = o.onPanic
+				ep.group = group
+				ep.index = index
+				ep.acking, ep.ackTimeout, ep.ackRetries = o.acking, o.ackTimeout, o.ackRetries
+				ep.ackSeq = parked
+				ep.deadLetters, ep.onDeadLetter, ep.poison = nil, nil, nil
+				ep.manualCommit = o.manualCommit
+				atomic.StoreUint64(&ep.committed, start)
+				atomic.StoreUint64(&ep.held, parked)
+				ep.cursorStore, ep.checkpointEvery = o.cursorStore, o.checkpointEvery
+				ep.checkpointed, ep.saved = 0, start
+				ep.filter = nil
+				ep.transform = nil
+				atomic.StoreUint64(&ep.dropped, 0)
+				atomic.StoreUint32(&ep.overflowed, 0)
+				atomic.StoreUint64(&ep.demand, 0)
+				atomic.StoreUint32(&ep.evicted, 0)
+				atomic.StoreUint32(&ep.lagging, 0)
+				atomic.StoreUint32(&ep.endpointPaused, 0)
+				ep.origin = c.origin()
+				atomic.StoreUint32(&ep.leakReported, 0)
+				e.enter(ep)
+				count = c.attach()
 				return ep, nil
 			}
 		}
@@ -149,14 +473,46 @@ func (e *endpointsInt) NewForChanInt(c *ChanInt, keep uint64) (*EndpointInt, err
 	ep.cursor = start
 	ep.endpointState = atomic.LoadUint64(&c.channelState)
 	ep.lastActive = time.Now()
-	e.len++
+	ep.lastRead = ep.lastActive.UnixNano()
+	ep.endpointDone = make(chan struct{})
+	ep.name = o.name
+	ep.maxAge = o.maxAge
+	ep.gap = o.gap
+	ep.overflow = o.overflow
+	ep.idleTimeout = o.idleTimeout
+	ep.sample = o.sample
+	ep.throttle = o.throttle
+	ep.debounce = o.debounce
+	ep.onPanic = o.onPanic
+	ep.group = group
+	ep.index = e.len
+	ep.acking, ep.ackTimeout, ep.ackRetries = o.acking, o.ackTimeout, o.ackRetries
+	ep.ackSeq = parked
+	ep.manualCommit = o.manualCommit
+	ep.committed = start
+	ep.held = parked
+	ep.cursorStore, ep.checkpointEvery = o.cursorStore, o.checkpointEvery
+	ep.saved = start
+	ep.origin = c.origin()
+	e.enter(ep)
+	atomic.StoreUint32(&e.len, e.len+1)
+	count = c.attach()
 	return ep, nil
 }
 
-func (e *endpointsInt) Access(access func(*endpointsInt)) bool {
+// Access calls access with exclusive access to the endpoints. It waits for
+// NewForChan, other calls to Access and calls to AccessShared to finish, so
+// access has a stable view of the endpoints and the beginning of the buffer.
+// It returns false when it had to wait.
+func (e *endpointsInt) Access(budget uint32, access func(*endpointsInt)) bool {
 	contention := false
+	var spins uint32
 	for !atomic.CompareAndSwapUint32(&e.endpointsActivity, idling, enumerating) {
-		runtime.Gosched()
+		backoff(&spins, budget)
+		contention = true
+	}
+	for atomic.LoadInt32(&e.sliding) != 0 {
+		backoff(&spins, budget)
 		contention = true
 	}
 	access(e)
@@ -164,6 +520,109 @@ func (e *endpointsInt) Access(access func(*endpointsInt)) bool {
 	return !contention
 }
 
+// AccessShared calls access with access to the endpoints that is shared with
+// other calls to AccessShared, but excludes NewForChan and Access. Senders
+// sliding the buffer use it, so they don't serialize on each other. Access
+// may only read fields of the endpoints that are accessed atomically and
+// must move the beginning of the buffer with a compare-and-swap, see
+// advanceEnd. It returns false when it had to wait.
+func (e *endpointsInt) AccessShared(budget uint32, access func(*endpointsInt)) bool {
+	contention := false
+	var spins uint32
+	for {
+		atomic.AddInt32(&e.sliding, 1)
+		if atomic.LoadUint32(&e.endpointsActivity) == idling {
+			break
+		}
+		atomic.AddInt32(&e.sliding, -1)
+		backoff(&spins, budget)
+		contention = true
+	}
+	access(e)
+	atomic.AddInt32(&e.sliding, -1)
+	return !contention
+}
+
+// Snapshot returns the entries of the endpoints registered so far without
+// getting access to the endpoints. Entries are never moved or freed and their
+// number only grows, a finished endpoint just parks its cursor until its
+// entry is reused. So the snapshot can be scanned while endpoints are created
+// and canceled, as long as only fields are read that are accessed atomically,
+// like the cursor. Scans that need a stable view, e.g. because they move the
+// beginning of the buffer, must use Access instead.
+func (e *endpointsInt) Snapshot() []EndpointInt {
+	n := atomic.LoadUint32(&e.len)
+	if n == 0 {
+		return nil
+	}
+	return e.entry[:n]
+}
+
+// enter accounts for an endpoint created by NewForChan. An endpoint that
+// doesn't block senders is counted until it parks, see park.
+func (e *endpointsInt) enter(ep *EndpointInt) {
+	if ep.overflow != OverflowBlock {
+		atomic.AddInt32(&e.lossy, 1)
+	}
+	e.invalidate(ep.index)
+}
+
+// invalidate forgets the lower bounds of the cursors kept by slowest for the
+// entry at index, after its cursor was moved back. It must be called with
+// exclusive access to the endpoints.
+func (e *endpointsInt) invalidate(index uint32) {
+	atomic.StoreUint64(&e.shards[index/64], 0)
+	atomic.StoreUint64(&e.min, 0)
+}
+
+//jig:name ErrCapacity
+
+// ErrCapacity is returned by NewChanChecked when the requested buffer or
+// endpoint capacity is negative or too large to be allocated.
+// NewChan and NewChanOpts panic with it instead.
+const ErrCapacity = ChannelError("capacity out of range")
+
+//jig:name maxBytes
+
+// maxBytes is the largest allocation the Go runtime can make: 2^31-1 bytes on
+// 32-bit platforms and 2^47-1 bytes on 64-bit platforms, whose address space
+// is limited to 48 bits.
+const maxBytes = uint64(^uintptr(0) >> 1 >> (^uintptr(0) >> 63 * 16))
+
+//jig:name bufferSizeInt
+
+// bufferSizeInt returns the number of messages in the buffer of a channel
+// created with the given capacity. The capacity is rounded up to a power of 2
+// unless exact is true, and a capacity of 0 gives a buffer of 1 message.
+// Every message takes a slot in the buffer and a timestamp, so ErrCapacity is
+// returned when the slots and timestamps together would not fit the largest
+// possible allocation.
+func bufferSizeInt(capacity int, exact bool) (uint64, error) {
+	if capacity < 0 {
+		return 0, ErrCapacity
+	}
+	size := uint64(capacity)
+	if size < 1 {
+		size = 1
+	}
+	if !exact && size&(size-1) != 0 {
+		if bits.Len64(size-1) == 64 {
+			return 0, ErrCapacity
+		}
+		size = 1 << uint(bits.Len64(size-1))
+	}
+	if size > maxBufferSizeInt() {
+		return 0, ErrCapacity
+	}
+	return size, nil
+}
+
+// maxBufferSizeInt returns the largest number of messages a buffer can hold.
+func maxBufferSizeInt() uint64 {
+	var zero int
+	return maxBytes / (uint64(unsafe.Sizeof(zero)) + 8)
+}
+
 //jig:name NewChanInt
 
 // NewChanInt creates a new channel. The parameters bufferCapacity and
@@ -172,28 +631,54 @@ func (e *endpointsInt) Access(access func(*endpointsInt)) bool {
 //
 // Note that bufferCapacity is always scaled up to a power of 2 so e.g.
 // specifying 400 will create a buffer of 512 (2^9). Also because of this a
-// bufferCapacity of 0 is scaled up to 1 (2^0).
+// bufferCapacity of 0 is scaled up to 1 (2^0). See WithExactCapacity to use
+// the exact capacity instead.
+//
+// NewChanInt panics with ErrCapacity when a capacity is negative or the
+// buffer or endpoint table is too large to be allocated, see NewChanChecked.
 func NewChanInt(bufferCapacity int, endpointCapacity int) *ChanInt {
+	size, err := bufferSizeInt(bufferCapacity, false)
+	if err != nil {
+		panic(err)
+	}
+	entries, err := endpointTableInt(endpointCapacity)
+	if err != nil {
+		panic(err)
+	}
+	return newChanInt(size, entries)
+}
 
-	size := uint64(1) << uint(math.Ceil(math.Log2(float64(bufferCapacity))))
-	c := &ChanInt{
+// newChanInt creates a new channel with a buffer of exactly size messages and
+// a table of entries endpoints, both validated by the caller. They are
+// allocated when first used, see loadRing and NewForChan.
+func newChanInt(size uint64, entries uint32) *ChanInt {
+	receivers := make(chan struct{})
+	senders := make(chan struct{})
+	return &ChanInt{
+		ring:		unsafe.Pointer(&ringInt{mod: size - 1, size: size}),
 		end:		size,
-		mod:		size - 1,
-		buffer:		make([]int, size),
 		start:		time.Now(),
-		written:	make([]int64, size),
+		closing:	unsafe.Pointer(&closeSignal{done: make(chan struct{})}),
+		closeAfter:	time.Millisecond,
+		blockAfter:	250 * time.Millisecond,
 		endpoints: endpointsInt{
-			entry: make([]EndpointInt, endpointCapacity),
+			capacity: entries,
 		},
+		receivers:	unsafe.Pointer(&receivers),
+		senders:	unsafe.Pointer(&senders),
 	}
-	c.receivers = sync.NewCond(c)
-	return c
 }
 
-// Lock, empty method so we can pass *ChanInt to sync.NewCond as a Locker.
+// Lock is an empty method, kept because *ChanInt used to be passed to
+// sync.NewCond as a Locker.
+//
+// Deprecated: Lock does nothing.
 func (c *ChanInt) Lock()	{}
 
-// Unlock, empty method so we can pass *ChanInt to sync.NewCond as a Locker.
+// Unlock is an empty method, kept because *ChanInt used to be passed to
+// sync.NewCond as a Locker.
+//
+// Deprecated: Unlock does nothing.
 func (c *ChanInt) Unlock()	{}
 
 //jig:name EndpointInt
@@ -201,22 +686,170 @@ func (c *ChanInt) Unlock()	{}
 // EndpointInt is returned by a call to NewEndpoint on the channel. Every
 // endpoint should be used by only a single goroutine, so no sharing between
 // goroutines.
+// Use Shared to wrap an endpoint that has to be shared between goroutines.
 type EndpointInt struct {
 	*ChanInt
-	_____________a	pad56
-	cursor		uint64
-	_____________b	pad56
-	endpointState	uint64	// active, canceled, closed
-	_____________c	pad56
-	lastActive	time.Time	// track activity to deterime when to sleep
-	_____________d	pad40
-	endpointClosed	uint64	// active, closed
-	_____________e	pad56
+	_____________a		pad56
+	cursor			uint64
+	committed		uint64	// see WithManualCommit
+	held			uint64	// first value handed out by the last Next or ReadBatch, see Recycle
+	_____________b		pad40
+	endpointState		uint64	// active, canceled, closed
+	_____________c		pad56
+	demand			uint64	// see Request
+	endpointActivity	uint32	// idling, ranging
+	sleeping		uint32
+	ackState		uint32	// unacknowledged, acknowledged, rejected
+	_____________d		pad44
+
+	lastRead		int64	// see Chan.Endpoints
+	delivered		int64
+	dropped			uint64	// see Dropped
+	endpointClosed		uint64	// active, closed
+	ackSeq			uint64	// sequence number of the message awaiting ack
+	ackDeadline		int64
+	checkpointed		int64
+	saved			uint64
+	lastActive		time.Time	// track activity to deterime when to sleep
+	poison			error		// see Reject
+	ackAttempts		uint32
+	overflowed		uint32
+	lagging			uint32	// see OnLag
+	evicted			uint32	// see EvictSlow
+	endpointPaused		uint32	// see Endpoint.Pause
+	leakReported		uint32
+	endpointFinished	uint32
+	_____________e		pad60
+
+	name		string					// see WithName
+	origin		string					// see WithLeakDetection
+	cursorStore	CursorStore				// see WithCursorStore
+	maxAge		time.Duration				// see WithMaxAge
+	gap		func(missed uint64)			// see WithGapHandler
+	idleTimeout	time.Duration				// see WithIdleTimeout
+	filter		func(value int) bool			// see Filter
+	transform	func(value int) int			// see Map
+	sample		uint64					// see WithSample
+	throttle	time.Duration				// see WithThrottle
+	debounce	time.Duration				// see WithDebounce
+	onPanic		func(recovered interface{})		// see WithPanicHandler
+	group		*consumerGroup				// see WithGroup
+	ackTimeout	time.Duration				// see WithAck
+	deadLetters	*ChanInt				// see DeadLetter
+	onDeadLetter	func(value int, failure Failure)	// see DeadLetter
+	checkpointEvery	time.Duration
+	wakeup		chan struct{}	// see WithEndpointWakeups
+	endpointDone	chan struct{}	// closed when the endpoint finishes
+	overflow	OverflowPolicy	// see WithOverflow
+	index		uint32		// position in the endpoints, see WithRoundRobin
+	acking		uint32
+	ackRetries	uint32
+	manualCommit	uint32
+}
+
+//jig:name EndpointInt_info
+
+// info describes the endpoint at the given cursor for the given commit index.
+func (e *EndpointInt) info(cursor, commit uint64) EndpointInfo {
+	info := EndpointInfo{
+		Name:		e.name,
+		Cursor:		cursor,
+		LastActive:	time.Unix(0, atomic.LoadInt64(&e.lastRead)),
+		Origin:		e.origin,
+	}
+	if cursor < commit {
+		info.Lag = commit - cursor
+	}
+	switch {
+	case atomic.LoadUint32(&e.evicted) == 1:
+		info.State = EndpointEvicted
+	case atomic.LoadUint64(&e.endpointState) == canceled:
+		info.State = EndpointCanceled
+	case atomic.LoadUint64(&e.endpointState) == closed:
+		info.State = EndpointClosed
+	case atomic.LoadUint32(&e.endpointPaused) == 1:
+		info.State = EndpointPaused
+	}
+	return info
+}
+
+//jig:name ChanInt_broadcast
+
+// broadcast wakes up all endpoints blocked on the channel shared by them, see
+// block. The channel is closed and replaced by a new one, so every endpoint
+// that took the channel before the broadcast is woken up.
+func (c *ChanInt) broadcast() {
+	next := make(chan struct{})
+	close(*(*chan struct{})(atomic.SwapPointer(&c.receivers, unsafe.Pointer(&next))))
+}
+
+//jig:name EndpointInt_wakeUp
+
+// wakeUp wakes up the endpoint when it is blocked waiting for messages. With
+// a shared channel this wakes up all blocked endpoints of the channel.
+func (e *EndpointInt) wakeUp() {
+	if e.wakeup == nil {
+		e.broadcast()
+		return
+	}
+	if atomic.CompareAndSwapUint32(&e.sleeping, 1, 0) {
+		select {
+		case e.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//jig:name ChanInt_wakeEndpoints
+
+// wakeEndpoints wakes up every endpoint blocked on its own wakeup channel, see
+// WithEndpointWakeups.
+func (c *ChanInt) wakeEndpoints() {
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if atomic.LoadUint32(&entries[i].sleeping) == 1 {
+			entries[i].wakeUp()
+		}
+	}
+}
+
+//jig:name ChanInt_wake
+
+// wake wakes up the endpoints blocked waiting for messages. When no endpoint
+// is blocked, wake returns right away without broadcasting.
+// Concurrent calls are coalesced: while one sender is broadcasting, the others
+// only flag that there is more to tell, so a burst of sends wakes up every
+// blocked endpoint just once instead of once per message.
+func (c *ChanInt) wake() {
+	if atomic.LoadInt32(&c.sleepers) == 0 {
+		return
+	}
+	if c.wakeups == 1 {
+		c.wakeEndpoints()
+		return
+	}
+	atomic.StoreUint32(&c.dirty, 1)
+	for atomic.LoadUint32(&c.dirty) == 1 && atomic.CompareAndSwapUint32(&c.waking, 0, 1) {
+		atomic.StoreUint32(&c.dirty, 0)
+		c.broadcast()
+		atomic.StoreUint32(&c.waking, 0)
+	}
 }
 
 //jig:name ChanInt_commitData
 
 func (c *ChanInt) commitData() uint64 {
+	commit := atomic.LoadUint64(&c.commit)
+	if atomic.LoadUint32(&c.committer) != working && (c.commitBatch <= 1 || c.batched(commit)) {
+		commit = c.commitAll()
+	}
+	if final := atomic.LoadUint64(&c.final); final != 0 && commit > final {
+		return final
+	}
+	return commit
+}
+
+func (c *ChanInt) commitAll() uint64 {
 	commit := atomic.LoadUint64(&c.commit)
 	if commit >= atomic.LoadUint64(&c.write) {
 		return commit
@@ -225,9 +858,10 @@ func (c *ChanInt) commitData() uint64 {
 		return commit
 	}
 	commit = atomic.LoadUint64(&c.commit)
+	r := c.loadRing()
 	newcommit := commit
-	for ; atomic.LoadInt64(&c.written[newcommit&c.mod])&1 == 1; newcommit++ {
-		atomic.AddInt64(&c.written[newcommit&c.mod], -1)
+	for ; atomic.LoadInt64(&r.written[r.slot(newcommit)])&1 == 1; newcommit++ {
+		atomic.AddInt64(&r.written[r.slot(newcommit)], -1)
 		if newcommit >= atomic.LoadUint64(&c.end) {
 			break
 		}
@@ -237,15 +871,142 @@ func (c *ChanInt) commitData() uint64 {
 		panic(fmt.Sprintf("commitData: range error (commit=%d,write=%d,newcommit=%d)", commit, write, newcommit))
 	}
 	if newcommit > commit {
+		if c.reduce != nil {
+			summary := c.summary.Load().(*reductionInt).value
+			for seq := commit; seq < newcommit; seq++ {
+				if atomic.LoadInt64(&r.written[r.slot(seq)])&2 == 0 {
+					summary = c.reduce(summary, r.buffer[r.slot(seq)])
+				}
+			}
+			c.summary.Store(&reductionInt{summary})
+		}
 		if !atomic.CompareAndSwapUint64(&c.commit, commit, newcommit) {
 			panic(fmt.Sprintf("commitData; swap error (c.commit=%d,%d,%d)", c.commit, commit, newcommit))
 		}
-		c.receivers.Broadcast()
+		if c.commitBatch > 1 {
+			atomic.StoreInt64(&c.lastCommit, c.elapsed())
+		}
+		c.wake()
 	}
 	atomic.StoreUint32(&c.committerActivity, resting)
 	return atomic.LoadUint64(&c.commit)
 }
 
+//jig:name ChanInt_leaked
+
+// origin returns the stack trace of the goroutine creating an endpoint when
+// leak detection is enabled, see WithLeakDetection.
+func (c *ChanInt) origin() string {
+	if c.leakIdle == 0 {
+		return ""
+	}
+	return string(debug.Stack())
+}
+
+// leaked returns the endpoints that did not read any messages for longer than
+// the leak detection idle time while holding on to the oldest message in the
+// full buffer. Every endpoint is returned only once. It must be called with
+// access to the endpoints, which may be shared (see AccessShared), after
+// which the caller should call reportLeaks.
+func (c *ChanInt) leaked(entries []EndpointInt) (leaks []EndpointInfo) {
+	if c.leakIdle == 0 {
+		return nil
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	idle := time.Now().Add(-c.leakIdle).UnixNano()
+	for i := range entries {
+		ep := &entries[i]
+		cursor := atomic.LoadUint64(&ep.cursor)
+		if cursor != begin || ep.overflow != OverflowBlock ||
+			atomic.LoadUint64(&ep.endpointState) != active ||
+			atomic.LoadUint32(&ep.endpointPaused) == 1 ||
+			atomic.LoadUint32(&ep.endpointActivity) != idling ||
+			atomic.LoadInt64(&ep.lastRead) > idle {
+			continue
+		}
+		if atomic.CompareAndSwapUint32(&ep.leakReported, 0, 1) {
+			leaks = append(leaks, ep.info(cursor, c.commitData()))
+		}
+	}
+	return leaks
+}
+
+// reportLeaks passes the leaked endpoints to the leak detection callback.
+func (c *ChanInt) reportLeaks(leaks []EndpointInfo) {
+	for _, leak := range leaks {
+		c.onLeak(leak)
+	}
+}
+
+//jig:name ChanInt_attach
+
+// attach counts an endpoint created on the channel. It returns the number of
+// endpoints that did not finish yet, which should be passed to created after
+// allowing access to the endpoints again.
+func (c *ChanInt) attach() int64 {
+	return atomic.AddInt64(&c.attached, 1)
+}
+
+// created calls the first endpoint callback and the start function of
+// AutoConnect when due.
+func (c *ChanInt) created(count int64) {
+	if count == 1 && c.onFirst != nil {
+		c.onFirst()
+	}
+	if c.connect != nil && atomic.AddInt64(&c.connectPending, -1) == 0 {
+		c.connect()
+	}
+}
+
+//jig:name ChanInt_join
+
+// join returns the consumer group with the given name, creating it when it
+// does not exist yet, and the sequence number a new member should start at.
+// It must be called while creating an endpoint.
+func (c *ChanInt) join(name string, start uint64) (*consumerGroup, uint64) {
+	if c.groups == nil {
+		c.groups = make(map[string]*consumerGroup)
+	}
+	group := c.groups[name]
+	if group == nil {
+		group = &consumerGroup{claimed: start}
+		c.groups[name] = group
+	} else if claimed := atomic.LoadUint64(&group.claimed); claimed > start {
+		start = claimed
+	}
+	return group, start
+}
+
+//jig:name endpointsInt_allocate
+
+// allocate creates the table of endpoints, sized from the endpointCapacity
+// passed when creating the channel, together with the lower bounds of their
+// cursors (see slowest). It is called by the first NewEndpoint, which has
+// exclusive access to the endpoints. Entries are never moved, so the table is
+// allocated only once.
+func (e *endpointsInt) allocate(c *ChanInt) {
+	e.entry = make([]EndpointInt, e.capacity)
+	e.shards = make([]uint64, (e.capacity+63)/64)
+	if c.wakeups == 1 {
+		for i := range e.entry {
+			e.entry[i].wakeup = make(chan struct{}, 1)
+		}
+	}
+}
+
+//jig:name ChanInt_loadRing
+
+// loadRing returns the ring holding the messages. A channel is created with
+// an empty ring, which is replaced by an allocated one the first time the
+// ring is loaded, normally by the first Send, see allocate.
+func (c *ChanInt) loadRing() *ringInt {
+	r := (*ringInt)(atomic.LoadPointer(&c.ring))
+	if r.written == nil {
+		return c.allocate(r)
+	}
+	return r
+}
+
 //jig:name ChanInt_NewEndpoint
 
 // NewEndpoint will create a new channel endpoint that can be used to receive
@@ -259,178 +1020,5702 @@ func (c *ChanInt) commitData() uint64 {
 // An endpoint that is canceled or read until it is exhausted (after channel was
 // closed) will be reused by NewEndpoint.
 func (c *ChanInt) NewEndpoint(keep uint64) (*EndpointInt, error) {
-	return c.endpoints.NewForChanInt(c, keep)
+	return c.endpoints.NewForChanInt(c, endpointOptions{keep: keep})
 }
 
-//jig:name ChanInt_slideBuffer
+//jig:name ChanInt_Done
 
-func (c *ChanInt) slideBuffer() bool {
-	slowestCursor := parked
-	spinlock := c.endpoints.Access(func(endpoints *endpointsInt) {
-		for i := uint32(0); i < endpoints.len; i++ {
-			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
-			if cursor < slowestCursor {
-				slowestCursor = cursor
-			}
-		}
-		if atomic.LoadUint64(&c.begin) < slowestCursor && slowestCursor <= atomic.LoadUint64(&c.end) {
-			if c.mod < 16 {
-				atomic.AddUint64(&c.begin, 1)
-				atomic.AddUint64(&c.end, 1)
-			} else {
-				atomic.StoreUint64(&c.begin, slowestCursor)
-				atomic.StoreUint64(&c.end, slowestCursor+c.mod+1)
-			}
-		} else {
-			slowestCursor = parked
+// Done returns a channel that is closed when the channel is closed using the
+// Close method. This allows observing termination of the channel in a select
+// statement without creating an endpoint.
+func (c *ChanInt) Done() <-chan struct{} {
+	return c.signal().done
+}
+
+//jig:name EndpointInt_Done
+
+// Done returns a channel that is closed when the endpoint finishes. That is
+// when the close notification of the channel has been delivered after reading
+// all messages, or when the endpoint was canceled. Use it to select on the
+// completion of the endpoint alongside other channels.
+func (e *EndpointInt) Done() <-chan struct{} {
+	return e.endpointDone
+}
+
+//jig:name ChanInt_watermark
+
+// watermark calls the watermark callbacks of the channel (see WithWatermarks)
+// when the number of unread messages crossed one of the watermarks. It is
+// called after sending a message and after an endpoint advanced its cursor.
+func (c *ChanInt) watermark() {
+	if c.highWater == 0 {
+		return
+	}
+	above := atomic.LoadUint32(&c.aboveHigh) == 1
+	write := atomic.LoadUint64(&c.write)
+	if !above && write-atomic.LoadUint64(&c.begin) < c.highWater {
+		return
+	}
+	slowest := write
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if cursor := atomic.LoadUint64(&entries[i].cursor); cursor < slowest {
+			slowest = cursor
 		}
-	})
-	if slowestCursor == parked {
-		if spinlock {
-			runtime.Gosched()
+	}
+	unread := write - slowest
+	switch {
+	case !above && unread >= c.highWater:
+		if atomic.CompareAndSwapUint32(&c.aboveHigh, 0, 1) && c.onHigh != nil {
+			c.onHigh()
 		}
-		if atomic.LoadUint64(&c.channelState) != active {
-			return false
+	case above && unread <= c.lowWater:
+		if atomic.CompareAndSwapUint32(&c.aboveHigh, 1, 0) && c.onLow != nil {
+			c.onLow()
 		}
 	}
-	return true
 }
 
-//jig:name ChanInt_Send
+//jig:name ChanInt_wakeSenders
 
-// Send can be used by concurrent goroutines to send values to the channel.
-//
-// Note, that when the number of unread messages has reached bufferCapacity, then
-// the call to Send will block until the slowest Endpoint has read another
-// message.
-func (c *ChanInt) Send(value int) {
-	write := atomic.AddUint64(&c.write, 1) - 1
-	for write >= atomic.LoadUint64(&c.end) {
-		if !c.slideBuffer() {
-			return
-		}
+// wakeSenders wakes up the senders blocked in awaitConsumed. It is called
+// after an endpoint advanced its cursor. When no sender is blocked, it returns
+// right away.
+func (c *ChanInt) wakeSenders() {
+	if atomic.LoadInt32(&c.stalled) == 0 {
+		return
 	}
-	c.buffer[write&c.mod] = value
-	updated := time.Since(c.start).Nanoseconds()
-	if updated == 0 {
-		panic("clock failure; zero duration measured")
-	}
-	atomic.StoreInt64(&c.written[write&c.mod], updated<<1+1)
-	c.receivers.Broadcast()
+	next := make(chan struct{})
+	close(*(*chan struct{})(atomic.SwapPointer(&c.senders, unsafe.Pointer(&next))))
 }
 
-//jig:name ChanInt_Close
+//jig:name ChanInt_wakeAll
 
-// Close will close the channel. Pass in an error or nil. Endpoints  continue to
-// receive data until the buffer is empty. Only then will the close notification
-// be delivered to the Range function.
-func (c *ChanInt) Close(err error) {
-	if atomic.CompareAndSwapUint64(&c.channelState, active, closed) {
-		c.err = err
-		c.endpoints.Access(func(endpoints *endpointsInt) {
-			for i := uint32(0); i < endpoints.len; i++ {
-				atomic.CompareAndSwapUint64(&endpoints.entry[i].endpointState, active, closed)
-			}
-		})
+// wakeAll wakes up all blocked endpoints so they notice a change of state,
+// e.g. the channel was closed or some endpoints were evicted.
+func (c *ChanInt) wakeAll() {
+	c.broadcast()
+	if c.wakeups == 1 {
+		c.wakeEndpoints()
 	}
-	c.receivers.Broadcast()
 }
 
-//jig:name ChanInt_Closed
+//jig:name EndpointInt_park
 
-// Closed returns true when the channel was closed using the Close method.
-func (c *ChanInt) Closed() bool {
-	return atomic.LoadUint64(&c.channelState) >= closed
+func (e *EndpointInt) park() {
+	finished := atomic.CompareAndSwapUint32(&e.endpointFinished, 0, 1)
+	if finished {
+		close(e.endpointDone)
+	}
+	atomic.StoreUint32(&e.endpointActivity, idling)
+	atomic.StoreUint64(&e.cursor, parked)
+	e.watermark()
+	e.wakeSenders()
+	if finished {
+		if e.overflow != OverflowBlock {
+			atomic.AddInt32(&e.endpoints.lossy, -1)
+		}
+		e.detach()
+	}
 }
 
-//jig:name ChanInt_FastSend
+//jig:name ChanInt_evict
 
-// FastSend can be used to send values to the channel from a SINGLE goroutine.
-// Also, this does not record the time a message was sent, so the maxAge value
-// passed to Range will be ignored.
-//
-// Note, that when the number of unread messages has reached bufferCapacity, then
-// the call to FastSend will block until the slowest Endpoint has read another
-// message.
-func (c *ChanInt) FastSend(value int) {
-	for c.commit == c.end {
-		if !c.slideBuffer() {
-			return
+type evictionInt struct {
+	endpoint	*EndpointInt
+	lag		uint64
+}
+
+// evict marks the endpoints lagging behind too far as evicted and cancels
+// them. It must be called with access to the endpoints, which may be shared
+// (see AccessShared). The evicted endpoints are returned, so the caller can
+// call evicted after releasing the endpoints.
+func (c *ChanInt) evict(entries []EndpointInt) (evicted []evictionInt) {
+	if c.maxLag == 0 && c.maxDelay == 0 {
+		return nil
+	}
+	commit := c.commitData()
+	for i := range entries {
+		ep := &entries[i]
+		cursor := atomic.LoadUint64(&ep.cursor)
+		if cursor == parked || cursor >= commit || atomic.LoadUint32(&ep.evicted) == 1 {
+			continue
+		}
+		if (c.maxLag == 0 || commit-cursor <= c.maxLag) && (c.maxDelay == 0 || !c.delayed(cursor)) {
+			continue
+		}
+		atomic.StoreUint32(&ep.evicted, 1)
+		if atomic.CompareAndSwapUint64(&ep.endpointState, active, canceled) ||
+			atomic.CompareAndSwapUint64(&ep.endpointState, closed, canceled) {
+			evicted = append(evicted, evictionInt{ep, commit - cursor})
 		}
 	}
-	c.buffer[c.commit&c.mod] = value
-	atomic.AddUint64(&c.commit, 1)
-	c.receivers.Broadcast()
+	return evicted
 }
 
-//jig:name EndpointInt_Range
+// delayed returns true when the message at index was sent longer than
+// maxDelay ago.
+func (c *ChanInt) delayed(index uint64) bool {
+	r := c.loadRing()
+	updated := atomic.LoadInt64(&r.written[r.slot(index)]) >> 2
+	return updated != 0 && c.elapsed()-updated > c.maxDelay.Nanoseconds()
+}
 
-// Range will call the passed in foreach function with all the messages in
-// the buffer, followed by all the messages received. When the foreach function
-// returns true Range will continue, when you return false this is the same as
-// calling Cancel. When canceled the foreach will never be called again.
-// Passing a maxAge duration other than 0 will skip messages that are older
-// than maxAge.
-//
-// When the channel is closed, eventually when the buffer is exhausted the close
-// with optional error will be notified by calling foreach one last time with
-// the closed parameter set to true.
-func (e *EndpointInt) Range(foreach func(value int, err error, closed bool) bool, maxAge time.Duration) {
+// evicted parks the evicted endpoints that are not inside a call to Range and
+// calls the eviction callback of the channel.
+func (c *ChanInt) evicted(evicted []evictionInt) {
+	for _, eviction := range evicted {
+		if atomic.LoadUint32(&eviction.endpoint.endpointActivity) == idling {
+			eviction.endpoint.park()
+		}
+	}
+	for _, eviction := range evicted {
+		eviction.endpoint.wakeUp()
+	}
+	for _, eviction := range evicted {
+		if c.onEvict != nil {
+			c.onEvict(eviction.endpoint, eviction.lag)
+		}
+	}
+}
+
+//jig:name ChanInt_idle
+
+// idle cancels the endpoints that were idle for longer than their idle
+// timeout, see WithIdleTimeout. It must be called with access to the
+// endpoints, which may be shared (see AccessShared). The canceled endpoints
+// are returned, so the caller can call idled after releasing the endpoints.
+func (c *ChanInt) idle(entries []EndpointInt) (idle []*EndpointInt) {
+	now := time.Now().UnixNano()
+	for i := range entries {
+		ep := &entries[i]
+		if ep.idleTimeout == 0 || atomic.LoadUint64(&ep.cursor) == parked ||
+			atomic.LoadUint32(&ep.endpointActivity) != idling ||
+			now-atomic.LoadInt64(&ep.lastRead) <= ep.idleTimeout.Nanoseconds() {
+			continue
+		}
+		if atomic.CompareAndSwapUint64(&ep.endpointState, active, canceled) ||
+			atomic.CompareAndSwapUint64(&ep.endpointState, closed, canceled) {
+			idle = append(idle, ep)
+		}
+	}
+	return idle
+}
+
+// idled parks the canceled idle endpoints that are still not inside a call to
+// Range.
+func (c *ChanInt) idled(idle []*EndpointInt) {
+	for _, ep := range idle {
+		if atomic.LoadUint32(&ep.endpointActivity) == idling {
+			ep.park()
+		}
+	}
+	for _, ep := range idle {
+		ep.wakeUp()
+	}
+}
+
+//jig:name EndpointInt_await
+
+// await blocks until data beyond the cursor of the endpoint has been committed
+// and then returns the commit index with state active. When the endpoint was
+// canceled, the cursor is parked and state canceled is returned. When the
+// channel was closed and all data has been read, state closed is returned and
+// the caller should park the cursor after delivering the close notification.
+// When ranging was suspended via control, the returned commit index equals
+// the cursor.
+func (e *EndpointInt) await(control *uint32) (commit uint64, state uint64) {
+	if atomic.LoadUint32(&e.evicted) == 1 {
+		e.park()
+		return e.cursor, canceled
+	}
+	if atomic.LoadUint32(&e.aborted) == 1 && atomic.LoadUint64(&e.endpointState) == closed {
+		commit = atomic.LoadUint64(&e.commit)
+		atomic.StoreUint64(&e.cursor, commit)
+		return commit, closed
+	}
+	if atomic.LoadUint32(&e.overflowed) == 1 && atomic.LoadUint64(&e.endpointState) == closed {
+		return e.cursor, closed
+	}
+	var spins, attempt uint32
+	budget := atomic.LoadUint32(&e.spinBudget)
+	for commit = e.commitData(); e.cursor == commit; commit = e.commitData() {
+		if control != nil && atomic.LoadUint32(control) == abort {
+			atomic.StoreUint64(&e.endpointState, canceled)
+		}
+		if atomic.CompareAndSwapUint64(&e.endpointState, canceled, canceled) {
+			e.park()
+			return commit, canceled
+		}
+		if control != nil && atomic.LoadUint32(control) == suspend {
+			atomic.StoreUint32(&e.endpointActivity, idling)
+			return commit, active
+		}
+		if final := atomic.LoadUint64(&e.final); atomic.LoadUint64(&e.commit) < atomic.LoadUint64(&e.write) && (final == 0 || commit < final) {
+			if e.endpointClosed == 1 {
+				panic(fmt.Sprintf("data written after closing endpoint; commit(%d) write(%d)",
+					atomic.LoadUint64(&e.commit), atomic.LoadUint64(&e.write)))
+			}
+			backoff(&spins, budget)
+			e.lastActive = time.Now()
+		} else if e.wait != nil {
+			if atomic.LoadUint64(&e.endpointState) == closed {
+				if time.Since(e.lastActive) >= e.closeAfter {
+					return commit, closed
+				}
+				e.endpointClosed = 1
+				backoff(&spins, budget)
+			} else if attempt++; e.wait.Wait(attempt) {
+				e.block(control)
+				e.lastActive = time.Now()
+				attempt = 0
+			}
+		} else {
+			now := time.Now()
+			if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
+				if !now.Before(e.lastActive.Add(e.closeAfter)) {
+					return commit, closed
+				}
+				e.endpointClosed = 1
+				backoff(&spins, budget)
+			} else if now.Before(e.lastActive.Add(e.blockAfter)) {
+				backoff(&spins, budget)
+			} else {
+				e.block(control)
+				e.lastActive = time.Now()
+			}
+		}
+	}
+	return commit, active
+}
+
+//jig:name ErrOverflow
+
+// ErrOverflow is delivered with the close notification to an endpoint created
+// with policy OverflowError when it fell too far behind.
+const ErrOverflow = ChannelError("endpoint overflow")
+
+//jig:name EndpointInt_closeErr
+
+// closeErr returns the error to deliver with the close notification.
+func (e *EndpointInt) closeErr() error {
+	if atomic.LoadUint32(&e.overflowed) == 1 {
+		return ErrOverflow
+	}
+	return e.signal().err
+}
+
+//jig:name EndpointInt_lapped
+
+// lapped is called after reading the message at cursor. On a lossy channel it
+// reports whether the buffer was slid beyond cursor, in which case the message
+// read may have been overwritten. The same applies after ForceTrimBefore. An
+// endpoint that was evicted (see EvictSlow) is always lapped. The cursor of the endpoint is then moved to
+// the oldest message still in the buffer, the skipped messages are counted as
+// dropped and the gap handler of the endpoint is called. For an endpoint with
+// policy OverflowError, the endpoint is closed with ErrOverflow instead.
+func (e *EndpointInt) lapped(cursor uint64) bool {
+	if atomic.LoadUint32(&e.evicted) == 1 {
+		return true
+	}
+	if e.lossy == 0 && e.overflow == OverflowBlock && atomic.LoadUint32(&e.trimmed) == 0 {
+		return false
+	}
+	begin := atomic.LoadUint64(&e.begin)
+	if cursor >= begin {
+		return false
+	}
+	if e.overflow == OverflowError {
+		atomic.CompareAndSwapUint64(&e.endpointState, active, closed)
+		atomic.StoreUint32(&e.overflowed, 1)
+		return true
+	}
+	e.skip(cursor, begin)
+	return true
+}
+
+// skip moves the cursor of the endpoint from cursor forward to seq, counting
+// the messages in between as dropped and reporting them to the gap handler.
+func (e *EndpointInt) skip(cursor, seq uint64) {
+	atomic.AddUint64(&e.dropped, seq-cursor)
+	atomic.StoreUint64(&e.cursor, seq)
+	if e.gap != nil {
+		e.gap(seq - cursor)
+	}
+}
+
+//jig:name ChanInt_elapsed
+
+// elapsed returns the nanoseconds passed since the channel was created. When
+// the channel has a custom clock, the result is at least 1, so it can be
+// distinguished from a missing timestamp.
+func (c *ChanInt) elapsed() int64 {
+	if c.clock == nil {
+		return time.Since(c.start).Nanoseconds()
+	}
+	if elapsed := c.clock().Sub(c.start).Nanoseconds(); elapsed > 0 {
+		return elapsed
+	}
+	return 1
+}
+
+//jig:name ChanInt_batched
+
+// batched returns true when the messages written after commit should be
+// committed now, see WithCommitBatch. This is the case when a full batch is
+// waiting, when the maximum delay since the previous commit has passed, or
+// when the channel is closing and every message has to be delivered.
+func (c *ChanInt) batched(commit uint64) bool {
+	if atomic.LoadUint64(&c.write)-commit >= c.commitBatch || atomic.LoadUint64(&c.channelState) != active {
+		return true
+	}
+	return c.elapsed()-atomic.LoadInt64(&c.lastCommit) >= c.commitDelay
+}
+
+//jig:name ringInt_settled
+
+// settled returns the written entry of a committed message after waiting for
+// a replacement of the message by a conflating Send to complete.
+func (r *ringInt) settled(index uint64) int64 {
+	written := atomic.LoadInt64(&r.written[r.slot(index)])
+	for written&1 == 1 {
+		runtime.Gosched()
+		written = atomic.LoadInt64(&r.written[r.slot(index)])
+	}
+	return written
+}
+
+//jig:name ChanInt_checkLag
+
+func (c *ChanInt) checkLag() {
+	if c.onLag == nil {
+		return
+	}
+	now := c.elapsed()
+	checked := atomic.LoadInt64(&c.lagChecked)
+	if checked != 0 && now-checked < c.lagInterval.Nanoseconds() {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.lagChecked, checked, now) {
+		return
+	}
+	type change struct {
+		endpoint	*EndpointInt
+		lag		uint64
+		lagging		bool
+	}
+	var changes []change
+	commit := c.commitData()
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		ep := &entries[i]
+		lag := uint64(0)
+		if cursor := atomic.LoadUint64(&ep.cursor); cursor != parked && cursor < commit {
+			lag = commit - cursor
+		}
+		lagging := lag > c.lagThreshold
+		if lagging != (atomic.LoadUint32(&ep.lagging) == 1) {
+			if lagging {
+				atomic.StoreUint32(&ep.lagging, 1)
+			} else {
+				atomic.StoreUint32(&ep.lagging, 0)
+			}
+			changes = append(changes, change{ep, lag, lagging})
+		}
+	}
+	for _, change := range changes {
+		c.onLag(change.endpoint, change.lag, change.lagging)
+	}
+}
+
+//jig:name EndpointInt_hold
+
+// hold blocks while the endpoint is paused, until Resume wakes it up.
+// It returns false when the endpoint was canceled or when control asks to
+// abort or suspend ranging.
+func (e *EndpointInt) hold(control *uint32) bool {
+	for atomic.LoadUint32(&e.endpointPaused) == 1 {
+		if control != nil && atomic.LoadUint32(control) == abort {
+			atomic.StoreUint64(&e.endpointState, canceled)
+		}
+		if atomic.LoadUint64(&e.endpointState) == canceled {
+			return false
+		}
+		if control != nil && atomic.LoadUint32(control) == suspend {
+			return false
+		}
+		e.blockWhile(func() bool {
+			return atomic.LoadUint32(&e.endpointPaused) == 1 &&
+				atomic.LoadUint64(&e.endpointState) != canceled &&
+				(control == nil || atomic.LoadUint32(control) == proceed)
+		})
+	}
+	return true
+}
+
+//jig:name EndpointInt_sleep
+
+// sleep waits for duration d in steps of at most 1ms, so it can return false
+// as soon as the endpoint was canceled or reading was suspended or aborted via
+// control.
+func (e *EndpointInt) sleep(d time.Duration, control *uint32) bool {
+	deadline := time.Now().Add(d)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if atomic.LoadUint64(&e.endpointState) == canceled || (control != nil && atomic.LoadUint32(control) != proceed) {
+			return false
+		}
+		if step := deadline.Sub(now); step < time.Millisecond {
+			time.Sleep(step)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return true
+}
+
+//jig:name EndpointInt_coalesce
+
+// coalesce waits until the next message may be delivered to an endpoint with
+// a throttle (see WithThrottle) or debounce (see WithDebounce) duration. It
+// returns false when the endpoint was canceled or reading was suspended or
+// aborted via control while waiting.
+func (e *EndpointInt) coalesce(control *uint32) bool {
+	if e.throttle != 0 && !e.throttled(control) {
+		return false
+	}
+	return e.debounce == 0 || e.debounced(control)
+}
+
+// throttled waits until the throttle interval of the endpoint has passed since
+// the previous message was delivered.
+func (e *EndpointInt) throttled(control *uint32) bool {
+	wait := time.Duration(e.delivered + e.throttle.Nanoseconds() - time.Now().UnixNano())
+	if !e.sleep(wait, control) {
+		return false
+	}
+	e.delivered = time.Now().UnixNano()
+	return true
+}
+
+// debounced waits until no messages were committed for the debounce duration.
+func (e *EndpointInt) debounced(control *uint32) bool {
+	commit := e.commitData()
+	deadline := time.Now().Add(e.debounce)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if !e.sleep(time.Millisecond, control) {
+			return false
+		}
+		if latest := e.commitData(); latest != commit {
+			commit = latest
+			deadline = time.Now().Add(e.debounce)
+		}
+	}
+	return true
+}
+
+//jig:name EndpointInt_recoverPanic
+
+// recoverPanic is deferred by Range when the endpoint has a panic handler, see
+// WithPanicHandler. It recovers from a panic, cancels and parks the endpoint
+// and passes the recovered value to the panic handler.
+func (e *EndpointInt) recoverPanic() {
+	if recovered := recover(); recovered != nil {
+		atomic.StoreUint64(&e.endpointState, canceled)
+		e.park()
+		e.wakeUp()
+		e.onPanic(recovered)
+	}
+}
+
+//jig:name ChanInt_orphaned
+
+// orphaned returns true when a message assigned to owner (see WithRoundRobin)
+// may be taken over by another endpoint, because it was sent while there were
+// no endpoints or because its owner was canceled.
+func (c *ChanInt) orphaned(owner uint32) bool {
+	if owner == 0 {
+		return true
+	}
+	ep := &c.endpoints.entry[owner-1]
+	return atomic.LoadUint64(&ep.cursor) == parked || atomic.LoadUint64(&ep.endpointState) == canceled
+}
+
+//jig:name EndpointInt_owns
+
+// owns returns true when the message at index was assigned to the endpoint,
+// taking it over when it was orphaned.
+func (e *EndpointInt) owns(r *ringInt, index uint64) bool {
+	slot := &r.owners[r.slot(index)]
+	for {
+		owner := atomic.LoadUint32(slot)
+		if owner == e.index+1 {
+			return true
+		}
+		if !e.orphaned(owner) {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(slot, owner, e.index+1) {
+			return true
+		}
+	}
+}
+
+//jig:name EndpointInt_deadLetter
+
+// deadLetter routes the failed message at seq to the dead-letter channel of the
+// endpoint. It sends from the goroutine reading the endpoint, so reading
+// blocks while the dead-letter channel is full, see DeadLetter.
+func (e *EndpointInt) deadLetter(value int, seq uint64, attempts uint32, err error) {
+	e.poison = nil
+	failure := Failure{Endpoint: e.name, Seq: seq, Attempts: int(attempts), Err: err}
+	if e.onDeadLetter != nil {
+		e.onDeadLetter(value, failure)
+	}
+	if e.deadLetters != nil {
+		e.deadLetters.Send(value)
+	}
+}
+
+//jig:name ErrRetriesExhausted
+
+// ErrRetriesExhausted is reported for a message that was dead-lettered because
+// it was not acknowledged after being delivered the maximum number of times,
+// see WithAck and DeadLetter.
+const ErrRetriesExhausted = ChannelError("retries exhausted")
+
+//jig:name EndpointInt_awaitAck
+
+// awaitingAck records that the message at index is delivered and awaits
+// acknowledgement.
+func (e *EndpointInt) awaitingAck(index uint64) {
+	if e.ackSeq != index {
+		e.ackSeq = index
+		e.ackAttempts = 0
+	}
+	e.ackAttempts++
+	if e.ackTimeout != 0 {
+		e.ackDeadline = time.Now().Add(e.ackTimeout).UnixNano()
+	}
+	atomic.StoreUint32(&e.ackState, unacknowledged)
+}
+
+// awaitAck blocks until the message awaiting acknowledgement is acknowledged
+// or rejected, see Ack and Nack, or its ack timeout expires. It returns
+// redeliver true when the message should be delivered again. A rejected
+// message that is not delivered again is routed to the dead-letter channel,
+// which blocks like Send while that channel is full. It returns ok false when
+// the endpoint was canceled or reading was suspended or aborted via control
+// while waiting.
+func (e *EndpointInt) awaitAck(control *uint32) (redeliver bool, ok bool) {
+	var timer *time.Timer
+	for atomic.LoadUint32(&e.ackState) == unacknowledged {
+		if e.ackTimeout != 0 {
+			wait := time.Until(time.Unix(0, e.ackDeadline))
+			if wait <= 0 {
+				if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected) {
+					break
+				}
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(wait, e.wakeUp)
+				defer timer.Stop()
+			} else {
+				timer.Reset(wait)
+			}
+		}
+		if atomic.LoadUint64(&e.endpointState) == canceled || (control != nil && atomic.LoadUint32(control) != proceed) {
+			return false, false
+		}
+		e.blockWhile(func() bool {
+			return atomic.LoadUint32(&e.ackState) == unacknowledged && atomic.LoadUint64(&e.endpointState) != canceled &&
+				(control == nil || atomic.LoadUint32(control) == proceed) &&
+				(e.ackTimeout == 0 || time.Now().UnixNano() < e.ackDeadline)
+		})
+	}
+	if atomic.LoadUint32(&e.ackState) == acknowledged {
+		e.ackSeq = parked
+		return false, true
+	}
+	if e.poison != nil || e.ackAttempts > e.ackRetries {
+		err := e.poison
+		if err == nil {
+			err = ErrRetriesExhausted
+		}
+		r := e.loadRing()
+		e.deadLetter(r.buffer[r.slot(e.ackSeq)], e.ackSeq, e.ackAttempts, err)
+		e.ackSeq = parked
+		return false, true
+	}
+	return true, true
+}
+
+//jig:name EndpointInt_checkpoint
+
+// checkpoint saves the position of the endpoint in its cursor store when it
+// changed and the checkpoint interval has passed since it was last saved.
+func (e *EndpointInt) checkpoint() {
+	if e.cursorStore == nil || e.name == "" {
+		return
+	}
+	seq := atomic.LoadUint64(&e.cursor)
+	if e.manualCommit == 1 {
+		seq = atomic.LoadUint64(&e.committed)
+	}
+	if seq == parked || seq == e.saved {
+		return
+	}
+	now := time.Now().UnixNano()
+	if now-e.checkpointed < e.checkpointEvery.Nanoseconds() {
+		return
+	}
+	if e.cursorStore.Save(e.name, seq) == nil {
+		e.saved, e.checkpointed = seq, now
+	}
+}
+
+//jig:name EndpointInt_due
+
+// pending returns true when the message with the given written entry was sent
+// by SendAt or SendAfter and is not due yet. Other messages are never due in
+// the future, so the clock is only read once a delayed message was sent. This
+// keeps reading the clock for every message off the receive path, which
+// matters when the channel is used as a plain queue.
+func (e *EndpointInt) pending(written int64) bool {
+	return written&2 == 0 && atomic.LoadUint32(&e.deferred) == 1 && written>>2 > e.elapsed()
+}
+
+// due waits until the message with the given written entry is due. It returns
+// false when the endpoint was canceled or reading was suspended or aborted via
+// control while waiting.
+func (e *EndpointInt) due(written int64, control *uint32) bool {
+	for e.pending(written) {
+		if !e.sleep(time.Duration(written>>2-e.elapsed()), control) {
+			return false
+		}
+	}
+	return true
+}
+
+//jig:name EndpointInt_iterate
+
+func (e *EndpointInt) iterate(foreach func(value int, err error, closed bool) bool, mark func(label string, seq uint64) bool, maxAge time.Duration, control *uint32) {
+	atomic.StoreUint32(&e.endpointActivity, ranging)
+	if atomic.LoadUint64(&e.endpointState) == canceled || atomic.LoadUint64(&e.cursor) == parked {
+		e.park()
+		return
+	}
+	if e.onPanic != nil {
+		defer e.recoverPanic()
+	}
+	if maxAge == 0 {
+		maxAge = e.maxAge
+	}
+	if e.recycle != nil {
+		atomic.StoreUint64(&e.held, parked)
+	}
 	e.lastActive = time.Now()
 	for {
-		commit := e.commitData()
-		for ; e.cursor == commit; commit = e.commitData() {
-			if atomic.CompareAndSwapUint64(&e.endpointState, canceled, canceled) {
-				atomic.StoreUint64(&e.cursor, parked)
+		commit, state := e.await(control)
+		switch {
+		case state == canceled:
+			return
+		case state == closed:
+			var zero int
+			foreach(zero, e.closeErr(), true)
+			e.park()
+			return
+		case commit == e.cursor:
+			return
+		}
+		if e.conflate == 1 && commit-e.cursor > 1 {
+			e.skip(e.cursor, commit-1)
+		}
+		if e.throttle != 0 || e.debounce != 0 {
+			if !e.coalesce(control) {
+				if control != nil && atomic.LoadUint32(control) == abort {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
+				}
+				atomic.StoreUint32(&e.endpointActivity, idling)
 				return
 			}
-			if atomic.LoadUint64(&e.commit) < atomic.LoadUint64(&e.write) {
-				if e.endpointClosed == 1 {
-					panic(fmt.Sprintf("data written after closing endpoint; commit(%d) write(%d)",
-						atomic.LoadUint64(&e.commit), atomic.LoadUint64(&e.write)))
+			commit = e.commitData()
+			atomic.StoreUint64(&e.cursor, commit-1)
+		}
+
+		r := e.loadRing()
+		for ; e.cursor != commit && atomic.LoadUint32(&e.aborted) == 0; atomic.AddUint64(&e.cursor, 1) {
+			if !e.hold(control) {
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
 				}
-				runtime.Gosched()
-				e.lastActive = time.Now()
-			} else {
-				now := time.Now()
-				if now.Before(e.lastActive.Add(1 * time.Millisecond)) {
-					if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
-						e.endpointClosed = 1
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return
+			}
+			redeliver := false
+			if e.acking == 1 && e.ackSeq == e.cursor {
+				var ok bool
+				if redeliver, ok = e.awaitAck(control); !ok {
+					if control != nil && atomic.LoadUint32(control) == abort {
+						atomic.StoreUint64(&e.endpointState, canceled)
 					}
-					runtime.Gosched()
-				} else if now.Before(e.lastActive.Add(250 * time.Millisecond)) {
-					if atomic.CompareAndSwapUint64(&e.endpointState, closed, closed) {
-						var zero int
-						foreach(zero, e.err, true)
-						atomic.StoreUint64(&e.cursor, parked)
+					if atomic.LoadUint64(&e.endpointState) == canceled {
+						e.park()
 						return
 					}
-					runtime.Gosched()
-				} else {
-					e.receivers.Wait()
-					e.lastActive = time.Now()
+					atomic.StoreUint32(&e.endpointActivity, idling)
+					return
+				}
+				if !redeliver {
+					continue
 				}
 			}
-		}
-
-		for ; e.cursor != commit; atomic.AddUint64(&e.cursor, 1) {
-			item := e.buffer[e.cursor&e.mod]
+			written := r.settled(e.cursor)
+			if !e.due(written, control) {
+				if control != nil && atomic.LoadUint32(control) == abort {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				if atomic.LoadUint64(&e.endpointState) == canceled {
+					e.park()
+					return
+				}
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return
+			}
+			item := r.buffer[r.slot(e.cursor)]
+			if e.lapped(e.cursor) {
+				break
+			}
 			emit := true
-			if maxAge != 0 {
-				stale := time.Since(e.start).Nanoseconds() - maxAge.Nanoseconds()
-				updated := atomic.LoadInt64(&e.written[e.cursor&e.mod]) >> 1
+			if redeliver {
+
+			} else if written&2 == 2 {
+				if mark != nil && !mark(r.labels[r.slot(e.cursor)], e.cursor) {
+					atomic.StoreUint64(&e.endpointState, canceled)
+				}
+				emit = false
+			} else if e.sample > 1 && e.cursor%e.sample != 0 {
+				emit = false
+			} else if maxAge != 0 {
+				stale := e.elapsed() - maxAge.Nanoseconds()
+				updated := written >> 2
 				if updated != 0 && updated <= stale {
 					emit = false
 				}
 			}
+			if emit && !redeliver {
+				if e.filter != nil && !e.filter(item) {
+					emit = false
+				} else if r.owners != nil && !e.owns(r, e.cursor) {
+					emit = false
+				} else if e.group != nil && !e.group.claim(e.cursor, r.size) {
+					emit = false
+				}
+			}
+			if emit && e.transform != nil {
+				item = e.transform(item)
+			}
+			stay := emit && e.acking == 1
+			if stay {
+				e.awaitingAck(e.cursor)
+			}
 			if emit && !foreach(item, nil, false) {
 				atomic.StoreUint64(&e.endpointState, canceled)
 			}
+			if e.poison != nil && !stay {
+				e.deadLetter(r.buffer[r.slot(e.cursor)], e.cursor, 1, e.poison)
+			}
+			if control != nil && atomic.LoadUint32(control) == abort {
+				atomic.StoreUint64(&e.endpointState, canceled)
+			}
 			if atomic.LoadUint64(&e.endpointState) == canceled {
-				atomic.StoreUint64(&e.cursor, parked)
+				e.park()
 				return
 			}
+			if control != nil && atomic.LoadUint32(control) == suspend {
+				if !stay {
+					atomic.AddUint64(&e.cursor, 1)
+				}
+				e.watermark()
+				e.wakeSenders()
+				e.checkLag()
+				e.checkpoint()
+				atomic.StoreInt64(&e.lastRead, time.Now().UnixNano())
+				atomic.StoreUint32(&e.endpointActivity, idling)
+				return
+			}
+			if stay {
+				atomic.AddUint64(&e.cursor, ^uint64(0))
+			}
 		}
+		e.watermark()
+		e.wakeSenders()
+		e.checkLag()
+		e.checkpoint()
 		e.lastActive = time.Now()
+		atomic.StoreInt64(&e.lastRead, e.lastActive.UnixNano())
 	}
 }
+
+//jig:name ChanInt_slideBuffer
+
+// slideBuffer moves the beginning of the buffer up to the slowest endpoint to
+// make room for new messages. Senders slide the buffer concurrently, with
+// shared access to the endpoints. Only when the buffer may grow, values are
+// recycled (see Recycle) or messages are assigned round-robin, slideBuffer
+// takes exclusive access. A channel with a single endpoint takes the fast path
+// of slideSingle instead. It returns false when the channel is no longer
+// active and there is no room.
+func (c *ChanInt) slideBuffer(spins *uint32) bool {
+	exclusive := c.roundRobin == 1 || c.recycle != nil || c.loadRing().size <= c.growLimit/2
+	if c.endpoints.capacity == 1 && !exclusive && c.lossy == 0 && c.maxLag == 0 && c.maxDelay == 0 && c.leakIdle == 0 {
+		if slowestCursor, spinlock, ok := c.slideSingle(); ok {
+			return c.slid(slowestCursor, spinlock, spins)
+		}
+	}
+	slowestCursor := parked
+	var evicted []evictionInt
+	var leaks []EndpointInfo
+	var idle []*EndpointInt
+	access := c.endpoints.AccessShared
+	if exclusive {
+		access = c.endpoints.Access
+	}
+	spinlock := access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		now := time.Now().UnixNano()
+		full := now-atomic.LoadInt64(&c.scanned) > time.Millisecond.Nanoseconds()
+		if full {
+			atomic.StoreInt64(&c.scanned, now)
+			evicted = c.evict(endpoints.entry[:endpoints.len])
+		}
+		lossy := c.lossy == 1 || atomic.LoadInt32(&endpoints.lossy) > 0
+		begin := atomic.LoadUint64(&c.begin)
+		slowestCursor = endpoints.slowest(c, begin, full)
+		r := c.loadRing()
+		if begin < slowestCursor && slowestCursor <= atomic.LoadUint64(&c.end) {
+			next := slowestCursor
+			if r.size <= 16 {
+				next = begin + 1
+			}
+			if atomic.CompareAndSwapUint64(&c.begin, begin, next) {
+				c.release(r, begin, next, !lossy)
+				c.advanceEnd(r, begin, next)
+			}
+		} else if exclusive && r.size <= c.growLimit/2 && c.commitData() == atomic.LoadUint64(&c.end) {
+			c.grow()
+			slowestCursor = begin
+		} else if lossy && slowestCursor == parked && begin < c.commitData() {
+
+			if atomic.CompareAndSwapUint64(&c.begin, begin, begin+1) {
+				c.release(r, begin, begin+1, false)
+				c.advanceEnd(r, begin, begin+1)
+			}
+			slowestCursor = begin + 1
+		} else {
+			slowestCursor = parked
+			if full {
+				leaks = c.leaked(endpoints.entry[:endpoints.len])
+				idle = c.idle(endpoints.entry[:endpoints.len])
+			}
+		}
+	})
+	c.evicted(evicted)
+	c.reportLeaks(leaks)
+	c.idled(idle)
+	return c.slid(slowestCursor, spinlock, spins)
+}
+
+// slid backs off a sender waiting for room after slideBuffer found none, which
+// is when slowestCursor is parked. It returns false when the channel is no
+// longer active and there is no room.
+func (c *ChanInt) slid(slowestCursor uint64, spinlock bool, spins *uint32) bool {
+	if slowestCursor == parked {
+		if spinlock && spins != nil {
+			if c.wait == nil {
+				backoff(spins, atomic.LoadUint32(&c.spinBudget))
+			} else if *spins++; c.wait.Wait(*spins) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if atomic.LoadUint64(&c.channelState) != active {
+			return false
+		}
+	}
+	return true
+}
+
+//jig:name ChanInt_discard
+
+// discard removes the messages from begin up to end from the buffer, zeroing
+// their slots. It must be called with exclusive access to the endpoints. See
+// release for read.
+func (c *ChanInt) discard(r *ringInt, begin, end uint64, read bool) {
+	c.release(r, begin, end, read)
+	var zero int
+	for index := begin; index < end; index++ {
+		r.buffer[r.slot(index)] = zero
+		if r.labels != nil {
+			r.labels[r.slot(index)] = ""
+			r.errs[r.slot(index)] = nil
+		}
+	}
+	atomic.StoreUint64(&c.begin, end)
+	atomic.StoreUint64(&c.end, end+r.size)
+}
+
+//jig:name ChanInt_retain
+
+func (c *ChanInt) retain() {
+	policy := c.retention
+	if policy == (RetentionPolicy{}) {
+		return
+	}
+	stale := int64(0)
+	if policy.MaxAge > 0 {
+		stale = c.elapsed() - policy.MaxAge.Nanoseconds()
+	}
+	expired := func(r *ringInt, begin, commit uint64, bytes int64) bool {
+		switch {
+		case begin >= commit:
+			return false
+		case policy.MaxCount > 0 && commit-begin > uint64(policy.MaxCount):
+			return true
+		case policy.MaxAge > 0:
+			if written := atomic.LoadInt64(&r.written[r.slot(begin)]) >> 2; written > 0 && written < stale {
+				return true
+			}
+		}
+		return policy.MaxBytes > 0 && c.size != nil && bytes > policy.MaxBytes
+	}
+	if !expired(c.loadRing(), atomic.LoadUint64(&c.begin), c.commitData(), atomic.LoadInt64(&c.bytes)) {
+		return
+	}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		r := c.loadRing()
+		begin := atomic.LoadUint64(&c.begin)
+		commit := c.commitData()
+		limit := commit
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := endpoints.entry[i].retained(atomic.LoadUint64(&endpoints.entry[i].cursor))
+			if cursor < limit {
+				limit = cursor
+			}
+		}
+		bytes := atomic.LoadInt64(&c.bytes)
+		index := begin
+		for ; index < limit && expired(r, index, commit, bytes); index++ {
+			if c.size != nil && atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+				bytes -= int64(c.size(r.buffer[r.slot(index)]))
+			}
+		}
+		if index > begin {
+			c.discard(r, begin, index, true)
+		}
+	})
+}
+
+//jig:name ChanInt_evictSlow
+
+// evictSlow evicts the endpoints lagging behind too far. It returns quickly
+// when the messages in the buffer can't exceed the thresholds.
+func (c *ChanInt) evictSlow() {
+	if c.maxLag == 0 && c.maxDelay == 0 {
+		return
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	commit := c.commitData()
+	if begin == commit {
+		return
+	}
+	if c.maxLag == 0 || commit-begin <= c.maxLag {
+		if c.maxDelay == 0 || !c.delayed(begin) {
+			return
+		}
+	}
+	var evicted []evictionInt
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		evicted = c.evict(endpoints.entry[:endpoints.len])
+	})
+	c.evicted(evicted)
+}
+
+//jig:name ChanInt_assign
+
+// assign assigns the message at index to the next endpoint in turn. It must
+// be called before the message is committed.
+func (c *ChanInt) assign(r *ringInt, index uint64) {
+	owner := uint32(0)
+	n := atomic.LoadUint32(&c.endpoints.len)
+	for tries := uint32(0); tries < n; tries++ {
+		i := atomic.AddUint32(&c.rotation, 1) % n
+		if !c.orphaned(i + 1) {
+			owner = i + 1
+			break
+		}
+	}
+	atomic.StoreUint32(&r.owners[r.slot(index)], owner)
+}
+
+//jig:name ChanInt_published
+
+// published is called by a sender after storing messages in the buffer. With
+// a committer goroutine, the committer is notified and it will wake up the
+// endpoints once the messages are committed. Otherwise the endpoints are woken
+// up to commit the messages themselves.
+func (c *ChanInt) published() {
+	if c.commits != nil {
+		select {
+		case c.commits <- struct{}{}:
+		default:
+		}
+		return
+	}
+	c.wake()
+}
+
+//jig:name ChanInt_timestamp
+
+// timestamp returns the time to record with a message sent now. When
+// timestamps are disabled (see WithoutTimestamps) it returns 0, which marks
+// the message as having no timestamp, like messages sent using FastSend.
+func (c *ChanInt) timestamp() int64 {
+	if c.untimed == 1 {
+		return 0
+	}
+	if c.resolution != 0 {
+		return atomic.LoadInt64(&c.coarse)
+	}
+	updated := c.elapsed()
+	if updated == 0 {
+		panic("clock failure; zero duration measured")
+	}
+	return updated
+}
+
+//jig:name ChanInt_cloned
+
+// cloned returns value as it should be stored in the buffer, see Recycle.
+func (c *ChanInt) cloned(value int) int {
+	if c.clone == nil {
+		return value
+	}
+	return c.clone(value)
+}
+
+//jig:name ChanInt_halve
+
+// halve replaces the ring of the channel by one of half the size. It keeps
+// the messages that were sent up to write and that fit in half of the new
+// ring, but never fewer than the endpoints did not read yet. It must be
+// called with exclusive access to the endpoints and only when no more than a
+// quarter of the old ring is unread. Senders store messages without access to
+// the endpoints, so halve first moves the end of the buffer to write to make
+// new senders wait. It gives up and returns false when a message is still
+// being published.
+func (c *ChanInt) halve(old *ringInt, write uint64) bool {
+	if c.commitData() != write {
+		return false
+	}
+	end := atomic.LoadUint64(&c.end)
+	atomic.StoreUint64(&c.end, write)
+	if atomic.LoadUint64(&c.write) != write {
+		atomic.StoreUint64(&c.end, end)
+		return false
+	}
+	size := old.size / 2
+	begin := atomic.LoadUint64(&c.begin)
+	keep := begin
+	if write-begin > size/2 {
+		keep = write - size/2
+	}
+	c.release(old, begin, keep, true)
+	r := &ringInt{
+		buffer:		make([]int, size),
+		written:	make([]int64, size),
+		mod:		size - 1,
+		size:		size,
+	}
+	if old.labels != nil {
+		r.labels = make([]string, size)
+		r.errs = make([]error, size)
+	}
+	if old.owners != nil {
+		r.owners = make([]uint32, size)
+	}
+	if old.headers != nil {
+		r.headers = make([]Headers, size)
+	}
+	for index := keep; index < write; index++ {
+		r.buffer[r.slot(index)] = old.buffer[old.slot(index)]
+		r.written[r.slot(index)] = atomic.LoadInt64(&old.written[old.slot(index)])
+		if r.labels != nil {
+			r.labels[r.slot(index)] = old.labels[old.slot(index)]
+			r.errs[r.slot(index)] = old.errs[old.slot(index)]
+		}
+		if r.owners != nil {
+			r.owners[r.slot(index)] = atomic.LoadUint32(&old.owners[old.slot(index)])
+		}
+		if r.headers != nil {
+			r.headers[r.slot(index)] = old.headers[old.slot(index)]
+		}
+	}
+	atomic.StorePointer(&c.ring, unsafe.Pointer(r))
+	atomic.StoreUint64(&c.begin, keep)
+	atomic.StoreUint64(&c.end, keep+size)
+	return true
+}
+
+//jig:name ChanInt_shrink
+
+// shrink halves the buffer when the endpoints have been close to the most
+// recent message for the period set by WithShrink, i.e. when no more than a
+// quarter of the buffer was unread all that time. The buffer is checked at
+// most 8 times per period, so sending stays cheap.
+func (c *ChanInt) shrink() {
+	if c.shrinkAfter == 0 {
+		return
+	}
+	now := c.elapsed()
+	checked := atomic.LoadInt64(&c.shrinkChecked)
+	if checked != 0 && now-checked < c.shrinkAfter/8 || !atomic.CompareAndSwapInt64(&c.shrinkChecked, checked, now) {
+		return
+	}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		r := c.loadRing()
+		write := atomic.LoadUint64(&c.write)
+		slowest := write
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := endpoints.entry[i].retained(atomic.LoadUint64(&endpoints.entry[i].cursor))
+			if cursor < slowest {
+				slowest = cursor
+			}
+		}
+		if r.size/2 < c.shrinkMin || write-slowest > r.size/4 {
+			atomic.StoreInt64(&c.lowSince, 0)
+			return
+		}
+		since := atomic.LoadInt64(&c.lowSince)
+		if since == 0 {
+			atomic.StoreInt64(&c.lowSince, now)
+			return
+		}
+		if now-since >= c.shrinkAfter && c.halve(r, write) {
+			atomic.StoreInt64(&c.lowSince, now)
+		}
+	})
+}
+
+//jig:name ChanInt_publish
+
+func (c *ChanInt) publish(write uint64, value int) {
+	c.publishAt(write, value, 0, nil)
+}
+
+// publishAt publishes value like publish, but timestamps it with due when that
+// lies in the future, so endpoints withhold it until it is due (see SendAt).
+// The headers are stored with the message when the channel keeps headers.
+func (c *ChanInt) publishAt(write uint64, value int, due int64, headers Headers) {
+	r := c.loadRing()
+	r.buffer[r.slot(write)] = c.cloned(value)
+	c.stamp(r, write, due, headers)
+}
+
+// stamp commits the message already stored in the buffer at write, see
+// publishAt.
+func (c *ChanInt) stamp(r *ringInt, write uint64, due int64, headers Headers) {
+	if r.headers != nil {
+		r.headers[r.slot(write)] = headers
+	}
+	updated := c.timestamp()
+	if due > updated {
+		updated = due
+		if atomic.LoadUint32(&c.deferred) == 0 {
+			atomic.StoreUint32(&c.deferred, 1)
+		}
+	}
+	if r.owners != nil {
+		c.assign(r, write)
+	}
+	atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+1)
+	c.published()
+	c.retain()
+	c.shrink()
+	c.watermark()
+	c.evictSlow()
+	c.checkLag()
+}
+
+//jig:name ChanInt_replace
+
+// replace looks for the most recent committed message with the same key as
+// value that is beyond the cursors of all endpoints and replaces it in place,
+// with the due time (see SendAt) and headers (see SendHeaders) of value.
+// While replacing, the uncommitted bit of the message is set, so endpoints
+// reaching it will wait (see settled) until the replacement is complete.
+func (c *ChanInt) replace(value int, due int64, headers Headers) bool {
+	commit := c.commitData()
+	key := c.key(value)
+	replaced := false
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		unread := func(index uint64) bool {
+			for i := uint32(0); i < endpoints.len; i++ {
+				cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+				if cursor != parked && cursor >= index {
+					return false
+				}
+			}
+			return true
+		}
+		r := c.loadRing()
+		begin := atomic.LoadUint64(&c.begin)
+		for index := commit; index > begin && unread(index-1); index-- {
+			slot := r.slot(index - 1)
+			written := atomic.LoadInt64(&r.written[slot])
+			if written&2 == 2 || c.key(r.buffer[slot]) != key {
+				continue
+			}
+			atomic.StoreInt64(&r.written[slot], written|1)
+			if !unread(index - 1) {
+				atomic.StoreInt64(&r.written[slot], written)
+				return
+			}
+			if c.size != nil {
+				atomic.AddInt64(&c.bytes, -int64(c.size(r.buffer[slot])))
+			}
+			old := r.buffer[slot]
+			r.buffer[slot] = c.cloned(value)
+			if c.recycle != nil {
+				c.recycle(old)
+			}
+			if r.headers != nil {
+				r.headers[slot] = headers
+			}
+			updated := c.timestamp()
+			if due > updated {
+				updated = due
+				if atomic.LoadUint32(&c.deferred) == 0 {
+					atomic.StoreUint32(&c.deferred, 1)
+				}
+			}
+			atomic.StoreInt64(&r.written[slot], updated<<2)
+			replaced = true
+			return
+		}
+	})
+	return replaced
+}
+
+//jig:name ChanInt_awaitEnd
+
+// awaitEnd waits until the slot a sender reserved with a compare-and-swap of
+// write, after checking it was below the end of the buffer, is below the end
+// again. The end only moves down while the buffer is being halved (see
+// halve), which moves it back up when done.
+func (c *ChanInt) awaitEnd(write uint64) {
+	for write >= atomic.LoadUint64(&c.end) {
+		runtime.Gosched()
+	}
+}
+
+//jig:name ChanInt_sendConflated
+
+// sendConflated sends value like send, but when the buffer is full it
+// replaces an older message with the same key instead of waiting for room.
+// It returns false when the channel was closed before value was sent.
+func (c *ChanInt) sendConflated(value int, due int64, headers Headers) bool {
+	var spins uint32
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write >= atomic.LoadUint64(&c.end) {
+			if !c.slideBuffer(nil) {
+				return false
+			}
+			if write >= atomic.LoadUint64(&c.end) {
+				if c.replace(value, due, headers) {
+					return true
+				}
+				backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+				continue
+			}
+		}
+		if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+			c.awaitEnd(write)
+			c.publishAt(write, value, due, headers)
+			return true
+		}
+	}
+}
+
+//jig:name ChanInt_admit
+
+// admit adds size to the bytes in the buffer when this fits the budget,
+// sliding the buffer to make room. When spins is nil, admit does not wait for
+// endpoints to read. It returns false when the size was not admitted.
+func (c *ChanInt) admit(size int64, spins *uint32) bool {
+	for retry := true; ; {
+		bytes := atomic.LoadInt64(&c.bytes)
+		if bytes == 0 || bytes+size <= c.byteBudget {
+			if atomic.CompareAndSwapInt64(&c.bytes, bytes, bytes+size) {
+				return true
+			}
+			continue
+		}
+		if !c.slideBuffer(spins) {
+			return false
+		}
+		if spins == nil {
+			if !retry {
+				return false
+			}
+			retry = false
+		}
+	}
+}
+
+//jig:name ErrSealed
+
+// ErrSealed is returned by Send and FastSend when the channel was sealed by
+// calling Seal.
+const ErrSealed = ChannelError("channel sealed")
+
+//jig:name ChanInt_awaitResume
+
+// awaitResume blocks while the channel is paused and not closed.
+func (c *ChanInt) awaitResume() {
+	for {
+		switch atomic.LoadUint32(&c.paused) {
+		case running:
+			return
+		case pausing:
+			runtime.Gosched()
+		case paused:
+			select {
+			case <-c.resumed.Load().(chan struct{}):
+			case <-c.signal().done:
+				return
+			}
+		}
+	}
+}
+
+//jig:name ChanInt_reserve
+
+// reserve implements the rate limit as a token bucket, using the generic cell
+// rate algorithm. The theoretical arrival time of the next message is kept in
+// rateArrival, so a reservation is a single compare and swap. It returns 0 when
+// count messages can be sent now, otherwise the nanoseconds to wait before
+// trying again.
+func (c *ChanInt) reserve(count uint64) int64 {
+	cost := int64(count) * c.rateInterval
+	tolerance := c.rateTolerance
+	if cost > tolerance {
+		tolerance = cost
+	}
+	for {
+		now := c.elapsed()
+		loaded := atomic.LoadInt64(&c.rateArrival)
+		arrival := loaded
+		if arrival < now {
+			arrival = now
+		}
+		if wait := arrival + cost - now - tolerance; wait > 0 {
+			return wait
+		}
+		if atomic.CompareAndSwapInt64(&c.rateArrival, loaded, arrival+cost) {
+			return 0
+		}
+	}
+}
+
+//jig:name ErrRateLimited
+
+// ErrRateLimited is returned by Send when the channel has a rate limit with
+// policy RateReject and the limit was exceeded.
+const ErrRateLimited = ChannelError("rate limited")
+
+//jig:name ChanInt_throttle
+
+// throttle enforces the rate limit of the channel (see WithRateLimit) for
+// sending count messages. It blocks or returns ErrRateLimited depending on the
+// rate policy.
+func (c *ChanInt) throttle(count uint64) error {
+	if c.rateInterval == 0 {
+		return nil
+	}
+	for wait := c.reserve(count); wait != 0; wait = c.reserve(count) {
+		if c.ratePolicy == RateReject {
+			return ErrRateLimited
+		}
+		time.Sleep(time.Duration(wait))
+	}
+	return nil
+}
+
+//jig:name ChanInt_allocate
+
+// allocate replaces the empty ring the channel was created with by a ring of
+// the same size that can hold messages, sized from the bufferCapacity passed
+// when creating the channel, so channels discarded before their first
+// message don't pay for a buffer and its timestamps. The timestamps also hold
+// the commit flags of the messages, so they are needed by every Send, not
+// only those that record a time. When goroutines allocate concurrently, the
+// ring stored first is returned to all.
+func (c *ChanInt) allocate(empty *ringInt) *ringInt {
+	r := &ringInt{
+		buffer:		make([]int, empty.size),
+		written:	make([]int64, empty.size),
+		mod:		empty.mod,
+		size:		empty.size,
+	}
+	if c.roundRobin == 1 {
+		r.owners = make([]uint32, empty.size)
+	}
+	if c.headers == 1 {
+		r.headers = make([]Headers, empty.size)
+	}
+	if !atomic.CompareAndSwapPointer(&c.ring, unsafe.Pointer(empty), unsafe.Pointer(r)) {
+		return (*ringInt)(atomic.LoadPointer(&c.ring))
+	}
+	return r
+}
+
+//jig:name ChanInt_awaitTurn
+
+// awaitTurn takes a ticket and blocks until it is the turn of the ticket to
+// send, see WithFairSend. When expired returns an error before that, the error
+// is returned and a goroutine is started that passes on the turn when it
+// comes, so the senders behind it are not blocked.
+func (c *ChanInt) awaitTurn(expired func() error) error {
+	ticket := atomic.AddUint64(&c.ticket, 1) - 1
+	var spins uint32
+	for atomic.LoadUint64(&c.serving) != ticket {
+		if expired != nil {
+			if err := expired(); err != nil {
+				go func() {
+					for atomic.LoadUint64(&c.serving) != ticket {
+						runtime.Gosched()
+					}
+					c.passTurn()
+				}()
+				return err
+			}
+		}
+		backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+	}
+	return nil
+}
+
+// tryTurn takes a ticket only when it is its turn right away.
+func (c *ChanInt) tryTurn() bool {
+	serving := atomic.LoadUint64(&c.serving)
+	return atomic.CompareAndSwapUint64(&c.ticket, serving, serving+1)
+}
+
+// passTurn lets the sender with the next ticket send.
+func (c *ChanInt) passTurn() {
+	atomic.AddUint64(&c.serving, 1)
+}
+
+//jig:name ChanInt_awaitConsumed
+
+// awaitConsumed blocks until every active endpoint has consumed the messages
+// before seq, see WithLockstep. Endpoints that finished or were canceled don't
+// have to consume anything. Like an endpoint in blockWhile, the sender
+// registers as stalled and takes the channel to block on before checking the
+// endpoints one last time, so an endpoint advancing its cursor concurrently
+// either sees the sender and wakes it, or the sender notices the advance.
+func (c *ChanInt) awaitConsumed(seq uint64) {
+	for !c.consumed(seq) {
+		atomic.AddInt32(&c.stalled, 1)
+		senders := *(*chan struct{})(atomic.LoadPointer(&c.senders))
+		if !c.consumed(seq) {
+			<-senders
+		}
+		atomic.AddInt32(&c.stalled, -1)
+	}
+}
+
+// consumed returns true when every active endpoint has consumed the messages
+// before seq.
+func (c *ChanInt) consumed(seq uint64) bool {
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		if cursor := atomic.LoadUint64(&entries[i].cursor); cursor != parked && cursor < seq {
+			return false
+		}
+	}
+	return true
+}
+
+//jig:name ChanInt_Send
+
+// Send can be used by concurrent goroutines to send values to the channel.
+//
+// Note, that when the number of unread messages has reached bufferCapacity, then
+// the call to Send will block until the slowest Endpoint has read another
+// message.
+//
+// When the channel was sealed, Send returns ErrSealed. When the channel is
+// closed while waiting for room, Send returns ErrClosed.
+func (c *ChanInt) Send(value int) error {
+	return c.send(value, 0, nil)
+}
+
+// send sends value with the given headers (see SendHeaders), withholding it
+// from the endpoints until the channel has existed for due nanoseconds (see
+// SendAt). A due of 0 delivers it right away.
+func (c *ChanInt) send(value int, due int64, headers Headers) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if c.fair == 1 {
+		c.awaitTurn(nil)
+		defer c.passTurn()
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return err
+	}
+	var spins uint32
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		if !c.admit(size, &spins) {
+			return ErrClosed
+		}
+	}
+	if c.key != nil {
+		if !c.sendConflated(value, due, headers) {
+			atomic.AddInt64(&c.bytes, -size)
+			return ErrClosed
+		}
+		if c.lockstep == 1 {
+			c.awaitConsumed(atomic.LoadUint64(&c.write))
+		}
+		return nil
+	}
+	write := atomic.AddUint64(&c.write, 1) - 1
+	for write >= atomic.LoadUint64(&c.end) {
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			atomic.AddInt64(&c.bytes, -size)
+			return ErrClosed
+		}
+	}
+	c.publishAt(write, value, due, headers)
+	if c.lockstep == 1 {
+		c.awaitConsumed(write + 1)
+	}
+	return nil
+}
+
+//jig:name ChanInt_Close
+
+// Close will close the channel. Pass in an error or nil. Endpoints  continue to
+// receive data until the buffer is empty. Only then will the close notification
+// be delivered to the Range function.
+func (c *ChanInt) Close(err error) {
+	if atomic.CompareAndSwapUint64(&c.channelState, active, closed) {
+		signal := c.signal()
+		signal.err = err
+		c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+			for i := uint32(0); i < endpoints.len; i++ {
+				atomic.CompareAndSwapUint64(&endpoints.entry[i].endpointState, active, closed)
+			}
+		})
+		close(signal.done)
+	}
+	c.wakeAll()
+}
+
+//jig:name ChanInt_detach
+
+// detach uncounts a finished endpoint. When it was the last endpoint, the last
+// endpoint callback is called. Also, when the channel was created with
+// WithRefCount, the channel is closed and torn down, but only once.
+func (c *ChanInt) detach() {
+	if atomic.AddInt64(&c.attached, -1) != 0 {
+		return
+	}
+	if c.onLast != nil {
+		c.onLast()
+	}
+	if atomic.CompareAndSwapUint32(&c.refCount, 1, 2) {
+		c.Close(nil)
+		if c.teardown != nil {
+			c.teardown()
+		}
+	}
+}
+
+//jig:name ChanInt_Closed
+
+// Closed returns true when the channel was closed using the Close method.
+func (c *ChanInt) Closed() bool {
+	return atomic.LoadUint64(&c.channelState) >= closed
+}
+
+//jig:name ChanInt_FastSend
+
+// FastSend can be used to send values to the channel from a SINGLE goroutine.
+// Also, this does not record the time a message was sent, so the maxAge value
+// passed to Range will be ignored.
+//
+// Note, that when the number of unread messages has reached bufferCapacity, then
+// the call to FastSend will block until the slowest Endpoint has read another
+// message.
+//
+// When the channel was sealed, FastSend returns ErrSealed. When the channel is
+// closed while waiting for room, FastSend returns ErrClosed.
+func (c *ChanInt) FastSend(value int) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return err
+	}
+	var spins uint32
+	for c.commit == c.end {
+		if !c.slideBuffer(&spins) {
+			return ErrClosed
+		}
+	}
+	r := c.loadRing()
+	r.buffer[r.slot(c.commit)] = c.cloned(value)
+	if r.owners != nil {
+		c.assign(r, c.commit)
+	}
+	if c.reduce != nil {
+		summary := c.summary.Load().(*reductionInt).value
+		c.summary.Store(&reductionInt{c.reduce(summary, value)})
+	}
+	atomic.AddUint64(&c.commit, 1)
+	c.wake()
+	c.watermark()
+	c.checkLag()
+	if c.lockstep == 1 {
+		c.awaitConsumed(c.commit)
+	}
+	return nil
+}
+
+//jig:name ChanInt_Mark
+
+// Mark injects an in-band marker with the given label into the channel and
+// returns its sequence number. The marker occupies a slot in the buffer just
+// like a message sent via Send, so it is ordered with respect to the messages
+// sent concurrently. Range will skip markers, use RangeMarks to observe them.
+// Markers are never skipped because of the maxAge passed to RangeMarks.
+//
+// Like Send, Mark can be used by concurrent goroutines but should not be
+// mixed with FastSend.
+func (c *ChanInt) Mark(label string) (seq uint64) {
+	seq, _ = c.mark(label, nil)
+	return seq
+}
+
+// mark injects a marker with the given label into the channel, which is an
+// error event when err is not nil, see SendError. It returns false when the
+// channel was closed before the marker was stored.
+func (c *ChanInt) mark(label string, err error) (seq uint64, ok bool) {
+	c.awaitResume()
+	c.marks.Do(func() {
+		c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(*endpointsInt) {
+			r := c.loadRing()
+			r.labels = make([]string, len(r.buffer))
+			r.errs = make([]error, len(r.buffer))
+		})
+	})
+	write := atomic.AddUint64(&c.write, 1) - 1
+	var spins uint32
+	for write >= atomic.LoadUint64(&c.end) {
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			return write, false
+		}
+	}
+	var zero int
+	r := c.loadRing()
+	r.buffer[r.slot(write)] = zero
+	r.labels[r.slot(write)] = label
+	r.errs[r.slot(write)] = err
+	updated := c.timestamp()
+	atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+2+1)
+	c.published()
+	return write, true
+}
+
+//jig:name EndpointInt_RangeMarks
+
+// RangeMarks works like Range, but will additionally call the passed in mark
+// function for every marker injected in the channel by Mark. The mark function
+// is passed the label and sequence number of the marker. Returning false from
+// mark is the same as calling Cancel.
+func (e *EndpointInt) RangeMarks(foreach func(value int, err error, closed bool) bool, mark func(label string, seq uint64) bool, maxAge time.Duration) {
+	e.iterate(foreach, mark, maxAge, nil)
+}
+
+//jig:name EndpointInt_Cancel
+
+// Cancel cancels the endpoint, making it available to be reused when
+// NewEndpoint is called on the channel. When canceled the foreach function
+// passed to Range is not notified, instead just never called again.
+//
+// When the endpoint is not inside a call to Range, its cursor is parked
+// immediately so the endpoint no longer holds back senders that are blocked
+// on a full buffer. Otherwise Range will park the cursor as soon as it
+// observes the cancel.
+func (e *EndpointInt) Cancel() {
+	if atomic.CompareAndSwapUint64(&e.endpointState, active, canceled) ||
+		atomic.CompareAndSwapUint64(&e.endpointState, closed, canceled) {
+		if atomic.LoadUint32(&e.endpointActivity) == idling {
+			e.park()
+		}
+	}
+	e.wakeUp()
+}
+
+//jig:name RoutePolicy
+
+// RoutePolicy determines what a router does when the buffer of the channel
+// a message is routed to is full.
+type RoutePolicy int
+
+const (
+	// RouteBlock blocks the router until the route channel has room for the
+	// message. This exerts backpressure on the channel the router consumes.
+	RouteBlock	RoutePolicy	= iota
+
+	// RouteDrop drops the message when the route channel is full.
+	RouteDrop
+)
+
+//jig:name RouteMetrics
+
+// RouteMetrics contains the number of messages routed to and dropped by a
+// single route of a router.
+type RouteMetrics struct {
+	Routed	uint64
+	Dropped	uint64
+}
+
+//jig:name RouterInt
+
+// RouterInt consumes the messages of a single endpoint and routes every
+// message to one of several output channels, based on a route index returned
+// by a user supplied key function. This is the opposite of multicasting a
+// message to all endpoints of a channel.
+type RouterInt struct {
+	endpoint	*EndpointInt
+	key		func(value int) int
+	routes		[]routeInt
+	unrouted	uint64
+}
+
+type routeInt struct {
+	*ChanInt
+	policy	RoutePolicy
+	routed	uint64
+	dropped	uint64
+}
+
+//jig:name NewRouterInt
+
+// NewRouterInt creates a router that will consume the messages received by
+// endpoint. The key function is called for every message and should return
+// the index of the route (as returned by Route) to send the message to. When
+// the index does not refer to a route, the message is discarded and counted
+// as unrouted.
+func NewRouterInt(endpoint *EndpointInt, key func(value int) int) *RouterInt {
+	return &RouterInt{endpoint: endpoint, key: key}
+}
+
+//jig:name EndpointInt_Dropped
+
+// Dropped returns the number of messages the endpoint missed because it was
+// lagging too far behind on a lossy channel (see WithLossy). Dropped may be
+// called from any goroutine.
+func (e *EndpointInt) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+//jig:name RouterInt_Route
+
+// Route adds the channel c as an output of the router and returns its route
+// index. The policy determines what happens when the buffer of c is full.
+// Routes should be added before calling Run.
+func (r *RouterInt) Route(c *ChanInt, policy RoutePolicy) int {
+	r.routes = append(r.routes, routeInt{ChanInt: c, policy: policy})
+	return len(r.routes) - 1
+}
+
+//jig:name RouterInt_Metrics
+
+// Metrics returns the number of messages routed to and dropped by the route
+// with the given index. It is safe to call Metrics while Run is active.
+func (r *RouterInt) Metrics(route int) RouteMetrics {
+	return RouteMetrics{
+		Routed:		atomic.LoadUint64(&r.routes[route].routed),
+		Dropped:	atomic.LoadUint64(&r.routes[route].dropped),
+	}
+}
+
+//jig:name RouterInt_Unrouted
+
+// Unrouted returns the number of messages discarded because the key function
+// returned an index that did not refer to a route.
+func (r *RouterInt) Unrouted() uint64 {
+	return atomic.LoadUint64(&r.unrouted)
+}
+
+//jig:name ChanInt_Summarize
+
+// Summarize makes the channel maintain a summary of all the messages sent to
+// it, e.g. a count or a checksum. The summary starts out as initial and for
+// every message (in the order the endpoints observe them) the reduce function
+// is called to combine the summary with the message into a new summary.
+//
+// Summarize must be called before any message is sent to the channel. The
+// final summary can be obtained by calling Summary after the close
+// notification was delivered to an endpoint. This allows consumers to verify
+// they received the complete stream.
+func (c *ChanInt) Summarize(initial interface{}, reduce func(summary interface{}, value int) interface{}) {
+	c.summary.Store(&reductionInt{initial})
+	c.reduce = reduce
+}
+
+//jig:name ChanInt_Summary
+
+// Summary returns the summary of the messages sent to the channel so far, or
+// nil when Summarize was not called. Once the close notification has been
+// delivered to an endpoint, the summary covers all messages sent.
+func (c *ChanInt) Summary() interface{} {
+	c.commitData()
+	if summary, ok := c.summary.Load().(*reductionInt); ok {
+		return summary.value
+	}
+	return nil
+}
+
+//jig:name ChanInt_SetSpinBudget
+
+// SetSpinBudget sets the number of times a goroutine waiting on the channel
+// will retry before calling runtime.Gosched to yield the processor. This
+// applies to senders waiting for buffer space, goroutines creating endpoints
+// or enumerating them and receivers backing off in Range. The default of 0
+// yields on every retry, which works well on machines with few cores. On
+// machines with many cores a larger budget may reduce latency.
+func (c *ChanInt) SetSpinBudget(spins int) {
+	atomic.StoreUint32(&c.spinBudget, uint32(spins))
+}
+
+//jig:name ChanInt_Seal
+
+// Seal will seal the channel, after which Send and FastSend will reject any
+// further messages by returning ErrSealed. Unlike Close, the channel stays
+// open; new endpoints can still be created and will replay the messages in
+// the buffer, after which they keep waiting for messages that will never
+// come. This is useful for serving a finalized stream to late receivers.
+func (c *ChanInt) Seal() {
+	atomic.StoreUint32(&c.sealed, 1)
+}
+
+//jig:name ChanInt_Sealed
+
+// Sealed returns true when the channel was sealed using the Seal method.
+func (c *ChanInt) Sealed() bool {
+	return atomic.LoadUint32(&c.sealed) != 0
+}
+
+//jig:name ReadOnlyChanInt
+
+// ReadOnlyChanInt is a view on a channel that only allows creating endpoints
+// and observing whether the channel was closed. It can be handed to
+// components that should be able to receive from the channel, but not send
+// to or close it. The endpoints it creates are read-only as well.
+type ReadOnlyChanInt struct {
+	c *ChanInt
+}
+
+// NewEndpoint will create a new endpoint on the underlying channel, see
+// ChanInt.NewEndpoint for details. The endpoint doesn't give access to the
+// channel.
+func (r ReadOnlyChanInt) NewEndpoint(keep uint64) (*ReadOnlyEndpointInt, error) {
+	e, err := r.c.NewEndpoint(keep)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyEndpointInt{endpoint: e}, nil
+}
+
+// Closed returns true when the underlying channel was closed.
+func (r ReadOnlyChanInt) Closed() bool {
+	return r.c.Closed()
+}
+
+// Done returns a channel that is closed when the underlying channel is
+// closed.
+func (r ReadOnlyChanInt) Done() <-chan struct{} {
+	return r.c.Done()
+}
+
+//jig:name ChanInt_ReadOnly
+
+// ReadOnly returns a read-only view on the channel.
+func (c *ChanInt) ReadOnly() ReadOnlyChanInt {
+	return ReadOnlyChanInt{c}
+}
+
+//jig:name ChanInt_TrySend
+
+// TrySend can be used by concurrent goroutines to send values to the channel
+// without ever blocking. When the number of unread messages has reached
+// bufferCapacity, TrySend will return false immediately instead of waiting
+// for the slowest Endpoint to read another message. TrySend also returns false
+// when the channel was sealed or paused, when its rate limit was exceeded or,
+// in lockstep mode, when the previous message was not consumed yet. When the
+// channel conflates messages (see ConflateBy), a full buffer only makes
+// TrySend return false when there is no older message to replace.
+func (c *ChanInt) TrySend(value int) bool {
+	if atomic.LoadUint32(&c.sealed) != 0 || atomic.LoadUint32(&c.paused) != 0 {
+		return false
+	}
+	if c.fair == 1 {
+		if !c.tryTurn() {
+			return false
+		}
+		defer c.passTurn()
+	}
+	if c.lockstep == 1 && !c.consumed(atomic.LoadUint64(&c.write)) {
+		return false
+	}
+	if c.rateInterval != 0 && c.reserve(1) != 0 {
+		return false
+	}
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		if !c.admit(size, nil) {
+			return false
+		}
+	}
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write >= atomic.LoadUint64(&c.end) {
+			c.slideBuffer(nil)
+			if write >= atomic.LoadUint64(&c.end) {
+				if c.key != nil && c.replace(value, 0, nil) {
+					return true
+				}
+				atomic.AddInt64(&c.bytes, -size)
+				return false
+			}
+		}
+		if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+			c.awaitEnd(write)
+			c.publish(write, value)
+			return true
+		}
+	}
+}
+
+//jig:name SenderInt
+
+// SenderInt is a view on a channel that only allows sending to and closing
+// the channel. It can be handed to producer components that should not be
+// able to create endpoints or inspect the receivers of the channel.
+type SenderInt struct {
+	c *ChanInt
+}
+
+// Send will send a value to the underlying channel, see ChanInt.Send for
+// details.
+func (s SenderInt) Send(value int) error {
+	return s.c.Send(value)
+}
+
+// TrySend will send a value to the underlying channel only when this can be
+// done without blocking, see ChanInt.TrySend for details.
+func (s SenderInt) TrySend(value int) bool {
+	return s.c.TrySend(value)
+}
+
+// Close will close the underlying channel, see ChanInt.Close for details.
+func (s SenderInt) Close(err error) {
+	s.c.Close(err)
+}
+
+//jig:name ChanInt_Sender
+
+// Sender returns a send-only view on the channel.
+func (c *ChanInt) Sender() SenderInt {
+	return SenderInt{c}
+}
+
+//jig:name EndpointInt_RangeContext
+
+// RangeContext works like Range, but will also stop when the passed in
+// context is canceled. In that case the endpoint is canceled and RangeContext
+// returns the error of the context. When the context is never canceled,
+// RangeContext returns nil when the endpoint was canceled or the channel was
+// closed.
+//
+// Note that, unlike Range, RangeContext starts a goroutine to wait for the
+// context to be done. This goroutine exits when RangeContext returns.
+func (e *EndpointInt) RangeContext(ctx context.Context, foreach func(value int, err error, closed bool) bool, maxAge time.Duration) error {
+	if ctx.Done() == nil {
+		e.iterate(foreach, nil, maxAge, nil)
+		return nil
+	}
+	var control uint32
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreUint32(&control, abort)
+			e.wakeUp()
+		case <-returned:
+		}
+	}()
+	e.iterate(foreach, nil, maxAge, &control)
+	close(returned)
+	if atomic.LoadUint32(&control) == abort {
+		return ctx.Err()
+	}
+	return nil
+}
+
+//jig:name ChanInt_sendWait
+
+// sendWait sends value like Send, but gives up with the error returned by
+// expired. While the channel is paused, it blocks until cancel is closed or
+// the deadline passes, unless the deadline is zero.
+func (c *ChanInt) sendWait(value int, cancel <-chan struct{}, deadline time.Time, expired func() error) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if c.fair == 1 {
+		if err := c.awaitTurn(expired); err != nil {
+			return err
+		}
+		defer c.passTurn()
+	}
+	if err := c.awaitResumeUntil(cancel, deadline, expired); err != nil {
+		return err
+	}
+	var spins uint32
+	if c.rateInterval != 0 {
+		for wait := c.reserve(1); wait != 0; wait = c.reserve(1) {
+			if c.ratePolicy == RateReject {
+				return ErrRateLimited
+			}
+			if err := expired(); err != nil {
+				return err
+			}
+			if wait > int64(time.Millisecond) {
+				wait = int64(time.Millisecond)
+			}
+			time.Sleep(time.Duration(wait))
+		}
+	}
+	size := int64(0)
+	if c.size != nil {
+		size = int64(c.size(value))
+		for !c.admit(size, nil) {
+			if err := expired(); err != nil {
+				return err
+			}
+			if !c.slideBuffer(&spins) {
+				return ErrClosed
+			}
+		}
+	}
+	for {
+		write := atomic.LoadUint64(&c.write)
+		if write < atomic.LoadUint64(&c.end) {
+			if atomic.CompareAndSwapUint64(&c.write, write, write+1) {
+				c.awaitEnd(write)
+				c.publish(write, value)
+				if c.lockstep == 1 {
+					c.awaitConsumed(write + 1)
+				}
+				return nil
+			}
+			continue
+		}
+		if c.key != nil && c.replace(value, 0, nil) {
+			if c.lockstep == 1 {
+				c.awaitConsumed(atomic.LoadUint64(&c.write))
+			}
+			return nil
+		}
+		if err := expired(); err != nil {
+			atomic.AddInt64(&c.bytes, -size)
+			return err
+		}
+		if !c.slideBuffer(&spins) {
+			atomic.AddInt64(&c.bytes, -size)
+			return ErrClosed
+		}
+	}
+}
+
+//jig:name ChanInt_SendContext
+
+// SendContext works like Send, but when it is blocked on a full buffer it
+// will give up when the passed in context is canceled and return the error of
+// the context. The message is then not sent. A conflating channel (see
+// ConflateBy) replaces an older message instead of blocking, when it can. When the channel was sealed,
+// SendContext returns ErrSealed. When the channel is closed while waiting for
+// room, SendContext returns ErrClosed.
+func (c *ChanInt) SendContext(ctx context.Context, value int) error {
+	return c.sendWait(value, ctx.Done(), time.Time{}, func() error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			return nil
+		}
+	})
+}
+
+//jig:name ChanInt_refund
+
+// refund subtracts the size of values that were admitted but not sent, because
+// the channel was closed, from the bytes in the buffer.
+func (c *ChanInt) refund(values []int) {
+	if c.size == nil {
+		return
+	}
+	size := int64(0)
+	for _, value := range values {
+		size += int64(c.size(value))
+	}
+	atomic.AddInt64(&c.bytes, -size)
+}
+
+//jig:name ErrTimeout
+
+// ErrTimeout is returned by SendTimeout when the message could not be sent
+// before the timeout expired.
+const ErrTimeout = ChannelError("timeout")
+
+//jig:name ChanInt_awaitResumeUntil
+
+// awaitResumeUntil blocks like awaitResume, but gives up when cancel is closed
+// and returns the error of expired, or returns ErrTimeout when the deadline
+// passes. A zero deadline never passes.
+func (c *ChanInt) awaitResumeUntil(cancel <-chan struct{}, deadline time.Time, expired func() error) error {
+	var timeout <-chan time.Time
+	for {
+		switch atomic.LoadUint32(&c.paused) {
+		case running:
+			return nil
+		case pausing:
+			runtime.Gosched()
+		case paused:
+			if timeout == nil && !deadline.IsZero() {
+				timer := time.NewTimer(time.Until(deadline))
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			select {
+			case <-c.resumed.Load().(chan struct{}):
+			case <-c.signal().done:
+				return nil
+			case <-cancel:
+				return expired()
+			case <-timeout:
+				return ErrTimeout
+			}
+		}
+	}
+}
+
+//jig:name ChanInt_SendTimeout
+
+// SendTimeout works like Send, but when it is blocked on a full buffer for
+// longer than the timeout it will give up and return ErrTimeout. The message
+// is then not sent. A conflating channel (see ConflateBy) replaces an older
+// message instead of blocking, when it can. When the channel was sealed, SendTimeout returns
+// ErrSealed. When the channel is closed while waiting for room, SendTimeout
+// returns ErrClosed.
+func (c *ChanInt) SendTimeout(value int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	return c.sendWait(value, nil, deadline, func() error {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		return nil
+	})
+}
+
+//jig:name EndpointInt_NextTimeout
+
+// NextTimeout works like Next, but will give up waiting for the next message
+// when the timeout expires. In that case both ok and closed are false, but
+// unlike when canceled, the endpoint can still be used.
+func (e *EndpointInt) NextTimeout(timeout time.Duration) (value int, ok bool, closed bool) {
+	var control uint32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreUint32(&control, suspend)
+		e.wakeUp()
+	})
+	defer timer.Stop()
+	return e.next(&control)
+}
+
+//jig:name ChanInt_SendSlice
+
+// SendSlice can be used by concurrent goroutines to send a burst of values to
+// the channel. It reserves a contiguous range of messages in the buffer in one
+// go and stores a single timestamp for all the values. Receivers are notified
+// once after all values have been stored, instead of once per value as is the
+// case for Send.
+//
+// Note, that when the number of unread messages reaches bufferCapacity, then
+// the call to SendSlice will block until the slowest Endpoint has read
+// another message.
+//
+// When the channel conflates messages (see ConflateBy), the values are sent
+// one by one instead, so each of them can replace an older message.
+//
+// When the channel was sealed, SendSlice returns ErrSealed. When the channel
+// is closed while waiting for room, SendSlice returns ErrClosed and the values
+// not stored yet are not sent.
+func (c *ChanInt) SendSlice(values []int) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if c.fair == 1 {
+		c.awaitTurn(nil)
+		defer c.passTurn()
+	}
+	c.awaitResume()
+	if err := c.throttle(uint64(len(values))); err != nil {
+		return err
+	}
+	var spins uint32
+	if c.size != nil {
+		size := int64(0)
+		for _, value := range values {
+			size += int64(c.size(value))
+		}
+		if !c.admit(size, &spins) {
+			return ErrClosed
+		}
+	}
+	if c.key != nil {
+		for i, value := range values {
+			if !c.sendConflated(value, 0, nil) {
+				c.refund(values[i:])
+				return ErrClosed
+			}
+		}
+		if c.lockstep == 1 {
+			c.awaitConsumed(atomic.LoadUint64(&c.write))
+		}
+		return nil
+	}
+	count := uint64(len(values))
+	write := atomic.AddUint64(&c.write, count) - count
+	updated := c.timestamp()
+	for i, value := range values {
+		if write >= atomic.LoadUint64(&c.end) {
+			c.published()
+			for write >= atomic.LoadUint64(&c.end) {
+				if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+					c.refund(values[i:])
+					return ErrClosed
+				}
+			}
+			updated = c.timestamp()
+		}
+		r := c.loadRing()
+		r.buffer[r.slot(write)] = c.cloned(value)
+		if r.owners != nil {
+			c.assign(r, write)
+		}
+		atomic.StoreInt64(&r.written[r.slot(write)], updated<<2+1)
+		write++
+	}
+	c.published()
+	c.retain()
+	c.shrink()
+	c.watermark()
+	c.checkLag()
+	if c.lockstep == 1 {
+		c.awaitConsumed(write)
+	}
+	return nil
+}
+
+//jig:name EndpointInt_ReadBatch
+
+// ReadBatch will block until messages are available and then copy up to
+// len(dst) of them into dst in one go, returning the number of messages
+// copied. The cursor of the endpoint is advanced only once per batch, which
+// makes ReadBatch cheaper than Range for high throughput consumers. Markers
+// and messages older than the maxAge the endpoint was created with are
+// skipped.
+//
+// When the channel is closed, eventually when the buffer is exhausted
+// ReadBatch will return 0. ReadBatch also returns 0 when the endpoint was
+// canceled.
+func (e *EndpointInt) ReadBatch(dst []int) int {
+	if len(dst) == 0 {
+		return 0
+	}
+	if e.acking == 1 {
+		value, ok, _ := e.Next()
+		if !ok {
+			return 0
+		}
+		dst[0] = value
+		return 1
+	}
+	atomic.StoreUint32(&e.endpointActivity, ranging)
+	if atomic.LoadUint64(&e.endpointState) == canceled || atomic.LoadUint64(&e.cursor) == parked {
+		e.park()
+		return 0
+	}
+	if e.recycle != nil {
+		atomic.StoreUint64(&e.held, parked)
+	}
+	e.lastActive = time.Now()
+	for {
+		commit, state := e.await(nil)
+		switch state {
+		case canceled:
+			return 0
+		case closed:
+			e.park()
+			return 0
+		}
+		count := 0
+		cursor := e.cursor
+		if e.conflate == 1 && commit-cursor > 1 {
+			e.skip(cursor, commit-1)
+			cursor = commit - 1
+		}
+		if e.throttle != 0 || e.debounce != 0 {
+			if !e.coalesce(nil) {
+				e.park()
+				return 0
+			}
+			commit = e.commitData()
+			cursor = commit - 1
+		}
+		stale := int64(0)
+		if e.maxAge != 0 {
+			stale = e.elapsed() - e.maxAge.Nanoseconds()
+		}
+		if !e.hold(nil) {
+			e.park()
+			return 0
+		}
+		r := e.loadRing()
+		if e.recycle != nil {
+			atomic.StoreUint64(&e.held, cursor)
+		}
+		for ; cursor != commit && count < len(dst) && atomic.LoadUint32(&e.aborted) == 0; cursor++ {
+			if e.key != nil {
+				atomic.StoreUint64(&e.cursor, cursor)
+			}
+			written := r.settled(cursor)
+			if count > 0 && e.pending(written) {
+				break
+			}
+			if !e.due(written, nil) {
+				e.park()
+				return 0
+			}
+			value := r.buffer[r.slot(cursor)]
+			if e.lapped(cursor) {
+				cursor = atomic.LoadUint64(&e.cursor)
+				break
+			}
+			if updated := written >> 2; written&2 == 0 && (updated == 0 || updated > stale) &&
+				(e.sample <= 1 || cursor%e.sample == 0) && (e.filter == nil || e.filter(value)) &&
+				(r.owners == nil || e.owns(r, cursor)) && (e.group == nil || e.group.claim(cursor, r.size)) {
+				if e.transform != nil {
+					value = e.transform(value)
+				}
+				dst[count] = value
+				count++
+			}
+		}
+		atomic.StoreUint64(&e.cursor, cursor)
+		e.watermark()
+		e.wakeSenders()
+		e.checkLag()
+		e.checkpoint()
+		e.lastActive = time.Now()
+		atomic.StoreInt64(&e.lastRead, e.lastActive.UnixNano())
+		if count > 0 {
+			atomic.StoreUint32(&e.endpointActivity, idling)
+			return count
+		}
+	}
+}
+
+//jig:name ChanInt_Latest
+
+// Latest returns the most recently committed message without the need to
+// create an endpoint. This is useful for channels carrying "current state"
+// style messages, where a late joiner is only interested in the newest one.
+// When no message has been committed yet, ok is false.
+func (c *ChanInt) Latest() (value int, ok bool) {
+	for index := c.commitData(); index > 0; {
+		index--
+		r := c.loadRing()
+		written := r.settled(index)
+		value = r.buffer[r.slot(index)]
+		if atomic.LoadUint64(&c.end) > index+r.size || atomic.LoadInt64(&r.written[r.slot(index)]) != written {
+			index = c.commitData()
+			continue
+		}
+		if written&2 == 0 {
+			return value, true
+		}
+	}
+	var zero int
+	return zero, false
+}
+
+//jig:name ChanInt_Cap
+
+// Cap returns the capacity of the buffer of the channel. This is
+// bufferCapacity as passed to NewChan rounded up to a power of 2 (unless
+// WithExactCapacity was used), or larger when the buffer has grown (see
+// WithGrowth).
+func (c *ChanInt) Cap() int {
+	return int((*ringInt)(atomic.LoadPointer(&c.ring)).size)
+}
+
+//jig:name EndpointInt_Lag
+
+// Lag returns the number of committed messages the endpoint has not read yet.
+// Unlike the other methods of the endpoint, Lag may be called from any
+// goroutine, e.g. to monitor how far a consumer is behind. When the endpoint
+// was canceled or closed and all messages have been read, Lag returns 0.
+func (e *EndpointInt) Lag() int {
+	commit := e.commitData()
+	cursor := atomic.LoadUint64(&e.cursor)
+	if cursor >= commit {
+		return 0
+	}
+	return int(commit - cursor)
+}
+
+//jig:name ChanInt_Len
+
+// Len returns the number of committed messages that have not yet been read by
+// the slowest endpoint. When the channel has no endpoints, Len returns 0.
+func (c *ChanInt) Len() int {
+	commit := c.commitData()
+	slowest := commit
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+			if cursor < slowest {
+				slowest = cursor
+			}
+		}
+	})
+	return int(commit - slowest)
+}
+
+//jig:name ChanOption
+
+// ChanOption configures a channel created by NewChanOpts. Options allow new
+// settings to be added to the channel without changing the signature of its
+// constructor.
+type ChanOption func(*chanOptions)
+
+type chanOptions struct {
+	bufferCapacity		int
+	endpointCapacity	int
+	spinBudget		int
+	clock			func() time.Time
+	lossy			bool
+	conflate		bool
+	growth			bool
+	maxCapacity		int
+	retention		RetentionPolicy
+	lowWater		int
+	highWater		int
+	onHigh			func()
+	onLow			func()
+	rate			float64
+	burst			int
+	ratePolicy		RatePolicy
+	fair			bool
+	lockstep		bool
+	leakIdle		time.Duration
+	onLeak			func(leak EndpointInfo)
+	roundRobin		bool
+	refCount		bool
+	teardown		func()
+	headers			bool
+	wait			WaitStrategy
+	wakeups			bool
+	commitBatch		int
+	commitDelay		time.Duration
+	committer		bool
+	backoff			bool
+	closeAfter		time.Duration
+	blockAfter		time.Duration
+	untimed			bool
+	exact			bool
+	shrinkMin		int
+	shrinkAfter		time.Duration
+	resolution		time.Duration
+}
+
+// WithBufferCapacity sets the size of the message buffer of the channel. The
+// capacity is scaled up to a power of 2, unless WithExactCapacity is used.
+// The default is 128.
+func WithBufferCapacity(capacity int) ChanOption {
+	return func(o *chanOptions) { o.bufferCapacity = capacity }
+}
+
+// WithExactCapacity makes the channel use a buffer of exactly the capacity
+// set by WithBufferCapacity instead of scaling it up to a power of 2. This
+// saves memory on large buffers, e.g. 5 million messages take 5 million slots
+// instead of 8 million, at the cost of a division for every access to the
+// buffer when the capacity is not a power of 2. Growth (see WithGrowth)
+// doubles the exact capacity.
+func WithExactCapacity() ChanOption {
+	return func(o *chanOptions) { o.exact = true }
+}
+
+// WithEndpointCapacity sets the maximum number of concurrent receiving
+// endpoints of the channel. The default is 8.
+func WithEndpointCapacity(capacity int) ChanOption {
+	return func(o *chanOptions) { o.endpointCapacity = capacity }
+}
+
+// WithSpinBudget sets the spin budget of the channel, see SetSpinBudget.
+func WithSpinBudget(spins int) ChanOption {
+	return func(o *chanOptions) { o.spinBudget = spins }
+}
+
+// WithClock replaces time.Now as the source of the timestamps recorded with
+// messages sent to the channel. This affects the maxAge filtering performed
+// by endpoints and the interval of RangeWindow, so a fake clock allows testing
+// them deterministically. The clock should never go back in time.
+func WithClock(now func() time.Time) ChanOption {
+	return func(o *chanOptions) { o.clock = now }
+}
+
+// WithWaitStrategy replaces the default way goroutines wait on the channel,
+// see WaitStrategy. By default, an endpoint that has read everything spins
+// and yields for a while, then blocks when the channel has been idle for
+// 250ms. A sender waiting for room spins and yields.
+func WithWaitStrategy(strategy WaitStrategy) ChanOption {
+	return func(o *chanOptions) { o.wait = strategy }
+}
+
+// WithEndpointWakeups gives every endpoint its own wakeup channel, instead of
+// all endpoints blocking on one wakeup channel shared by them. A state change
+// of a single endpoint, like it being canceled, evicted or its NextTimeout
+// expiring, then only wakes up that endpoint instead of all of them. This pays
+// off with many mostly idle endpoints. Blocked endpoints are woken up by
+// WaitStrategy BlockingWait or by the default strategy after 250ms of idling.
+func WithEndpointWakeups() ChanOption {
+	return func(o *chanOptions) { o.wakeups = true }
+}
+
+// WithCommitBatch makes the endpoints commit the messages sent to the channel
+// in batches of the given size, instead of committing every message as soon
+// as it is available. This reduces the contention between the endpoints of a
+// channel with a high fan-out that all race to do the commit work. A batch is
+// also committed when maxDelay has passed since the previous commit (at least
+// 1ms), so maxDelay bounds the latency added to every message. When the
+// channel is closed, the remaining messages are committed right away.
+// Messages sent with FastSend are not affected.
+func WithCommitBatch(size int, maxDelay time.Duration) ChanOption {
+	return func(o *chanOptions) { o.commitBatch, o.commitDelay = size, maxDelay }
+}
+
+// WithCommitter runs a dedicated goroutine that commits the messages sent to
+// the channel, so the endpoints never do commit work and the order of the
+// messages of concurrent senders is settled with a predictable latency. The
+// endpoints are woken up by the committer, so WithCommitBatch has no effect.
+// The goroutine exits when the channel is closed and is restarted by Reset.
+func WithCommitter() ChanOption {
+	return func(o *chanOptions) { o.committer = true }
+}
+
+// WithBackoff sets the thresholds of the way an endpoint that has read
+// everything waits for new messages, when no WaitStrategy is set. The endpoint
+// spins, yielding the processor every spin budget, until it has been idle for
+// blockAfter (default 250ms) and then blocks until a sender wakes it up. A
+// blockAfter of 0 disables spinning, the endpoint then blocks right away.
+// When the channel is closed, the endpoint keeps waiting for messages still
+// being sent until it has been idle for closeAfter (default 1ms).
+func WithBackoff(closeAfter, blockAfter time.Duration) ChanOption {
+	return func(o *chanOptions) { o.backoff, o.closeAfter, o.blockAfter = true, closeAfter, blockAfter }
+}
+
+// WithoutTimestamps stops the channel from recording the time every message
+// was sent, saving a clock call per message for users that never filter on
+// age. Messages are then treated like messages sent using FastSend: maxAge
+// doesn't skip them, Message.Sent is zero and neither SeekTime nor a
+// RetentionPolicy with a MaxAge work. Messages sent with SendAt or SendAfter
+// are still delayed. The buffer keeps a word per message regardless, because
+// it also tracks whether the message was committed.
+func WithoutTimestamps() ChanOption {
+	return func(o *chanOptions) { o.untimed = true }
+}
+
+// WithCoarseClock makes the channel record the time messages were sent from
+// a clock that is updated by a ticker every resolution (e.g. 1ms), instead of
+// reading the clock for every message. This saves a clock call per message,
+// at the cost of timestamps, and so maxAge filtering, being only as precise as
+// the resolution. The ticker stops when the channel is closed and is
+// restarted by Reset.
+func WithCoarseClock(resolution time.Duration) ChanOption {
+	return func(o *chanOptions) { o.resolution = resolution }
+}
+
+// WithLossy makes the channel never block a sender because of an endpoint
+// lagging behind. Instead, when the buffer is full the oldest message is
+// overwritten, like in a classic ring buffer, and so dropped for the endpoints
+// that did not read it yet. Every endpoint counts the messages it missed, see
+// Dropped. To observe the gaps in the stream of messages as they occur, create
+// endpoints with WithGapHandler.
+func WithLossy() ChanOption {
+	return func(o *chanOptions) { o.lossy = true }
+}
+
+// WithConflate turns the channel into a latest-only channel. Like with
+// WithLossy, senders never block because of an endpoint lagging behind. On top
+// of that, an endpoint that has fallen behind skips directly to the most
+// recent message, so it never observes intermediate values. The skipped
+// messages are counted as dropped, see Dropped. This is useful for
+// broadcasting state snapshots.
+func WithConflate() ChanOption {
+	return func(o *chanOptions) { o.conflate = true }
+}
+
+// WithGrowth makes the buffer of the channel grow instead of blocking senders
+// when it is full because an endpoint is lagging behind. Every time the buffer
+// grows, its capacity is doubled. The capacity never exceeds maxCapacity, a
+// maxCapacity of 0 means the buffer can grow without limit. Once the maximum
+// is reached, senders block as usual. The buffer never shrinks.
+func WithGrowth(maxCapacity int) ChanOption {
+	return func(o *chanOptions) { o.growth, o.maxCapacity = true, maxCapacity }
+}
+
+// WithShrink makes the buffer of the channel shrink when it is mostly unused,
+// so a channel sized for bursts doesn't hold on to the memory of its buffer
+// while idle. When for the duration after no more than a quarter of the
+// buffer held messages that an endpoint did not read yet, the capacity of the
+// buffer is halved, but never below minCapacity. Messages read by all
+// endpoints that don't fit half of the smaller buffer are released, so they
+// are no longer replayed to new endpoints. The buffer is checked when
+// messages are sent and when Shrink is called. WithShrink should not be
+// combined with FastSend.
+func WithShrink(minCapacity int, after time.Duration) ChanOption {
+	return func(o *chanOptions) { o.shrinkMin, o.shrinkAfter = minCapacity, after }
+}
+
+// WithRetention sets the policy that determines how long messages are kept in
+// the buffer for replay to new endpoints, see RetentionPolicy.
+func WithRetention(policy RetentionPolicy) ChanOption {
+	return func(o *chanOptions) { o.retention = policy }
+}
+
+// WithWatermarks registers callbacks that are called when the number of
+// messages sent but not yet read by the slowest endpoint crosses the high and
+// low watermarks. The onHigh callback is called once the number of unread
+// messages reaches high, after which onLow is called once it has dropped to low
+// again, and so on. This allows producers to throttle themselves before Send
+// starts to block on a full buffer. The callbacks are called from the goroutine
+// sending or reading the message that crossed the watermark and should return
+// quickly.
+func WithWatermarks(low, high int, onHigh, onLow func()) ChanOption {
+	return func(o *chanOptions) {
+		o.lowWater, o.highWater = low, high
+		o.onHigh, o.onLow = onHigh, onLow
+	}
+}
+
+// WithRateLimit limits the rate at which messages can be sent to the channel
+// to rate messages per second, allowing bursts of up to burst messages. The
+// policy determines what happens when a message would exceed the limit. The
+// limit applies to Send, FastSend, SendSlice, SendTimeout and SendContext.
+// TrySend returns false when the limit would be exceeded.
+func WithRateLimit(rate float64, burst int, policy RatePolicy) ChanOption {
+	return func(o *chanOptions) { o.rate, o.burst, o.ratePolicy = rate, burst, policy }
+}
+
+// WithFairSend makes concurrent senders enter the channel in the order in
+// which they arrived. Without it, a sender that keeps sending can overtake
+// senders waiting for room in a nearly full buffer. With fair sending, every
+// sender waits for its turn, so it makes progress in roughly arrival order at
+// the cost of some throughput. This applies to Send, SendSlice, SendTimeout
+// and SendContext. TrySend returns false when other senders are waiting.
+func WithFairSend() ChanOption {
+	return func(o *chanOptions) { o.fair = true }
+}
+
+// WithLockstep turns the channel into a barrier. Send does not return until
+// every active endpoint has consumed the message sent, so every message is
+// processed by all endpoints before the next one is sent. This allows driving
+// e.g. simulation steps with strict round based progress. This applies to
+// Send, FastSend, SendSlice, SendTimeout and SendContext; the timeout of the
+// latter two does not apply to waiting for the endpoints. TrySend does not
+// wait, but returns false while the previous message was not consumed yet.
+func WithLockstep() ChanOption {
+	return func(o *chanOptions) { o.lockstep = true }
+}
+
+// WithLeakDetection enables reporting endpoints that appear to be leaked. An
+// endpoint that is no longer used, but was not canceled, keeps the oldest
+// message it did not read in the buffer, so it eventually blocks all senders.
+// With leak detection enabled, the stack trace of the goroutine creating an
+// endpoint is recorded. When a sender finds the buffer full because of an
+// endpoint that is not inside a call to Range and did not read any messages
+// for longer than idle, report is called once for that endpoint. The Origin of
+// the leak passed to report tells where the endpoint was created. The callback
+// is called from the goroutine of the sender and should return quickly.
+//
+// Recording stack traces makes creating endpoints considerably slower, so
+// leak detection is meant for debugging.
+func WithLeakDetection(idle time.Duration, report func(leak EndpointInfo)) ChanOption {
+	return func(o *chanOptions) { o.leakIdle, o.onLeak = idle, report }
+}
+
+// WithRefCount makes the channel close automatically when its last endpoint
+// is canceled or finishes, after which teardown is called when not nil. This
+// allows a producer to stop when nobody is listening anymore, e.g. by
+// selecting on Done. The channel is only closed after at least one endpoint
+// was created. Once closed, the channel stays closed, even when new endpoints
+// are created.
+func WithRefCount(teardown func()) ChanOption {
+	return func(o *chanOptions) { o.refCount, o.teardown = true, teardown }
+}
+
+// WithRoundRobin turns the channel into a work distribution queue. Instead of
+// multicasting every message to all endpoints, every message is assigned to
+// only one of the endpoints when it is sent, taking turns. The other endpoints
+// skip it. Only the endpoint a message was assigned to holds back senders when
+// the buffer is full, so endpoints don't have to wait for each other. When the
+// endpoint a message was assigned to is canceled before reading it, the
+// message is taken over by the next endpoint reaching it. A message sent while
+// there are no endpoints is delivered to the first endpoint reaching it.
+func WithRoundRobin() ChanOption {
+	return func(o *chanOptions) { o.roundRobin = true }
+}
+
+// WithHeaders makes the channel keep the headers passed to SendHeaders with
+// every message, so they can be observed via RangeMeta. Without this option
+// the headers are dropped, which saves the memory to hold them.
+func WithHeaders() ChanOption {
+	return func(o *chanOptions) { o.headers = true }
+}
+
+//jig:name ChanInt_startCommitter
+
+// startCommitter starts the goroutine committing the messages sent to the
+// channel, see WithCommitter. The goroutine exits when the channel is closed,
+// after which the endpoints commit the remaining messages themselves.
+func (c *ChanInt) startCommitter() {
+	exit := make(chan struct{})
+	c.committerExit = exit
+	atomic.StoreUint32(&c.committer, working)
+	go func(done <-chan struct{}) {
+		defer close(exit)
+		for {
+			select {
+			case <-c.commits:
+				c.commitAll()
+			case <-done:
+				atomic.StoreUint32(&c.committer, resting)
+				c.commitAll()
+				return
+			}
+		}
+	}(c.signal().done)
+}
+
+//jig:name ChanInt_startClock
+
+// startClock starts the goroutine updating the coarse clock of the channel,
+// see WithCoarseClock. The goroutine exits when the channel is closed.
+func (c *ChanInt) startClock() {
+	tick := func() {
+		if elapsed := c.elapsed(); elapsed > 0 {
+			atomic.StoreInt64(&c.coarse, elapsed)
+		} else {
+			atomic.StoreInt64(&c.coarse, 1)
+		}
+	}
+	tick()
+	exit := make(chan struct{})
+	c.clockExit = exit
+	go func(done <-chan struct{}) {
+		defer close(exit)
+		ticker := time.NewTicker(c.resolution)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tick()
+			case <-done:
+				return
+			}
+		}
+	}(c.signal().done)
+}
+
+//jig:name NewChanOptsInt
+
+// NewChanOptsInt creates a new channel configured by the given options.
+// Without any options a channel with a buffer capacity of 128 and an endpoint
+// capacity of 8 is created. Like NewChan it panics with ErrCapacity when a
+// capacity is out of range.
+func NewChanOptsInt(options ...ChanOption) *ChanInt {
+	o := chanOptions{bufferCapacity: 128, endpointCapacity: 8}
+	for _, option := range options {
+		option(&o)
+	}
+	size, err := bufferSizeInt(o.bufferCapacity, o.exact)
+	if err != nil {
+		panic(err)
+	}
+	entries, err := endpointTableInt(o.endpointCapacity)
+	if err != nil {
+		panic(err)
+	}
+	c := newChanInt(size, entries)
+	atomic.StoreUint32(&c.spinBudget, uint32(o.spinBudget))
+	if o.lossy || o.conflate {
+		c.lossy = 1
+	}
+	if o.conflate {
+		c.conflate = 1
+	}
+	if o.fair {
+		c.fair = 1
+	}
+	if o.lockstep {
+		c.lockstep = 1
+	}
+	if o.roundRobin {
+		c.roundRobin = 1
+	}
+	if o.headers {
+		c.headers = 1
+	}
+	if o.refCount {
+		c.refCount = 1
+		c.teardown = o.teardown
+	}
+	if o.growth {
+		c.growLimit = maxBufferSizeInt()
+		if o.maxCapacity > 0 && uint64(o.maxCapacity) < c.growLimit {
+			c.growLimit = uint64(o.maxCapacity)
+		}
+	}
+	c.retention = o.retention
+	if o.shrinkAfter > 0 {
+		if o.shrinkMin < 1 {
+			o.shrinkMin = 1
+		}
+		c.shrinkMin, c.shrinkAfter = uint64(o.shrinkMin), int64(o.shrinkAfter)
+	}
+	if o.rate > 0 {
+		if o.burst < 1 {
+			o.burst = 1
+		}
+		c.rateInterval = int64(float64(time.Second) / o.rate)
+		c.rateTolerance = int64(o.burst) * c.rateInterval
+		c.ratePolicy = o.ratePolicy
+	}
+	if o.leakIdle > 0 && o.onLeak != nil {
+		c.leakIdle, c.onLeak = o.leakIdle, o.onLeak
+	}
+	if o.highWater > 0 {
+		c.lowWater, c.highWater = uint64(o.lowWater), uint64(o.highWater)
+		c.onHigh, c.onLow = o.onHigh, o.onLow
+	}
+	c.wait = o.wait
+	if o.untimed {
+		c.untimed = 1
+	}
+	if o.backoff {
+		c.closeAfter, c.blockAfter = o.closeAfter, o.blockAfter
+	}
+	if o.commitBatch > 1 {
+		if o.commitDelay < time.Millisecond {
+			o.commitDelay = time.Millisecond
+		}
+		c.commitBatch, c.commitDelay = uint64(o.commitBatch), int64(o.commitDelay)
+	}
+	if o.wakeups {
+		c.wakeups = 1
+	}
+	if o.clock != nil {
+		c.clock = o.clock
+		c.start = o.clock()
+	}
+	if o.resolution > 0 {
+		c.resolution = o.resolution
+		c.startClock()
+	}
+	if o.committer {
+		c.commits = make(chan struct{}, 1)
+		c.startCommitter()
+	}
+	return c
+}
+
+//jig:name endpointTableInt
+
+// endpointTableInt returns the number of entries in the endpoint table of a
+// channel created with the given endpoint capacity. ErrCapacity is returned
+// when the capacity is negative, doesn't fit the uint32 the table is indexed
+// with or when the table would not fit the largest possible allocation.
+func endpointTableInt(capacity int) (uint32, error) {
+	var entry EndpointInt
+	if capacity < 0 || uint64(capacity) > math.MaxUint32 || uint64(capacity) > maxBytes/uint64(unsafe.Sizeof(entry)) {
+		return 0, ErrCapacity
+	}
+	return uint32(capacity), nil
+}
+
+//jig:name EndpointOption
+
+// EndpointOption configures an endpoint created by NewEndpointOpts.
+type EndpointOption func(*endpointOptions)
+
+// WithKeep specifies how many entries of the existing channel buffer the
+// endpoint should keep, see NewEndpoint. The default is ReplayAll.
+func WithKeep(keep uint64) EndpointOption {
+	return func(o *endpointOptions) { o.keep = keep }
+}
+
+// WithMaxAge fixes the maxAge of the endpoint. Messages older than maxAge are
+// skipped, both when replaying the messages kept in the buffer and when
+// receiving new messages. A maxAge passed explicitly to Range takes
+// precedence.
+func WithMaxAge(maxAge time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.maxAge = maxAge }
+}
+
+// WithName gives the endpoint a human-readable name, e.g. for logging.
+func WithName(name string) EndpointOption {
+	return func(o *endpointOptions) { o.name = name }
+}
+
+// WithGapHandler sets a function that is called whenever messages were dropped
+// before the endpoint could read them, so its cursor jumped ahead. This
+// happens when the endpoint fell behind on a lossy or conflating channel (see
+// WithLossy and WithConflate) or with policy OverflowDropOldest, and when
+// messages were trimmed from the buffer (see ForceTrimBefore and
+// WithRetention). The number of missed messages is passed to the handler. The
+// handler is called from the goroutine using the endpoint, just before the
+// first message after the gap is read. Sequence numbers (see Seq) are stable
+// message IDs, so inside the handler Seq returns the ID of the first message
+// after the gap and the IDs missed are Seq()-missed up to Seq().
+func WithGapHandler(gap func(missed uint64)) EndpointOption {
+	return func(o *endpointOptions) { o.gap = gap }
+}
+
+// WithOverflow sets the policy that determines what happens when the buffer
+// of the channel is full and the endpoint is lagging behind. The default is
+// OverflowBlock.
+func WithOverflow(policy OverflowPolicy) EndpointOption {
+	return func(o *endpointOptions) { o.overflow = policy }
+}
+
+// WithIdleTimeout makes the channel cancel the endpoint automatically when it
+// is not inside a call to Range and did not read any messages for longer than
+// timeout. This releases the slot of an endpoint abandoned by a crashed
+// consumer, so it no longer blocks senders forever. The endpoint is only
+// checked when a sender finds the buffer full. A canceled endpoint behaves as
+// if Cancel was called on it.
+func WithIdleTimeout(timeout time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.idleTimeout = timeout }
+}
+
+// WithSample makes the endpoint deliver only every nth message, skipping the
+// others without calling foreach. Messages are sampled by sequence number (see
+// Seq), so only messages with a sequence number that is a multiple of n are
+// delivered. This allows e.g. a dashboard to follow a high frequency stream
+// at a fraction of the cost. An n of 0 or 1 delivers every message.
+func WithSample(n uint64) EndpointOption {
+	return func(o *endpointOptions) { o.sample = n }
+}
+
+// WithThrottle makes the endpoint deliver at most one message per interval.
+// When the interval has passed since the previous message was delivered, the
+// most recent message is delivered and the messages sent in between are
+// skipped, so the latest message wins. This suits e.g. user interfaces that
+// can't keep up with every update. Markers in between are skipped as well.
+func WithThrottle(interval time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.throttle = interval }
+}
+
+// WithDebounce makes the endpoint deliver a message only after no messages
+// were sent to the channel for the quiet duration. Of every burst of messages
+// only the most recent one is delivered, the others are skipped. This allows
+// e.g. coalescing a burst of configuration changes into a single expensive
+// reload. Markers in between are skipped as well.
+func WithDebounce(quiet time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.debounce = quiet }
+}
+
+// WithPanicHandler makes the endpoint recover from a panic raised by the
+// foreach function passed to Range, or by the functions passed to Filter and
+// Map. The endpoint is then canceled, so its slot can be reused and it no
+// longer blocks senders, and the recovered value is passed to handler. The
+// call to Range then returns normally. The handler is called from the
+// goroutine reading the endpoint.
+func WithPanicHandler(handler func(recovered interface{})) EndpointOption {
+	return func(o *endpointOptions) { o.onPanic = handler }
+}
+
+// WithGroup makes the endpoint join the consumer group with the given name.
+// Every message is delivered to only one of the members of a group, the first
+// member to reach it, while the other members skip it. This turns the members
+// of a group into competing consumers. A member that doesn't deliver a message,
+// e.g. because of its filter (see Filter), leaves it to the other members. A member joining the group starts
+// after the last message delivered to the group, the keep option only applies
+// to the first member. Members can join and leave at any time, the remaining
+// members simply take over their share of the messages.
+func WithGroup(name string) EndpointOption {
+	return func(o *endpointOptions) { o.group = name }
+}
+
+// WithAck turns on acknowledged delivery for the endpoint. The endpoint then
+// delivers one message at a time and only advances past it once the consumer
+// called Ack. When the consumer calls Nack instead, or does not acknowledge
+// the message within timeout, the message is delivered again, up to retries
+// times. After that the message is skipped, or routed to the dead-letter
+// channel of the endpoint (see DeadLetter). A timeout of 0 waits for Ack or
+// Nack indefinitely. Together this gives at-least-once delivery. Note that a
+// message awaiting acknowledgement holds back senders when the buffer is
+// full, like any unread message. ReadBatch reads a single message at a time
+// in this mode.
+func WithAck(timeout time.Duration, retries int) EndpointOption {
+	return func(o *endpointOptions) { o.acking, o.ackTimeout, o.ackRetries = 1, timeout, uint32(retries) }
+}
+
+// WithManualCommit decouples reading from committing progress. The channel
+// then retains every message the endpoint read but did not yet mark as
+// processed by calling Commit, so after a failure the consumer can Seek back
+// to the sequence number returned by Committed and have the uncommitted
+// messages delivered again. Note that uncommitted messages hold back senders
+// when the buffer is full, like any unread message.
+func WithManualCommit() EndpointOption {
+	return func(o *endpointOptions) { o.manualCommit = 1 }
+}
+
+// WithCursorStore makes the endpoint resume from the position saved in store
+// under the name of the endpoint (see WithName), and save its position there
+// after reading, at most once every interval. A restarted process can then
+// continue where it left off, instead of replaying everything or losing its
+// place. The saved position is only used when it is within the messages
+// retained in the buffer, otherwise the endpoint starts as configured by
+// WithKeep. For an endpoint created with WithManualCommit, the committed
+// position (see Commit) is saved instead of the read position. An endpoint
+// without a name does not use the store.
+func WithCursorStore(store CursorStore, interval time.Duration) EndpointOption {
+	return func(o *endpointOptions) { o.cursorStore, o.checkpointEvery = store, interval }
+}
+
+//jig:name ChanInt_NewEndpointOpts
+
+// NewEndpointOpts will create a new channel endpoint configured by the given
+// options. Without any options it behaves like NewEndpoint(ReplayAll). When
+// the position of the endpoint can't be loaded from its cursor store (see
+// WithCursorStore), the error of the store is returned.
+func (c *ChanInt) NewEndpointOpts(options ...EndpointOption) (*EndpointInt, error) {
+	o := endpointOptions{keep: ReplayAll}
+	for _, option := range options {
+		option(&o)
+	}
+	if o.cursorStore != nil && o.name != "" {
+		var err error
+		if o.resume, o.resuming, err = o.cursorStore.Load(o.name); err != nil {
+			return nil, err
+		}
+	}
+	return c.endpoints.NewForChanInt(c, o)
+}
+
+//jig:name EndpointInt_Name
+
+// Name returns the human-readable name of the endpoint as passed to
+// NewEndpointOpts using WithName.
+func (e *EndpointInt) Name() string {
+	return e.name
+}
+
+//jig:name EndpointInt_Seq
+
+// Seq returns the sequence number of the next message the endpoint will read.
+// Every message sent to the channel gets the next sequence number, starting
+// at 0. Markers (see Mark) also occupy a sequence number.
+func (e *EndpointInt) Seq() uint64 {
+	return atomic.LoadUint64(&e.cursor)
+}
+
+//jig:name ChanInt_Err
+
+// Err returns the error passed to Close once the channel is closed (see Done).
+// Before the channel is closed, or when it was closed with a nil error, Err
+// returns nil.
+func (c *ChanInt) Err() error {
+	signal := c.signal()
+	select {
+	case <-signal.done:
+		return signal.err
+	default:
+		return nil
+	}
+}
+
+//jig:name EndpointInt_block
+
+// block blocks the endpoint until a sender or a state change wakes it up, see
+// blockWhile. It doesn't block when there are messages to read or the
+// endpoint is no longer active.
+func (e *EndpointInt) block(control *uint32) {
+	e.blockWhile(func() bool {
+		return e.commitData() == e.cursor && atomic.LoadUint64(&e.endpointState) == active &&
+			(control == nil || atomic.LoadUint32(control) == proceed)
+	})
+}
+
+// blockWhile blocks the endpoint until it is woken up, when blocked returns
+// true. The endpoint registers as a sleeper and takes the channel to block on
+// before calling blocked one last time, so a goroutine changing the condition
+// concurrently either sees the sleeper and wakes it, or the change is noticed
+// by blocked and the endpoint doesn't block. A wakeup can't be missed: a
+// broadcast coming in between the check and blocking closes the channel that
+// was taken.
+func (e *EndpointInt) blockWhile(blocked func() bool) {
+	atomic.AddInt32(&e.sleepers, 1)
+	var receivers chan struct{}
+	if e.wakeup != nil {
+		atomic.StoreUint32(&e.sleeping, 1)
+	} else {
+		receivers = *(*chan struct{})(atomic.LoadPointer(&e.receivers))
+	}
+	if blocked() {
+		if e.wakeup != nil {
+			<-e.wakeup
+		} else {
+			<-receivers
+		}
+	}
+	atomic.StoreUint32(&e.sleeping, 0)
+	atomic.AddInt32(&e.sleepers, -1)
+}
+
+//jig:name ErrOutOfRange
+
+// ErrOutOfRange is returned by Seek when the sequence number is not (or no
+// longer) available in the buffer or when the endpoint has finished.
+const ErrOutOfRange = ChannelError("sequence number out of range")
+
+//jig:name EndpointInt_Seek
+
+// Seek positions the endpoint so the next message it reads is the one with
+// sequence number seq. This allows rewinding the endpoint to reprocess
+// messages still retained in the buffer, or skipping ahead up to the most
+// recently committed message. When seq is not within that range or the
+// endpoint has finished, Seek returns ErrOutOfRange.
+//
+// Seek should be called from the goroutine using the endpoint, but not from
+// inside the function passed to Range.
+func (e *EndpointInt) Seek(seq uint64) error {
+	commit := e.commitData()
+	err := error(ErrOutOfRange)
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(endpoints *endpointsInt) {
+
+		if atomic.LoadUint64(&e.cursor) != parked && atomic.LoadUint64(&e.begin) <= seq && seq <= commit {
+			atomic.StoreUint64(&e.cursor, seq)
+			endpoints.invalidate(e.index)
+			err = nil
+		}
+	})
+	return err
+}
+
+//jig:name EndpointInt_SeekTime
+
+// SeekTime positions the endpoint at the first message retained in the buffer
+// that was sent at or after t. When all retained messages were sent before t,
+// the endpoint is positioned after the most recently committed message. This
+// is useful to e.g. replay the messages of the last 30 seconds. When the
+// endpoint has finished, SeekTime returns ErrOutOfRange.
+//
+// SeekTime relies on the timestamps recorded by Send, so it should not be
+// used on channels fed by FastSend. Like Seek, it should not be called from
+// inside the function passed to Range.
+func (e *EndpointInt) SeekTime(t time.Time) error {
+	e.commitData()
+	target := t.Sub(e.start).Nanoseconds()
+	err := error(ErrOutOfRange)
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(endpoints *endpointsInt) {
+		if atomic.LoadUint64(&e.cursor) == parked {
+			return
+		}
+		begin := atomic.LoadUint64(&e.begin)
+		commit := atomic.LoadUint64(&e.commit)
+		r := e.loadRing()
+		offset := sort.Search(int(commit-begin), func(i int) bool {
+			return atomic.LoadInt64(&r.written[r.slot(begin+uint64(i))])>>2 >= target
+		})
+		atomic.StoreUint64(&e.cursor, begin+uint64(offset))
+		endpoints.invalidate(e.index)
+		err = nil
+	})
+	return err
+}
+
+//jig:name EndpointInt_RangeSeq
+
+// RangeSeq works like Range, but passes the sequence number of every message
+// and the time it was sent to the foreach function. Sequence numbers are
+// consecutive, so a consumer can detect gaps, e.g. caused by maxAge skipping
+// messages. The sent time is the zero time for messages sent using FastSend.
+// The close notification carries the sequence number the next message would
+// have had.
+func (e *EndpointInt) RangeSeq(foreach func(value int, seq uint64, sent time.Time, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(func(value int, err error, closed bool) bool {
+		seq := e.cursor
+		if closed {
+			return foreach(value, seq, time.Time{}, err, true)
+		}
+		var sent time.Time
+		r := e.loadRing()
+		if updated := atomic.LoadInt64(&r.written[r.slot(seq)]) >> 2; updated != 0 {
+			sent = e.start.Add(time.Duration(updated))
+		}
+		return foreach(value, seq, sent, nil, false)
+	}, nil, maxAge, nil)
+}
+
+//jig:name ErrInUse
+
+// ErrInUse is returned by Reset when the channel is not closed or still has
+// endpoints that did not finish.
+const ErrInUse = ChannelError("channel in use")
+
+//jig:name ChanInt_Reset
+
+// Reset makes a closed channel available for reuse, without reallocating its
+// buffer and endpoints. The buffered messages, the error passed to Close and
+// any summary (see Summarize) are cleared and the channel is unsealed.
+//
+// Reset returns ErrInUse when the channel was not closed or when any of its
+// endpoints did not finish yet. The caller must make sure no goroutine is
+// sending to the channel while calling Reset.
+func (c *ChanInt) Reset() error {
+	err := error(ErrInUse)
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		if atomic.LoadUint64(&c.channelState) != closed {
+			return
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			if atomic.LoadUint64(&endpoints.entry[i].cursor) != parked {
+				return
+			}
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			endpoints.entry[i].endpointClosed = 0
+			endpoints.invalidate(i)
+		}
+		var zero int
+		r := (*ringInt)(atomic.LoadPointer(&c.ring))
+		for i := range r.buffer {
+			r.buffer[i] = zero
+			r.written[i] = 0
+		}
+		for i := range r.labels {
+			r.labels[i] = ""
+			r.errs[i] = nil
+		}
+		for i := range r.headers {
+			r.headers[i] = nil
+		}
+		size := r.size
+		atomic.StoreUint64(&c.begin, 0)
+		atomic.StoreUint64(&c.end, size)
+		atomic.StoreUint64(&c.commit, 0)
+		atomic.StoreUint64(&c.write, 0)
+		atomic.StoreInt64(&c.bytes, 0)
+		c.reduce = nil
+		c.summary = atomic.Value{}
+		c.groups = nil
+		atomic.StorePointer(&c.closing, unsafe.Pointer(&closeSignal{done: make(chan struct{})}))
+		if c.clock != nil {
+			c.start = c.clock()
+		} else {
+			c.start = time.Now()
+		}
+		atomic.StoreUint32(&c.sealed, 0)
+		atomic.StoreUint32(&c.aborted, 0)
+		atomic.StoreUint64(&c.final, 0)
+		atomic.StoreUint32(&c.trimmed, 0)
+		atomic.StoreUint64(&c.channelState, active)
+		err = nil
+	})
+	if err == nil && c.commits != nil {
+		<-c.committerExit
+		c.startCommitter()
+	}
+	if err == nil && c.resolution != 0 {
+		<-c.clockExit
+		c.startClock()
+	}
+	return err
+}
+
+//jig:name ChanInt_CloseNow
+
+// CloseNow will close the channel like Close, but instead of letting the
+// endpoints receive the data remaining in the buffer, the remaining data is
+// discarded and the close notification is delivered immediately. Messages
+// already being delivered to the foreach function of Range when CloseNow is
+// called are not affected.
+func (c *ChanInt) CloseNow(err error) {
+	c.Close(err)
+	atomic.StoreUint32(&c.aborted, 1)
+	c.wakeAll()
+}
+
+//jig:name ChanInt_ConflateBy
+
+// ConflateBy makes Send conflate messages by key when the buffer is full.
+// Instead of blocking until the slowest endpoint has read another message,
+// Send will replace an older message with the same key as the new message.
+// Only messages that none of the endpoints started reading are replaced, so
+// every endpoint still observes the latest message for every key. When there
+// is no such message, Send blocks as usual. The key function is called for
+// every message compared and should return a comparable value.
+//
+// ConflateBy must be called before any message is sent to the channel. Send,
+// SendAt, SendAfter, SendHeaders, SendSlice, SendContext, SendTimeout and
+// TrySend conflate messages, FastSend does not. TrySend, SendContext and
+// SendTimeout only fail when there is no message to replace either. The
+// replacing message takes the place of the replaced one, with its own
+// timestamp, due time and headers. Note that a message replaced this way is
+// not passed to the reduce function of Summarize.
+func (c *ChanInt) ConflateBy(key func(value int) interface{}) {
+	c.key = key
+}
+
+//jig:name ChanInt_LimitBytes
+
+// LimitBytes bounds the channel by the total estimated size of the messages
+// in its buffer, on top of the number of messages it can hold. The size
+// function is called for every message sent and should return its size in
+// bytes. It is called again when the message leaves the buffer, so it must
+// return the same size for the same message.
+//
+// Send, SendSlice, SendTimeout and SendContext block while the messages in
+// the buffer would exceed the budget, until the slowest endpoint has read
+// enough messages to make room. TrySend returns false instead of blocking. A single message larger than the
+// budget is accepted when the buffer is empty. FastSend ignores the budget.
+//
+// LimitBytes must be called before any message is sent to the channel.
+func (c *ChanInt) LimitBytes(budget int64, size func(value int) int) {
+	c.byteBudget = budget
+	c.size = size
+}
+
+//jig:name ChanInt_Bytes
+
+// Bytes returns the total estimated size of the messages in the buffer of a
+// channel bounded by LimitBytes. For other channels it returns 0.
+func (c *ChanInt) Bytes() int64 {
+	return atomic.LoadInt64(&c.bytes)
+}
+
+//jig:name NewChanCheckedInt
+
+// NewChanCheckedInt creates a channel like NewChanOpts, but returns
+// ErrCapacity instead of panicking when the buffer or endpoint capacity is
+// out of range. Use it to validate capacities that come from configuration,
+// e.g. a buffer of hundreds of millions of messages retaining a full day of
+// data.
+func NewChanCheckedInt(options ...ChanOption) (*ChanInt, error) {
+	o := chanOptions{bufferCapacity: 128, endpointCapacity: 8}
+	for _, option := range options {
+		option(&o)
+	}
+	if _, err := endpointTableInt(o.endpointCapacity); err != nil {
+		return nil, err
+	}
+	if _, err := bufferSizeInt(o.bufferCapacity, o.exact); err != nil {
+		return nil, err
+	}
+	return NewChanOptsInt(options...), nil
+}
+
+//jig:name MemStats
+
+// MemStats reports the memory used by a channel in bytes, see MemStats.
+type MemStats struct {
+	Channel		uint64	// the channel itself
+	Buffer		uint64	// slots of the messages in the buffer
+	Timestamps	uint64	// timestamps recorded with the messages
+	Metadata	uint64	// labels, errors, owners and headers of the messages
+	Endpoints	uint64	// table of endpoints
+	Payload		uint64	// estimated size of the data the messages refer to
+}
+
+// Total returns the total number of bytes reported.
+func (m MemStats) Total() uint64 {
+	return m.Channel + m.Buffer + m.Timestamps + m.Metadata + m.Endpoints + m.Payload
+}
+
+//jig:name ChanInt_MemStats
+
+// MemStats returns the memory used by the channel, which helps planning the
+// capacity of many channels. The sizes of the buffer, timestamps and endpoint
+// table follow from the capacities of the channel. The data messages refer to
+// (e.g. the bytes of a slice) is estimated by calling size for every message
+// in the buffer. When size is nil, the size passed to LimitBytes is used
+// instead, otherwise the payload is reported as 0.
+func (c *ChanInt) MemStats(size func(value int) int) MemStats {
+	var zero int
+	var entry EndpointInt
+	var label string
+	var err error
+	var headers Headers
+	stats := MemStats{Channel: uint64(unsafe.Sizeof(*c))}
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		r := (*ringInt)(atomic.LoadPointer(&c.ring))
+		stats.Buffer = uint64(len(r.buffer)) * uint64(unsafe.Sizeof(zero))
+		stats.Timestamps = uint64(len(r.written)) * 8
+		stats.Metadata = uint64(len(r.labels))*uint64(unsafe.Sizeof(label)) +
+			uint64(len(r.errs))*uint64(unsafe.Sizeof(err)) +
+			uint64(len(r.owners))*4 +
+			uint64(len(r.headers))*uint64(unsafe.Sizeof(headers))
+		stats.Endpoints = uint64(len(endpoints.entry)) * uint64(unsafe.Sizeof(entry))
+		switch {
+		case size != nil:
+
+			commit := c.commitData()
+			for index := atomic.LoadUint64(&c.begin); index < commit; index++ {
+				if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+					stats.Payload += uint64(size(r.buffer[r.slot(index)]))
+				}
+			}
+		case c.size != nil:
+			stats.Payload = uint64(atomic.LoadInt64(&c.bytes))
+		}
+	})
+	return stats
+}
+
+//jig:name ChanInt_Recycle
+
+// Recycle makes the channel pass every value through clone before storing it
+// in the buffer and call recycle with the stored value once no endpoint can
+// read it anymore. Together with a BytePool, this allows a channel of byte
+// slices to copy payloads into pooled buffers and return them to the pool:
+//
+//	pool := NewBytePool(64 << 10)
+//	channel.Recycle(pool.Copy, pool.Put)
+//
+// A value is recycled when the buffer slides past it after all endpoints
+// read it, when it is discarded by a retention policy or TrimBefore and when
+// it is replaced by a conflating Send. Values that a lossy endpoint (see
+// WithLossy and WithOverflow) or ForceTrimBefore may still be reading are not
+// recycled, nor are the values left in the buffer of a closed channel.
+//
+// A receiver may use a value until its foreach function returns. The values
+// returned by Next or ReadBatch may be used until the next call to Next,
+// ReadBatch or Range on the same endpoint. Until then, the channel holds them
+// back from recycling, which also keeps senders from reusing their slots. A
+// receiver that holds on to a value after that must copy it. Values stored
+// using Claim and Publish are not cloned.
+//
+// Either function may be nil. Recycle must be called before any message is
+// sent to the channel.
+func (c *ChanInt) Recycle(clone func(value int) int, recycle func(value int)) {
+	c.clone = clone
+	c.recycle = recycle
+}
+
+//jig:name BytePool
+
+// BytePool is a pool of byte buffers of a fixed size backed by a sync.Pool.
+// It allows a channel of byte slices to copy the payload of every message
+// into a pooled buffer and to return the buffer once all endpoints have read
+// the message, so the buffers are reused instead of left to the garbage
+// collector, see Recycle.
+type BytePool struct {
+	size	int
+	pool	sync.Pool
+}
+
+// NewBytePool creates a pool of buffers with a capacity of size bytes.
+func NewBytePool(size int) *BytePool {
+	p := &BytePool{size: size}
+	p.pool.New = func() interface{} { return make([]byte, size) }
+	return p
+}
+
+// Copy returns a copy of data in a buffer taken from the pool. Data that
+// doesn't fit a buffer of the pool is copied into a newly allocated slice
+// instead, which Put will not keep.
+func (p *BytePool) Copy(data []byte) []byte {
+	if len(data) > p.size {
+		return append([]byte(nil), data...)
+	}
+	buf := p.pool.Get().([]byte)[:len(data)]
+	copy(buf, data)
+	return buf
+}
+
+// Put returns a buffer obtained from Copy to the pool. Slices that were not
+// allocated by the pool are ignored.
+func (p *BytePool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	p.pool.Put(buf[:p.size])
+}
+
+//jig:name ChanInt_Shrink
+
+// Shrink enforces the shrink policy of the channel (see WithShrink). The
+// policy is enforced every time a message is sent, but shrinking a channel
+// that no longer receives any messages requires calling Shrink periodically.
+func (c *ChanInt) Shrink() {
+	c.shrink()
+}
+
+//jig:name ChanInt_Retain
+
+// Retain enforces the retention policy of the channel (see WithRetention).
+// The policy is enforced every time a message is sent, but releasing messages
+// because of their age also requires calling Retain periodically when no
+// messages are being sent.
+func (c *ChanInt) Retain() {
+	c.retain()
+}
+
+//jig:name ChanInt_trim
+
+func (c *ChanInt) trim(seq uint64, force bool) error {
+	commit := c.commitData()
+	if seq > commit {
+		return ErrOutOfRange
+	}
+	err := error(nil)
+	forced := false
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		begin := atomic.LoadUint64(&c.begin)
+		if seq <= begin {
+			return
+		}
+		for i := uint32(0); i < endpoints.len; i++ {
+			cursor := atomic.LoadUint64(&endpoints.entry[i].cursor)
+			if endpoints.entry[i].retained(cursor) >= seq {
+				continue
+			}
+			if !force {
+				err = ErrInUse
+				return
+			}
+			if cursor < seq {
+				atomic.StoreUint32(&c.trimmed, 1)
+			}
+			forced = true
+		}
+		c.discard(c.loadRing(), begin, seq, !forced)
+	})
+	return err
+}
+
+//jig:name ChanInt_TrimBefore
+
+// TrimBefore discards the messages with a sequence number before seq from the
+// buffer and zeroes their slots, so they will no longer be replayed to new
+// endpoints. This allows freeing memory for messages that were checkpointed
+// downstream. When an active endpoint did not read all of these messages yet,
+// or did not commit them (see WithManualCommit), TrimBefore returns ErrInUse
+// and discards nothing. The same applies to a value of a recycling channel
+// that was handed out by the last call to Next or ReadBatch (see Recycle). When seq is beyond the most
+// recently committed message, TrimBefore returns ErrOutOfRange.
+func (c *ChanInt) TrimBefore(seq uint64) error {
+	return c.trim(seq, false)
+}
+
+//jig:name ChanInt_ForceTrimBefore
+
+// ForceTrimBefore works like TrimBefore, but instead of failing it advances
+// endpoints that did not read all of the discarded messages yet. Such an
+// endpoint skips to seq as if it fell behind on a lossy channel; the skipped
+// messages are counted as dropped and reported to its gap handler. An endpoint
+// created with policy OverflowError is closed with ErrOverflow instead.
+func (c *ChanInt) ForceTrimBefore(seq uint64) error {
+	return c.trim(seq, true)
+}
+
+//jig:name ChanInt_Demand
+
+// Demand returns the number of messages that can be sent to the channel
+// before exceeding the credit granted by any of the endpoints that called
+// Request. This is the smallest outstanding demand of those endpoints, so a
+// producer that sends no more than Demand messages never sends a message one of
+// them did not ask for. When no endpoint requested messages, Demand returns 0.
+func (c *ChanInt) Demand() uint64 {
+	write := atomic.LoadUint64(&c.write)
+	demand := uint64(0)
+	requested := false
+	entries := c.endpoints.Snapshot()
+	for i := range entries {
+		limit := atomic.LoadUint64(&entries[i].demand)
+		if limit == 0 || atomic.LoadUint64(&entries[i].cursor) == parked {
+			continue
+		}
+		outstanding := uint64(0)
+		if limit > write {
+			outstanding = limit - write
+		}
+		if !requested || outstanding < demand {
+			demand = outstanding
+			requested = true
+		}
+	}
+	return demand
+}
+
+//jig:name EndpointInt_Request
+
+// Request grants the channel credit for n more messages to be sent to the
+// endpoint. An endpoint that calls Request takes part in the demand signaled
+// to producers, see Demand. Credit granted while the endpoint is lagging
+// behind counts from the message it will read next, so credit is never spent
+// on messages it did not receive yet.
+func (e *EndpointInt) Request(n uint64) {
+	if n == 0 {
+		return
+	}
+	for {
+		demand := atomic.LoadUint64(&e.demand)
+		base := demand
+		if cursor := atomic.LoadUint64(&e.cursor); base < cursor {
+			base = cursor
+		}
+		if atomic.CompareAndSwapUint64(&e.demand, demand, base+n) {
+			return
+		}
+	}
+}
+
+//jig:name ChanInt_AwaitDemand
+
+// AwaitDemand blocks until Demand is non-zero and then returns it. This allows
+// a producer to generate messages only when consumers asked for them. When the
+// channel is closed or sealed, AwaitDemand returns 0.
+func (c *ChanInt) AwaitDemand() uint64 {
+	var spins uint32
+	for {
+		if demand := c.Demand(); demand > 0 {
+			return demand
+		}
+		if atomic.LoadUint64(&c.channelState) != active || atomic.LoadUint32(&c.sealed) != 0 {
+			return 0
+		}
+		backoff(&spins, atomic.LoadUint32(&c.spinBudget))
+	}
+}
+
+//jig:name Subscription
+
+// Subscription is the link between a publisher and a subscriber in the style
+// of Reactive Streams. The subscriber uses it to signal demand for messages
+// and to cancel the subscription.
+type Subscription interface {
+	// Request signals demand for n more messages. A request of
+	// math.MaxInt64 or more in total is treated as unbounded. Requesting
+	// a number that is not positive fails the subscription with
+	// ErrInvalidRequest.
+	Request(n int64)
+
+	// Cancel stops the delivery of messages to the subscriber.
+	Cancel()
+}
+
+//jig:name NotificationKind
+
+// NotificationKind tells what a Notification delivered by RangeNotifications
+// is about.
+type NotificationKind int
+
+const (
+	// OnNext notifications carry a message sent to the channel.
+	OnNext	NotificationKind	= iota
+	// OnError notifications carry an error sent by SendError. More
+	// notifications may follow.
+	OnError
+	// OnComplete is the last notification, delivered when the channel is
+	// closed. It carries the error the channel was closed with, if any.
+	OnComplete
+)
+
+//jig:name SubscriberInt
+
+// SubscriberInt receives messages from a publisher in the style of Reactive
+// Streams. OnSubscribe is called first, followed by at most as many calls to
+// OnNext as were requested via the subscription, terminated by either
+// OnError or OnComplete.
+type SubscriberInt interface {
+	OnSubscribe(subscription Subscription)
+	OnNext(value int)
+	OnError(err error)
+	OnComplete()
+}
+
+//jig:name PublisherInt
+
+// PublisherInt publishes messages to subscribers in the style of Reactive
+// Streams.
+type PublisherInt interface {
+	Subscribe(subscriber SubscriberInt)
+}
+
+//jig:name ErrInvalidRequest
+
+// ErrInvalidRequest is delivered to a subscriber that requested a number of
+// messages that is not positive, see Subscription.
+const ErrInvalidRequest = ChannelError("invalid request")
+
+//jig:name subscriptionInt
+
+type subscriptionInt struct {
+	endpoint	*EndpointInt
+	requested	int64
+	invalid		uint32
+	canceled	uint32
+	demand		chan struct{}	// signaled by Request and Cancel
+}
+
+func (s *subscriptionInt) Request(n int64) {
+	if atomic.LoadUint32(&s.canceled) == 1 {
+		return
+	}
+	if n <= 0 {
+		atomic.StoreUint32(&s.invalid, 1)
+		s.stop()
+		return
+	}
+	for {
+		requested := atomic.LoadInt64(&s.requested)
+		total := requested + n
+		if total < requested {
+			total = math.MaxInt64
+		}
+		if atomic.CompareAndSwapInt64(&s.requested, requested, total) {
+			break
+		}
+	}
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriptionInt) Cancel() {
+	if atomic.CompareAndSwapUint32(&s.canceled, 0, 1) {
+		s.stop()
+	}
+}
+
+// stop cancels the endpoint and wakes up the goroutine delivering messages.
+func (s *subscriptionInt) stop() {
+	if s.endpoint == nil {
+		return
+	}
+	s.endpoint.Cancel()
+	s.endpoint.wakeUp()
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriptionInt) deliver(subscriber SubscriberInt) {
+	for {
+		for atomic.LoadInt64(&s.requested) == 0 && atomic.LoadUint32(&s.invalid) == 0 && atomic.LoadUint32(&s.canceled) == 0 {
+			<-s.demand
+		}
+		value, ok, closed := s.endpoint.Next()
+		switch {
+		case atomic.LoadUint32(&s.invalid) == 1:
+			s.endpoint.Cancel()
+			subscriber.OnError(ErrInvalidRequest)
+			return
+		case closed:
+			if err := s.endpoint.closeErr(); err != nil {
+				subscriber.OnError(err)
+			} else {
+				subscriber.OnComplete()
+			}
+			return
+		case !ok:
+			return
+		}
+		if atomic.LoadInt64(&s.requested) != math.MaxInt64 {
+			atomic.AddInt64(&s.requested, -1)
+		}
+		subscriber.OnNext(value)
+	}
+}
+
+//jig:name publisherInt
+
+type publisherInt struct {
+	channel	*ChanInt
+	keep	uint64
+}
+
+func (p publisherInt) Subscribe(subscriber SubscriberInt) {
+	endpoint, err := p.channel.NewEndpoint(p.keep)
+	if err != nil {
+		subscriber.OnSubscribe(&subscriptionInt{canceled: 1})
+		subscriber.OnError(err)
+		return
+	}
+	s := &subscriptionInt{endpoint: endpoint, demand: make(chan struct{}, 1)}
+	subscriber.OnSubscribe(s)
+	go s.deliver(subscriber)
+}
+
+//jig:name ChanInt_Publisher
+
+// Publisher returns the channel as a Reactive Streams style publisher. Every
+// subscriber gets its own endpoint on the channel, created with the given
+// keep argument (see NewEndpoint). Messages are delivered to the subscriber
+// from a goroutine started by Subscribe, but only as many as the subscriber
+// requested. Closing the channel completes the subscriber, or fails it when
+// the channel was closed with an error. When no endpoint can be created, the
+// subscriber fails with ErrOutOfEndpoints.
+func (c *ChanInt) Publisher(keep uint64) PublisherInt {
+	return publisherInt{c, keep}
+}
+
+//jig:name chanSubscriberInt
+
+type chanSubscriberInt struct {
+	channel		*ChanInt
+	prefetch	int64
+	received	int64
+	subscription	Subscription
+}
+
+func (s *chanSubscriberInt) OnSubscribe(subscription Subscription) {
+	if s.subscription != nil {
+		subscription.Cancel()
+		return
+	}
+	s.subscription = subscription
+	subscription.Request(s.prefetch)
+}
+
+func (s *chanSubscriberInt) OnNext(value int) {
+	if s.channel.Send(value) != nil {
+		s.subscription.Cancel()
+		return
+	}
+	s.received++
+	if s.received >= (s.prefetch+1)/2 {
+		s.subscription.Request(s.received)
+		s.received = 0
+	}
+}
+
+func (s *chanSubscriberInt) OnError(err error) {
+	s.channel.Close(err)
+}
+
+func (s *chanSubscriberInt) OnComplete() {
+	s.channel.Close(nil)
+}
+
+//jig:name ChanInt_Subscriber
+
+// Subscriber returns a Reactive Streams style subscriber that sends the
+// messages it receives to the channel. This allows subscribing the channel to
+// a publisher. The subscriber keeps up to prefetch messages requested from the
+// publisher. Because OnNext blocks while the buffer of the channel is full, it
+// exerts backpressure on the publisher. When the publisher completes or fails,
+// the channel is closed with the corresponding error. When the channel was
+// sealed, the subscription is canceled.
+func (c *ChanInt) Subscriber(prefetch int64) SubscriberInt {
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	return &chanSubscriberInt{channel: c, prefetch: prefetch}
+}
+
+//jig:name ChanInt_EvictSlow
+
+// EvictSlow makes the channel automatically cancel endpoints that fall too
+// far behind, so a single stuck endpoint can no longer stall all senders. An
+// endpoint is evicted when the number of committed messages it did not read
+// exceeds maxLag, or when the oldest message it did not read is older than
+// maxDelay. A zero maxLag or maxDelay disables that threshold. When not nil,
+// the evicted function is called with the evicted endpoint and its lag in
+// messages, e.g. to log the name of the endpoint (see WithName).
+//
+// An evicted endpoint behaves as if Cancel was called on it. Use Evicted to
+// find out whether an endpoint was evicted. EvictSlow must be called before any
+// message is sent to the channel. Endpoints are checked when a message is sent
+// and when a sender finds the buffer full.
+func (c *ChanInt) EvictSlow(maxLag uint64, maxDelay time.Duration, evicted func(endpoint *EndpointInt, lag uint64)) {
+	c.maxLag = maxLag
+	c.maxDelay = maxDelay
+	c.onEvict = evicted
+}
+
+//jig:name EndpointInt_Evicted
+
+// Evicted returns true when the endpoint was canceled because it fell too far
+// behind, see EvictSlow.
+func (e *EndpointInt) Evicted() bool {
+	return atomic.LoadUint32(&e.evicted) == 1
+}
+
+//jig:name ChanInt_OnLag
+
+// OnLag registers an observer that is called when the lag of an endpoint, the
+// number of committed messages it did not read yet, first exceeds threshold
+// and again when it has recovered. The lagging argument of the observer tells
+// which of the two happened. An endpoint that finishes while lagging is
+// reported as recovered with a lag of 0. This allows alerting on slow
+// endpoints long before they have to be evicted (see EvictSlow).
+//
+// The lag of the endpoints is checked when messages are sent or read, but at
+// most once per interval, so the observer is called at most once per interval
+// for any endpoint. The observer is called from the goroutine sending or
+// reading the message that triggered the check. OnLag must be called before
+// any message is sent to the channel.
+func (c *ChanInt) OnLag(threshold uint64, interval time.Duration, observer func(endpoint *EndpointInt, lag uint64, lagging bool)) {
+	c.lagThreshold = threshold
+	c.lagInterval = interval
+	c.onLag = observer
+}
+
+//jig:name ChanInt_Pause
+
+// Pause makes Send, FastSend, SendSlice and Mark block until Resume is called,
+// without closing the channel. TrySend returns false while the channel is
+// paused, SendTimeout and SendContext give up when they expire. Endpoints keep
+// receiving the messages already sent. Closing a paused channel releases the
+// blocked senders. This allows quiescing producers, e.g. while consumers are
+// moved to another channel during a failover.
+func (c *ChanInt) Pause() {
+	if atomic.CompareAndSwapUint32(&c.paused, running, pausing) {
+		c.resumed.Store(make(chan struct{}))
+		atomic.StoreUint32(&c.paused, paused)
+	}
+}
+
+//jig:name EndpointInt_Pause
+
+// Pause temporarily stops the endpoint from receiving messages, without
+// abandoning its cursor like Cancel does. Range, Next and ReadBatch block
+// before delivering the next message until Resume is called. Messages sent in
+// the mean time are retained in the buffer, so a paused endpoint holds back
+// senders like any other endpoint that is lagging behind. Pause can be called
+// from any goroutine.
+//
+// Note that Pause, Resume and Paused of the endpoint hide those of the channel
+// the endpoint was created on. To pause the senders of the channel, call Pause
+// on the channel itself.
+func (e *EndpointInt) Pause() {
+	atomic.StoreUint32(&e.endpointPaused, 1)
+}
+
+//jig:name ChanInt_Paused
+
+// Paused returns true when the channel was paused using the Pause method.
+func (c *ChanInt) Paused() bool {
+	return atomic.LoadUint32(&c.paused) != running
+}
+
+//jig:name EndpointInt_Paused
+
+// Paused returns true when the endpoint was paused using its Pause method.
+func (e *EndpointInt) Paused() bool {
+	return atomic.LoadUint32(&e.endpointPaused) == 1
+}
+
+//jig:name ChanInt_Resume
+
+// Resume releases the senders blocked by Pause.
+func (c *ChanInt) Resume() {
+	for !atomic.CompareAndSwapUint32(&c.paused, paused, running) {
+		if atomic.LoadUint32(&c.paused) == running {
+			return
+		}
+		runtime.Gosched()
+	}
+	close(c.resumed.Load().(chan struct{}))
+}
+
+//jig:name EndpointInt_Resume
+
+// Resume lets the endpoint continue receiving messages from where it was
+// paused.
+func (e *EndpointInt) Resume() {
+	atomic.StoreUint32(&e.endpointPaused, 0)
+	e.wakeUp()
+}
+
+//jig:name SharedEndpointInt
+
+// SharedEndpointInt wraps an endpoint so it can be used from multiple
+// goroutines. Calls that receive messages are serialized, so every message is
+// received by only one of the goroutines sharing the endpoint. Note that Range
+// holds on to the endpoint until it returns, so other goroutines wanting to
+// receive will block until then. Cancel can be called at any time, also while
+// other goroutines are blocked receiving.
+type SharedEndpointInt struct {
+	endpoint	*EndpointInt
+	mutex		sync.Mutex
+}
+
+// Range will call foreach for the messages received from the endpoint, see
+// EndpointInt.Range for details.
+func (s *SharedEndpointInt) Range(foreach func(value int, err error, closed bool) bool, maxAge time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endpoint.Range(foreach, maxAge)
+}
+
+// Next will block until the next message is available and return it, see
+// EndpointInt.Next for details.
+func (s *SharedEndpointInt) Next() (value int, ok bool, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.Next()
+}
+
+// NextTimeout works like Next, but gives up when no message is available
+// within timeout, see EndpointInt.NextTimeout for details. The time spent
+// waiting for other goroutines using the endpoint is not included in the
+// timeout.
+func (s *SharedEndpointInt) NextTimeout(timeout time.Duration) (value int, ok bool, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.NextTimeout(timeout)
+}
+
+// ReadBatch will block until messages are available and copy them into dst,
+// see EndpointInt.ReadBatch for details.
+func (s *SharedEndpointInt) ReadBatch(dst []int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint.ReadBatch(dst)
+}
+
+// Cancel cancels the endpoint. Goroutines blocked receiving from the endpoint
+// will return as if the endpoint was canceled before they started.
+func (s *SharedEndpointInt) Cancel() {
+	s.endpoint.Cancel()
+	s.endpoint.wakeUp()
+}
+
+// Done returns a channel that is closed when the endpoint finishes, see
+// EndpointInt.Done for details.
+func (s *SharedEndpointInt) Done() <-chan struct{} {
+	return s.endpoint.Done()
+}
+
+// Lag returns the number of messages the endpoint did not read yet, see
+// EndpointInt.Lag for details.
+func (s *SharedEndpointInt) Lag() int {
+	return s.endpoint.Lag()
+}
+
+//jig:name EndpointInt_Shared
+
+// Shared wraps the endpoint so it can be safely used from multiple goroutines,
+// e.g. by handlers serving concurrent requests. After calling Shared, the
+// endpoint should only be used via the returned wrapper.
+func (e *EndpointInt) Shared() *SharedEndpointInt {
+	return &SharedEndpointInt{endpoint: e}
+}
+
+//jig:name EndpointInt_Clone
+
+// Clone creates a new endpoint on the same channel that starts at the current
+// cursor position of the endpoint, so it will receive the same messages the
+// endpoint receives from now on. This allows forking processing, e.g. to start
+// a debug tap exactly where the main consumer currently is. The clone gets the
+// same options (see NewEndpointOpts), filter and transform (see Filter and Map)
+// as the endpoint, but it does not join the group of the endpoint (see
+// WithGroup) nor save its position in the cursor store of the endpoint (see
+// WithCursorStore). When the endpoint has finished, Clone returns ErrOutOfRange.
+// When no endpoint can be created, Clone returns ErrOutOfEndpoints.
+func (e *EndpointInt) Clone() (*EndpointInt, error) {
+	clone, err := e.endpoints.NewForChanInt(e.ChanInt, endpointOptions{
+		keep:		ReplayAll,
+		maxAge:		e.maxAge,
+		name:		e.name,
+		gap:		e.gap,
+		overflow:	e.overflow,
+		idleTimeout:	e.idleTimeout,
+		sample:		e.sample,
+		throttle:	e.throttle,
+		debounce:	e.debounce,
+		onPanic:	e.onPanic,
+		acking:		e.acking,
+		ackTimeout:	e.ackTimeout,
+		ackRetries:	e.ackRetries,
+		manualCommit:	e.manualCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clone.filter, clone.transform = e.filter, e.transform
+	clone.deadLetters, clone.onDeadLetter = e.deadLetters, e.onDeadLetter
+	err = ErrOutOfRange
+	e.endpoints.Access(atomic.LoadUint32(&e.spinBudget), func(*endpointsInt) {
+
+		cursor := atomic.LoadUint64(&e.cursor)
+		if cursor == parked {
+			return
+		}
+		if begin := atomic.LoadUint64(&e.begin); cursor < begin {
+			cursor = begin
+		}
+		atomic.StoreUint64(&clone.cursor, cursor)
+		atomic.StoreUint64(&clone.committed, cursor)
+		err = nil
+	})
+	if err != nil {
+		clone.Cancel()
+		return nil, err
+	}
+	return clone, nil
+}
+
+//jig:name EndpointStatus
+
+// EndpointStatus is the state of an endpoint as reported by Chan.Endpoints.
+type EndpointStatus uint32
+
+const (
+	// EndpointActive is the state of an endpoint receiving messages.
+	EndpointActive	EndpointStatus	= iota
+
+	// EndpointPaused is the state of an endpoint that was paused, see
+	// Endpoint.Pause.
+	EndpointPaused
+
+	// EndpointCanceled is the state of an endpoint that was canceled but did
+	// not finish yet.
+	EndpointCanceled
+
+	// EndpointClosed is the state of an endpoint of a closed channel that did
+	// not read all messages yet.
+	EndpointClosed
+
+	// EndpointEvicted is the state of an endpoint that was evicted because it
+	// was too slow, see EvictSlow.
+	EndpointEvicted
+)
+
+// String returns the state as a lowercase word, e.g. for logging.
+func (s EndpointStatus) String() string {
+	switch s {
+	case EndpointActive:
+		return "active"
+	case EndpointPaused:
+		return "paused"
+	case EndpointCanceled:
+		return "canceled"
+	case EndpointClosed:
+		return "closed"
+	case EndpointEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+//jig:name EndpointInfo
+
+// EndpointInfo describes an endpoint registered with a channel at the time
+// Chan.Endpoints was called.
+type EndpointInfo struct {
+	Name		string		// see WithName
+	Cursor		uint64		// sequence number of the next message to read
+	Lag		uint64		// committed messages not read yet
+	State		EndpointStatus	// see EndpointStatus
+	LastActive	time.Time	// when the endpoint last read messages
+	Origin		string		// stack trace of its creation, see WithLeakDetection
+}
+
+//jig:name consumerGroup
+
+// consumerGroup is shared by the endpoints that joined a group, see WithGroup.
+type consumerGroup struct {
+	claimed	uint64	// sequence number after the last message claimed
+	_______	pad56
+	resize	sync.RWMutex	// held for writing while claims grows
+	claims	[]uint64	// sequence number+1 of the message claimed, by slot
+}
+
+// claim returns true when the message with sequence number seq was not
+// claimed by another member of the group yet, in which case it is now claimed.
+// Claims are kept for every message in the buffer, so a message skipped by one
+// member, e.g. because of its filter, can still be claimed by a member that
+// reaches it later. Size is the size of the ring holding the message.
+func (g *consumerGroup) claim(seq, size uint64) bool {
+	g.resize.RLock()
+	for uint64(len(g.claims)) < size {
+		g.resize.RUnlock()
+		g.grow(size)
+		g.resize.RLock()
+	}
+	defer g.resize.RUnlock()
+	slot := &g.claims[seq&uint64(len(g.claims)-1)]
+	for {
+		claimed := atomic.LoadUint64(slot)
+		if claimed > seq {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(slot, claimed, seq+1) {
+			break
+		}
+	}
+	for {
+		claimed := atomic.LoadUint64(&g.claimed)
+		if claimed > seq || atomic.CompareAndSwapUint64(&g.claimed, claimed, seq+1) {
+			return true
+		}
+	}
+}
+
+// grow makes room for the claims of the messages in a ring of the given size.
+// The number of claims is a power of 2 of at least size, so the messages in
+// the buffer never share a slot.
+func (g *consumerGroup) grow(size uint64) {
+	g.resize.Lock()
+	defer g.resize.Unlock()
+	if uint64(len(g.claims)) >= size {
+		return
+	}
+	n := uint64(1)
+	for n < size {
+		n *= 2
+	}
+	claims := make([]uint64, n)
+	for _, claimed := range g.claims {
+		if claimed != 0 {
+			claims[(claimed-1)&(n-1)] = claimed
+		}
+	}
+	g.claims = claims
+}
+
+//jig:name Failure
+
+// Failure describes why a message was routed to the dead-letter channel of an
+// endpoint, see DeadLetter.
+type Failure struct {
+	Endpoint	string	// name of the endpoint, see WithName
+	Seq		uint64	// sequence number of the message
+	Attempts	int	// number of times the message was delivered
+	Err		error	// ErrRetriesExhausted or the error passed to Reject
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("message %d failed after %d attempts: %v", f.Seq, f.Attempts, f.Err)
+}
+
+//jig:name CursorStore
+
+// CursorStore saves the positions of named endpoints, so a restarted process
+// can resume reading where it left off, see WithCursorStore. Load returns ok
+// false when no position was saved for the endpoint. Save is called from the
+// goroutine reading the endpoint. When Save returns an error, the position is
+// saved again later.
+type CursorStore interface {
+	Load(name string) (seq uint64, ok bool, err error)
+	Save(name string, seq uint64) error
+}
+
+//jig:name Headers
+
+// Headers holds metadata of a message, like a trace ID, its source or content
+// type, see SendHeaders. Headers should not be modified after being sent, as
+// they are shared by all endpoints.
+type Headers map[string]string
+
+//jig:name WaitStrategy
+
+// WaitStrategy determines how goroutines wait on a channel, i.e. how endpoints
+// wait for new messages when they have read everything and how senders wait
+// for room when the buffer is full, see WithWaitStrategy. The choice trades
+// latency for CPU usage: a busy-spinning endpoint picks up a message within
+// nanoseconds but burns a core, a blocking endpoint uses no CPU while idle
+// but needs a sender to wake it up.
+//
+// Wait is called every time a goroutine finds it still has to wait, with the
+// number of times it already waited in a row (starting at 1). It should
+// return quickly, e.g. after yielding the processor or sleeping briefly.
+// When Wait returns true, an endpoint blocks until the next message is sent
+// or the channel is closed. Senders are not woken up by endpoints reading, so
+// a sender sleeps for a millisecond instead.
+type WaitStrategy interface {
+	Wait(attempt uint32) (block bool)
+}
+
+// WaitFunc is an adapter to allow the use of an ordinary function as a
+// WaitStrategy.
+type WaitFunc func(attempt uint32) (block bool)
+
+// Wait calls f(attempt).
+func (f WaitFunc) Wait(attempt uint32) bool {
+	return f(attempt)
+}
+
+// BusySpinWait returns a WaitStrategy that keeps checking the channel without
+// ever giving up the processor. This gives the lowest latency, but occupies a
+// core for every waiting goroutine, so it only makes sense when there are
+// more cores than goroutines using the channel.
+func BusySpinWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool { return false })
+}
+
+// YieldWait returns a WaitStrategy that yields the processor to other
+// goroutines by calling runtime.Gosched every time it waits.
+func YieldWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool {
+		runtime.Gosched()
+		return false
+	})
+}
+
+// SleepWait returns a WaitStrategy that sleeps for the given duration every
+// time it waits. The latency of picking up a message is then roughly the
+// sleep duration.
+func SleepWait(d time.Duration) WaitStrategy {
+	return WaitFunc(func(uint32) bool {
+		time.Sleep(d)
+		return false
+	})
+}
+
+// BlockingWait returns a WaitStrategy that blocks waiting endpoints right
+// away. Idle endpoints then use no CPU at all, but every message they wait for
+// costs a wake up.
+func BlockingWait() WaitStrategy {
+	return WaitFunc(func(uint32) bool { return true })
+}
+
+//jig:name ChanInt_Endpoints
+
+// Endpoints returns a snapshot of all endpoints registered with the channel
+// that did not finish yet. The name of every endpoint can be set when it is
+// created using WithName, so a misbehaving endpoint can be identified e.g. by
+// its lag or the time it was last active. Endpoints may be called from any
+// goroutine.
+func (c *ChanInt) Endpoints() []EndpointInfo {
+	var infos []EndpointInfo
+	c.endpoints.Access(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		commit := c.commitData()
+		for i := uint32(0); i < endpoints.len; i++ {
+			e := &endpoints.entry[i]
+			cursor := atomic.LoadUint64(&e.cursor)
+			if cursor == parked {
+				continue
+			}
+			infos = append(infos, e.info(cursor, commit))
+		}
+	})
+	return infos
+}
+
+//jig:name ChanInt_OnFirstEndpoint
+
+// OnFirstEndpoint registers a callback that is called when the number of
+// endpoints of the channel that did not finish yet goes from 0 to 1. Together
+// with OnLastEndpoint this allows a lazy producer to start e.g. polling
+// upstream only when someone subscribes. The callback is called from the
+// goroutine creating the endpoint, just before NewEndpoint returns.
+// OnFirstEndpoint must be called before any endpoint is created.
+func (c *ChanInt) OnFirstEndpoint(first func()) {
+	c.onFirst = first
+}
+
+//jig:name ChanInt_OnLastEndpoint
+
+// OnLastEndpoint registers a callback that is called when the number of
+// endpoints of the channel that did not finish yet goes from 1 to 0, because
+// the last endpoint was canceled or finished reading a closed channel. This
+// allows a lazy producer to stop when the last subscriber leaves. The callback
+// is called from the goroutine that finished the endpoint. OnLastEndpoint must
+// be called before any endpoint is created.
+func (c *ChanInt) OnLastEndpoint(last func()) {
+	c.onLast = last
+}
+
+//jig:name ChanInt_AutoConnect
+
+// AutoConnect defers starting the producer of the channel until n endpoints
+// have been created. The start function is called exactly once, from the
+// goroutine creating the n-th endpoint, just before NewEndpoint returns. This
+// way all n consumers are guaranteed to receive every message sent by the
+// producer, without coordinating their startup by hand. When n is not
+// positive, start is called immediately. AutoConnect must be called before any
+// endpoint is created.
+func (c *ChanInt) AutoConnect(n int, start func()) {
+	if n <= 0 {
+		start()
+		return
+	}
+	atomic.StoreInt64(&c.connectPending, int64(n))
+	c.connect = start
+}
+
+//jig:name EndpointInt_Filter
+
+// Filter makes the endpoint skip messages for which the keep function returns
+// false. Skipped messages are never passed to the foreach function of Range,
+// nor returned by Next or ReadBatch, which saves the cost of calling foreach
+// for messages the consumer is not interested in. The keep function is called
+// from the goroutine reading the endpoint. Filter must be called before
+// reading from the endpoint.
+func (e *EndpointInt) Filter(keep func(value int) bool) {
+	e.filter = keep
+}
+
+//jig:name EndpointInt_Map
+
+// Map makes the endpoint pass every message through the transform function
+// before delivering it, e.g. to redact or enrich messages for a specific
+// consumer without copying them into a separate channel. The message in the
+// buffer of the channel is not changed, so other endpoints are not affected.
+// When a filter was set (see Filter), only messages kept by the filter are
+// transformed. The transform function is called from the goroutine reading
+// the endpoint. Map must be called before reading from the endpoint.
+func (e *EndpointInt) Map(transform func(value int) int) {
+	e.transform = transform
+}
+
+//jig:name EndpointInt_RangeWindow
+
+// RangeWindow works like Range, but delivers messages in batches to the
+// foreach function. A batch is delivered as soon as size messages have been
+// collected, or when interval has passed since the first message of the batch
+// was received, whichever comes first. This suits consumers feeding bulk
+// APIs, like database inserts or batched HTTP posts. The foreach function
+// owns the batch passed to it and may retain it. A size of 0 or less means
+// batches are only limited by interval and an interval of 0 means batches are
+// only limited by size. The interval is measured with the clock of the
+// channel, see WithClock.
+//
+// When the channel is closed, the remaining messages are delivered as a final
+// batch, followed by the close notification with a nil batch and closed set
+// to true. Returning false from foreach is the same as calling Cancel.
+func (e *EndpointInt) RangeWindow(foreach func(batch []int, err error, closed bool) bool, size int, interval time.Duration, maxAge time.Duration) {
+	var batch []int
+	var opened int64	// elapsed time the first message of the batch was received
+	var timer *time.Timer
+	flush := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		full := batch
+		batch = nil
+		return foreach(full, nil, false)
+	}
+	for {
+		var control uint32
+		arm := func(d time.Duration) {
+			timer = time.AfterFunc(d, func() {
+				atomic.StoreUint32(&control, suspend)
+				e.wakeUp()
+			})
+		}
+		if len(batch) > 0 && interval > 0 {
+			arm(interval - time.Duration(e.elapsed()-opened))
+		}
+		e.iterate(func(value int, err error, closed bool) bool {
+			if closed {
+				return flush() && foreach(nil, err, true)
+			}
+			batch = append(batch, value)
+			if len(batch) == 1 && interval > 0 {
+				opened = e.elapsed()
+				arm(interval)
+			}
+			if size > 0 && len(batch) >= size {
+				return flush()
+			}
+			return true
+		}, nil, maxAge, &control)
+		if atomic.LoadUint64(&e.cursor) == parked {
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if len(batch) > 0 && time.Duration(e.elapsed()-opened) < interval {
+			continue
+		}
+		if !flush() {
+			e.Cancel()
+			return
+		}
+	}
+}
+
+//jig:name Message
+
+// Message describes a message delivered by RangeMeta.
+type Message struct {
+	Seq	uint64		// sequence number, see RangeSeq
+	Sent	time.Time	// zero for messages sent using FastSend
+	Age	time.Duration	// time between sending and delivery
+
+	// Headers passed to SendHeaders, nil unless the channel was created
+	// with WithHeaders.
+	Headers	Headers
+}
+
+//jig:name EndpointInt_RangeMeta
+
+// RangeMeta works like Range, but passes a Message describing every message to
+// the foreach function. It carries the sequence number, the time the message
+// was sent and its age at the time of delivery, so a consumer can e.g. detect
+// that it is processing stale messages. The sent time and age are zero for
+// messages sent using FastSend. The message also carries its headers, see
+// SendHeaders. The close notification carries the sequence
+// number the next message would have had.
+func (e *EndpointInt) RangeMeta(foreach func(value int, msg Message, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(func(value int, err error, closed bool) bool {
+		msg := Message{Seq: e.cursor}
+		if closed {
+			return foreach(value, msg, err, true)
+		}
+		r := e.loadRing()
+		if updated := atomic.LoadInt64(&r.written[r.slot(msg.Seq)]) >> 2; updated != 0 {
+			msg.Sent = e.start.Add(time.Duration(updated))
+			msg.Age = time.Duration(e.elapsed() - updated)
+		}
+		if r.headers != nil {
+			msg.Headers = r.headers[r.slot(msg.Seq)]
+		}
+		return foreach(value, msg, nil, false)
+	}, nil, maxAge, nil)
+}
+
+//jig:name EndpointInt_RangeErr
+
+// RangeErr works like Range, but the foreach function returns an error
+// instead of a bool. When foreach returns a non-nil error, the endpoint is
+// canceled and RangeErr returns that error. This way the reason for stopping
+// is not lost. RangeErr returns nil when the endpoint was canceled otherwise,
+// or when foreach returned nil for the close notification.
+func (e *EndpointInt) RangeErr(foreach func(value int, err error, closed bool) error, maxAge time.Duration) (err error) {
+	e.iterate(func(value int, closeErr error, closed bool) bool {
+		err = foreach(value, closeErr, closed)
+		return err == nil
+	}, nil, maxAge, nil)
+	return err
+}
+
+//jig:name EndpointInt_RangeTimeout
+
+// RangeTimeout works like Range, but returns when no new message arrived
+// within the deadline. The endpoint is then not canceled, so the caller can
+// do some housekeeping and call RangeTimeout again to resume where it left
+// off. RangeTimeout returns true when it returned because of the deadline and
+// false when the endpoint was canceled or the close notification was
+// delivered.
+func (e *EndpointInt) RangeTimeout(foreach func(value int, err error, closed bool) bool, maxAge time.Duration, deadline time.Duration) (timeout bool) {
+	var control, returned uint32
+	last := time.Now().UnixNano()
+	var expire func()
+	expire = func() {
+		if atomic.LoadUint32(&returned) == 1 {
+			return
+		}
+		if idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&last)); idle < deadline {
+			time.AfterFunc(deadline-idle, expire)
+			return
+		}
+		atomic.StoreUint32(&control, suspend)
+		e.wakeUp()
+	}
+	timer := time.AfterFunc(deadline, expire)
+	e.iterate(func(value int, err error, closed bool) bool {
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+		return foreach(value, err, closed)
+	}, nil, maxAge, &control)
+	atomic.StoreUint32(&returned, 1)
+	timer.Stop()
+	return atomic.LoadUint64(&e.cursor) != parked
+}
+
+//jig:name ChanInt_NewEndpointContext
+
+// NewEndpointContext works like NewEndpoint, but binds the endpoint to the
+// passed in context. When the context is canceled, the endpoint is canceled,
+// waking up a Range or Next blocked on it. This way an endpoint is never
+// leaked because Cancel was forgotten on an early return.
+//
+// Note that, when the context can be canceled, NewEndpointContext starts a
+// goroutine to wait for the context to be done. This goroutine exits when the
+// endpoint finishes.
+func (c *ChanInt) NewEndpointContext(ctx context.Context, keep uint64) (*EndpointInt, error) {
+	e, err := c.NewEndpoint(keep)
+	if err != nil || ctx.Done() == nil {
+		return e, err
+	}
+	done := e.Done()
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-done:
+			default:
+				e.Cancel()
+			}
+		case <-done:
+		}
+	}()
+	return e, nil
+}
+
+//jig:name PartitionedChanInt
+
+// PartitionedChanInt spreads the messages sent to it over a number of
+// partitions, each of which is a separate channel. The partition of a message
+// is determined by hashing its key, so all messages with the same key end up
+// in the same partition in the order they were sent. Messages with different
+// keys can then be consumed in parallel by endpoints on different partitions.
+type PartitionedChanInt struct {
+	partitions	[]*ChanInt
+	key		func(value int) string
+}
+
+// Partitions returns the number of partitions of the channel.
+func (p *PartitionedChanInt) Partitions() int {
+	return len(p.partitions)
+}
+
+// Partition returns the channel of partition i.
+func (p *PartitionedChanInt) Partition(i int) *ChanInt {
+	return p.partitions[i]
+}
+
+// PartitionOf returns the index of the partition a message with the given
+// key is sent to.
+func (p *PartitionedChanInt) PartitionOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.partitions)))
+}
+
+// Send sends a value to the partition determined by its key, see
+// ChanInt.Send for details.
+func (p *PartitionedChanInt) Send(value int) error {
+	return p.partitions[p.PartitionOf(p.key(value))].Send(value)
+}
+
+// TrySend sends a value to the partition determined by its key only when
+// this can be done without blocking, see ChanInt.TrySend for details.
+func (p *PartitionedChanInt) TrySend(value int) bool {
+	return p.partitions[p.PartitionOf(p.key(value))].TrySend(value)
+}
+
+// Close closes all partitions, see ChanInt.Close for details.
+func (p *PartitionedChanInt) Close(err error) {
+	for _, c := range p.partitions {
+		c.Close(err)
+	}
+}
+
+// NewEndpoints creates an endpoint on every partition, see
+// ChanInt.NewEndpoint for details. The endpoint at index i of the returned
+// slice receives the messages of partition i. When an endpoint can't be
+// created on one of the partitions, the endpoints created so far are canceled
+// and the error is returned.
+func (p *PartitionedChanInt) NewEndpoints(keep uint64) ([]*EndpointInt, error) {
+	list := make([]*EndpointInt, 0, len(p.partitions))
+	for _, c := range p.partitions {
+		e, err := c.NewEndpoint(keep)
+		if err != nil {
+			for _, e := range list {
+				e.Cancel()
+			}
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+//jig:name NewPartitionedChanInt
+
+// NewPartitionedChanInt creates a channel with the given number of partitions
+// (at least 1). The key function returns the key of a message that determines
+// its partition. Every partition is created by NewChanOpts with the given
+// options.
+func NewPartitionedChanInt(partitions int, key func(value int) string, options ...ChanOption) *PartitionedChanInt {
+	if partitions < 1 {
+		partitions = 1
+	}
+	p := &PartitionedChanInt{key: key}
+	for i := 0; i < partitions; i++ {
+		p.partitions = append(p.partitions, NewChanOptsInt(options...))
+	}
+	return p
+}
+
+//jig:name EndpointInt_Nack
+
+// Nack rejects the message most recently delivered to an endpoint created
+// with WithAck, so it is delivered again unless it has been retried too often.
+// Nack may be called from any goroutine, also from within the foreach
+// function passed to Range. Calling Nack when there is no message awaiting
+// acknowledgement has no effect.
+func (e *EndpointInt) Nack() {
+	if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected) {
+		e.wakeUp()
+	}
+}
+
+//jig:name EndpointInt_Ack
+
+// Ack acknowledges the message most recently delivered to an endpoint created
+// with WithAck, so the endpoint advances to the next message. Ack may be
+// called from any goroutine, also from within the foreach function passed to
+// Range. Calling Ack when there is no message awaiting acknowledgement has no
+// effect.
+func (e *EndpointInt) Ack() {
+	if atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, acknowledged) {
+		e.wakeUp()
+	}
+}
+
+//jig:name EndpointInt_DeadLetter
+
+// DeadLetter makes the endpoint route messages that failed to the channel
+// passed in, instead of silently advancing past them. A message fails when
+// it was not acknowledged after being delivered the maximum number of times
+// (see WithAck) or when the foreach function rejects it by calling Reject.
+// The failed function, when not nil, is called with the message and a Failure
+// describing why it failed, before the message is sent to the channel. Either
+// the channel or the failed function may be nil. Both are used from the
+// goroutine reading the endpoint, so a full dead-letter channel will block
+// reading until there is room. DeadLetter must be called before reading from
+// the endpoint.
+func (e *EndpointInt) DeadLetter(channel *ChanInt, failed func(value int, failure Failure)) {
+	e.deadLetters, e.onDeadLetter = channel, failed
+}
+
+//jig:name EndpointInt_Reject
+
+// Reject reports the message being delivered as a poison message that should
+// not be processed again. The message is routed to the dead-letter channel of
+// the endpoint (see DeadLetter) with err as the reason of the failure. For an
+// endpoint created with WithAck, the message is not redelivered regardless of
+// the number of retries left. Reject must be called from within the foreach
+// function passed to Range.
+func (e *EndpointInt) Reject(err error) {
+	e.poison = err
+	atomic.CompareAndSwapUint32(&e.ackState, unacknowledged, rejected)
+}
+
+//jig:name EndpointInt_Commit
+
+// Commit marks all messages with a sequence number lower than seq as processed
+// by an endpoint created with WithManualCommit, so the channel no longer needs
+// to retain them for the endpoint. To commit the message being delivered from
+// inside the function passed to Range, pass Seq()+1. Progress can only move
+// forward and not beyond the most recently sent message, otherwise Commit
+// returns ErrOutOfRange. Commit also returns ErrOutOfRange when the endpoint
+// has finished. Commit should be called from the goroutine using the endpoint.
+func (e *EndpointInt) Commit(seq uint64) error {
+	if atomic.LoadUint64(&e.cursor) == parked {
+		return ErrOutOfRange
+	}
+	if seq < atomic.LoadUint64(&e.committed) || seq > e.commitData() {
+		return ErrOutOfRange
+	}
+	atomic.StoreUint64(&e.committed, seq)
+	e.checkpoint()
+	return nil
+}
+
+//jig:name EndpointInt_Committed
+
+// Committed returns the sequence number of the first message that was not
+// committed (see Commit). For an endpoint created with WithManualCommit,
+// calling Seek with this sequence number redelivers every uncommitted message.
+func (e *EndpointInt) Committed() uint64 {
+	return atomic.LoadUint64(&e.committed)
+}
+
+//jig:name EndpointInt_poll
+
+// poll returns the next message when one is available without waiting.
+func (e *EndpointInt) poll() (value int, ok bool) {
+	if atomic.LoadUint64(&e.cursor) >= e.commitData() {
+		return value, false
+	}
+	control := suspend
+	value, ok, _ = e.next(&control)
+	return value, ok
+}
+
+//jig:name EndpointInt_exhausted
+
+// exhausted returns true when the endpoint has finished, or its channel was
+// closed or the endpoint canceled and it has read all messages.
+func (e *EndpointInt) exhausted() bool {
+	cursor := atomic.LoadUint64(&e.cursor)
+	return cursor == parked || atomic.LoadUint64(&e.endpointState) != active && cursor >= e.commitData()
+}
+
+//jig:name PriorityEndpointInt
+
+// PriorityEndpointInt is returned by a call to NewEndpoint on a priority
+// channel. It reads from the lane with the highest priority that has a
+// message available. Like any endpoint, it should be used by only a single
+// goroutine.
+type PriorityEndpointInt struct {
+	lanes		[]*EndpointInt
+	canceled	uint32
+	wakeups		[]reflect.SelectCase	// see block
+}
+
+// Next will block until the next message is available on any of the lanes and
+// return the one with the highest priority with ok set to true.
+//
+// When all lanes are closed, eventually when their buffers are exhausted Next
+// will return with closed set to true. When the endpoint is canceled, Next
+// will return with both ok and closed set to false.
+func (p *PriorityEndpointInt) Next() (value int, ok bool, closed bool) {
+	lastActive := time.Now()
+	var spins uint32
+	for atomic.LoadUint32(&p.canceled) == 0 {
+		open := 0
+		for _, e := range p.lanes {
+			if value, ok = e.poll(); ok {
+				return value, true, false
+			}
+			if !e.exhausted() {
+				open++
+			}
+		}
+		if open == 0 {
+			for _, e := range p.lanes {
+				e.park()
+			}
+			return value, false, true
+		}
+		if time.Since(lastActive) < time.Millisecond {
+			backoff(&spins, atomic.LoadUint32(&p.lanes[0].spinBudget))
+		} else {
+			p.block(open)
+		}
+	}
+	return value, false, false
+}
+
+// block blocks until a message is available on one of the lanes, or a lane
+// wakes up its endpoint because its state changed, see Next. Like blockWhile
+// does for a single endpoint, block registers as a sleeper on every lane and
+// takes the channels to block on before checking the lanes one last time, so
+// a wakeup can't be missed. It doesn't block when the number of open lanes
+// differs from open.
+func (p *PriorityEndpointInt) block(open int) {
+	p.wakeups = p.wakeups[:0]
+	for _, e := range p.lanes {
+		atomic.AddInt32(&e.sleepers, 1)
+		wakeup := e.wakeup
+		if wakeup != nil {
+			atomic.StoreUint32(&e.sleeping, 1)
+		} else {
+			wakeup = *(*chan struct{})(atomic.LoadPointer(&e.receivers))
+		}
+		p.wakeups = append(p.wakeups, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wakeup)})
+	}
+	blocked := atomic.LoadUint32(&p.canceled) == 0
+	for _, e := range p.lanes {
+		if atomic.LoadUint64(&e.cursor) < e.commitData() {
+			blocked = false
+		} else if !e.exhausted() {
+			open--
+		}
+	}
+	if blocked && open == 0 {
+		reflect.Select(p.wakeups)
+	}
+	for _, e := range p.lanes {
+		atomic.StoreUint32(&e.sleeping, 0)
+		atomic.AddInt32(&e.sleepers, -1)
+	}
+}
+
+// Range will call the passed in foreach function with the messages of all
+// lanes, the one with the highest priority available first. When the channel
+// is closed, foreach is called once with closed set to true and err set to
+// the error the channel was closed with. When foreach returns false, the
+// endpoint is canceled.
+func (p *PriorityEndpointInt) Range(foreach func(value int, err error, closed bool) bool) {
+	for {
+		value, ok, closed := p.Next()
+		switch {
+		case ok:
+			if !foreach(value, nil, false) {
+				p.Cancel()
+				return
+			}
+		case closed:
+			foreach(value, p.lanes[0].closeErr(), true)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// Cancel cancels the endpoint on every lane, see EndpointInt.Cancel.
+func (p *PriorityEndpointInt) Cancel() {
+	atomic.StoreUint32(&p.canceled, 1)
+	for _, e := range p.lanes {
+		e.Cancel()
+	}
+}
+
+//jig:name PriorityChanInt
+
+// PriorityChanInt delivers messages sent with a higher priority before
+// messages sent with a lower priority that are still waiting to be read. Every
+// priority has its own lane, which is a separate channel, and the endpoints
+// of the channel merge the lanes at read time. This allows e.g. control
+// messages to overtake bulk data. Priority 0 is the highest priority. The
+// order of messages sent with the same priority is preserved.
+type PriorityChanInt struct {
+	lanes []*ChanInt
+}
+
+// Lanes returns the number of priorities of the channel.
+func (p *PriorityChanInt) Lanes() int {
+	return len(p.lanes)
+}
+
+// Lane returns the channel of the given priority.
+func (p *PriorityChanInt) Lane(priority int) *ChanInt {
+	return p.lanes[p.lane(priority)]
+}
+
+// lane returns the index of the lane for priority, clamping the priority to
+// the lanes available.
+func (p *PriorityChanInt) lane(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority >= len(p.lanes) {
+		return len(p.lanes) - 1
+	}
+	return priority
+}
+
+// Send sends a value with the given priority, see ChanInt.Send for details.
+// A priority beyond the lowest priority of the channel is sent with the lowest
+// priority.
+func (p *PriorityChanInt) Send(value int, priority int) error {
+	return p.lanes[p.lane(priority)].Send(value)
+}
+
+// TrySend sends a value with the given priority only when this can be done
+// without blocking, see ChanInt.TrySend for details.
+func (p *PriorityChanInt) TrySend(value int, priority int) bool {
+	return p.lanes[p.lane(priority)].TrySend(value)
+}
+
+// Close closes all lanes, see ChanInt.Close for details.
+func (p *PriorityChanInt) Close(err error) {
+	for _, c := range p.lanes {
+		c.Close(err)
+	}
+}
+
+// NewEndpoint creates an endpoint that receives the messages of all lanes,
+// see ChanInt.NewEndpoint for details. When an endpoint can't be created on
+// one of the lanes, the endpoints created so far are canceled and the error
+// is returned.
+func (p *PriorityChanInt) NewEndpoint(keep uint64) (*PriorityEndpointInt, error) {
+	e := &PriorityEndpointInt{}
+	for _, c := range p.lanes {
+		ep, err := c.NewEndpoint(keep)
+		if err != nil {
+			e.Cancel()
+			return nil, err
+		}
+		e.lanes = append(e.lanes, ep)
+	}
+	return e, nil
+}
+
+//jig:name NewPriorityChanInt
+
+// NewPriorityChanInt creates a channel with the given number of priorities
+// (at least 1). Every lane is created by NewChanOpts with the given options.
+func NewPriorityChanInt(lanes int, options ...ChanOption) *PriorityChanInt {
+	if lanes < 1 {
+		lanes = 1
+	}
+	p := &PriorityChanInt{}
+	for i := 0; i < lanes; i++ {
+		p.lanes = append(p.lanes, NewChanOptsInt(options...))
+	}
+	return p
+}
+
+//jig:name ChanInt_SendAfter
+
+// SendAfter sends a value to the channel like Send, but the endpoints
+// withhold the message until duration d has passed, see SendAt for details.
+func (c *ChanInt) SendAfter(value int, d time.Duration) error {
+	if d <= 0 {
+		return c.send(value, 0, nil)
+	}
+	return c.send(value, c.elapsed()+d.Nanoseconds(), nil)
+}
+
+//jig:name ChanInt_SendAt
+
+// SendAt sends a value to the channel like Send, but the endpoints withhold
+// the message until time t. The message is committed to the buffer right
+// away, so it keeps its place in the order of messages and its sequence
+// number. Because endpoints read messages in order, a message that is not due
+// yet also holds back the messages sent after it. So SendAt works best as a
+// delay queue when the due times increase with the order of sending, e.g. when
+// every message is delayed by the same duration. Timestamps reported for the
+// message (e.g. by RangeMeta) are its due time. A time in the past delivers
+// the message right away. On a conflating channel (see ConflateBy), a message
+// replacing an older one takes its place, with the new due time.
+func (c *ChanInt) SendAt(value int, t time.Time) error {
+	due := t.Sub(c.start).Nanoseconds()
+	if due <= 0 {
+		due = 0
+	}
+	return c.send(value, due, nil)
+}
+
+//jig:name ChanInt_SendHeaders
+
+// SendHeaders sends a value with headers attached to it, see Send for details.
+// The headers are carried through the buffer with the message and passed to
+// the foreach function of RangeMeta, so metadata like a trace ID doesn't have
+// to be wrapped together with every value. Headers are only kept when the
+// channel was created with WithHeaders. On a conflating channel (see
+// ConflateBy), a message replacing an older one carries the new headers.
+func (c *ChanInt) SendHeaders(value int, headers Headers) error {
+	return c.send(value, 0, headers)
+}
+
+//jig:name ChanInt_SendError
+
+// SendError sends an error event to the channel without closing it. Unlike
+// Close, more messages can be sent after the error, which matches Rx
+// semantics where individual errors flow through the stream. The error event
+// occupies a sequence number like a marker (see Mark) and is delivered as an
+// OnError notification by RangeNotifications. Other ways of reading skip error
+// events like they skip markers, but RangeMarks observes them as markers
+// labeled with the text of the error. A nil err is ignored. When the channel
+// was sealed, SendError returns ErrSealed. When the channel is closed while
+// waiting for room, SendError returns ErrClosed.
+func (c *ChanInt) SendError(err error) error {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return ErrSealed
+	}
+	if err != nil {
+		if _, ok := c.mark(err.Error(), err); !ok {
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+//jig:name NotificationInt
+
+// NotificationInt is a materialized event delivered by RangeNotifications.
+type NotificationInt struct {
+	Kind	NotificationKind
+	Value	int	// for OnNext
+	Err	error	// for OnError and OnComplete
+}
+
+//jig:name EndpointInt_RangeNotifications
+
+// RangeNotifications works like Range, but passes every message, error event
+// (see SendError) and the close of the channel to the foreach function as a
+// materialized notification. When foreach returns false, the endpoint is
+// canceled.
+func (e *EndpointInt) RangeNotifications(foreach func(n NotificationInt) bool, maxAge time.Duration) {
+	e.iterate(func(value int, err error, closed bool) bool {
+		if closed {
+			return foreach(NotificationInt{Kind: OnComplete, Err: err})
+		}
+		return foreach(NotificationInt{Kind: OnNext, Value: value})
+	}, func(label string, seq uint64) bool {
+		r := e.loadRing()
+		if err := r.errs[r.slot(seq)]; err != nil {
+			return foreach(NotificationInt{Kind: OnError, Err: err})
+		}
+		return true
+	}, maxAge, nil)
+}
+
+//jig:name ChanInt_CloseWith
+
+// CloseWith sends a final value to the channel and then closes it with err,
+// see Close. The final value is guaranteed to be the last message delivered
+// to every endpoint, immediately before the close notification. To guarantee
+// this, CloseWith seals the channel (see Seal) and endpoints ignore any
+// message that a concurrent Send still manages to commit after the final
+// value. This gives e.g. "summary record then close" semantics without having
+// to coordinate senders with the goroutine closing the channel. When the
+// channel was already closed, CloseWith only calls Close.
+func (c *ChanInt) CloseWith(value int, err error) {
+	if atomic.LoadUint64(&c.channelState) == active {
+		c.Seal()
+		var spins uint32
+		size := int64(0)
+		if c.size != nil {
+			size = int64(c.size(value))
+		}
+		if c.size == nil || c.admit(size, &spins) {
+			write := atomic.AddUint64(&c.write, 1) - 1
+			for write >= atomic.LoadUint64(&c.end) {
+				if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+					atomic.AddInt64(&c.bytes, -size)
+					return
+				}
+			}
+			atomic.StoreUint64(&c.final, write+1)
+			c.publish(write, value)
+		}
+	}
+	c.Close(err)
+}
+
+//jig:name SlotInt
+
+// SlotInt is a slot in the buffer of a channel claimed by Claim. The message
+// is constructed in place through Value and then sent by passing the slot to
+// Publish.
+type SlotInt struct {
+	Value	*int	// points into the buffer of the channel
+	seq	uint64
+}
+
+//jig:name ErrClosed
+
+// ErrClosed is returned by Send, Claim and the other methods that send to the
+// channel, when the channel was closed while waiting for room in the buffer.
+// The message is then not sent.
+const ErrClosed = ChannelError("channel closed")
+
+//jig:name ChanInt_Claim
+
+// Claim reserves the next slot in the buffer of the channel, blocking like
+// Send until there is room. The message is then constructed directly in the
+// buffer through the Value of the slot, which saves copying a large value
+// through the parameter of Send. Claim can be used by concurrent goroutines.
+// Every claimed slot must be passed to Publish as soon as possible, because
+// endpoints can't read past a slot that is not published yet. The value in
+// the slot may hold an old message, so every field should be set.
+//
+// When the channel was sealed, Claim returns ErrSealed. When the channel is
+// closed while waiting for room, Claim returns ErrClosed.
+func (c *ChanInt) Claim() (SlotInt, error) {
+	if atomic.LoadUint32(&c.sealed) != 0 {
+		return SlotInt{}, ErrSealed
+	}
+	c.awaitResume()
+	if err := c.throttle(1); err != nil {
+		return SlotInt{}, err
+	}
+	write := atomic.AddUint64(&c.write, 1) - 1
+	var spins uint32
+	for write >= atomic.LoadUint64(&c.end) {
+		if !c.slideBuffer(&spins) && write >= atomic.LoadUint64(&c.end) {
+			return SlotInt{}, ErrClosed
+		}
+	}
+	r := c.loadRing()
+	return SlotInt{Value: &r.buffer[r.slot(write)], seq: write}, nil
+}
+
+// Publish sends the message constructed in a slot returned by Claim. Messages
+// count against the byte budget of the channel (see LimitBytes) when they are
+// published, but Publish never blocks on it.
+func (c *ChanInt) Publish(slot SlotInt) {
+	if c.size != nil {
+		atomic.AddInt64(&c.bytes, int64(c.size(*slot.Value)))
+	}
+	c.stamp(c.loadRing(), slot.seq, 0, nil)
+	if c.lockstep == 1 {
+		c.awaitConsumed(slot.seq + 1)
+	}
+}
+
+//jig:name ProducerInt
+
+// ProducerInt batches the messages sent by a single goroutine, so many
+// producers can send to the same channel without contending for every
+// message. Messages are collected locally and sent to the channel in one go
+// using SendSlice once the batch is full, which reserves all their slots in
+// the buffer with a single atomic operation and notifies the receivers once.
+//
+// Messages are not visible to the endpoints until their batch was flushed.
+// So a producer that may go quiet should call Flush after a burst of messages,
+// to bound their latency. The order of the messages of a producer is
+// preserved, but batches of different producers are not interleaved message
+// by message. A producer should be used by only a single goroutine.
+type ProducerInt struct {
+	c	*ChanInt
+	batch	[]int
+}
+
+// Send adds a value to the batch of the producer and flushes the batch when
+// it is full. When flushing fails, the error of Flush is returned.
+func (p *ProducerInt) Send(value int) error {
+	p.batch = append(p.batch, value)
+	if len(p.batch) < cap(p.batch) {
+		return nil
+	}
+	return p.Flush()
+}
+
+// Flush sends the messages in the batch of the producer to the channel, see
+// ChanInt.SendSlice for details. The batch is emptied even when the channel
+// rejects the messages, e.g. because it was sealed.
+func (p *ProducerInt) Flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := p.c.SendSlice(p.batch)
+	var zero int
+	for i := range p.batch {
+		p.batch[i] = zero
+	}
+	p.batch = p.batch[:0]
+	return err
+}
+
+//jig:name ChanInt_Producer
+
+// Producer returns a producer that sends to the channel in batches of the
+// given size (at least 1), see ProducerInt. Every sending goroutine should
+// use its own producer.
+func (c *ChanInt) Producer(size int) *ProducerInt {
+	if size < 1 {
+		size = 1
+	}
+	return &ProducerInt{c: c, batch: make([]int, 0, size)}
+}
+
+//jig:name ReadOnlyEndpointInt
+
+// ReadOnlyEndpointInt is an endpoint created by a read-only view on a channel
+// (see ReadOnly). Unlike EndpointInt, it doesn't embed the channel, so the
+// methods that send to, close or configure the channel can't be reached
+// through it. Like an endpoint, it should be used by a single goroutine.
+type ReadOnlyEndpointInt struct {
+	endpoint *EndpointInt
+}
+
+// Range will call foreach for the messages received from the endpoint, see
+// EndpointInt.Range for details.
+func (r *ReadOnlyEndpointInt) Range(foreach func(value int, err error, closed bool) bool, maxAge time.Duration) {
+	r.endpoint.Range(foreach, maxAge)
+}
+
+// RangeSeq works like Range, but also passes the sequence number and sent
+// time of every message, see EndpointInt.RangeSeq for details.
+func (r *ReadOnlyEndpointInt) RangeSeq(foreach func(value int, seq uint64, sent time.Time, err error, closed bool) bool, maxAge time.Duration) {
+	r.endpoint.RangeSeq(foreach, maxAge)
+}
+
+// RangeErr works like Range, but stops with the error returned by foreach,
+// see EndpointInt.RangeErr for details.
+func (r *ReadOnlyEndpointInt) RangeErr(foreach func(value int, err error, closed bool) error, maxAge time.Duration) error {
+	return r.endpoint.RangeErr(foreach, maxAge)
+}
+
+// Next will block until the next message is available and return it, see
+// EndpointInt.Next for details.
+func (r *ReadOnlyEndpointInt) Next() (value int, ok bool, closed bool) {
+	return r.endpoint.Next()
+}
+
+// NextTimeout works like Next, but gives up when no message is available
+// within timeout, see EndpointInt.NextTimeout for details.
+func (r *ReadOnlyEndpointInt) NextTimeout(timeout time.Duration) (value int, ok bool, closed bool) {
+	return r.endpoint.NextTimeout(timeout)
+}
+
+// ReadBatch will block until messages are available and copy them into dst,
+// see EndpointInt.ReadBatch for details.
+func (r *ReadOnlyEndpointInt) ReadBatch(dst []int) int {
+	return r.endpoint.ReadBatch(dst)
+}
+
+// Cancel cancels the endpoint, see EndpointInt.Cancel for details.
+func (r *ReadOnlyEndpointInt) Cancel() {
+	r.endpoint.Cancel()
+}
+
+// Done returns a channel that is closed when the endpoint finishes, see
+// EndpointInt.Done for details.
+func (r *ReadOnlyEndpointInt) Done() <-chan struct{} {
+	return r.endpoint.Done()
+}
+
+// Lag returns the number of messages the endpoint did not read yet, see
+// EndpointInt.Lag for details.
+func (r *ReadOnlyEndpointInt) Lag() int {
+	return r.endpoint.Lag()
+}
+
+// Seq returns the sequence number of the next message the endpoint will
+// read, see EndpointInt.Seq for details.
+func (r *ReadOnlyEndpointInt) Seq() uint64 {
+	return r.endpoint.Seq()
+}
+
+// Seek positions the endpoint at the message with sequence number seq, see
+// EndpointInt.Seek for details.
+func (r *ReadOnlyEndpointInt) Seek(seq uint64) error {
+	return r.endpoint.Seek(seq)
+}
+
+//jig:name RouterInt_Run
+
+// Run will range over the endpoint of the router and route the messages to
+// the output channels until the endpoint is canceled or closed. When the
+// endpoint is closed, all output channels are closed with the same error.
+// Run blocks, so it should be called from its own goroutine.
+func (r *RouterInt) Run(maxAge time.Duration) {
+	r.endpoint.Range(func(value int, err error, closed bool) bool {
+		if closed {
+			for i := range r.routes {
+				r.routes[i].Close(err)
+			}
+			return true
+		}
+		index := r.key(value)
+		if index < 0 || index >= len(r.routes) {
+			atomic.AddUint64(&r.unrouted, 1)
+			return true
+		}
+		route := &r.routes[index]
+		if route.policy == RouteDrop {
+			if !route.TrySend(value) {
+				atomic.AddUint64(&route.dropped, 1)
+				return true
+			}
+		} else {
+			route.Send(value)
+		}
+		atomic.AddUint64(&route.routed, 1)
+		return true
+	}, maxAge)
+}
+
+//jig:name EndpointInt_Range
+
+// Range will call the passed in foreach function with all the messages in
+// the buffer, followed by all the messages received. When the foreach function
+// returns true Range will continue, when you return false this is the same as
+// calling Cancel. When canceled the foreach will never be called again.
+// Passing a maxAge duration other than 0 will skip messages that are older
+// than maxAge. When maxAge is 0, the maxAge the endpoint was created with
+// applies (see WithMaxAge).
+//
+// When the channel is closed, eventually when the buffer is exhausted the close
+// with optional error will be notified by calling foreach one last time with
+// the closed parameter set to true.
+func (e *EndpointInt) Range(foreach func(value int, err error, closed bool) bool, maxAge time.Duration) {
+	e.iterate(foreach, nil, maxAge, nil)
+}
+
+//jig:name EndpointInt_next
+
+func (e *EndpointInt) next(control *uint32) (value int, ok bool, closed bool) {
+	e.iterate(func(v int, err error, c bool) bool {
+		value, ok, closed = v, !c, c
+		if e.recycle != nil && !c {
+			atomic.StoreUint64(&e.held, e.cursor)
+		}
+		atomic.StoreUint32(control, suspend)
+		return true
+	}, nil, 0, control)
+	return
+}
+
+//jig:name EndpointInt_Next
+
+// Next will block until the next message is available and return it with ok
+// set to true. Next allows pulling messages from the endpoint one at a time
+// instead of receiving them via a callback passed to Range.
+//
+// When the channel is closed, eventually when the buffer is exhausted Next
+// will return with closed set to true. When the endpoint is canceled, Next will
+// return with both ok and closed set to false.
+func (e *EndpointInt) Next() (value int, ok bool, closed bool) {
+	var control uint32
+	return e.next(&control)
+}
+
+//jig:name ChanInt_grow
+
+// grow replaces the ring of the channel by one of double the size. It must be
+// called with exclusive access to the endpoints and only when all messages in
+// the buffer are committed, so no sender or replace is writing to the ring.
+func (c *ChanInt) grow() {
+	old := c.loadRing()
+	size := old.size * 2
+	r := &ringInt{
+		buffer:		make([]int, size),
+		written:	make([]int64, size),
+		mod:		size - 1,
+		size:		size,
+	}
+	if old.labels != nil {
+		r.labels = make([]string, size)
+		r.errs = make([]error, size)
+	}
+	if old.owners != nil {
+		r.owners = make([]uint32, size)
+	}
+	if old.headers != nil {
+		r.headers = make([]Headers, size)
+	}
+	begin := atomic.LoadUint64(&c.begin)
+	end := atomic.LoadUint64(&c.end)
+	for index := begin; index < end; index++ {
+		r.buffer[r.slot(index)] = old.buffer[old.slot(index)]
+		r.written[r.slot(index)] = atomic.LoadInt64(&old.written[old.slot(index)])
+		if r.labels != nil {
+			r.labels[r.slot(index)] = old.labels[old.slot(index)]
+			r.errs[r.slot(index)] = old.errs[old.slot(index)]
+		}
+		if r.owners != nil {
+			r.owners[r.slot(index)] = atomic.LoadUint32(&old.owners[old.slot(index)])
+		}
+		if r.headers != nil {
+			r.headers[r.slot(index)] = old.headers[old.slot(index)]
+		}
+	}
+	atomic.StorePointer(&c.ring, unsafe.Pointer(r))
+	atomic.StoreUint64(&c.end, begin+size)
+}
+
+//jig:name ChanInt_release
+
+// release subtracts the size of the messages from begin up to end from the
+// bytes in the buffer and drops their headers. It is called just before the
+// messages leave the buffer. When read is true, no endpoint can read the
+// messages anymore, so their values are recycled (see Recycle).
+func (c *ChanInt) release(r *ringInt, begin, end uint64, read bool) {
+	if r.headers != nil {
+		for index := begin; index < end; index++ {
+			r.headers[r.slot(index)] = nil
+		}
+	}
+	if c.recycle != nil && read {
+		for index := begin; index < end; index++ {
+			if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+				c.recycle(r.buffer[r.slot(index)])
+			}
+		}
+	}
+	if c.size == nil {
+		return
+	}
+	size := int64(0)
+	for index := begin; index < end; index++ {
+		if atomic.LoadInt64(&r.written[r.slot(index)])&2 == 0 {
+			size += int64(c.size(r.buffer[r.slot(index)]))
+		}
+	}
+	atomic.AddInt64(&c.bytes, -size)
+}
+
+//jig:name ChanInt_gate
+
+// gate returns the index of the first message at or beyond cursor that the
+// endpoint at position i in entries may still read, so it holds back senders.
+// When there is no such message, the commit index is returned. It must be
+// called with exclusive access to the endpoints.
+func (c *ChanInt) gate(entries []EndpointInt, i uint32, cursor uint64) uint64 {
+	r := c.loadRing()
+	commit := c.commitData()
+	for ; cursor < commit; cursor++ {
+		owner := atomic.LoadUint32(&r.owners[r.slot(cursor)])
+		if owner == i+1 || c.orphaned(owner) {
+			return cursor
+		}
+	}
+	return commit
+}
+
+//jig:name EndpointInt_retained
+
+// retained returns the first message the channel has to keep in its buffer for
+// the endpoint with the given cursor. For an endpoint created with
+// WithManualCommit that is the first uncommitted message, so Seek can go back
+// to it (see Commit). When values are recycled, it is the first value handed
+// out by the last call to Next or ReadBatch, which the caller may use until
+// its next read (see Recycle). A parked cursor is returned as is.
+func (e *EndpointInt) retained(cursor uint64) uint64 {
+	if cursor == parked {
+		return parked
+	}
+	if e.manualCommit == 1 {
+		if committed := atomic.LoadUint64(&e.committed); committed < cursor {
+			cursor = committed
+		}
+	}
+	if e.recycle != nil {
+		if held := atomic.LoadUint64(&e.held); held < cursor {
+			cursor = held
+		}
+	}
+	return cursor
+}
+
+//jig:name endpointsInt_slowest
+
+// slowest returns the cursor of the slowest endpoint that blocks senders, or
+// parked when no endpoint does. To avoid scanning thousands of endpoints over
+// and over, it keeps a lower bound of the cursors of every 64 endpoints and of
+// all endpoints. Unless all is true, only the groups of endpoints holding back
+// the beginning of the buffer are scanned again. Cursors only move back with
+// exclusive access to the endpoints, which forgets the bounds (see
+// invalidate). It must be called by slideBuffer with access to the endpoints,
+// which may be shared (see AccessShared).
+func (e *endpointsInt) slowest(c *ChanInt, begin uint64, all bool) uint64 {
+	if c.lossy == 1 {
+		return parked
+	}
+	all = all || c.roundRobin == 1
+	if min := atomic.LoadUint64(&e.min); !all && begin < min {
+		return min
+	}
+	slowest := parked
+	for shard := uint32(0); shard*64 < e.len; shard++ {
+		min := atomic.LoadUint64(&e.shards[shard])
+		if all || min <= begin {
+			min = parked
+			end := shard*64 + 64
+			if end > e.len {
+				end = e.len
+			}
+			for i := shard * 64; i < end; i++ {
+				ep := &e.entry[i]
+				cursor := atomic.LoadUint64(&ep.cursor)
+				if cursor == parked || atomic.LoadUint32(&ep.evicted) == 1 || ep.overflow != OverflowBlock {
+					continue
+				}
+				if c.roundRobin == 1 {
+					cursor = c.gate(e.entry[:e.len], i, cursor)
+				}
+				if cursor = ep.retained(cursor); cursor < min {
+					min = cursor
+				}
+			}
+			atomic.StoreUint64(&e.shards[shard], min)
+		}
+		if min < slowest {
+			slowest = min
+		}
+	}
+	atomic.StoreUint64(&e.min, slowest)
+	return slowest
+}
+
+//jig:name ChanInt_advanceEnd
+
+// advanceEnd moves the end of the buffer after the beginning was moved from
+// begin to next with a compare-and-swap. Senders sliding concurrently move the
+// beginning in turn, so advanceEnd first waits for the slide that moved the
+// beginning to begin to move the end. This keeps senders from storing
+// messages in slots that are still being released.
+func (c *ChanInt) advanceEnd(r *ringInt, begin, next uint64) {
+	for atomic.LoadUint64(&c.end) != begin+r.size {
+		runtime.Gosched()
+	}
+	atomic.StoreUint64(&c.end, next+r.size)
+}
+
+//jig:name ChanInt_slideSingle
+
+// slideSingle is the fast path of slideBuffer for a channel created with an
+// endpointCapacity of 1, the common setup of a plain queue. The cursor of the
+// only endpoint is the slowest cursor, so there are no endpoints to scan, no
+// bounds to keep (see slowest) and no clock to read for a full scan. It
+// returns ok false when the endpoint needs the general path, because it
+// doesn't block senders or is canceled when idle.
+func (c *ChanInt) slideSingle() (slowestCursor uint64, spinlock bool, ok bool) {
+	slowestCursor, ok = parked, true
+	spinlock = c.endpoints.AccessShared(atomic.LoadUint32(&c.spinBudget), func(endpoints *endpointsInt) {
+		if atomic.LoadUint32(&endpoints.len) == 0 {
+			return
+		}
+		ep := &endpoints.entry[0]
+		if ep.overflow != OverflowBlock || ep.idleTimeout != 0 {
+			ok = false
+			return
+		}
+		cursor := ep.retained(atomic.LoadUint64(&ep.cursor))
+		begin := atomic.LoadUint64(&c.begin)
+		if cursor == parked || cursor <= begin || cursor > atomic.LoadUint64(&c.end) {
+			return
+		}
+		r := c.loadRing()
+		next := cursor
+		if r.size <= 16 {
+			next = begin + 1
+		}
+		if atomic.CompareAndSwapUint64(&c.begin, begin, next) {
+			c.release(r, begin, next, true)
+			c.advanceEnd(r, begin, next)
+		}
+		slowestCursor = next
+	})
+	return slowestCursor, spinlock, ok
+}
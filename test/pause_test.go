@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChanPauseResume(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Pause()
+	if !channel.Paused() {
+		t.Fatal("expected channel to be paused")
+	}
+	if channel.TrySend(1) {
+		t.Fatal("expected TrySend to fail while paused")
+	}
+	if err := channel.SendTimeout(1, time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout got %v", err)
+	}
+	sent := make(chan struct{})
+	go func() {
+		channel.Send(2)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expected Send to block while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	channel.Resume()
+	<-sent
+	if value, _, _ := ep.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+}
+
+func TestChanPauseSendContext(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- channel.SendContext(ctx, 1)
+	}()
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled got %v", err)
+	}
+	go func() {
+		errs <- channel.SendContext(context.Background(), 2)
+	}()
+	channel.Resume()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := ep.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+}
+
+func TestEndpointPauseResume(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	channel.Send(2)
+	ep.Pause()
+	if _, ok, _ := ep.NextTimeout(10 * time.Millisecond); ok {
+		t.Fatal("expected no message while paused")
+	}
+	ep.Resume()
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+	ep.Pause()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ep.Resume()
+	}()
+	if value, _, _ := ep.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+}
+
+func TestEndpointPauseCancel(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithEndpointCapacity(1), WithEndpointWakeups())
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	ep.Pause()
+	received := make(chan bool)
+	go func() {
+		_, ok, _ := ep.Next()
+		received <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ep.Cancel()
+	select {
+	case ok := <-received:
+		if ok {
+			t.Fatal("expected no message from a canceled endpoint")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Cancel to release the paused endpoint")
+	}
+}
+
+func TestEndpointPauseDoesNotPauseChan(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	ep.Pause()
+	if !ep.Paused() {
+		t.Fatal("expected the endpoint to be paused")
+	}
+	if channel.Paused() || !channel.TrySend(1) {
+		t.Fatal("expected Pause on the endpoint to leave the senders of the channel running")
+	}
+	ep.Resume()
+	if ep.Paused() {
+		t.Fatal("expected the endpoint to be resumed")
+	}
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestChanThousandsOfEndpoints(t *testing.T) {
+	const endpoints = 2000
+	channel := NewChanInt(16, endpoints)
+	var wg sync.WaitGroup
+	counts := make([]int, endpoints)
+	for i := range counts {
+		ep, err := channel.NewEndpoint(ReplayAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ep.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					counts[i]++
+				}
+				return true
+			}, 0)
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	wg.Wait()
+	for i, count := range counts {
+		if count != 100 {
+			t.Fatalf("endpoint %d: expected 100 messages got %d", i, count)
+		}
+	}
+}
+
+func TestChanSlowestAfterSeek(t *testing.T) {
+	channel := NewChanInt(64, 130)
+	var eps []*EndpointInt
+	for i := 0; i < 130; i++ {
+		ep, err := channel.NewEndpoint(ReplayAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eps = append(eps, ep)
+	}
+	for _, ep := range eps[1:129] {
+		ep.Cancel()
+	}
+	a, b := eps[0], eps[129] // in different groups of 64 endpoints
+	for i := 0; i < 64; i++ {
+		channel.Send(i)
+	}
+	b.ReadBatch(make([]int, 64))
+	if channel.TrySend(64) {
+		t.Fatal("expected a full buffer")
+	}
+	a.ReadBatch(make([]int, 32))
+	if !channel.TrySend(64) {
+		t.Fatal("expected room for 32 messages")
+	}
+	if err := b.Seek(40); err != nil {
+		t.Fatal(err)
+	}
+	a.ReadBatch(make([]int, 64))
+	for i := 65; channel.TrySend(i); i++ {
+	}
+	if value, _, _ := b.Next(); value != 40 || b.Dropped() != 0 {
+		t.Fatalf("expected 40 without drops got %d with %d dropped", value, b.Dropped())
+	}
+}
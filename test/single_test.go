@@ -0,0 +1,76 @@
+package test
+
+import "testing"
+
+func TestChanSingleEndpointQueue(t *testing.T) {
+	const messages = 10000
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithEndpointCapacity(1), WithoutTimestamps())
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < messages; i++ {
+			channel.FastSend(i)
+		}
+		channel.Close(nil)
+	}()
+	expect := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed && value != expect {
+			t.Fatalf("expected %d, got %d", expect, value)
+		}
+		expect++
+		return true
+	}, 0)
+	if expect != messages+1 {
+		t.Fatalf("expected %d messages, got %d", messages, expect-1)
+	}
+}
+
+func TestChanSingleEndpointDropOldest(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpointOpts(WithOverflow(OverflowDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		channel.Send(i) // must not block on the endpoint
+	}
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if len(received) != 4 || received[0] != 6 || ep.Dropped() != 6 {
+		t.Fatalf("expected [6 7 8 9] and 6 dropped, got %v and %d dropped", received, ep.Dropped())
+	}
+}
+
+func TestChanSingleEndpointManualCommit(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpointOpts(WithManualCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	for i := 0; i < 4; i++ {
+		if value, ok, _ := ep.Next(); !ok || value != i {
+			t.Fatalf("expected %d, got %d", i, value)
+		}
+	}
+	if channel.TrySend(4) {
+		t.Fatal("uncommitted messages were released")
+	}
+	if err := ep.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	if !channel.TrySend(4) || !channel.TrySend(5) || channel.TrySend(6) {
+		t.Fatal("expected room for exactly the 2 committed messages")
+	}
+}
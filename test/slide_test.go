@@ -0,0 +1,54 @@
+package test
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestChanConcurrentSlide(t *testing.T) {
+	const senders = 4
+	const messages = 20000
+	channel := NewChanInt(64, 3)
+	var rwg sync.WaitGroup
+	for r := 0; r < 3; r++ {
+		ep, err := channel.NewEndpoint(ReplayAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rwg.Add(1)
+		go func(r int) {
+			defer rwg.Done()
+			var next [senders]int
+			count := 0
+			ep.Range(func(value int, err error, closed bool) bool {
+				if closed {
+					return false
+				}
+				sender, seq := value/messages, value%messages
+				if seq != next[sender] {
+					t.Errorf("receiver %d: sender %d sent %d, expected %d", r, sender, seq, next[sender])
+					return false
+				}
+				next[sender]++
+				count++
+				return true
+			}, 0)
+			if count != senders*messages {
+				t.Errorf("receiver %d: received %d, expected %d", r, count, senders*messages)
+			}
+		}(r)
+	}
+	var swg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		swg.Add(1)
+		go func(s int) {
+			defer swg.Done()
+			for i := 0; i < messages; i++ {
+				channel.Send(s*messages + i)
+			}
+		}(s)
+	}
+	swg.Wait()
+	channel.Close(nil)
+	rwg.Wait()
+}
@@ -1,7 +1,14 @@
 package test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -79,3 +86,2970 @@ func TestChanEndpointKeep(t *testing.T) {
 		t.Fatal("Got", num, "buffered values but I ask for none (keep arg was 0)")
 	}
 }
+
+func TestChanMark(t *testing.T) {
+	channel := NewChanInt(128, 2)
+	channel.Send(1)
+	seq := channel.Mark("snapshot")
+	channel.Send(2)
+	channel.Close(nil)
+
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			got = append(got, value)
+		}
+		return true
+	}, 0)
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("expected [1 2] got %v", got)
+	}
+
+	ep, err = channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	ep.RangeMarks(func(value int, err error, closed bool) bool {
+		if !closed {
+			events = append(events, fmt.Sprint(value))
+		}
+		return true
+	}, func(label string, s uint64) bool {
+		if s != seq {
+			t.Errorf("expected seq %d got %d", seq, s)
+		}
+		events = append(events, label)
+		return true
+	}, 0)
+	if fmt.Sprint(events) != "[1 snapshot 2]" {
+		t.Fatalf("expected [1 snapshot 2] got %v", events)
+	}
+}
+
+func TestChanCancelReleasesSender(t *testing.T) {
+	channel := NewChanInt(4, 2)
+	stuck, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := make(chan struct{})
+	go func() {
+		ep.Range(func(value int, err error, closed bool) bool { return true }, 0)
+		close(wait)
+	}()
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			channel.Send(i)
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expected send to block on endpoint that is not ranging")
+	case <-time.After(10 * time.Millisecond):
+	}
+	stuck.Cancel()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after endpoint was canceled")
+	}
+	channel.Close(nil)
+	<-wait
+}
+
+func TestRouter(t *testing.T) {
+	source := NewChanInt(128, 1)
+	even := NewChanInt(128, 1)
+	odd := NewChanInt(2, 1)
+	ep, err := source.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouterInt(ep, func(value int) int {
+		if value < 0 {
+			return -1
+		}
+		return value % 2
+	})
+	router.Route(even, RouteBlock)
+	router.Route(odd, RouteDrop)
+	for i := 0; i < 10; i++ {
+		source.Send(i)
+	}
+	source.Send(-1)
+	source.Close(nil)
+	router.Run(0)
+
+	ep, err = even.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			got = append(got, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(got) != "[0 2 4 6 8]" {
+		t.Errorf("expected [0 2 4 6 8] got %v", got)
+	}
+	if m := router.Metrics(0); m.Routed != 5 || m.Dropped != 0 {
+		t.Errorf("even route: %+v", m)
+	}
+	if m := router.Metrics(1); m.Routed != 2 || m.Dropped != 3 {
+		t.Errorf("odd route: %+v", m)
+	}
+	if router.Unrouted() != 1 {
+		t.Errorf("expected 1 unrouted message got %d", router.Unrouted())
+	}
+	if !odd.Closed() {
+		t.Error("expected route channel to be closed")
+	}
+}
+
+func TestChanSummary(t *testing.T) {
+	channel := NewChanInt(128, 1)
+	channel.Summarize(0, func(summary interface{}, value int) interface{} {
+		return summary.(int) + value
+	})
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	sum := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			sum += value
+		} else if summary := channel.Summary(); summary != sum {
+			t.Errorf("expected summary %d got %v", sum, summary)
+		}
+		return true
+	}, 0)
+	if sum != 55 {
+		t.Errorf("expected 55 got %d", sum)
+	}
+}
+
+func TestChanSpinBudget(t *testing.T) {
+	channel := NewChanInt(4, 2)
+	channel.SetSpinBudget(100)
+	var wg sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		ep, err := channel.NewEndpoint(ReplayAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count := 0
+			ep.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					count++
+				}
+				return true
+			}, 0)
+			if count != 1000 {
+				t.Errorf("expected 1000 messages got %d", count)
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	wg.Wait()
+}
+
+func TestChanSeal(t *testing.T) {
+	channel := NewChanInt(128, 2)
+	for i := 0; i < 3; i++ {
+		if err := channel.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	channel.Seal()
+	if !channel.Sealed() || channel.Closed() {
+		t.Fatal("expected channel to be sealed but not closed")
+	}
+	if err := channel.Send(3); err != ErrSealed {
+		t.Fatalf("expected ErrSealed got %v", err)
+	}
+
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if closed {
+			t.Error("sealed channel should not deliver close")
+		}
+		got = append(got, value)
+		return len(got) < 3
+	}, 0)
+	if fmt.Sprint(got) != "[0 1 2]" {
+		t.Errorf("expected [0 1 2] got %v", got)
+	}
+}
+
+func TestRangeContext(t *testing.T) {
+	channel := NewChanInt(128, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	count := 0
+	err = ep.RangeContext(ctx, func(value int, err error, closed bool) bool {
+		count++
+		return true
+	}, 0)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled got %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 message got %d", count)
+	}
+	if _, err := channel.NewEndpoint(0); err != nil {
+		t.Fatalf("expected endpoint to be reusable, got %v", err)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	channel := NewChanInt(2, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := channel.SendContext(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := channel.SendContext(ctx, 2); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded got %v", err)
+	}
+	go func() {
+		channel.Send(3)
+		channel.Close(nil)
+	}()
+	var got []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			got = append(got, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(got) != "[0 1 3]" {
+		t.Errorf("expected [0 1 3] got %v", got)
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if !channel.TrySend(i) {
+			t.Fatalf("expected TrySend(%d) to succeed", i)
+		}
+	}
+	if channel.TrySend(4) {
+		t.Fatal("expected TrySend to fail on full buffer")
+	}
+	wait := make(chan struct{})
+	go func() {
+		ep.Range(func(value int, err error, closed bool) bool { return true }, 0)
+		close(wait)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !channel.TrySend(4) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected TrySend to succeed after endpoint read messages")
+		}
+		runtime.Gosched()
+	}
+	channel.Close(nil)
+	<-wait
+}
+
+func TestSendTimeout(t *testing.T) {
+	channel := NewChanInt(2, 1)
+	_, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := channel.SendTimeout(i, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if err := channel.SendTimeout(2, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout got %v", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("SendTimeout returned before the timeout expired")
+	}
+}
+
+func TestNext(t *testing.T) {
+	channel := NewChanInt(8, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(1)
+	channel.Send(2)
+	for i := 1; i <= 2; i++ {
+		value, ok, closed := ep.Next()
+		if !ok || closed || value != i {
+			t.Fatalf("expected %d got %d (ok=%v closed=%v)", i, value, ok, closed)
+		}
+	}
+	if _, ok, closed := ep.NextTimeout(10 * time.Millisecond); ok || closed {
+		t.Fatalf("expected timeout got ok=%v closed=%v", ok, closed)
+	}
+	channel.Send(3)
+	if value, ok, _ := ep.NextTimeout(time.Second); !ok || value != 3 {
+		t.Fatalf("expected 3 got %d (ok=%v)", value, ok)
+	}
+	channel.Close(nil)
+	if _, ok, closed := ep.Next(); ok || !closed {
+		t.Fatalf("expected closed got ok=%v closed=%v", ok, closed)
+	}
+}
+
+func TestSendSlice(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]int, 10)
+	for i := range values {
+		values[i] = i
+	}
+	go func() {
+		channel.SendSlice(values)
+		channel.Close(nil)
+	}()
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != fmt.Sprint(values) {
+		t.Fatalf("expected %v got %v", values, received)
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		channel.Send(i)
+	}
+	channel.Mark("five")
+	channel.Send(5)
+	channel.Close(nil)
+	dst := make([]int, 4)
+	var received []int
+	for n := ep.ReadBatch(dst); n > 0; n = ep.ReadBatch(dst) {
+		received = append(received, dst[:n]...)
+	}
+	if fmt.Sprint(received) != "[0 1 2 3 4 5]" {
+		t.Fatalf("expected [0 1 2 3 4 5] got %v", received)
+	}
+}
+
+func TestChanLatest(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	if _, ok := channel.Latest(); ok {
+		t.Fatal("expected no latest value on empty channel")
+	}
+	channel.Send(1)
+	channel.Send(2)
+	channel.Mark("after two")
+	if value, ok := channel.Latest(); !ok || value != 2 {
+		t.Fatalf("expected 2 got %d (ok=%v)", value, ok)
+	}
+}
+
+func TestChanLenCapLag(t *testing.T) {
+	channel := NewChanInt(5, 2)
+	if channel.Cap() != 8 {
+		t.Fatalf("expected Cap 8 got %d", channel.Cap())
+	}
+	fast, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		channel.Send(i)
+	}
+	if _, ok, _ := fast.Next(); !ok {
+		t.Fatal("expected a message")
+	}
+	if fast.Lag() != 2 {
+		t.Fatalf("expected fast Lag 2 got %d", fast.Lag())
+	}
+	if slow.Lag() != 3 {
+		t.Fatalf("expected slow Lag 3 got %d", slow.Lag())
+	}
+	if channel.Len() != 3 {
+		t.Fatalf("expected Len 3 got %d", channel.Len())
+	}
+	slow.Cancel()
+	if channel.Len() != 2 {
+		t.Fatalf("expected Len 2 got %d", channel.Len())
+	}
+}
+
+func TestEndpointDone(t *testing.T) {
+	channel := NewChanInt(4, 2)
+	closing, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceling, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceling.Cancel()
+	select {
+	case <-canceling.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected canceled endpoint to be done")
+	}
+	channel.Send(1)
+	channel.Close(nil)
+	select {
+	case <-closing.Done():
+		t.Fatal("expected endpoint not to be done before draining")
+	default:
+	}
+	go closing.Range(func(value int, err error, closed bool) bool { return true }, 0)
+	select {
+	case <-closing.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected closed endpoint to be done")
+	}
+}
+
+func TestNewChanOpts(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(5), WithEndpointCapacity(1), WithClock(clock))
+	if channel.Cap() != 8 {
+		t.Fatalf("expected Cap 8 got %d", channel.Cap())
+	}
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.NewEndpoint(ReplayAll); err != ErrOutOfEndpoints {
+		t.Fatalf("expected ErrOutOfEndpoints got %v", err)
+	}
+	channel.Send(1)
+	now = now.Add(time.Hour)
+	channel.Send(2)
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, time.Minute)
+	if fmt.Sprint(received) != "[2]" {
+		t.Fatalf("expected [2] got %v", received)
+	}
+}
+
+func TestNewEndpointOpts(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithClock(clock))
+	channel.Send(1)
+	now = now.Add(time.Hour)
+	channel.Send(2)
+	channel.Send(3)
+	ep, err := channel.NewEndpointOpts(WithKeep(2), WithMaxAge(time.Minute), WithName("recent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Name() != "recent" {
+		t.Fatalf("expected name recent got %q", ep.Name())
+	}
+	old, err := channel.NewEndpointOpts(WithMaxAge(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Close(nil)
+	for _, e := range []*EndpointInt{ep, old} {
+		var received []int
+		e.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				received = append(received, value)
+			}
+			return true
+		}, 0)
+		if fmt.Sprint(received) != "[2 3]" {
+			t.Fatalf("expected [2 3] got %v", received)
+		}
+	}
+}
+
+func TestEndpointSeek(t *testing.T) {
+	channel := NewChanInt(8, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		channel.Send(i * 10)
+	}
+	for i := 0; i < 3; i++ {
+		ep.Next()
+	}
+	if ep.Seq() != 3 {
+		t.Fatalf("expected Seq 3 got %d", ep.Seq())
+	}
+	if err := ep.Seek(1); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := ep.Next(); value != 10 {
+		t.Fatalf("expected 10 got %d", value)
+	}
+	if err := ep.Seek(5); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange got %v", err)
+	}
+	if err := ep.Seek(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := ep.NextTimeout(10 * time.Millisecond); ok {
+		t.Fatal("expected no message after seeking to the end")
+	}
+}
+
+func TestEndpointSeekTime(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithClock(clock))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		channel.Send(i)
+	}
+	for i := 0; i < 4; i++ {
+		ep.Next()
+	}
+	if err := ep.SeekTime(now.Add(-2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+	if err := ep.SeekTime(now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ep.Seq() != 4 {
+		t.Fatalf("expected Seq 4 got %d", ep.Seq())
+	}
+}
+
+func TestRangeSeq(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithClock(clock))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make([]time.Time, 3)
+	for i := range sent {
+		now = now.Add(time.Second)
+		sent[i] = now
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	ep.RangeSeq(func(value int, seq uint64, at time.Time, err error, closed bool) bool {
+		if closed {
+			if seq != 3 {
+				t.Errorf("expected close at seq 3 got %d", seq)
+			}
+			return true
+		}
+		if seq != uint64(value) {
+			t.Errorf("expected seq %d got %d", value, seq)
+		}
+		if !at.Equal(sent[value]) {
+			t.Errorf("expected sent %v got %v", sent[value], at)
+		}
+		return true
+	}, 0)
+}
+
+func TestChanReset(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(1)
+	if err := channel.Reset(); err != ErrInUse {
+		t.Fatalf("expected ErrInUse got %v", err)
+	}
+	channel.Close(fmt.Errorf("session ended"))
+	if err := channel.Reset(); err != ErrInUse {
+		t.Fatalf("expected ErrInUse got %v", err)
+	}
+	ep.Range(func(value int, err error, closed bool) bool { return true }, 0)
+	if err := channel.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if channel.Closed() {
+		t.Fatal("expected channel to be active after Reset")
+	}
+	ep, err = channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(2)
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if closed && err != nil {
+			t.Errorf("expected no error got %v", err)
+		}
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[2]" {
+		t.Fatalf("expected [2] got %v", received)
+	}
+}
+
+func TestChanResetDone(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	failure := errors.New("session ended")
+	stop := make(chan struct{})
+	observed := make(chan error)
+	go func() {
+		defer close(observed)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-channel.Done():
+				if err := channel.Err(); err != nil && err != failure {
+					observed <- err
+				}
+			default:
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		channel.Close(failure)
+		if err := channel.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if err := <-observed; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case <-channel.Done():
+		t.Fatal("expected Done of the reset channel to be open")
+	default:
+	}
+}
+
+func TestChanCloseNow(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(1)
+	channel.Send(2)
+	failure := fmt.Errorf("unauthorized")
+	channel.CloseNow(failure)
+	var received []int
+	var closeErr error
+	ep.Range(func(value int, err error, closed bool) bool {
+		if closed {
+			closeErr = err
+		} else {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if len(received) != 0 {
+		t.Fatalf("expected no messages got %v", received)
+	}
+	if closeErr != failure {
+		t.Fatalf("expected %v got %v", failure, closeErr)
+	}
+}
+
+func TestChanLossy(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithLossy())
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[6 7 8 9]" {
+		t.Fatalf("expected [6 7 8 9] got %v", received)
+	}
+	if ep.Dropped() != 6 {
+		t.Fatalf("expected 6 dropped got %d", ep.Dropped())
+	}
+}
+
+func TestChanLossyGap(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithLossy())
+	var gaps []uint64
+	ep, err := channel.NewEndpointOpts(WithGapHandler(func(missed uint64) {
+		gaps = append(gaps, missed)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(0)
+	if value, _, _ := ep.Next(); value != 0 {
+		t.Fatalf("expected 0 got %d", value)
+	}
+	for i := 1; i < 8; i++ {
+		channel.Send(i)
+	}
+	if value, _, _ := ep.Next(); value != 4 {
+		t.Fatalf("expected 4 got %d", value)
+	}
+	if fmt.Sprint(gaps) != "[3]" {
+		t.Fatalf("expected gaps [3] got %v", gaps)
+	}
+}
+
+func TestEndpointOverflow(t *testing.T) {
+	channel := NewChanInt(4, 3)
+	monitor, err := channel.NewEndpointOpts(WithOverflow(OverflowDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := channel.NewEndpointOpts(WithOverflow(OverflowError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	persist, err := channel.NewEndpointOpts(WithOverflow(OverflowBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted []int
+	wait := make(chan struct{})
+	go func() {
+		persist.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				persisted = append(persisted, value)
+			}
+			return true
+		}, 0)
+		close(wait)
+	}()
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	<-wait
+	if fmt.Sprint(persisted) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("expected all messages got %v", persisted)
+	}
+	var monitored []int
+	monitor.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			monitored = append(monitored, value)
+		}
+		return true
+	}, 0)
+	if len(monitored)+int(monitor.Dropped()) != 10 || monitor.Dropped() == 0 {
+		t.Fatalf("expected drops got %v with %d dropped", monitored, monitor.Dropped())
+	}
+	var closeErr error
+	strict.Range(func(value int, err error, closed bool) bool {
+		if closed {
+			closeErr = err
+		}
+		return true
+	}, 0)
+	if closeErr != ErrOverflow {
+		t.Fatalf("expected ErrOverflow got %v", closeErr)
+	}
+}
+
+func TestChanConflate(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithConflate())
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	if value, _, _ := ep.Next(); value != 9 {
+		t.Fatalf("expected 9 got %d", value)
+	}
+	channel.Send(10)
+	channel.Send(11)
+	dst := make([]int, 4)
+	if n := ep.ReadBatch(dst); n != 1 || dst[0] != 11 {
+		t.Fatalf("expected [11] got %v", dst[:n])
+	}
+}
+
+func TestChanGrowth(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithEndpointCapacity(1), WithGrowth(16))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		channel.Send(i)
+	}
+	if channel.Cap() != 16 {
+		t.Fatalf("expected capacity 16 got %d", channel.Cap())
+	}
+	if channel.TrySend(16) {
+		t.Fatal("expected TrySend to fail on a full buffer at maximum capacity")
+	}
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if len(received) != 16 || received[0] != 0 || received[15] != 15 {
+		t.Fatalf("expected 0..15 got %v", received)
+	}
+}
+
+func TestChanLimitBytes(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	channel.LimitBytes(10, func(value int) int { return value })
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(4)
+	channel.Send(6)
+	if channel.Bytes() != 10 {
+		t.Fatalf("expected 10 bytes got %d", channel.Bytes())
+	}
+	if channel.TrySend(1) {
+		t.Fatal("expected TrySend to fail when over budget")
+	}
+	if value, _, _ := ep.Next(); value != 4 {
+		t.Fatalf("expected 4 got %d", value)
+	}
+	if !channel.TrySend(3) {
+		t.Fatal("expected TrySend to succeed after reading")
+	}
+	if channel.Bytes() != 9 {
+		t.Fatalf("expected 9 bytes got %d", channel.Bytes())
+	}
+	ep.Next()
+	ep.Next()
+	channel.Send(20) // larger than the budget, but the buffer is empty
+	if channel.Bytes() != 20 {
+		t.Fatalf("expected 20 bytes got %d", channel.Bytes())
+	}
+}
+
+func TestChanLimitBytesClosed(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithExactCapacity())
+	channel.LimitBytes(100, func(value int) int { return value })
+	if _, err := channel.NewEndpoint(ReplayAll); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		channel.Send(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		channel.Send(5) // admitted, then waits for room in the buffer
+		channel.SendSlice([]int{6, 7})
+		close(done)
+	}()
+	for channel.Bytes() != 15 {
+		runtime.Gosched()
+	}
+	channel.Close(nil)
+	<-done
+	if channel.Bytes() != 10 {
+		t.Fatalf("expected 10 bytes got %d", channel.Bytes())
+	}
+}
+
+func TestChanExactCapacity(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(5), WithExactCapacity())
+	if channel.Cap() != 5 {
+		t.Fatalf("expected capacity 5 got %d", channel.Cap())
+	}
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 23; i++ {
+			channel.Send(i)
+		}
+		channel.Close(nil)
+	}()
+	expect := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			if value != expect {
+				t.Fatalf("expected %d got %d", expect, value)
+			}
+			expect++
+		}
+		return true
+	}, 0)
+	if expect != 23 {
+		t.Fatalf("expected 23 messages got %d", expect)
+	}
+
+	growing := NewChanOptsInt(WithBufferCapacity(3), WithExactCapacity(), WithGrowth(12))
+	if _, err := growing.NewEndpoint(ReplayAll); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		growing.Send(i)
+	}
+	if growing.Cap() != 12 {
+		t.Fatalf("expected capacity 12 after growing got %d", growing.Cap())
+	}
+}
+
+func TestChanMemStats(t *testing.T) {
+	channel := NewChanInt(16, 4)
+	if _, err := channel.NewEndpoint(ReplayAll); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		channel.Send(i)
+	}
+	stats := channel.MemStats(func(value int) int { return value })
+	if stats.Buffer != 16*8 || stats.Timestamps != 16*8 || stats.Metadata != 0 {
+		t.Fatalf("expected 128 bytes of buffer and timestamps got %+v", stats)
+	}
+	if stats.Endpoints == 0 || stats.Endpoints%4 != 0 || stats.Channel == 0 {
+		t.Fatalf("expected the size of the channel and 4 endpoints got %+v", stats)
+	}
+	if stats.Payload != 6 {
+		t.Fatalf("expected a payload of 6 bytes got %d", stats.Payload)
+	}
+	if stats.Total() != stats.Channel+stats.Buffer+stats.Timestamps+stats.Endpoints+stats.Payload {
+		t.Fatalf("expected the sum of all sizes got %d", stats.Total())
+	}
+	if stats = channel.MemStats(nil); stats.Payload != 0 {
+		t.Fatalf("expected no payload without a size function got %d", stats.Payload)
+	}
+}
+
+func TestChanLazyAllocation(t *testing.T) {
+	channel := NewChanInt(1024, 8)
+	if stats := channel.MemStats(nil); stats.Buffer != 0 || stats.Timestamps != 0 || stats.Endpoints != 0 {
+		t.Fatalf("expected nothing allocated by the constructor got %+v", stats)
+	}
+	if channel.Cap() != 1024 {
+		t.Fatalf("expected a capacity of 1024 got %d", channel.Cap())
+	}
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := channel.MemStats(nil); stats.Buffer != 0 || stats.Endpoints == 0 || stats.Endpoints%8 != 0 {
+		t.Fatalf("expected only 8 endpoints allocated got %+v", stats)
+	}
+	channel.Send(1)
+	if stats := channel.MemStats(nil); stats.Buffer != 1024*8 || stats.Timestamps != 1024*8 {
+		t.Fatalf("expected a buffer of 1024 messages got %+v", stats)
+	}
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+}
+
+func TestChanRecycle(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	var recycled []int
+	channel.Recycle(func(value int) int { return value * 10 }, func(value int) { recycled = append(recycled, value) })
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		channel.Send(i)
+	}
+	for i := 0; i < 4; i++ {
+		if value, _, _ := ep.Next(); value != i*10 {
+			t.Fatalf("expected %d got %d", i*10, value)
+		}
+	}
+	if len(recycled) != 0 {
+		t.Fatalf("expected nothing recycled before the buffer slides got %v", recycled)
+	}
+	for i := 16; i < 19; i++ {
+		channel.Send(i)
+	}
+	if len(recycled) != 3 || recycled[0] != 0 || recycled[2] != 20 {
+		t.Fatalf("expected 0,10,20 recycled got %v", recycled)
+	}
+	if channel.TrySend(19) {
+		t.Fatal("expected the value returned by Next to be held until the next read")
+	}
+	ep.Next()
+	channel.Send(19)
+	if len(recycled) != 4 || recycled[3] != 30 {
+		t.Fatalf("expected 0,10,20,30 recycled got %v", recycled)
+	}
+
+	pool := NewBytePool(4)
+	data := pool.Copy([]byte("abc"))
+	if string(data) != "abc" || cap(data) != 4 {
+		t.Fatalf("expected abc in a pooled buffer got %q with capacity %d", data, cap(data))
+	}
+	pool.Put(data)
+	if data = pool.Copy([]byte("abcdefgh")); string(data) != "abcdefgh" {
+		t.Fatalf("expected abcdefgh got %q", data)
+	}
+}
+
+func TestChanRecycleHeldUntilNextRead(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	var recycled []int
+	channel.Recycle(nil, func(value int) { recycled = append(recycled, value) })
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	if value, _, _ := ep.Next(); value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+	for i := 2; i <= 4; i++ {
+		channel.Send(i)
+	}
+	if channel.TrySend(5) || len(recycled) != 0 {
+		t.Fatalf("expected the value returned by Next to be held got %v recycled", recycled)
+	}
+	ep.Next()
+	if !channel.TrySend(5) || fmt.Sprint(recycled) != "[1]" {
+		t.Fatalf("expected 1 to be recycled after the next read got %v", recycled)
+	}
+
+	batch := make([]int, 4)
+	if n := ep.ReadBatch(batch); n != 3 || batch[0] != 3 {
+		t.Fatalf("expected [3 4 5] got %v", batch[:n])
+	}
+	channel.Send(6)
+	if channel.TrySend(7) || fmt.Sprint(recycled) != "[1 2]" {
+		t.Fatalf("expected the batch to be held got %v recycled", recycled)
+	}
+	ep.Next()
+	if fmt.Sprint(recycled) != "[1 2]" {
+		t.Fatalf("expected nothing recycled before the buffer slides got %v", recycled)
+	}
+	channel.Send(7)
+	channel.Send(8)
+	channel.Send(9)
+	if fmt.Sprint(recycled) != "[1 2 3 4 5]" {
+		t.Fatalf("expected the batch to be recycled after the next read got %v", recycled)
+	}
+}
+
+func TestChanShrink(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(64), WithClock(clock), WithShrink(16, time.Minute))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	for i := 0; i < 7; i++ {
+		ep.Next()
+	}
+	channel.Shrink()
+	if channel.Cap() != 64 {
+		t.Fatalf("expected capacity 64 before the period passed got %d", channel.Cap())
+	}
+	now = now.Add(time.Minute)
+	channel.Shrink()
+	if channel.Cap() != 32 {
+		t.Fatalf("expected capacity 32 after a period got %d", channel.Cap())
+	}
+	for i := 7; i < 10; i++ {
+		if value, _, _ := ep.Next(); value != i {
+			t.Fatalf("expected %d got %d", i, value)
+		}
+	}
+	now = now.Add(time.Minute)
+	channel.Shrink()
+	now = now.Add(time.Minute)
+	channel.Shrink()
+	if channel.Cap() != 16 {
+		t.Fatalf("expected minimum capacity 16 got %d", channel.Cap())
+	}
+	for i := 10; i < 50; i++ {
+		channel.Send(i)
+		if value, _, _ := ep.Next(); value != i {
+			t.Fatalf("expected %d got %d", i, value)
+		}
+	}
+	replay, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := replay.Next(); value != 34 {
+		t.Fatalf("expected replay of the last 16 messages to start at 34 got %d", value)
+	}
+}
+
+func TestChanRetention(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithClock(clock), WithRetention(RetentionPolicy{MaxCount: 4, MaxAge: time.Minute}))
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Seq() != 6 {
+		t.Fatalf("expected replay to start at 6 got %d", ep.Seq())
+	}
+	if value, _, _ := ep.Next(); value != 6 {
+		t.Fatalf("expected 6 got %d", value)
+	}
+	now = now.Add(2 * time.Minute)
+	channel.Retain()
+	if channel.Len() != 3 {
+		t.Fatalf("expected the unread messages to be kept got %d", channel.Len())
+	}
+	ep.Cancel()
+	channel.Retain()
+	late, _ := channel.NewEndpoint(ReplayAll)
+	channel.Close(nil)
+	if value, ok, closed := late.Next(); ok || !closed {
+		t.Fatalf("expected no messages to be retained got %d", value)
+	}
+}
+
+func TestChanTrimBefore(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	for i := 0; i < 8; i++ {
+		channel.Send(i)
+	}
+	if err := channel.TrimBefore(9); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange got %v", err)
+	}
+	if err := channel.TrimBefore(3); err != nil {
+		t.Fatal(err)
+	}
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	if ep.Seq() != 3 {
+		t.Fatalf("expected replay to start at 3 got %d", ep.Seq())
+	}
+	if err := channel.TrimBefore(5); err != ErrInUse {
+		t.Fatalf("expected ErrInUse got %v", err)
+	}
+	var missed uint64
+	lagging, _ := channel.NewEndpointOpts(WithGapHandler(func(n uint64) { missed = n }))
+	ep.Next()
+	if err := channel.ForceTrimBefore(5); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := lagging.Next(); value != 5 || missed != 2 || lagging.Dropped() != 2 {
+		t.Fatalf("expected 5 after missing 2 got %d after missing %d", value, missed)
+	}
+	if value, _, _ := ep.Next(); value != 5 || ep.Dropped() != 1 {
+		t.Fatalf("expected 5 after dropping 1 got %d after dropping %d", value, ep.Dropped())
+	}
+}
+
+func TestChanWatermarks(t *testing.T) {
+	var crossings []string
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithWatermarks(1, 4,
+		func() { crossings = append(crossings, "high") },
+		func() { crossings = append(crossings, "low") }))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 6; i++ {
+		channel.Send(i)
+	}
+	if fmt.Sprint(crossings) != "[high]" {
+		t.Fatalf("expected [high] got %v", crossings)
+	}
+	for i := 0; i < 4; i++ {
+		ep.Next()
+	}
+	if fmt.Sprint(crossings) != "[high]" {
+		t.Fatalf("expected [high] got %v", crossings)
+	}
+	ep.Next()
+	if fmt.Sprint(crossings) != "[high low]" {
+		t.Fatalf("expected [high low] got %v", crossings)
+	}
+}
+
+func TestChanDemand(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	ep1, _ := channel.NewEndpoint(ReplayAll)
+	ep2, _ := channel.NewEndpoint(ReplayAll)
+	if channel.Demand() != 0 {
+		t.Fatalf("expected no demand got %d", channel.Demand())
+	}
+	ep1.Request(3)
+	ep2.Request(5)
+	if channel.Demand() != 3 {
+		t.Fatalf("expected demand 3 got %d", channel.Demand())
+	}
+	channel.Send(1)
+	channel.Send(2)
+	if channel.Demand() != 1 {
+		t.Fatalf("expected demand 1 got %d", channel.Demand())
+	}
+	ep1.Cancel()
+	if channel.AwaitDemand() != 3 {
+		t.Fatalf("expected demand 3 got %d", channel.Demand())
+	}
+	ep2.Next()
+	ep2.Next()
+	ep2.Request(1)
+	if channel.Demand() != 4 {
+		t.Fatalf("expected demand 4 got %d", channel.Demand())
+	}
+}
+
+type takeSubscriberInt struct {
+	take     int64
+	values   chan int
+	complete chan error
+}
+
+func (s *takeSubscriberInt) OnSubscribe(subscription Subscription) { subscription.Request(s.take) }
+func (s *takeSubscriberInt) OnNext(value int)                      { s.values <- value }
+func (s *takeSubscriberInt) OnError(err error)                     { s.complete <- err }
+func (s *takeSubscriberInt) OnComplete()                           { s.complete <- nil }
+
+func TestChanPublisherSubscriber(t *testing.T) {
+	source := NewChanInt(16, 2)
+	target := NewChanInt(16, 1)
+	ep, _ := target.NewEndpoint(ReplayAll)
+	source.Publisher(ReplayAll).Subscribe(target.Subscriber(4))
+	take := &takeSubscriberInt{take: 3, values: make(chan int, 10), complete: make(chan error, 1)}
+	source.Publisher(ReplayAll).Subscribe(take)
+	for i := 0; i < 10; i++ {
+		source.Send(i)
+	}
+	source.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("expected 0..9 got %v", received)
+	}
+	for i := 0; i < 3; i++ {
+		if value := <-take.values; value != i {
+			t.Fatalf("expected %d got %d", i, value)
+		}
+	}
+	select {
+	case value := <-take.values:
+		t.Fatalf("expected no value without demand got %d", value)
+	case <-take.complete:
+		t.Fatal("expected no completion without demand")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestChanEvictSlow(t *testing.T) {
+	channel := NewChanInt(4, 2)
+	var evicted []string
+	channel.EvictSlow(3, 0, func(endpoint *EndpointInt, lag uint64) {
+		evicted = append(evicted, fmt.Sprint(endpoint.Name(), ":", lag))
+	})
+	slow, _ := channel.NewEndpointOpts(WithName("slow"))
+	fast, _ := channel.NewEndpointOpts(WithName("fast"))
+	for i := 0; i < 8; i++ {
+		channel.Send(i)
+		fast.Next()
+	}
+	channel.Close(nil)
+	if fmt.Sprint(evicted) != "[slow:4]" {
+		t.Fatalf("expected [slow:4] got %v", evicted)
+	}
+	if !slow.Evicted() || fast.Evicted() {
+		t.Fatal("expected only the slow endpoint to be evicted")
+	}
+	if _, ok, closed := slow.Next(); ok || closed {
+		t.Fatal("expected evicted endpoint to be canceled")
+	}
+	if _, _, closed := fast.Next(); !closed {
+		t.Fatal("expected fast endpoint to be closed")
+	}
+}
+
+func TestChanOnLag(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	var alarms []string
+	channel.OnLag(2, 0, func(endpoint *EndpointInt, lag uint64, lagging bool) {
+		alarms = append(alarms, fmt.Sprint(endpoint.Name(), ":", lag, ":", lagging))
+	})
+	ep, _ := channel.NewEndpointOpts(WithName("ep"))
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	for i := 0; i < 3; i++ {
+		ep.Next()
+	}
+	if fmt.Sprint(alarms) != "[ep:3:true ep:2:false]" {
+		t.Fatalf("expected [ep:3:true ep:2:false] got %v", alarms)
+	}
+}
+
+func TestChanOnLagClock(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithClock(clock))
+	var alarms []string
+	channel.OnLag(1, time.Minute, func(endpoint *EndpointInt, lag uint64, lagging bool) {
+		alarms = append(alarms, fmt.Sprint(endpoint.Name(), ":", lag, ":", lagging))
+	})
+	channel.NewEndpointOpts(WithName("ep"))
+	channel.Send(0)
+	channel.Send(1) // within the interval, so not checked
+	if len(alarms) != 0 {
+		t.Fatalf("expected no alarms got %v", alarms)
+	}
+	now = now.Add(2 * time.Minute)
+	channel.Send(2)
+	if fmt.Sprint(alarms) != "[ep:3:true]" {
+		t.Fatalf("expected [ep:3:true] got %v", alarms)
+	}
+}
+
+func TestChanRateLimit(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithClock(clock), WithRateLimit(10, 2, RateReject))
+	for i := 0; i < 2; i++ {
+		if err := channel.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := channel.Send(2); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited got %v", err)
+	}
+	if channel.TrySend(2) {
+		t.Fatal("expected TrySend to fail when rate limited")
+	}
+	now = now.Add(150 * time.Millisecond)
+	if err := channel.Send(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Send(3); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited got %v", err)
+	}
+}
+
+func TestChanFairSend(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(1), WithFairSend())
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(0)
+	for i := 1; i < 5; i++ {
+		go channel.Send(i)
+		for atomic.LoadUint64(&channel.ticket) != uint64(i+1) {
+			runtime.Gosched() // until the sender took its ticket
+		}
+	}
+	if channel.TrySend(5) {
+		t.Fatal("expected TrySend to fail while senders are waiting")
+	}
+	for i := 0; i < 5; i++ {
+		if value, _, _ := ep.Next(); value != i {
+			t.Fatalf("expected %d got %d", i, value)
+		}
+	}
+}
+
+func TestChanLockstep(t *testing.T) {
+	channel := NewChanOptsInt(WithLockstep())
+	var steps [2][]int
+	var wg sync.WaitGroup
+	for i := range steps {
+		ep, _ := channel.NewEndpoint(ReplayAll)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ep.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					steps[i] = append(steps[i], value)
+				}
+				return true
+			}, 0)
+		}(i)
+	}
+	for step := 0; step < 3; step++ {
+		channel.Send(step)
+		for i := range steps {
+			if len(steps[i]) != step+1 {
+				t.Fatalf("expected endpoint %d to have consumed step %d", i, step)
+			}
+		}
+	}
+	channel.Close(nil)
+	wg.Wait()
+}
+
+func TestChanLockstepNext(t *testing.T) {
+	channel := NewChanOptsInt(WithLockstep())
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	idle, _ := channel.NewEndpoint(ReplayAll)
+	go func() {
+		for step := 0; step < 3; step++ {
+			channel.Send(step) // woken up by Next and by the cancel of idle
+		}
+		channel.Close(nil)
+	}()
+	idle.Cancel()
+	for step := 0; step < 3; step++ {
+		if value, ok, _ := ep.Next(); !ok || value != step {
+			t.Fatalf("expected %d got %d", step, value)
+		}
+	}
+	if _, _, closed := ep.Next(); !closed {
+		t.Fatal("expected channel to be closed")
+	}
+}
+
+func TestSharedEndpoint(t *testing.T) {
+	channel := NewChanInt(128, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	shared := ep.Shared()
+	for i := 0; i < 100; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	var wg sync.WaitGroup
+	received := make([][]int, 4)
+	for i := range received {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				value, ok, _ := shared.Next()
+				if !ok {
+					return
+				}
+				received[i] = append(received[i], value)
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int]bool)
+	for _, values := range received {
+		for _, value := range values {
+			if seen[value] {
+				t.Fatalf("received %d more than once", value)
+			}
+			seen[value] = true
+		}
+	}
+	if len(seen) != 100 {
+		t.Fatalf("expected 100 messages got %d", len(seen))
+	}
+}
+
+func TestEndpointClone(t *testing.T) {
+	channel := NewChanInt(16, 3)
+	ep, _ := channel.NewEndpointOpts(WithName("main"))
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	ep.Next()
+	ep.Next()
+	clone, err := ep.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Seq() != 2 || clone.Name() != "main" {
+		t.Fatalf("expected clone at 2 named main got %d named %q", clone.Seq(), clone.Name())
+	}
+	if value, _, _ := clone.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+	ep.Cancel()
+	if _, err := ep.Clone(); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange got %v", err)
+	}
+}
+
+func TestChanEndpoints(t *testing.T) {
+	channel := NewChanInt(16, 3)
+	fast, _ := channel.NewEndpointOpts(WithName("fast"))
+	slow, _ := channel.NewEndpointOpts(WithName("slow"))
+	gone, _ := channel.NewEndpointOpts(WithName("gone"))
+	gone.Cancel()
+	gone.Next()
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	fast.ReadBatch(make([]int, 4))
+	slow.Pause()
+	infos := channel.Endpoints()
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 endpoints got %d", len(infos))
+	}
+	if infos[0].Name != "fast" || infos[0].Cursor != 4 || infos[0].Lag != 0 || infos[0].State != EndpointActive {
+		t.Fatalf("unexpected info for fast endpoint %+v", infos[0])
+	}
+	if infos[1].Name != "slow" || infos[1].Cursor != 0 || infos[1].Lag != 4 || infos[1].State.String() != "paused" {
+		t.Fatalf("unexpected info for slow endpoint %+v", infos[1])
+	}
+	if infos[1].LastActive.After(infos[0].LastActive) {
+		t.Fatal("expected fast endpoint to be active more recently")
+	}
+}
+
+func TestChanLeakDetection(t *testing.T) {
+	leaks := make(chan EndpointInfo, 1)
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithLeakDetection(10*time.Millisecond, func(leak EndpointInfo) {
+		leaks <- leak
+	}))
+	leaked, _ := channel.NewEndpointOpts(WithName("leaked"))
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	go channel.Send(4)
+	select {
+	case leak := <-leaks:
+		if leak.Name != "leaked" || leak.Lag != 4 || !strings.Contains(leak.Origin, "TestChanLeakDetection") {
+			t.Fatalf("unexpected leak %+v", leak)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected leak to be reported")
+	}
+	leaked.Cancel()
+	channel.Close(nil)
+}
+
+func TestEndpointIdleTimeout(t *testing.T) {
+	channel := NewChanInt(4, 2)
+	abandoned, _ := channel.NewEndpointOpts(WithIdleTimeout(10 * time.Millisecond))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	ep.ReadBatch(make([]int, 4))
+	time.Sleep(20 * time.Millisecond)
+	sent := make(chan struct{})
+	go func() {
+		channel.Send(4)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle endpoint to be canceled")
+	}
+	select {
+	case <-abandoned.Done():
+	default:
+		t.Fatal("expected idle endpoint to be done")
+	}
+}
+
+func TestChanRefCount(t *testing.T) {
+	torndown := 0
+	channel := NewChanOptsInt(WithRefCount(func() { torndown++ }))
+	first, _ := channel.NewEndpoint(ReplayAll)
+	second, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	first.Cancel()
+	if channel.Closed() {
+		t.Fatal("expected channel to be open while an endpoint is active")
+	}
+	second.Cancel()
+	if !channel.Closed() || torndown != 1 {
+		t.Fatalf("expected channel to be closed and torn down once got %v and %d", channel.Closed(), torndown)
+	}
+	third, _ := channel.NewEndpoint(ReplayAll)
+	third.Cancel()
+	if torndown != 1 {
+		t.Fatalf("expected teardown once got %d", torndown)
+	}
+}
+
+func TestChanFirstLastEndpoint(t *testing.T) {
+	var events []string
+	channel := NewChanInt(16, 3)
+	channel.OnFirstEndpoint(func() { events = append(events, "first") })
+	channel.OnLastEndpoint(func() { events = append(events, "last") })
+	first, _ := channel.NewEndpoint(ReplayAll)
+	second, _ := channel.NewEndpoint(ReplayAll)
+	first.Cancel()
+	second.Cancel()
+	third, _ := channel.NewEndpoint(ReplayAll)
+	channel.Close(nil)
+	third.Range(func(int, error, bool) bool { return true }, 0)
+	expect := fmt.Sprint([]string{"first", "last", "first", "last"})
+	if fmt.Sprint(events) != expect {
+		t.Fatalf("expected %s got %v", expect, events)
+	}
+}
+
+func TestChanAutoConnect(t *testing.T) {
+	channel := NewChanInt(16, 3)
+	started := 0
+	channel.AutoConnect(2, func() {
+		started++
+		for i := 0; i < 3; i++ {
+			channel.Send(i)
+		}
+		channel.Close(nil)
+	})
+	first, _ := channel.NewEndpoint(0)
+	if started != 0 {
+		t.Fatal("expected producer not to be started yet")
+	}
+	second, _ := channel.NewEndpoint(0)
+	third, _ := channel.NewEndpoint(ReplayAll)
+	if started != 1 {
+		t.Fatalf("expected producer to be started once got %d", started)
+	}
+	for _, ep := range []*EndpointInt{first, second, third} {
+		count := 0
+		ep.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				count++
+			}
+			return true
+		}, 0)
+		if count != 3 {
+			t.Fatalf("expected 3 messages got %d", count)
+		}
+	}
+}
+
+func TestEndpointFilter(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	ep.Filter(func(value int) bool { return value%3 == 0 })
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	if value, _, _ := ep.Next(); value != 0 {
+		t.Fatalf("expected 0 got %d", value)
+	}
+	batch := make([]int, 4)
+	if n := ep.ReadBatch(batch[:1]); n != 1 || batch[0] != 3 {
+		t.Fatalf("expected [3] got %v", batch[:n])
+	}
+	var values []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			values = append(values, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(values) != "[6 9]" {
+		t.Fatalf("expected [6 9] got %v", values)
+	}
+}
+
+func TestEndpointMap(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	doubled, _ := channel.NewEndpoint(ReplayAll)
+	doubled.Filter(func(value int) bool { return value != 2 })
+	doubled.Map(func(value int) int { return value * 2 })
+	plain, _ := channel.NewEndpoint(ReplayAll)
+	for i := 1; i <= 4; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	if value, _, _ := doubled.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+	batch := make([]int, 4)
+	if n := doubled.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[6 8]" {
+		t.Fatalf("expected [6 8] got %v", batch[:n])
+	}
+	if n := plain.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[1 2 3 4]" {
+		t.Fatalf("expected [1 2 3 4] got %v", batch[:n])
+	}
+}
+
+func TestEndpointSample(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	sampled, _ := channel.NewEndpointOpts(WithSample(3))
+	batched, _ := channel.NewEndpointOpts(WithSample(3))
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	var values []int
+	sampled.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			values = append(values, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(values) != "[0 3 6 9]" {
+		t.Fatalf("expected [0 3 6 9] got %v", values)
+	}
+	batch := make([]int, 10)
+	if n := batched.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[0 3 6 9]" {
+		t.Fatalf("expected [0 3 6 9] got %v", batch[:n])
+	}
+}
+
+func TestEndpointThrottle(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpointOpts(WithThrottle(20 * time.Millisecond))
+	for i := 0; i < 5; i++ {
+		channel.Send(i)
+	}
+	if value, _, _ := ep.Next(); value != 4 {
+		t.Fatalf("expected 4 got %d", value)
+	}
+	start := time.Now()
+	channel.Send(5)
+	channel.Send(6)
+	if value, _, _ := ep.Next(); value != 6 {
+		t.Fatalf("expected 6 got %d", value)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Fatalf("expected delivery to be throttled, took %v", elapsed)
+	}
+}
+
+func TestEndpointDebounce(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpointOpts(WithDebounce(20 * time.Millisecond))
+	start := time.Now()
+	go func() {
+		for i := 0; i < 3; i++ {
+			channel.Send(i)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	if value, _, _ := ep.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Fatalf("expected delivery to wait for quiet, took %v", elapsed)
+	}
+}
+
+func TestEndpointRangeWindow(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) }
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithClock(clock))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 5; i++ {
+		channel.Send(i)
+	}
+	full, expired := make(chan struct{}), int32(0)
+	go func() {
+		<-full
+		for atomic.LoadInt32(&expired) == 0 {
+			atomic.AddInt64(&now, int64(time.Second)) // until the window of 4 has passed
+			runtime.Gosched()
+		}
+		channel.Send(5) // the clock stopped, so only the close flushes 5
+		channel.Close(nil)
+	}()
+	var batches []string
+	closed := false
+	ep.RangeWindow(func(batch []int, err error, c bool) bool {
+		if c {
+			closed = true
+		} else {
+			batches = append(batches, fmt.Sprint(batch))
+		}
+		switch fmt.Sprint(batch) {
+		case "[2 3]":
+			close(full)
+		case "[4]":
+			atomic.StoreInt32(&expired, 1)
+		}
+		return true
+	}, 2, 10*time.Millisecond, 0)
+	expect := "[[0 1] [2 3] [4] [5]]"
+	if fmt.Sprint(batches) != expect || !closed {
+		t.Fatalf("expected %s and closed got %v and %v", expect, batches, closed)
+	}
+}
+
+func TestEndpointRangeMeta(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithClock(clock))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	now = now.Add(time.Second)
+	channel.Send(1)
+	sent := now
+	now = now.Add(time.Second)
+	channel.Send(2)
+	now = now.Add(time.Second)
+	channel.Close(nil)
+	var msgs []Message
+	ep.RangeMeta(func(value int, msg Message, err error, closed bool) bool {
+		msgs = append(msgs, msg)
+		return true
+	}, 0)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages got %d", len(msgs))
+	}
+	if msgs[0].Seq != 0 || !msgs[0].Sent.Equal(sent) || msgs[0].Age != 2*time.Second {
+		t.Fatalf("unexpected first message %+v", msgs[0])
+	}
+	if msgs[1].Seq != 1 || msgs[1].Age != time.Second {
+		t.Fatalf("unexpected second message %+v", msgs[1])
+	}
+	if msgs[2].Seq != 2 {
+		t.Fatalf("expected close at seq 2 got %d", msgs[2].Seq)
+	}
+}
+
+func TestEndpointRangeErr(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	failing, _ := channel.NewEndpoint(ReplayAll)
+	closing, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	stop := fmt.Errorf("stop at 2")
+	err := failing.RangeErr(func(value int, err error, closed bool) error {
+		if value == 2 {
+			return stop
+		}
+		return nil
+	}, 0)
+	if err != stop {
+		t.Fatalf("expected %v got %v", stop, err)
+	}
+	select {
+	case <-failing.Done():
+	default:
+		t.Fatal("expected endpoint to be canceled")
+	}
+	if err := closing.RangeErr(func(int, error, bool) error { return nil }, 0); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+}
+
+func TestEndpointPanicHandler(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	var recovered interface{}
+	ep, _ := channel.NewEndpointOpts(WithPanicHandler(func(r interface{}) { recovered = r }))
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	ep.Range(func(value int, err error, closed bool) bool {
+		if value == 1 {
+			panic("boom")
+		}
+		return true
+	}, 0)
+	if recovered != "boom" {
+		t.Fatalf("expected boom got %v", recovered)
+	}
+	select {
+	case <-ep.Done():
+	default:
+		t.Fatal("expected endpoint to be done")
+	}
+	reused, err := channel.NewEndpoint(ReplayAll)
+	if err != nil || reused != ep {
+		t.Fatalf("expected endpoint slot to be reused got %v", err)
+	}
+}
+
+func TestEndpointRangeTimeout(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	var received []int
+	collect := func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}
+	if !ep.RangeTimeout(collect, 0, 10*time.Millisecond) {
+		t.Fatal("expected RangeTimeout to time out")
+	}
+	channel.Send(2)
+	channel.Close(nil)
+	if ep.RangeTimeout(collect, 0, 10*time.Millisecond) {
+		t.Fatal("expected RangeTimeout to finish")
+	}
+	if fmt.Sprint(received) != "[1 2]" {
+		t.Fatalf("expected [1 2] got %v", received)
+	}
+}
+
+func TestChanNewEndpointContext(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	ep, err := channel.NewEndpointContext(ctx, ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, ok, closed := ep.Next()
+	if ok || closed {
+		t.Fatal("expected endpoint to be canceled")
+	}
+	select {
+	case <-ep.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected endpoint to be done")
+	}
+}
+
+func TestEndpointGroup(t *testing.T) {
+	channel := NewChanInt(16, 4)
+	first, _ := channel.NewEndpointOpts(WithGroup("workers"))
+	second, _ := channel.NewEndpointOpts(WithGroup("workers"))
+	all, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 6; i++ {
+		channel.Send(i)
+	}
+	batch := make([]int, 16)
+	if n := first.ReadBatch(batch[:2]); fmt.Sprint(batch[:n]) != "[0 1]" {
+		t.Fatalf("expected [0 1] got %v", batch[:n])
+	}
+	if value, _, _ := second.Next(); value != 2 {
+		t.Fatalf("expected 2 got %d", value)
+	}
+	first.Cancel()
+	third, _ := channel.NewEndpointOpts(WithGroup("workers"))
+	if third.Seq() != 3 {
+		t.Fatalf("expected new member to start at 3 got %d", third.Seq())
+	}
+	channel.Close(nil)
+	if n := third.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[3 4 5]" {
+		t.Fatalf("expected [3 4 5] got %v", batch[:n])
+	}
+	if n := second.ReadBatch(batch); n != 0 {
+		t.Fatalf("expected no more messages got %v", batch[:n])
+	}
+	if n := all.ReadBatch(batch); n != 6 {
+		t.Fatalf("expected 6 messages got %v", batch[:n])
+	}
+}
+
+func TestEndpointGroupFilter(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	even, _ := channel.NewEndpointOpts(WithGroup("workers"))
+	even.Filter(func(value int) bool { return value%2 == 0 })
+	any, _ := channel.NewEndpointOpts(WithGroup("workers"))
+	for i := 0; i < 6; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	batch := make([]int, 16)
+	if n := even.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[0 2 4]" {
+		t.Fatalf("expected [0 2 4] got %v", batch[:n])
+	}
+	if n := any.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[1 3 5]" {
+		t.Fatalf("expected the messages skipped by the filter [1 3 5] got %v", batch[:n])
+	}
+}
+
+func TestEndpointGroupExactlyOnce(t *testing.T) {
+	const messages = 20000
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithEndpointCapacity(3), WithGrowth(1024))
+	received := make([]int32, messages)
+	var wg sync.WaitGroup
+	for m := 0; m < 3; m++ {
+		member, _ := channel.NewEndpointOpts(WithGroup("workers"))
+		if m == 0 {
+			member.Filter(func(value int) bool { return value%3 != 0 })
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			member.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					atomic.AddInt32(&received[value], 1)
+				}
+				return true
+			}, 0)
+		}()
+	}
+	for i := 0; i < messages; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	wg.Wait()
+	for value, count := range received {
+		if count != 1 {
+			t.Fatalf("expected %d to be delivered once got %d times", value, count)
+		}
+	}
+}
+
+func TestChanRoundRobin(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithRoundRobin())
+	first, _ := channel.NewEndpoint(ReplayAll)
+	second, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 6; i++ {
+		channel.Send(i)
+	}
+	batch := make([]int, 8)
+	n := first.ReadBatch(batch)
+	m := second.ReadBatch(batch[n:])
+	if n != 3 || m != 3 {
+		t.Fatalf("expected messages to be distributed evenly got %d and %d", n, m)
+	}
+	channel.Send(6)
+	channel.Send(7)
+	second.Cancel()
+	channel.Close(nil)
+	n += first.ReadBatch(batch[n+m:])
+	if n != 5 {
+		t.Fatalf("expected first endpoint to take over got %d messages", n)
+	}
+	sort.Ints(batch)
+	if fmt.Sprint(batch) != "[0 1 2 3 4 5 6 7]" {
+		t.Fatalf("expected every message once got %v", batch)
+	}
+}
+
+func TestPartitionedChan(t *testing.T) {
+	channel := NewPartitionedChanInt(4, func(value int) string { return fmt.Sprint(value % 3) }, WithBufferCapacity(16))
+	endpoints, err := channel.NewEndpoints(ReplayAll)
+	if err != nil || len(endpoints) != channel.Partitions() {
+		t.Fatalf("expected an endpoint per partition got %d and %v", len(endpoints), err)
+	}
+	for i := 0; i < 9; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	batch := make([]int, 16)
+	total := 0
+	for i, ep := range endpoints {
+		n := ep.ReadBatch(batch)
+		total += n
+		for j := 0; j < n; j++ {
+			if channel.PartitionOf(fmt.Sprint(batch[j]%3)) != i {
+				t.Fatalf("message %d in wrong partition %d", batch[j], i)
+			}
+			if j > 0 && batch[j]%3 == batch[j-1]%3 && batch[j] < batch[j-1] {
+				t.Fatalf("messages with the same key out of order %v", batch[:n])
+			}
+		}
+	}
+	if total != 9 {
+		t.Fatalf("expected 9 messages got %d", total)
+	}
+}
+
+func TestEndpointAck(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	ep, _ := channel.NewEndpointOpts(WithAck(0, 1))
+	timed, _ := channel.NewEndpointOpts(WithAck(10*time.Millisecond, 1))
+	for i := 1; i <= 3; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	var received []int
+	next := func(e *EndpointInt) int {
+		value, _, _ := e.Next()
+		received = append(received, value)
+		return value
+	}
+	next(ep)
+	ep.Nack()
+	next(ep)
+	ep.Nack() // retries exhausted, so skipped
+	next(ep)
+	ep.Ack()
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+			ep.Ack()
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[1 1 2 3]" {
+		t.Fatalf("expected [1 1 2 3] got %v", received)
+	}
+	received = nil
+	next(timed)
+	next(timed) // redelivered after the ack timeout
+	timed.Ack()
+	next(timed)
+	if fmt.Sprint(received) != "[1 1 2]" {
+		t.Fatalf("expected [1 1 2] got %v", received)
+	}
+}
+
+func TestEndpointAckConcurrent(t *testing.T) {
+	for name, opts := range map[string][]ChanOption{"Shared": nil, "Wakeups": {WithEndpointWakeups()}} {
+		t.Run(name, func(t *testing.T) {
+			channel := NewChanOptsInt(opts...)
+			ep, _ := channel.NewEndpointOpts(WithAck(0, 1))
+			delivered := make(chan int)
+			go func() {
+				nacked := false
+				for value := range delivered {
+					if value == 2 && !nacked {
+						ep.Nack()
+						nacked = true
+					} else {
+						ep.Ack()
+					}
+				}
+			}()
+			for i := 1; i <= 3; i++ {
+				channel.Send(i)
+			}
+			channel.Close(nil)
+			var received []int
+			ep.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					received = append(received, value)
+					delivered <- value // acknowledged by another goroutine
+				}
+				return true
+			}, 0)
+			close(delivered)
+			if fmt.Sprint(received) != "[1 2 2 3]" {
+				t.Fatalf("expected [1 2 2 3] got %v", received)
+			}
+		})
+	}
+}
+
+func TestEndpointDeadLetter(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	dead := NewChanInt(16, 1)
+	letters, _ := dead.NewEndpoint(ReplayAll)
+	var failures []string
+	failed := func(value int, failure Failure) {
+		failures = append(failures, fmt.Sprintf("%d:%d:%d:%v", value, failure.Seq, failure.Attempts, failure.Err))
+	}
+	acking, _ := channel.NewEndpointOpts(WithAck(0, 1))
+	acking.DeadLetter(dead, failed)
+	plain, _ := channel.NewEndpoint(ReplayAll)
+	plain.DeadLetter(dead, failed)
+	for i := 1; i <= 3; i++ {
+		channel.Send(i)
+	}
+	channel.Close(nil)
+	acking.Next()
+	acking.Nack()
+	acking.Next()
+	acking.Nack() // retries exhausted, so dead-lettered
+	acking.Next()
+	acking.Ack()
+	poison := errors.New("poison")
+	plain.Range(func(value int, err error, closed bool) bool {
+		if value == 3 {
+			plain.Reject(poison)
+		}
+		return true
+	}, 0)
+	dead.Close(nil)
+	var values []int
+	letters.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			values = append(values, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(values) != "[1 3]" {
+		t.Fatalf("expected [1 3] got %v", values)
+	}
+	if fmt.Sprint(failures) != "[1:0:2:retries exhausted 3:2:1:poison]" {
+		t.Fatalf("unexpected failures %v", failures)
+	}
+}
+
+func TestEndpointCommit(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, _ := channel.NewEndpointOpts(WithManualCommit())
+	for i := 1; i <= 4; i++ {
+		channel.Send(i)
+	}
+	for i := 0; i < 4; i++ {
+		ep.Next()
+	}
+	if err := ep.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	if ep.Commit(1) != ErrOutOfRange {
+		t.Fatal("expected ErrOutOfRange committing backwards")
+	}
+	channel.Send(5)
+	channel.Send(6)
+	if channel.TrySend(7) {
+		t.Fatal("expected uncommitted messages to be retained")
+	}
+	if err := ep.Seek(ep.Committed()); err != nil {
+		t.Fatal(err)
+	}
+	var received []int
+	for i := 0; i < 4; i++ {
+		value, _, _ := ep.Next()
+		received = append(received, value)
+	}
+	if fmt.Sprint(received) != "[3 4 5 6]" {
+		t.Fatalf("expected [3 4 5 6] got %v", received)
+	}
+}
+
+func TestEndpointCommitRetention(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithRetention(RetentionPolicy{MaxCount: 2}))
+	ep, _ := channel.NewEndpointOpts(WithManualCommit())
+	for i := 0; i < 6; i++ {
+		channel.Send(i)
+		ep.Next()
+	}
+	if err := channel.TrimBefore(3); err != ErrInUse {
+		t.Fatalf("expected ErrInUse trimming uncommitted messages got %v", err)
+	}
+	if err := ep.Seek(ep.Committed()); err != nil {
+		t.Fatalf("expected the uncommitted messages to be retained got %v", err)
+	}
+	if value, _, _ := ep.Next(); value != 0 {
+		t.Fatalf("expected 0 got %d", value)
+	}
+	for i := 1; i < 6; i++ {
+		ep.Next()
+	}
+	ep.Commit(6)
+	channel.Retain()
+	if err := ep.Seek(3); err != ErrOutOfRange {
+		t.Fatalf("expected committed messages beyond the policy to be released got %v", err)
+	}
+}
+
+type cursorStore map[string]uint64
+
+func (s cursorStore) Load(name string) (uint64, bool, error) {
+	seq, ok := s[name]
+	return seq, ok, nil
+}
+
+func (s cursorStore) Save(name string, seq uint64) error {
+	s[name] = seq
+	return nil
+}
+
+func TestEndpointCursorStore(t *testing.T) {
+	store := cursorStore{}
+	channel := NewChanInt(16, 2)
+	ep, _ := channel.NewEndpointOpts(WithName("consumer"), WithCursorStore(store, 0))
+	for i := 1; i <= 4; i++ {
+		channel.Send(i)
+	}
+	ep.Next()
+	ep.Next()
+	if store["consumer"] != 2 {
+		t.Fatalf("expected saved position 2 got %d", store["consumer"])
+	}
+	ep.Cancel()
+	channel.Close(nil)
+	resumed, _ := channel.NewEndpointOpts(WithName("consumer"), WithCursorStore(store, 0))
+	var received []int
+	resumed.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[3 4]" {
+		t.Fatalf("expected [3 4] got %v", received)
+	}
+}
+
+func TestPriorityChan(t *testing.T) {
+	channel := NewPriorityChanInt(2, WithBufferCapacity(16))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		channel.Send(i, 1)
+	}
+	channel.Send(100, 0)
+	value, ok, _ := ep.Next()
+	if !ok || value != 100 {
+		t.Fatalf("expected 100 got %d", value)
+	}
+	channel.Send(101, 0)
+	channel.Close(nil)
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	})
+	if fmt.Sprint(received) != "[101 1 2 3]" {
+		t.Fatalf("expected [101 1 2 3] got %v", received)
+	}
+}
+
+func TestPriorityEndpointBlock(t *testing.T) {
+	for name, opts := range map[string][]ChanOption{"Shared": nil, "Wakeups": {WithEndpointWakeups()}} {
+		t.Run(name, func(t *testing.T) {
+			channel := NewPriorityChanInt(2, opts...)
+			ep, _ := channel.NewEndpoint(ReplayAll)
+			idle, _ := channel.NewEndpoint(ReplayAll)
+			received := make(chan string)
+			go func() {
+				for {
+					value, ok, closed := ep.Next()
+					received <- fmt.Sprint(value, ok, closed)
+					if !ok {
+						return
+					}
+				}
+			}()
+			go func() {
+				_, ok, closed := idle.Next()
+				received <- fmt.Sprint("idle ", ok, closed)
+			}()
+			time.Sleep(5 * time.Millisecond) // let the endpoints block
+			channel.Send(1, 1)
+			both := []string{<-received, <-received}
+			sort.Strings(both)
+			if fmt.Sprint(both) != "[1 true false idle true false]" {
+				t.Fatalf("expected both endpoints to receive 1 got %v", both)
+			}
+			time.Sleep(5 * time.Millisecond)
+			channel.Close(nil)
+			if r := <-received; r != "0 false true" {
+				t.Fatalf("expected closed got %s", r)
+			}
+		})
+	}
+}
+
+func TestPriorityEndpointCancel(t *testing.T) {
+	channel := NewPriorityChanInt(2)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	done := make(chan bool)
+	go func() {
+		_, ok, closed := ep.Next()
+		done <- ok || closed
+	}()
+	time.Sleep(5 * time.Millisecond) // let the endpoint block
+	ep.Cancel()
+	if <-done {
+		t.Fatal("expected Next to return canceled")
+	}
+}
+
+func TestChanSendAfter(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	start := time.Now()
+	channel.SendAfter(1, 50*time.Millisecond)
+	channel.Send(2) // held back by the delayed message
+	if _, ok, _ := ep.NextTimeout(10 * time.Millisecond); ok {
+		t.Fatal("expected the delayed message to be withheld")
+	}
+	value, ok, _ := ep.Next()
+	if !ok || value != 1 {
+		t.Fatalf("expected 1 got %d", value)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected delivery after 50ms got %v", elapsed)
+	}
+	channel.SendAt(3, time.Now().Add(-time.Second)) // due right away
+	batch := make([]int, 4)
+	if n := ep.ReadBatch(batch); fmt.Sprint(batch[:n]) != "[2 3]" {
+		t.Fatalf("expected [2 3] got %v", batch[:n])
+	}
+}
+
+func TestChanSendHeaders(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithEndpointCapacity(1), WithHeaders())
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	go func() {
+		for i := 0; i < 8; i++ {
+			if i%2 == 0 {
+				channel.SendHeaders(i, Headers{"trace": fmt.Sprint("t", i)})
+			} else {
+				channel.Send(i)
+			}
+		}
+		channel.Close(nil)
+	}()
+	var traces []string
+	ep.RangeMeta(func(value int, msg Message, err error, closed bool) bool {
+		if !closed {
+			traces = append(traces, fmt.Sprintf("%d:%s", value, msg.Headers["trace"]))
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(traces) != "[0:t0 1: 2:t2 3: 4:t4 5: 6:t6 7:]" {
+		t.Fatalf("unexpected headers %v", traces)
+	}
+}
+
+func TestEndpointGapSeq(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(8), WithConflate())
+	var gaps []string
+	var ep *EndpointInt
+	ep, _ = channel.NewEndpointOpts(WithGapHandler(func(missed uint64) {
+		gaps = append(gaps, fmt.Sprintf("%d-%d", ep.Seq()-missed, ep.Seq()))
+	}))
+	for i := 0; i < 5; i++ {
+		channel.Send(i)
+	}
+	if value, _, _ := ep.Next(); value != 4 {
+		t.Fatalf("expected 4 got %d", value)
+	}
+	if fmt.Sprint(gaps) != "[0-4]" || ep.Dropped() != 4 {
+		t.Fatalf("expected gap [0-4] and 4 dropped got %v and %d", gaps, ep.Dropped())
+	}
+}
+
+func TestEndpointRangeNotifications(t *testing.T) {
+	channel := NewChanInt(16, 2)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	plain, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	channel.SendError(errors.New("oops"))
+	channel.Send(2)
+	channel.Close(errors.New("done"))
+	var events []string
+	ep.RangeNotifications(func(n NotificationInt) bool {
+		switch n.Kind {
+		case OnNext:
+			events = append(events, fmt.Sprint(n.Value))
+		case OnError:
+			events = append(events, "error:"+n.Err.Error())
+		case OnComplete:
+			events = append(events, "complete:"+n.Err.Error())
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(events) != "[1 error:oops 2 complete:done]" {
+		t.Fatalf("unexpected notifications %v", events)
+	}
+	var values []int
+	plain.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			values = append(values, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(values) != "[1 2]" {
+		t.Fatalf("expected error event to be skipped got %v", values)
+	}
+}
+
+func TestChanCloseWith(t *testing.T) {
+	channel := NewChanInt(64, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for channel.Send(1) == nil {
+			}
+		}()
+	}
+	var last int
+	var closeErr error
+	done := make(chan struct{})
+	go func() {
+		ep.Range(func(value int, err error, closed bool) bool {
+			if closed {
+				closeErr = err
+			} else {
+				last = value
+			}
+			return true
+		}, 0)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond)
+	channel.CloseWith(-1, errors.New("eof"))
+	wg.Wait()
+	<-done
+	if last != -1 || closeErr == nil || closeErr.Error() != "eof" {
+		t.Fatalf("expected final value -1 before close got %d and %v", last, closeErr)
+	}
+}
+
+func TestChanErr(t *testing.T) {
+	channel := NewChanInt(16, 1)
+	if channel.Err() != nil {
+		t.Fatal("expected no error before close")
+	}
+	failure := errors.New("failure")
+	go channel.Close(failure)
+	<-channel.Done()
+	if channel.Err() != failure {
+		t.Fatalf("expected %v got %v", failure, channel.Err())
+	}
+}
+
+func TestChanClaimPublish(t *testing.T) {
+	channel := NewChanInt(4, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	go func() {
+		for i := 0; i < 8; i++ {
+			slot, err := channel.Claim()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			*slot.Value = i * i
+			channel.Publish(slot)
+		}
+		channel.Close(nil)
+	}()
+	var received []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(received) != "[0 1 4 9 16 25 36 49]" {
+		t.Fatalf("unexpected messages %v", received)
+	}
+	channel.Seal()
+	if _, err := channel.Claim(); err != ErrSealed {
+		t.Fatalf("expected ErrSealed got %v", err)
+	}
+}
+
+func TestChanSendClosed(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(4), WithExactCapacity())
+	if _, err := channel.NewEndpoint(ReplayAll); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		channel.Send(i)
+	}
+	sends := map[string]func() error{
+		"Send":        func() error { return channel.Send(4) },
+		"SendSlice":   func() error { return channel.SendSlice([]int{4, 5}) },
+		"SendTimeout": func() error { return channel.SendTimeout(4, time.Minute) },
+		"SendContext": func() error { return channel.SendContext(context.Background(), 4) },
+		"SendError":   func() error { return channel.SendError(errors.New("failed")) },
+	}
+	errs := make(chan string, len(sends))
+	for name, send := range sends {
+		go func(name string, send func() error) {
+			errs <- fmt.Sprintf("%s: %v", name, send())
+		}(name, send)
+	}
+	runtime.Gosched()
+	channel.Close(nil)
+	for range sends {
+		if err := <-errs; !strings.HasSuffix(err, ErrClosed.Error()) {
+			t.Errorf("expected ErrClosed, got %s", err)
+		}
+	}
+}
+
+func TestChanWaitStrategy(t *testing.T) {
+	strategies := map[string]WaitStrategy{
+		"BusySpin": BusySpinWait(),
+		"Yield":    YieldWait(),
+		"Sleep":    SleepWait(100 * time.Microsecond),
+		"Blocking": BlockingWait(),
+	}
+	for name, strategy := range strategies {
+		channel := NewChanOptsInt(WithBufferCapacity(4), WithWaitStrategy(strategy))
+		ep, _ := channel.NewEndpoint(ReplayAll)
+		go func() {
+			for i := 0; i < 64; i++ {
+				if i == 32 {
+					time.Sleep(10 * time.Millisecond) // let the endpoint idle
+				}
+				channel.Send(i)
+			}
+			channel.Close(nil)
+		}()
+		count := 0
+		ep.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				if value != count {
+					t.Errorf("%s: expected %d got %d", name, count, value)
+				}
+				count++
+			}
+			return true
+		}, 0)
+		if count != 64 {
+			t.Errorf("%s: expected 64 messages got %d", name, count)
+		}
+	}
+}
+
+func TestChanWakeCoalescing(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(64), WithWaitStrategy(BlockingWait()))
+	var wg sync.WaitGroup
+	counts := make([]int, 4)
+	for i := range counts {
+		ep, _ := channel.NewEndpoint(ReplayAll)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ep.Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					counts[i]++
+				}
+				return true
+			}, 0)
+		}(i)
+	}
+	var senders sync.WaitGroup
+	for s := 0; s < 4; s++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for burst := 0; burst < 10; burst++ {
+				for i := 0; i < 100; i++ {
+					channel.Send(i)
+				}
+				time.Sleep(time.Millisecond) // let the endpoints block
+			}
+		}()
+	}
+	senders.Wait()
+	channel.Close(nil)
+	wg.Wait()
+	for i, count := range counts {
+		if count != 4000 {
+			t.Errorf("endpoint %d: expected 4000 messages got %d", i, count)
+		}
+	}
+}
+
+func TestChanEndpointWakeups(t *testing.T) {
+	channel := NewChanOptsInt(WithEndpointCapacity(200), WithWaitStrategy(BlockingWait()), WithEndpointWakeups())
+	var wg sync.WaitGroup
+	endpoints := make([]*EndpointInt, 200)
+	counts := make([]int, len(endpoints))
+	for i := range endpoints {
+		endpoints[i], _ = channel.NewEndpoint(ReplayAll)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			endpoints[i].Range(func(value int, err error, closed bool) bool {
+				if !closed {
+					counts[i]++
+				}
+				return true
+			}, 0)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond) // let the endpoints block
+	endpoints[0].Cancel()
+	for i := 0; i < 10; i++ {
+		channel.Send(i)
+		time.Sleep(time.Millisecond)
+	}
+	channel.Close(nil)
+	wg.Wait()
+	for i, count := range counts[1:] {
+		if count != 10 {
+			t.Errorf("endpoint %d: expected 10 messages got %d", i+1, count)
+		}
+	}
+}
+
+func TestChanCommitBatch(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithCommitBatch(4, 100*time.Millisecond))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	for i := 0; i < 3; i++ {
+		channel.Send(i)
+	}
+	if _, ok, _ := ep.NextTimeout(10 * time.Millisecond); ok {
+		t.Fatal("expected no message before the batch is complete")
+	}
+	channel.Send(3)
+	for i := 0; i < 4; i++ {
+		if value, ok, _ := ep.NextTimeout(time.Second); !ok || value != i {
+			t.Fatalf("expected %d got %d (ok=%v)", i, value, ok)
+		}
+	}
+	channel.Send(4)
+	start := time.Now()
+	if value, ok, _ := ep.NextTimeout(time.Second); !ok || value != 4 {
+		t.Fatalf("expected 4 got %d (ok=%v)", value, ok)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected the incomplete batch to be committed after the delay")
+	}
+}
+
+func TestChanCommitter(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(64), WithCommitter())
+	for round := 0; round < 2; round++ {
+		ep, _ := channel.NewEndpoint(ReplayAll)
+		var senders sync.WaitGroup
+		for s := 0; s < 4; s++ {
+			senders.Add(1)
+			go func(s int) {
+				defer senders.Done()
+				for i := 0; i < 1000; i++ {
+					channel.Send(s*1000 + i)
+				}
+			}(s)
+		}
+		go func() {
+			senders.Wait()
+			channel.Close(nil)
+		}()
+		next := make([]int, 4)
+		count := 0
+		ep.Range(func(value int, err error, closed bool) bool {
+			if !closed {
+				if s := value / 1000; value != s*1000+next[s] {
+					t.Errorf("expected %d got %d", s*1000+next[s], value)
+				} else {
+					next[s]++
+				}
+				count++
+			}
+			return true
+		}, 0)
+		if count != 4000 {
+			t.Errorf("round %d: expected 4000 messages got %d", round, count)
+		}
+		if err := channel.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChanBackoff(t *testing.T) {
+	channel := NewChanOptsInt(WithBackoff(50*time.Millisecond, 0))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond) // the endpoint blocks right away
+			channel.Send(i)
+		}
+		channel.Close(nil)
+	}()
+	var received []int
+	var last, end time.Time
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			received = append(received, value)
+			last = time.Now()
+		} else {
+			end = time.Now()
+		}
+		return true
+	}, 0)
+	if len(received) != 3 || received[0] != 0 || received[1] != 1 || received[2] != 2 {
+		t.Errorf("expected [0 1 2] got %v", received)
+	}
+	if end.Sub(last) < 40*time.Millisecond {
+		t.Errorf("expected the close to be reported after idling for 50ms, got %v", end.Sub(last))
+	}
+}
+
+func TestChanWithoutTimestamps(t *testing.T) {
+	channel := NewChanOptsInt(WithoutTimestamps())
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	channel.Send(2)
+	time.Sleep(20 * time.Millisecond)
+	channel.Close(nil)
+	var received []int
+	ep.RangeMeta(func(value int, msg Message, err error, closed bool) bool {
+		if !closed {
+			if !msg.Sent.IsZero() {
+				t.Errorf("expected no timestamp got %v", msg.Sent)
+			}
+			received = append(received, value)
+		}
+		return true
+	}, 5*time.Millisecond)
+	if len(received) != 2 {
+		t.Errorf("expected maxAge to skip no messages got %v", received)
+	}
+}
+
+func TestChanCoarseClock(t *testing.T) {
+	channel := NewChanOptsInt(WithCoarseClock(time.Hour))
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	channel.Send(1)
+	time.Sleep(10 * time.Millisecond)
+	channel.Send(2)
+	channel.Close(nil)
+	var sent []time.Time
+	ep.RangeMeta(func(value int, msg Message, err error, closed bool) bool {
+		if !closed {
+			sent = append(sent, msg.Sent)
+		}
+		return true
+	}, 0)
+	if len(sent) != 2 || sent[0].IsZero() || !sent[0].Equal(sent[1]) {
+		t.Errorf("expected both messages to share a coarse timestamp got %v", sent)
+	}
+}
+
+func TestChanEndpointChurn(t *testing.T) {
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithEndpointCapacity(8), WithWatermarks(2, 8, func() {}, func() {}))
+	channel.OnLag(4, time.Microsecond, func(endpoint *EndpointInt, lag uint64, lagging bool) {})
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if e, err := channel.NewEndpoint(0); err == nil {
+				e.Cancel()
+			}
+		}
+	}()
+	go func() {
+		for i := 0; i < 200; i++ {
+			channel.Send(i)
+			channel.Demand()
+		}
+		channel.Close(nil)
+	}()
+	count := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			if value != count {
+				t.Errorf("expected %d got %d", count, value)
+			}
+			count++
+		}
+		return true
+	}, 0)
+	close(stop)
+	<-churned
+	if count != 200 {
+		t.Errorf("expected 200 messages got %d", count)
+	}
+}
+
+func TestChanProducer(t *testing.T) {
+	channel := NewChanInt(64, 1)
+	ep, _ := channel.NewEndpoint(ReplayAll)
+	var producers sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		producers.Add(1)
+		go func(p int) {
+			defer producers.Done()
+			producer := channel.Producer(16)
+			for i := 0; i < 1000; i++ {
+				producer.Send(p*1000 + i)
+			}
+			producer.Flush()
+		}(p)
+	}
+	go func() {
+		producers.Wait()
+		channel.Close(nil)
+	}()
+	next := make([]int, 8)
+	count := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			if p := value / 1000; value != p*1000+next[p] {
+				t.Errorf("expected %d got %d", p*1000+next[p], value)
+			} else {
+				next[p]++
+			}
+			count++
+		}
+		return true
+	}, 0)
+	if count != 8000 {
+		t.Errorf("expected 8000 messages got %d", count)
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// A read-only view must only create read-only endpoints.
+var _ func(keep uint64) (*ReadOnlyEndpointInt, error) = ReadOnlyChanInt{}.NewEndpoint
+
+func TestReadOnlyChan(t *testing.T) {
+	channel := NewChanInt(128, 1)
+	view := channel.ReadOnly()
+	channel.Send(1)
+	channel.Close(nil)
+	select {
+	case <-view.Done():
+	default:
+		t.Fatal("expected done channel to be closed")
+	}
+	if !view.Closed() {
+		t.Fatal("expected view to report closed")
+	}
+	ep, err := view.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			count++
+		}
+		return true
+	}, 0)
+	if count != 1 {
+		t.Errorf("expected 1 message got %d", count)
+	}
+}
+
+func TestSender(t *testing.T) {
+	channel := NewChanInt(2, 1)
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := channel.Sender()
+	if err := sender.Send(1); err != nil {
+		t.Fatal(err)
+	}
+	if !sender.TrySend(2) {
+		t.Fatal("expected TrySend to succeed")
+	}
+	if sender.TrySend(3) {
+		t.Fatal("expected TrySend to fail on full buffer")
+	}
+	sender.Close(nil)
+	var got []int
+	ep.Range(func(value int, err error, closed bool) bool {
+		if !closed {
+			got = append(got, value)
+		}
+		return true
+	}, 0)
+	if fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("expected [1 2] got %v", got)
+	}
+}
+
+func TestReadOnlyEndpoint(t *testing.T) {
+	// Methods of the channel that a holder of the read-only view must not be
+	// able to reach, neither on the view nor on the endpoints it creates.
+	forbidden := []string{"Send", "TrySend", "FastSend", "SendSlice", "Close", "CloseNow", "Pause", "Resume", "TrimBefore", "Seal", "Reset"}
+	for _, typ := range []reflect.Type{reflect.TypeOf(ReadOnlyChanInt{}), reflect.TypeOf(&ReadOnlyEndpointInt{})} {
+		for _, name := range forbidden {
+			if _, ok := typ.MethodByName(name); ok {
+				t.Errorf("%s exposes %s", typ, name)
+			}
+		}
+		elem := typ
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		for i := 0; i < elem.NumField(); i++ {
+			if field := elem.Field(i); field.PkgPath == "" || field.Anonymous {
+				t.Errorf("%s exposes field %s", typ, field.Name)
+			}
+		}
+	}
+
+	channel := NewChanInt(128, 1)
+	ep, err := channel.ReadOnly().NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Send(1)
+	channel.Send(2)
+	if value, ok, _ := ep.Next(); !ok || value != 1 || ep.Seq() != 1 || ep.Lag() != 1 {
+		t.Fatalf("expected 1 with seq 1 and lag 1 got %d, %d and %d", value, ep.Seq(), ep.Lag())
+	}
+	ep.Cancel()
+	<-ep.Done()
+}
@@ -0,0 +1,40 @@
+package test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestChanLostWakeup(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	channel := NewChanOptsInt(WithBufferCapacity(16), WithEndpointCapacity(1), WithWaitStrategy(BlockingWait()))
+	ep, err := channel.NewEndpoint(ReplayAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acks := make(chan int)
+	go func() {
+		for {
+			value, ok, _ := ep.Next()
+			if !ok {
+				close(acks)
+				return
+			}
+			acks <- value
+		}
+	}()
+	for i := 0; i < 100000; i++ {
+		channel.Send(i)
+		select {
+		case value := <-acks:
+			if value != i {
+				t.Fatalf("expected %d got %d", i, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not received, the wakeup was lost", i)
+		}
+	}
+	channel.Close(nil)
+	<-acks
+}
@@ -0,0 +1,15 @@
+// Package typed provides the multicast channel of this module as a generic
+// type for Go 1.18 and later. Use it to create strongly typed channels without
+// having to generate code with jig:
+//
+//	ch := typed.NewChan[string](128, 8)
+//	ch.Send("hello")
+//	ch.Close(nil)
+//
+// The implementation is generated from the same templates (found in the
+// "generic" folder) that jig uses, so the behavior of the channel is identical
+// to the jig generated channels. To regenerate, run go generate inside this
+// package directory.
+package typed
+
+//go:generate go run gen.go
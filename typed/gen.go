@@ -0,0 +1,253 @@
+//go:build ignore
+
+// This program generates multicast.go in this folder from the jig templates
+// found in the "generic" folder of this module. Every template is
+// instantiated once with the place-holder type foo replaced by the type
+// parameter T. Types, functions and methods depending on foo are turned into
+// Go 1.18 generic declarations.
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const header = `// Code generated by gen.go from the templates in ../generic; DO NOT EDIT.
+
+//go:build go1.18
+
+`
+
+func main() {
+	files, err := filepath.Glob("../generic/*.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(files)
+	for i, name := range files {
+		if filepath.Base(name) == "multicast.go" {
+			files = append([]string{name}, append(files[:i:i], files[i+1:]...)...)
+			break
+		}
+	}
+
+	foo := regexp.MustCompile(`\bfoo\b`)
+	imports := map[string]string{}
+	var src bytes.Buffer
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parts := strings.Split(string(data), "\n//jig:template ")
+		f, err := parser.ParseFile(token.NewFileSet(), name, parts[0], parser.ImportsOnly)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, spec := range f.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			imports[filepath.Base(path)] = path
+		}
+		for _, part := range parts[1:] {
+			lines := strings.Split(part, "\n")
+			i := 1
+			for i < len(lines) && strings.HasPrefix(lines[i], "//jig:") {
+				i++
+			}
+			text := strings.Join(lines[i:], "\n")
+			text = strings.Replace(text, "Foo", "", -1)
+			text = foo.ReplaceAllString(text, "T")
+			src.WriteString(text)
+			src.WriteString("\n")
+		}
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "multicast.go", "package typed\n"+src.String(), parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+	generic := genericNames(file)
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok && generic[spec.Name.Name] {
+					spec.TypeParams = typeParams()
+				}
+			}
+		case *ast.FuncDecl:
+			if decl.Recv == nil && generic[decl.Name.Name] {
+				decl.Type.TypeParams = typeParams()
+			}
+		}
+	}
+	instantiate(file, generic)
+
+	used := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && imports[x.Name] != "" {
+				used[imports[x.Name]] = true
+			}
+		}
+		return true
+	})
+	var paths []string
+	for path := range used {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// The import declaration is inserted as text after printing the file. An
+	// import declaration added to the syntax tree has no position, so the
+	// printer would attach the comments of the first declarations to it.
+	var body bytes.Buffer
+	if err := format.Node(&body, fset, file); err != nil {
+		log.Fatal(err)
+	}
+	pkg := "package typed\n"
+	if !bytes.HasPrefix(body.Bytes(), []byte(pkg)) {
+		log.Fatal("unexpected package clause")
+	}
+	var out bytes.Buffer
+	out.WriteString(header)
+	out.WriteString(pkg)
+	out.WriteString("\nimport (\n")
+	for _, path := range paths {
+		out.WriteString("\t" + strconv.Quote(path) + "\n")
+	}
+	out.WriteString(")\n")
+	out.Write(body.Bytes()[len(pkg):])
+	res, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("multicast.go", res, 0664); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// genericNames returns the names of the top-level types and functions that
+// (transitively) depend on the type parameter T.
+func genericNames(file *ast.File) map[string]bool {
+	generic := map[string]bool{"T": true}
+	for changed := true; changed; {
+		changed = false
+		for _, decl := range file.Decls {
+			var name string
+			var node ast.Node
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok && !generic[spec.Name.Name] && refers(spec.Type, generic) {
+						generic[spec.Name.Name] = true
+						changed = true
+					}
+				}
+				continue
+			case *ast.FuncDecl:
+				if decl.Recv != nil {
+					continue
+				}
+				name, node = decl.Name.Name, decl
+			}
+			if !generic[name] && refers(node, generic) {
+				generic[name] = true
+				changed = true
+			}
+		}
+	}
+	delete(generic, "T")
+	return generic
+}
+
+func refers(node ast.Node, names map[string]bool) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && names[id.Name] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func typeParams() *ast.FieldList {
+	return &ast.FieldList{List: []*ast.Field{{
+		Names: []*ast.Ident{ast.NewIdent("T")},
+		Type:  ast.NewIdent("any"),
+	}}}
+}
+
+// instantiate replaces every reference to a generic type or function by its
+// instantiation with type parameter T.
+func instantiate(file *ast.File, generic map[string]bool) {
+	skip := map[*ast.Ident]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.TypeSpec:
+			skip[n.Name] = true
+		case *ast.FuncDecl:
+			skip[n.Name] = true
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+		case *ast.KeyValueExpr:
+			if id, ok := n.Key.(*ast.Ident); ok {
+				skip[id] = true
+			}
+		case *ast.Field:
+			for _, id := range n.Names {
+				skip[id] = true
+			}
+		}
+		return true
+	})
+	wrap := func(expr ast.Expr) ast.Expr {
+		if id, ok := expr.(*ast.Ident); ok && generic[id.Name] && !skip[id] {
+			return &ast.IndexExpr{X: id, Lbrack: id.End(), Index: ast.NewIdent("T"), Rbrack: id.End()}
+		}
+		return expr
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.StarExpr:
+			n.X = wrap(n.X)
+		case *ast.UnaryExpr:
+			n.X = wrap(n.X)
+		case *ast.CompositeLit:
+			n.Type = wrap(n.Type)
+		case *ast.CallExpr:
+			n.Fun = wrap(n.Fun)
+			for i, arg := range n.Args {
+				n.Args[i] = wrap(arg)
+			}
+		case *ast.Field:
+			n.Type = wrap(n.Type)
+		case *ast.ArrayType:
+			n.Elt = wrap(n.Elt)
+		case *ast.MapType:
+			n.Key = wrap(n.Key)
+			n.Value = wrap(n.Value)
+		case *ast.ChanType:
+			n.Value = wrap(n.Value)
+		case *ast.ValueSpec:
+			n.Type = wrap(n.Type)
+		case *ast.TypeSpec:
+			n.Type = wrap(n.Type)
+		case *ast.TypeAssertExpr:
+			n.Type = wrap(n.Type)
+		}
+		return true
+	})
+}
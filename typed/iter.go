@@ -0,0 +1,33 @@
+//go:build go1.23
+
+package typed
+
+import (
+	"iter"
+	"time"
+)
+
+// All returns an iterator over the messages received by the endpoint, for use
+// with a range-over-func loop:
+//
+//	for value, err := range ep.All(0) {
+//		...
+//	}
+//
+// Like Range, messages older than maxAge are skipped when maxAge is not 0.
+// When the channel is closed with an error, the last pair yielded carries that
+// error. Breaking out of the loop cancels the endpoint, just like returning
+// false from the function passed to Range.
+func (e *Endpoint[T]) All(maxAge time.Duration) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		e.Range(func(value T, err error, closed bool) bool {
+			if closed {
+				if err != nil {
+					yield(value, err)
+				}
+				return true
+			}
+			return yield(value, nil)
+		}, maxAge)
+	}
+}
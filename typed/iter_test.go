@@ -0,0 +1,32 @@
+//go:build go1.23
+
+package typed_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/reactivego/multicast/typed"
+)
+
+func Example_all() {
+	ch := typed.NewChan[string](128, 1)
+
+	ch.Send("Hello")
+	ch.Send("World!")
+	ch.Close(errors.New("done"))
+
+	ep, _ := ch.NewEndpoint(typed.ReplayAll)
+	for value, err := range ep.All(0) {
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		fmt.Println(value)
+	}
+
+	// Output:
+	// Hello
+	// World!
+	// done
+}
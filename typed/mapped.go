@@ -0,0 +1,53 @@
+//go:build go1.18
+
+package typed
+
+import "time"
+
+// MappedEndpoint is a view on an endpoint that delivers every message passed
+// through a transform function, producing messages of a different type. It is
+// created by MapEndpoint.
+type MappedEndpoint[T, U any] struct {
+	e         *Endpoint[T]
+	transform func(T) U
+}
+
+// MapEndpoint returns a view on the endpoint that delivers messages of type U
+// produced by passing every message of type T through the transform function.
+// Use Endpoint.Map when the transformed message has the same type. The
+// endpoint should no longer be read directly once it is wrapped.
+func MapEndpoint[T, U any](e *Endpoint[T], transform func(T) U) *MappedEndpoint[T, U] {
+	return &MappedEndpoint[T, U]{e, transform}
+}
+
+// Range works like Endpoint.Range, but passes transformed messages to the
+// foreach function.
+func (m *MappedEndpoint[T, U]) Range(foreach func(value U, err error, closed bool) bool, maxAge time.Duration) {
+	m.e.Range(func(value T, err error, closed bool) bool {
+		if closed {
+			var zero U
+			return foreach(zero, err, true)
+		}
+		return foreach(m.transform(value), nil, false)
+	}, maxAge)
+}
+
+// Next works like Endpoint.Next, but returns the transformed message.
+func (m *MappedEndpoint[T, U]) Next() (value U, ok bool, closed bool) {
+	v, ok, closed := m.e.Next()
+	if ok {
+		value = m.transform(v)
+	}
+	return value, ok, closed
+}
+
+// Cancel cancels the underlying endpoint, see Endpoint.Cancel.
+func (m *MappedEndpoint[T, U]) Cancel() {
+	m.e.Cancel()
+}
+
+// Done returns a channel that is closed when the underlying endpoint
+// finishes, see Endpoint.Done.
+func (m *MappedEndpoint[T, U]) Done() <-chan struct{} {
+	return m.e.Done()
+}
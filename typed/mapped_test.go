@@ -0,0 +1,33 @@
+//go:build go1.18
+
+package typed_test
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/reactivego/multicast/typed"
+)
+
+func ExampleMapEndpoint() {
+	ch := typed.NewChan[int](128, 1)
+
+	ch.Send(1)
+	ch.Send(2)
+	ch.Close(nil)
+
+	ep, _ := ch.NewEndpoint(typed.ReplayAll)
+	labels := typed.MapEndpoint(ep, func(value int) string {
+		return "#" + strconv.Itoa(value)
+	})
+	labels.Range(func(value string, err error, closed bool) bool {
+		if !closed {
+			fmt.Println(value)
+		}
+		return true
+	}, 0)
+
+	// Output:
+	// #1
+	// #2
+}
@@ -0,0 +1,32 @@
+//go:build go1.18
+
+package typed_test
+
+import (
+	"fmt"
+
+	"github.com/reactivego/multicast/typed"
+)
+
+func Example_send() {
+	ch := typed.NewChan[string](128, 1)
+
+	ch.Send("Hello")
+	ch.Send("World!")
+	ch.Close(nil)
+
+	ep, _ := ch.NewEndpoint(typed.ReplayAll)
+	ep.Range(func(value string, err error, closed bool) bool {
+		if !closed {
+			fmt.Println(value)
+		} else {
+			fmt.Println("closed")
+		}
+		return true
+	}, 0)
+
+	// Output:
+	// Hello
+	// World!
+	// closed
+}